@@ -0,0 +1,144 @@
+package cache
+
+import "container/list"
+
+// ARC lists, after Megiddo & Modha, "ARC: A Self-Tuning, Low Overhead
+// Replacement Cache" (FAST '03). T1 holds keys seen once recently, T2 keys
+// seen at least twice. B1 and B2 are ghosts: keys recently evicted from T1
+// and T2, without their values.
+const (
+	arcT1 = iota
+	arcT2
+	arcB1
+	arcB2
+)
+
+type arcNode struct {
+	key  string
+	list int
+}
+
+type arc struct {
+	capacity int // 0 follows the number of live entries (byte limit only)
+	p        int // Target size of T1
+	lists    [4]*list.List
+	nodes    map[string]*list.Element // Value is *arcNode
+
+	// adapted is the incoming key p was last adjusted for, so a key that
+	// needs several evictions adjusts it once
+	adapted  string
+	ghostHit int // List the incoming key was found in: arcB1, arcB2 or -1
+}
+
+func newARC(capacity int) *arc {
+	a := &arc{capacity: capacity, nodes: make(map[string]*list.Element), ghostHit: -1}
+	for i := range a.lists {
+		a.lists[i] = list.New()
+	}
+	return a
+}
+
+func (a *arc) len(l int) int { return a.lists[l].Len() }
+
+func (a *arc) size() int {
+	if a.capacity > 0 {
+		return a.capacity
+	}
+	return max(1, a.len(arcT1)+a.len(arcT2))
+}
+
+func (a *arc) moveTo(key string, l int) {
+	if el, ok := a.nodes[key]; ok {
+		n := el.Value.(*arcNode)
+		a.lists[n.list].Remove(el)
+		n.list = l
+		a.nodes[key] = a.lists[l].PushFront(n)
+		return
+	}
+	a.nodes[key] = a.lists[l].PushFront(&arcNode{key: key, list: l})
+}
+
+func (a *arc) drop(el *list.Element) {
+	n := el.Value.(*arcNode)
+	a.lists[n.list].Remove(el)
+	delete(a.nodes, n.key)
+}
+
+// adapt moves the target on a ghost hit: a key evicted from T1 too early
+// means T1 should grow, one from T2 means T2 should.
+func (a *arc) adapt(key string) {
+	if a.adapted == key {
+		return
+	}
+	a.adapted, a.ghostHit = key, -1
+	el, ok := a.nodes[key]
+	if !ok {
+		return
+	}
+	switch l := el.Value.(*arcNode).list; l {
+	case arcB1:
+		a.p = min(a.size(), a.p+max(a.len(arcB2)/a.len(arcB1), 1))
+		a.ghostHit = l
+	case arcB2:
+		a.p = max(0, a.p-max(a.len(arcB1)/a.len(arcB2), 1))
+		a.ghostHit = l
+	}
+}
+
+// evict is the paper's REPLACE: take from T1 while it's over its target.
+func (a *arc) evict(incoming string) (string, bool) {
+	a.adapt(incoming)
+	t1 := a.len(arcT1)
+	from := arcT2
+	if t1 > 0 && (t1 > a.p || (a.ghostHit == arcB2 && t1 == a.p) || a.len(arcT2) == 0) {
+		from = arcT1
+	}
+	el := a.lists[from].Back()
+	if el == nil {
+		return "", false
+	}
+	key := el.Value.(*arcNode).key
+	a.moveTo(key, arcB1+from) // T1 -> B1, T2 -> B2
+	a.trim()
+	return key, true
+}
+
+func (a *arc) insert(key string) {
+	a.adapt(key)
+	if a.ghostHit >= 0 {
+		a.moveTo(key, arcT2) // Seen before, just not cached
+	} else {
+		a.moveTo(key, arcT1)
+	}
+	a.adapted, a.ghostHit = "", -1
+	a.trim()
+}
+
+func (a *arc) access(key string) {
+	if el, ok := a.nodes[key]; ok && el.Value.(*arcNode).list <= arcT2 {
+		a.moveTo(key, arcT2)
+	}
+}
+
+func (a *arc) remove(key string) {
+	if el, ok := a.nodes[key]; ok {
+		a.drop(el)
+	}
+}
+
+// trim bounds the ghosts: T1+B1 to c entries and all four lists to 2c.
+func (a *arc) trim() {
+	c := a.size()
+	for a.len(arcT1)+a.len(arcB1) > c && a.len(arcB1) > 0 {
+		a.drop(a.lists[arcB1].Back())
+	}
+	for a.len(arcT1)+a.len(arcT2)+a.len(arcB1)+a.len(arcB2) > 2*c {
+		if a.len(arcB2) > 0 {
+			a.drop(a.lists[arcB2].Back())
+		} else if a.len(arcB1) > 0 {
+			a.drop(a.lists[arcB1].Back())
+		} else {
+			return
+		}
+	}
+}
@@ -2,34 +2,384 @@ package cache
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Clock tells the cache the time. Tests swap in a fake one to expire
+// entries without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+type entry struct {
+	value   string
+	expires time.Time // Zero means never
+}
+
+func (e entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// dead is expired and past the stale-while-revalidate window, so no use
+// to anyone.
+func (e entry) dead(now time.Time, stale time.Duration) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires.Add(stale))
+}
+
+// size is what an entry counts against WithMaxBytes.
+func size(key, value string) int { return len(key) + len(value) }
+
+// EvictReason says why an entry left the cache without a Delete.
+type EvictReason int
+
+const (
+	Evicted  EvictReason = iota // Pushed out by the size limits
+	Expired                     // Its TTL ran out
+	Replaced                    // Overwritten by a value too big to keep
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case Expired:
+		return "expired"
+	case Replaced:
+		return "replaced"
+	}
+	return "evicted"
+}
+
+// Stats are counters since New, and the current size.
+type Stats struct {
+	Hits, Misses uint64
+	Evictions    uint64 // For space
+	Expirations  uint64
+	Entries      int
+	Bytes        int
+}
+
 type Cache struct {
 	mu    sync.RWMutex
-	store map[string]string
+	store map[string]entry
+	bytes int
+
+	clock      Clock
+	defaultTTL time.Duration
+	interval   time.Duration // Janitor sweep interval
+
+	maxEntries int
+	maxBytes   int
+	policy     Policy
+	evictor    evictor // nil when unbounded
+	onEvict    func(key, value string, reason EvictReason)
+
+	hits, misses, evictions, expirations atomic.Uint64
+
+	// GetOrLoad
+	negativeTTL time.Duration
+	stale       time.Duration
+	errs        map[string]failure // Cached loader errors
+	loadMu      sync.Mutex
+	calls       map[string]*call // Loads in flight
+
+	janitorOnce sync.Once
+	closeOnce   sync.Once
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// Option configures a Cache in New.
+type Option func(*Cache)
+
+// WithDefaultTTL makes Set entries expire after ttl. Without it they
+// live until deleted.
+func WithDefaultTTL(ttl time.Duration) Option {
+	return func(c *Cache) { c.defaultTTL = ttl }
+}
+
+// WithClock replaces the wall clock.
+func WithClock(clock Clock) Option {
+	return func(c *Cache) { c.clock = clock }
+}
+
+// WithJanitorInterval sets how often the janitor removes expired
+// entries (default one minute).
+func WithJanitorInterval(d time.Duration) Option {
+	return func(c *Cache) { c.interval = d }
+}
+
+// WithMaxEntries bounds the number of entries.
+func WithMaxEntries(n int) Option {
+	return func(c *Cache) { c.maxEntries = n }
+}
+
+// WithMaxBytes bounds the total length of keys and values. An entry
+// bigger than the whole limit is evicted as soon as it's set.
+func WithMaxBytes(n int) Option {
+	return func(c *Cache) { c.maxBytes = n }
+}
+
+// WithPolicy chooses what a full cache evicts (default LRU).
+func WithPolicy(p Policy) Option {
+	return func(c *Cache) { c.policy = p }
 }
 
-func New() *Cache {
-	return &Cache{
-		store: make(map[string]string),
+// WithOnEvict calls fn for each entry evicted or expired, but not for
+// Delete or overwrites, unless the new value is too big to store and
+// the old one goes with nothing in its place (Replaced). It runs after
+// the cache is unlocked, so it may use the cache.
+func WithOnEvict(fn func(key, value string, reason EvictReason)) Option {
+	return func(c *Cache) { c.onEvict = fn }
+}
+
+func New(opts ...Option) *Cache {
+	c := &Cache{
+		store:    make(map[string]entry),
+		clock:    realClock{},
+		interval: time.Minute,
+		errs:     make(map[string]failure),
+		calls:    make(map[string]*call),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	if c.maxEntries > 0 || c.maxBytes > 0 {
+		c.evictor = newEvictor(c.policy, c.maxEntries)
+	}
+	if c.defaultTTL > 0 {
+		c.startJanitor()
+	}
+	return c
 }
 
+// Set stores value with the default TTL.
 func (c *Cache) Set(key, value string) {
+	c.SetWithTTL(key, value, c.defaultTTL)
+}
+
+// SetWithTTL stores value until ttl has passed. A ttl <= 0 never expires.
+// In a bounded cache it evicts what the policy picks to make room.
+func (c *Cache) SetWithTTL(key, value string, ttl time.Duration) {
+	e := entry{value: value}
+	if ttl > 0 {
+		e.expires = c.clock.Now().Add(ttl)
+		c.startJanitor()
+	}
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.store[key] = value
+	delete(c.errs, key)
+	if c.evictor == nil {
+		c.store[key] = e
+		c.mu.Unlock()
+		return
+	}
+
+	old, exists := c.store[key]
+	need := size(key, value)
+	if c.maxBytes > 0 && need > c.maxBytes {
+		// It can never fit; don't empty the cache trying. The old value
+		// goes, since it's no longer what was set.
+		if !exists {
+			c.mu.Unlock()
+			return
+		}
+		c.drop(key, old)
+		c.mu.Unlock()
+		c.notify([]removal{{key, old.value, Replaced}})
+		return
+	}
+	if exists {
+		c.bytes -= size(key, old.value)
+		c.evictor.access(key)
+	}
+	var gone []removal
+	for c.full(exists, need) {
+		victim, ok := c.evictor.evict(key)
+		if !ok {
+			break
+		}
+		if victim == key {
+			// The old value was on its way out anyway
+			delete(c.store, key)
+			exists = false
+			continue
+		}
+		v := c.store[victim]
+		c.drop(victim, v)
+		c.evictions.Add(1)
+		gone = append(gone, removal{victim, v.value, Evicted})
+	}
+	if !exists {
+		c.evictor.insert(key)
+	}
+	c.store[key] = e
+	c.bytes += need
+	c.mu.Unlock()
+	c.notify(gone)
 }
 
+// full reports whether adding need bytes (and a new key unless replacing)
+// would break a limit.
+func (c *Cache) full(replacing bool, need int) bool {
+	n := len(c.store)
+	if !replacing {
+		n++
+	}
+	return c.maxEntries > 0 && n > c.maxEntries || c.maxBytes > 0 && c.bytes+need > c.maxBytes
+}
+
+// Get returns the value for key. An expired entry is a miss and is
+// removed on the spot, unless GetOrLoad may still serve it stale.
 func (c *Cache) Get(key string) (string, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	val, ok := c.store[key]
-	return val, ok
+	now := c.clock.Now()
+	if c.evictor == nil {
+		// Unbounded, a hit changes nothing and a read lock is enough
+		c.mu.RLock()
+		e, ok := c.store[key]
+		c.mu.RUnlock()
+		if !ok {
+			c.misses.Add(1)
+			return "", false
+		}
+		if !e.expired(now) {
+			c.hits.Add(1)
+			return e.value, true
+		}
+	}
+
+	c.mu.Lock()
+	// It may have been set again since we looked
+	e, ok := c.store[key]
+	switch {
+	case !ok:
+		c.mu.Unlock()
+	case !e.expired(now):
+		if c.evictor != nil {
+			c.evictor.access(key)
+		}
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return e.value, true
+	case e.dead(now, c.stale):
+		c.drop(key, e)
+		c.expirations.Add(1)
+		c.mu.Unlock()
+		c.notify([]removal{{key, e.value, Expired}})
+	default:
+		c.mu.Unlock()
+	}
+	c.misses.Add(1)
+	return "", false
 }
 
 func (c *Cache) Delete(key string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	delete(c.errs, key)
+	if e, ok := c.store[key]; ok {
+		c.drop(key, e)
+	}
+}
+
+// drop removes an entry the cache holds. The caller has the lock.
+func (c *Cache) drop(key string, e entry) {
 	delete(c.store, key)
+	if c.evictor != nil {
+		c.bytes -= size(key, e.value)
+		c.evictor.remove(key)
+	}
+}
+
+type removal struct {
+	key, value string
+	reason     EvictReason
+}
+
+func (c *Cache) notify(gone []removal) {
+	if c.onEvict == nil {
+		return
+	}
+	for _, r := range gone {
+		c.onEvict(r.key, r.value, r.reason)
+	}
+}
+
+// Stats returns the counters and current size. Bytes is only tracked
+// with a limit set.
+func (c *Cache) Stats() Stats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return Stats{
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Evictions:   c.evictions.Load(),
+		Expirations: c.expirations.Load(),
+		Entries:     len(c.store),
+		Bytes:       c.bytes,
+	}
+}
+
+// Len counts the stored entries, including expired ones not yet removed.
+func (c *Cache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.store)
+}
+
+// DeleteExpired removes every expired entry, once past any stale window,
+// and expired loader errors. The janitor calls it on each tick.
+func (c *Cache) DeleteExpired() {
+	now := c.clock.Now()
+	var gone []removal
+	c.mu.Lock()
+	for k, f := range c.errs {
+		if !now.Before(f.expires) {
+			delete(c.errs, k)
+		}
+	}
+	for k, e := range c.store {
+		if e.dead(now, c.stale) {
+			c.drop(k, e)
+			c.expirations.Add(1)
+			gone = append(gone, removal{k, e.value, Expired})
+		}
+	}
+	c.mu.Unlock()
+	c.notify(gone)
+}
+
+// startJanitor runs the janitor once the first entry can expire, so a
+// cache without TTLs never starts a goroutine.
+func (c *Cache) startJanitor() {
+	c.janitorOnce.Do(func() {
+		go func() {
+			defer close(c.done)
+			ticker := time.NewTicker(c.interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					c.DeleteExpired()
+				case <-c.stop:
+					return
+				}
+			}
+		}()
+	})
+}
+
+// Close stops the janitor and waits for it to exit. The cache still
+// works afterwards, with expired entries removed only on Get.
+func (c *Cache) Close() {
+	c.closeOnce.Do(func() {
+		// Nothing can start the janitor after this
+		c.janitorOnce.Do(func() { close(c.done) })
+		close(c.stop)
+		<-c.done
+	})
 }
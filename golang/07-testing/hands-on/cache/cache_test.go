@@ -1,10 +1,35 @@
 package cache
 
 import (
+	"math/rand/v2"
+	"strconv"
 	"sync"
 	"testing"
+	"time"
 )
 
+// fakeClock only moves when told to
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
 func TestCacheOperations(t *testing.T) {
 	c := New()
 
@@ -23,6 +48,85 @@ func TestCacheOperations(t *testing.T) {
 	}
 }
 
+func TestTTL(t *testing.T) {
+	clock := newFakeClock()
+	c := New(WithDefaultTTL(time.Minute), WithClock(clock))
+	defer c.Close()
+
+	c.Set("session", "abc")                     // Default TTL
+	c.SetWithTTL("token", "xyz", 5*time.Second) // Shorter
+	c.SetWithTTL("config", "v1", 0)             // Never expires
+
+	tests := []struct {
+		after time.Duration
+		key   string
+		want  bool
+	}{
+		{4 * time.Second, "token", true},
+		{time.Second, "token", false}, // Exactly at its expiry
+		{54 * time.Second, "session", true},
+		{time.Second, "session", false},
+		{24 * time.Hour, "config", true},
+	}
+	for _, tt := range tests {
+		clock.Advance(tt.after)
+		if _, ok := c.Get(tt.key); ok != tt.want {
+			t.Errorf("Get(%s) at %v = %v; want %v", tt.key, clock.Now(), ok, tt.want)
+		}
+	}
+	// The misses removed what they found expired
+	if n := c.Len(); n != 1 {
+		t.Errorf("Len() = %d; want 1", n)
+	}
+
+	// Setting a key again restarts its TTL
+	c.Set("session", "def")
+	clock.Advance(59 * time.Second)
+	if val, ok := c.Get("session"); !ok || val != "def" {
+		t.Errorf("Get(session) = %s, %v; want def, true", val, ok)
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	clock := newFakeClock()
+	c := New(WithClock(clock), WithJanitorInterval(time.Millisecond))
+	for _, k := range []string{"a", "b", "c"} {
+		c.SetWithTTL(k, "v", time.Second)
+	}
+	c.SetWithTTL("d", "v", time.Hour)
+	clock.Advance(time.Minute)
+
+	// Nobody calls Get, the janitor has to find them
+	deadline := time.Now().Add(time.Second)
+	for c.Len() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := c.Len(); n != 1 {
+		t.Errorf("Len() = %d after the janitor ran; want 1", n)
+	}
+
+	c.Close()
+	c.Close() // Safe to call twice
+	clock.Advance(2 * time.Hour)
+	time.Sleep(10 * time.Millisecond)
+	if n := c.Len(); n != 1 {
+		t.Errorf("Len() = %d; the janitor ran after Close", n)
+	}
+	if _, ok := c.Get("d"); ok {
+		t.Error("Get(d) after Close should still expire lazily")
+	}
+}
+
+func TestCloseWithoutJanitor(t *testing.T) {
+	c := New()
+	c.Set("k", "v")
+	c.Close() // Never started a janitor, mustn't block
+	c.SetWithTTL("k", "v", time.Second)
+	if val, ok := c.Get("k"); !ok || val != "v" {
+		t.Errorf("Get(k) after Close = %s, %v", val, ok)
+	}
+}
+
 // TestConcurrency runs many goroutines to check for race conditions
 // Use: go test -race
 func TestConcurrency(t *testing.T) {
@@ -66,3 +170,65 @@ func BenchmarkCacheGet(b *testing.B) {
 		c.Get("key")
 	}
 }
+
+// The policy benchmarks use twice as many keys as fit. "none" is the
+// unbounded cache.
+var benchPolicies = []struct {
+	name string
+	opts []Option
+}{
+	{"none", nil},
+	{"LRU", []Option{WithMaxEntries(1024), WithPolicy(LRU)}},
+	{"LFU", []Option{WithMaxEntries(1024), WithPolicy(LFU)}},
+	{"ARC", []Option{WithMaxEntries(1024), WithPolicy(ARC)}},
+}
+
+func benchKeys() []string {
+	keys := make([]string, 2048)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+	}
+	return keys
+}
+
+func BenchmarkPolicySet(b *testing.B) {
+	keys := benchKeys()
+	for _, p := range benchPolicies {
+		b.Run(p.name, func(b *testing.B) {
+			c := New(p.opts...)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.Set(keys[i%len(keys)], "value")
+			}
+		})
+	}
+}
+
+func BenchmarkPolicyGet(b *testing.B) {
+	keys := benchKeys()
+	for _, p := range benchPolicies {
+		b.Run(p.name, func(b *testing.B) {
+			c := New(p.opts...)
+			for _, k := range keys {
+				c.Set(k, "value")
+			}
+			// A Zipf stream, skewed towards the low keys as real traffic
+			// is, seeded so every policy sees the same one
+			z := rand.NewZipf(rand.New(rand.NewPCG(1, 2)), 1.1, 1, uint64(len(keys)-1))
+			stream := make([]string, 1<<16)
+			for i := range stream {
+				stream[i] = keys[z.Uint64()]
+			}
+			misses := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				k := stream[i%len(stream)]
+				if _, ok := c.Get(k); !ok {
+					misses++
+					c.Set(k, "value")
+				}
+			}
+			b.ReportMetric(100*float64(misses)/float64(b.N), "miss%")
+		})
+	}
+}
@@ -0,0 +1,241 @@
+// Package cluster spreads a cache over several nodes, groupcache-style.
+// Each key has one owner on a consistent-hash ring. Only the owner loads
+// and caches it, and other nodes ask the owner over HTTP.
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"07-testing/hands-on/cache"
+)
+
+// BasePath is where a Node serves its keys to the other nodes.
+const BasePath = "/_cache/"
+
+// maxValue bounds what a node reads back from a peer.
+const maxValue = 64 << 20
+
+type Node struct {
+	self   string
+	load   cache.Loader
+	local  *cache.Cache // Keys this node owns
+	near   *cache.Cache // Hot keys owned elsewhere; nil if off
+	seen   *cache.Cache // Keys owned elsewhere fetched once, not yet near
+	client *http.Client
+	mux    *http.ServeMux
+
+	replicas  int
+	cacheOpts []cache.Option
+	nearSize  int
+	nearTTL   time.Duration
+
+	mu   sync.RWMutex
+	ring *Ring
+}
+
+// Option configures a Node in NewNode.
+type Option func(*Node)
+
+// WithReplicas sets how many points each peer has on the ring (default 50).
+func WithReplicas(replicas int) Option {
+	return func(n *Node) { n.replicas = replicas }
+}
+
+// WithCacheOptions configures the cache of owned keys, e.g. its TTL,
+// size limit, negative caching or stale-while-revalidate.
+func WithCacheOptions(opts ...cache.Option) Option {
+	return func(n *Node) { n.cacheOpts = append(n.cacheOpts, opts...) }
+}
+
+// WithNearCache keeps up to size keys owned by other nodes for ttl, so a
+// hot key doesn't cost a round trip each time. A key is kept from its
+// second fetch within ttl, so one-offs pass through. Nothing tells a node
+// when the owner's value changes, so without a ttl the near-cache is off.
+func WithNearCache(size int, ttl time.Duration) Option {
+	return func(n *Node) { n.nearSize, n.nearTTL = size, ttl }
+}
+
+// WithClient replaces the HTTP client used to reach peers (default a 5s
+// timeout).
+func WithClient(c *http.Client) Option {
+	return func(n *Node) { n.client = c }
+}
+
+// NewNode makes the node reachable at self, a base URL such as
+// "http://10.0.0.1:8080" that is also how the peer list names it. load
+// fetches owned keys from the source of truth. The node owns every key
+// until SetPeers is called.
+func NewNode(self string, load cache.Loader, opts ...Option) *Node {
+	n := &Node{
+		self:     strings.TrimSuffix(self, "/"),
+		load:     load,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		replicas: 50,
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	n.local = cache.New(n.cacheOpts...)
+	if n.nearSize > 0 && n.nearTTL > 0 {
+		n.near = cache.New(cache.WithMaxEntries(n.nearSize), cache.WithPolicy(cache.ARC), cache.WithDefaultTTL(n.nearTTL))
+		n.seen = cache.New(cache.WithMaxEntries(n.nearSize), cache.WithDefaultTTL(n.nearTTL))
+	}
+	n.ring = NewRing(n.replicas, n.self)
+	n.mux = http.NewServeMux()
+	n.mux.HandleFunc("GET "+BasePath+"{key}", n.handleGet)
+	return n
+}
+
+// SetPeers replaces the peer list, this node included. Keys that change
+// owner are loaded afresh by the new one; the old owner's copies age out.
+func (n *Node) SetPeers(peers ...string) {
+	trimmed := make([]string, len(peers))
+	for i, p := range peers {
+		trimmed[i] = strings.TrimSuffix(p, "/")
+	}
+	ring := NewRing(n.replicas, trimmed...)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.ring = ring
+}
+
+// ReloadPeers reads the peer list from a file, one base URL per line, with
+// blank lines and # comments ignored. Call it again when the file changes,
+// e.g. on SIGHUP.
+func (n *Node) ReloadPeers(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var peers []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if u, err := url.Parse(line); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("%s: bad peer %q", path, line)
+		}
+		peers = append(peers, line)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if len(peers) == 0 {
+		return fmt.Errorf("%s: no peers", path)
+	}
+	n.SetPeers(peers...)
+	return nil
+}
+
+// Owner returns the peer that owns key.
+func (n *Node) Owner(key string) string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.ring.Owner(key)
+}
+
+// Get returns the value for key from this node's cache if it owns the
+// key, or else from the owner (via the near-cache, if on).
+func (n *Node) Get(ctx context.Context, key string) (string, error) {
+	owner := n.Owner(key)
+	if owner == n.self {
+		return n.local.GetOrLoad(ctx, key, n.load)
+	}
+	fetch := func(ctx context.Context, key string) (string, error) {
+		return n.fetch(ctx, owner, key)
+	}
+	if n.near == nil {
+		return fetch(ctx, key)
+	}
+	if v, ok := n.near.Get(key); ok {
+		return v, nil
+	}
+	if _, ok := n.seen.Get(key); !ok {
+		n.seen.Set(key, "")
+		return fetch(ctx, key)
+	}
+	return n.near.GetOrLoad(ctx, key, fetch)
+}
+
+// fetch asks owner for key. If the owner can't be reached the key is
+// loaded here, uncached, so a dead node slows its keys down but doesn't
+// fail them.
+func (n *Node) fetch(ctx context.Context, owner, key string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, owner+BasePath+url.PathEscape(key), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return n.load(ctx, key)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxValue+1))
+	if err != nil {
+		return "", fmt.Errorf("cache: reading %q from %s: %w", key, owner, err)
+	}
+	if len(body) > maxValue {
+		return "", fmt.Errorf("cache: %q from %s is over %d bytes", key, owner, maxValue)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", &PeerError{Peer: owner, Status: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+	return string(body), nil
+}
+
+// PeerError is the owner's answer when it couldn't produce a key.
+type PeerError struct {
+	Peer    string
+	Status  int
+	Message string
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("cache: %s: %d %s", e.Peer, e.Status, e.Message)
+}
+
+// ServeHTTP answers the other nodes. A node serves whatever it's asked
+// for, even a key it no longer owns while peers disagree about the list,
+// so a request is never forwarded twice.
+func (n *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mux.ServeHTTP(w, r)
+}
+
+func (n *Node) handleGet(w http.ResponseWriter, r *http.Request) {
+	v, err := n.local.GetOrLoad(r.Context(), r.PathValue("key"), n.load)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.WriteString(w, v)
+}
+
+// Close stops the caches' janitors.
+func (n *Node) Close() {
+	n.local.Close()
+	if n.near != nil {
+		n.near.Close()
+		n.seen.Close()
+	}
+}
@@ -0,0 +1,296 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"07-testing/hands-on/cache"
+)
+
+// testNode is a Node behind an httptest server, counting what it loads
+// and how often peers ask it for something.
+type testNode struct {
+	*Node
+	srv      *httptest.Server
+	requests atomic.Int32
+
+	mu     sync.Mutex
+	loaded []string
+}
+
+func (tn *testNode) loads() []string {
+	tn.mu.Lock()
+	defer tn.mu.Unlock()
+	return append([]string(nil), tn.loaded...)
+}
+
+// startCluster runs n nodes that all know each other
+func startCluster(t *testing.T, n int, opts ...Option) []*testNode {
+	t.Helper()
+	nodes := make([]*testNode, n)
+	var urls []string
+	for i := range nodes {
+		tn := &testNode{}
+		tn.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tn.requests.Add(1)
+			tn.ServeHTTP(w, r)
+		}))
+		load := func(ctx context.Context, key string) (string, error) {
+			if strings.HasPrefix(key, "bad") {
+				return "", errors.New("no such row")
+			}
+			tn.mu.Lock()
+			defer tn.mu.Unlock()
+			tn.loaded = append(tn.loaded, key)
+			return "value of " + key, nil
+		}
+		tn.Node = NewNode(tn.srv.URL, load, opts...)
+		t.Cleanup(tn.srv.Close)
+		t.Cleanup(tn.Close)
+		nodes[i] = tn
+		urls = append(urls, tn.srv.URL)
+	}
+	for _, tn := range nodes {
+		tn.SetPeers(urls...)
+	}
+	return nodes
+}
+
+func (tn *testNode) mustGet(t *testing.T, key string) {
+	t.Helper()
+	v, err := tn.Get(context.Background(), key)
+	if err != nil || v != "value of "+key {
+		t.Fatalf("Get(%q) on %s = %q, %v", key, tn.srv.URL, v, err)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	nodes := startCluster(t, 3)
+	var keys []string
+	for i := range 60 {
+		keys = append(keys, "user/"+strconv.Itoa(i)) // The slash has to survive the URL
+	}
+
+	// Every node can answer for every key, but only the owner loads it
+	for _, tn := range nodes {
+		for _, k := range keys {
+			tn.mustGet(t, k)
+		}
+	}
+	total := 0
+	for _, tn := range nodes {
+		for _, k := range tn.loads() {
+			if owner := tn.Owner(k); owner != tn.srv.URL {
+				t.Errorf("%s loaded %s, owned by %s", tn.srv.URL, k, owner)
+			}
+		}
+		total += len(tn.loads())
+		if len(tn.loads()) == 0 {
+			t.Errorf("%s owns none of %d keys", tn.srv.URL, len(keys))
+		}
+	}
+	if total != len(keys) {
+		t.Errorf("%d loads for %d keys; want one each", total, len(keys))
+	}
+
+	// The owner's error comes back to whoever asked
+	var remote string
+	for i := 0; remote == ""; i++ {
+		if k := "bad-" + strconv.Itoa(i); nodes[0].Owner(k) != nodes[0].srv.URL {
+			remote = k
+		}
+	}
+	_, err := nodes[0].Get(context.Background(), remote)
+	var pe *PeerError
+	if !errors.As(err, &pe) || pe.Status != http.StatusInternalServerError || pe.Message != "no such row" {
+		t.Errorf("Get(%s) = %v; want the owner's error", remote, err)
+	}
+}
+
+func TestNearCache(t *testing.T) {
+	nodes := startCluster(t, 2, WithNearCache(10, time.Minute))
+	var hot string
+	for i := 0; hot == ""; i++ {
+		if k := "hot-" + strconv.Itoa(i); nodes[0].Owner(k) == nodes[1].srv.URL {
+			hot = k
+		}
+	}
+
+	// Kept from the second fetch on
+	for range 5 {
+		nodes[0].mustGet(t, hot)
+	}
+	if n := nodes[1].requests.Load(); n != 2 {
+		t.Errorf("the owner was asked %d times for a near-cached key; want 2", n)
+	}
+
+	// A key fetched once isn't kept
+	var cold string
+	for i := 0; cold == ""; i++ {
+		if k := "cold-" + strconv.Itoa(i); nodes[0].Owner(k) == nodes[1].srv.URL {
+			cold = k
+		}
+	}
+	nodes[0].mustGet(t, cold)
+	if _, ok := nodes[0].near.Get(cold); ok {
+		t.Errorf("%s near-cached after one fetch", cold)
+	}
+}
+
+func TestNearCacheExpires(t *testing.T) {
+	for _, ttl := range []time.Duration{50 * time.Millisecond, 0} {
+		nodes := startCluster(t, 2, WithNearCache(10, ttl))
+		var key string
+		for i := 0; key == ""; i++ {
+			if k := "k-" + strconv.Itoa(i); nodes[0].Owner(k) == nodes[1].srv.URL {
+				key = k
+			}
+		}
+		for range 3 {
+			nodes[0].mustGet(t, key)
+		}
+		if ttl == 0 {
+			// No ttl, no near-cache: it would serve the first value forever
+			if n := nodes[1].requests.Load(); n != 3 {
+				t.Errorf("without a ttl the owner was asked %d times; want 3", n)
+			}
+			continue
+		}
+		time.Sleep(2 * ttl)
+		nodes[0].mustGet(t, key)
+		if n := nodes[1].requests.Load(); n != 3 {
+			t.Errorf("owner asked %d times; want 3, the last once the near copy expired", n)
+		}
+	}
+}
+
+func TestOwnerDown(t *testing.T) {
+	nodes := startCluster(t, 2)
+	var key string
+	for i := 0; key == ""; i++ {
+		if k := "k-" + strconv.Itoa(i); nodes[0].Owner(k) == nodes[1].srv.URL {
+			key = k
+		}
+	}
+	nodes[1].srv.Close()
+
+	// Served anyway, loaded here without taking ownership
+	nodes[0].mustGet(t, key)
+	nodes[0].mustGet(t, key)
+	if got := nodes[0].loads(); len(got) != 2 {
+		t.Errorf("loads while the owner is down = %v; want two uncached", got)
+	}
+}
+
+// zeros reads as an endless run of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestOversizedValue(t *testing.T) {
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.CopyN(w, zeros{}, maxValue+1)
+	}))
+	defer owner.Close()
+	n := NewNode("http://self", func(context.Context, string) (string, error) { return "", errors.New("not here") })
+	defer n.Close()
+	n.SetPeers(owner.URL, "http://self")
+	var key string
+	for i := 0; key == ""; i++ {
+		if k := "k-" + strconv.Itoa(i); n.Owner(k) == owner.URL {
+			key = k
+		}
+	}
+
+	// Cut short, it would pass for the whole value
+	if v, err := n.Get(context.Background(), key); err == nil || !strings.Contains(err.Error(), "over") {
+		t.Errorf("Get of a value over the limit = %d bytes, %v; want an error", len(v), err)
+	}
+}
+
+func TestReloadPeers(t *testing.T) {
+	nodes := startCluster(t, 3)
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	var key string
+	for i := 0; key == ""; i++ {
+		if k := "k-" + strconv.Itoa(i); a.Owner(k) == c.srv.URL {
+			key = k
+		}
+	}
+
+	// c leaves: its keys move to a or b, and a node out of step with the
+	// list still answers rather than forwarding again
+	path := filepath.Join(t.TempDir(), "peers")
+	os.WriteFile(path, []byte("# The cluster\n"+a.srv.URL+"\n\n"+b.srv.URL+"/  # trailing slash\n"), 0o644)
+	if err := a.ReloadPeers(path); err != nil {
+		t.Fatal(err)
+	}
+	owner := a.Owner(key)
+	if owner == c.srv.URL || owner == "" {
+		t.Fatalf("%s still owned by %q", key, owner)
+	}
+	a.mustGet(t, key)
+	if owner == b.srv.URL && len(b.loads()) != 1 {
+		t.Errorf("new owner b loaded %v", b.loads())
+	}
+
+	for _, bad := range []string{"", "ftp://x\n", "localhost:8080\n"} {
+		os.WriteFile(path, []byte(bad), 0o644)
+		if err := a.ReloadPeers(path); err == nil {
+			t.Errorf("ReloadPeers accepted %q", bad)
+		}
+	}
+	if a.Owner(key) != owner {
+		t.Error("a bad peer list replaced the ring")
+	}
+}
+
+// TestSharedLoad checks the owner's GetOrLoad collapses concurrent asks
+// from several nodes into one load.
+func TestSharedLoad(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	slow := func(ctx context.Context, key string) (string, error) {
+		calls.Add(1)
+		<-release
+		return "value of " + key, nil
+	}
+	owner := NewNode("http://owner.invalid", slow, WithCacheOptions(cache.WithDefaultTTL(time.Minute)))
+	defer owner.Close()
+	srv := httptest.NewServer(owner)
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(srv.URL + BasePath + "k")
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("owner loaded k %d times; want 1", n)
+	}
+}
@@ -0,0 +1,47 @@
+package cluster
+
+import (
+	"hash/crc32"
+	"slices"
+	"strconv"
+)
+
+// Ring is a consistent-hash ring. Each peer sits at replicas points on it,
+// and a key belongs to the first peer point at or after the key's hash.
+// Adding or removing a peer only moves the keys next to its points, and
+// the virtual points even out the share each peer gets.
+type Ring struct {
+	hashes []uint32 // Sorted
+	owners map[uint32]string
+}
+
+// NewRing places peers on a ring. Every node has to build the same ring
+// from the same list, so peers are sorted first and the hash is a fixed
+// one, not a seeded one.
+func NewRing(replicas int, peers ...string) *Ring {
+	r := &Ring{owners: make(map[uint32]string)}
+	peers = slices.Sorted(slices.Values(peers))
+	for _, p := range slices.Compact(peers) {
+		for i := range replicas {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + p))
+			if _, taken := r.owners[h]; !taken {
+				r.owners[h] = p
+				r.hashes = append(r.hashes, h)
+			}
+		}
+	}
+	slices.Sort(r.hashes)
+	return r
+}
+
+// Owner returns the peer key belongs to, or "" for an empty ring.
+func (r *Ring) Owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	i, _ := slices.BinarySearch(r.hashes, crc32.ChecksumIEEE([]byte(key)))
+	if i == len(r.hashes) {
+		i = 0 // Wrap around
+	}
+	return r.owners[r.hashes[i]]
+}
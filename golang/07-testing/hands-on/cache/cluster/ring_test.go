@@ -0,0 +1,46 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	peers := []string{"http://a", "http://b", "http://c"}
+	r := NewRing(50, peers...)
+	if got := NewRing(50, "http://c", "http://a", "http://b", "http://a"); got.Owner("k") != r.Owner("k") || len(got.hashes) != len(r.hashes) {
+		t.Error("the ring depends on the order of the peer list")
+	}
+	if NewRing(50).Owner("k") != "" {
+		t.Error("an empty ring owns keys")
+	}
+
+	const keys = 10000
+	share := map[string]int{}
+	before := map[string]string{}
+	for i := range keys {
+		k := "key-" + strconv.Itoa(i)
+		before[k] = r.Owner(k)
+		share[before[k]]++
+	}
+	for _, p := range peers {
+		if share[p] < keys/5 || share[p] > keys/2 {
+			t.Errorf("%s owns %d of %d keys", p, share[p], keys)
+		}
+	}
+
+	// A fourth peer only takes keys; the rest stay where they were
+	r = NewRing(50, append(peers, "http://d")...)
+	moved := 0
+	for k, was := range before {
+		if now := r.Owner(k); now != was {
+			moved++
+			if now != "http://d" {
+				t.Fatalf("%s moved from %s to %s", k, was, now)
+			}
+		}
+	}
+	if moved < keys/8 || moved > keys*3/8 {
+		t.Errorf("%d of %d keys moved to the new peer; want about a quarter", moved, keys)
+	}
+}
@@ -0,0 +1,173 @@
+package cache
+
+import "container/list"
+
+// Policy picks which entry goes when a bounded cache is full.
+type Policy int
+
+const (
+	// LRU evicts the least recently used entry.
+	LRU Policy = iota
+	// LFU evicts the least frequently used entry, the least recently used
+	// one among equals.
+	LFU
+	// ARC (Adaptive Replacement Cache) balances recency against frequency
+	// and learns the mix from keys it evicted too early, so one big scan
+	// doesn't flush the hot set as it would with LRU.
+	ARC
+)
+
+func (p Policy) String() string {
+	switch p {
+	case LRU:
+		return "LRU"
+	case LFU:
+		return "LFU"
+	case ARC:
+		return "ARC"
+	}
+	return "Policy(?)"
+}
+
+// evictor tracks keys for a policy. The cache calls it under its lock.
+type evictor interface {
+	// evict removes and returns the next victim to make room for incoming,
+	// which isn't in the cache yet (or is being replaced).
+	evict(incoming string) (string, bool)
+	insert(key string) // A new key, after any evictions for it
+	access(key string) // A hit or an overwrite
+	remove(key string) // Deleted or expired
+}
+
+func newEvictor(p Policy, maxEntries int) evictor {
+	switch p {
+	case LFU:
+		return newLFU()
+	case ARC:
+		return newARC(maxEntries)
+	}
+	return newLRU()
+}
+
+// --- LRU ---
+
+type lru struct {
+	order *list.List // Most recent at the front
+	elems map[string]*list.Element
+}
+
+func newLRU() *lru {
+	return &lru{order: list.New(), elems: make(map[string]*list.Element)}
+}
+
+func (l *lru) insert(key string) { l.elems[key] = l.order.PushFront(key) }
+
+func (l *lru) access(key string) {
+	if el, ok := l.elems[key]; ok {
+		l.order.MoveToFront(el)
+	}
+}
+
+func (l *lru) remove(key string) {
+	if el, ok := l.elems[key]; ok {
+		l.order.Remove(el)
+		delete(l.elems, key)
+	}
+}
+
+func (l *lru) evict(string) (string, bool) {
+	el := l.order.Back()
+	if el == nil {
+		return "", false
+	}
+	key := el.Value.(string)
+	l.remove(key)
+	return key, true
+}
+
+// --- LFU ---
+
+// lfu is the O(1) scheme: one recency list per use count, and the lowest
+// count that has entries.
+type lfu struct {
+	nodes    map[string]*list.Element // Value is *lfuNode
+	counts   map[int]*list.List       // Most recent at the front
+	minCount int
+}
+
+type lfuNode struct {
+	key   string
+	count int
+}
+
+func newLFU() *lfu {
+	return &lfu{nodes: make(map[string]*list.Element), counts: make(map[int]*list.List)}
+}
+
+func (l *lfu) push(n *lfuNode) {
+	lst, ok := l.counts[n.count]
+	if !ok {
+		lst = list.New()
+		l.counts[n.count] = lst
+	}
+	l.nodes[n.key] = lst.PushFront(n)
+}
+
+// unlink takes el out of its count's list. It reports whether that left
+// the list empty.
+func (l *lfu) unlink(el *list.Element) bool {
+	n := el.Value.(*lfuNode)
+	lst := l.counts[n.count]
+	lst.Remove(el)
+	delete(l.nodes, n.key)
+	if lst.Len() == 0 {
+		delete(l.counts, n.count)
+		return true
+	}
+	return false
+}
+
+func (l *lfu) insert(key string) {
+	l.push(&lfuNode{key: key, count: 1})
+	l.minCount = 1
+}
+
+func (l *lfu) access(key string) {
+	el, ok := l.nodes[key]
+	if !ok {
+		return
+	}
+	n := el.Value.(*lfuNode)
+	if l.unlink(el) && l.minCount == n.count {
+		l.minCount++
+	}
+	n.count++
+	l.push(n)
+}
+
+func (l *lfu) remove(key string) {
+	el, ok := l.nodes[key]
+	if !ok {
+		return
+	}
+	count := el.Value.(*lfuNode).count
+	if l.unlink(el) && l.minCount == count {
+		// The next count up may be far away; there are few distinct counts
+		l.minCount = 0
+		for c := range l.counts {
+			if l.minCount == 0 || c < l.minCount {
+				l.minCount = c
+			}
+		}
+	}
+}
+
+func (l *lfu) evict(string) (string, bool) {
+	lst, ok := l.counts[l.minCount]
+	if !ok {
+		return "", false
+	}
+	key := lst.Back().Value.(*lfuNode).key
+	l.remove(key)
+	return key, true
+}
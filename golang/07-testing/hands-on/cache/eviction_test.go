@@ -0,0 +1,225 @@
+package cache
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// present lists which of keys are in c, without touching their recency
+func present(c *Cache, keys ...string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var in []string
+	for _, k := range keys {
+		if _, ok := c.store[k]; ok {
+			in = append(in, k)
+		}
+	}
+	return in
+}
+
+func TestPolicies(t *testing.T) {
+	tests := []struct {
+		policy Policy
+		ops    []string // "set k" or "get k"
+		want   []string // What's left of a, b, c, d
+	}{
+		// Reading a makes b the oldest
+		{LRU, []string{"set a", "set b", "set c", "get a", "set d"}, []string{"a", "c", "d"}},
+		// b was read least; ties go to the oldest
+		{LFU, []string{"set a", "set b", "set c", "get a", "get a", "get b", "get c", "get c", "set d"}, []string{"a", "c", "d"}},
+		{LFU, []string{"set a", "set b", "set c", "set d"}, []string{"b", "c", "d"}},
+		// Overwriting counts as a use
+		{LFU, []string{"set a", "set b", "set c", "get b", "get c", "set a", "set a", "set d"}, []string{"a", "c", "d"}},
+		// a and b were read twice, so the scan only cycles through T1
+		{ARC, []string{"set a", "set b", "get a", "get b", "set c", "set d"}, []string{"a", "b", "d"}},
+	}
+	for _, tt := range tests {
+		c := New(WithMaxEntries(3), WithPolicy(tt.policy))
+		for _, op := range tt.ops {
+			switch verb, key, _ := strings.Cut(op, " "); verb {
+			case "set":
+				c.Set(key, "v")
+			case "get":
+				c.Get(key)
+			}
+		}
+		if got := present(c, "a", "b", "c", "d"); !slices.Equal(got, tt.want) {
+			t.Errorf("%v after %q: have %v; want %v", tt.policy, tt.ops, got, tt.want)
+		}
+	}
+}
+
+// TestScan is the case ARC is for: a one-off pass over many keys flushes a
+// hot set out of LRU, but not out of ARC.
+func TestScan(t *testing.T) {
+	hot := []string{"h1", "h2", "h3", "h4"}
+	for _, tt := range []struct {
+		policy Policy
+		kept   int
+	}{{LRU, 0}, {ARC, 4}} {
+		c := New(WithMaxEntries(8), WithPolicy(tt.policy))
+		for _, k := range hot {
+			c.Set(k, "v")
+			c.Get(k)
+		}
+		for i := range 100 {
+			c.Set(fmt.Sprintf("scan-%d", i), "v")
+		}
+		if got := present(c, hot...); len(got) != tt.kept {
+			t.Errorf("%v kept %v of the hot set through a scan; want %d", tt.policy, got, tt.kept)
+		}
+		if n := c.Len(); n != 8 {
+			t.Errorf("%v Len() = %d; want 8", tt.policy, n)
+		}
+	}
+}
+
+// TestARCAdapts checks a ghost hit brings a key back into T2 and moves the
+// target towards the list it came from.
+func TestARCAdapts(t *testing.T) {
+	a := newARC(2)
+	list := func(key string) int { return a.nodes[key].Value.(*arcNode).list }
+	a.insert("x")
+	a.access("x") // T2
+	a.insert("y") // T1
+	if k, _ := a.evict("z"); k != "y" || list("y") != arcB1 {
+		t.Fatalf("evicted %q; want y, into B1", k)
+	}
+	a.insert("z")
+
+	// y comes back: T1 gave it up too soon, so its target grows and T2 pays
+	if k, _ := a.evict("y"); k != "x" || list("x") != arcB2 {
+		t.Errorf("evicted %q for a B1 ghost; want x, into B2", k)
+	}
+	a.insert("y")
+	if a.p != 1 || list("y") != arcT2 {
+		t.Errorf("after a B1 hit p = %d, y in list %d; want 1 and T2", a.p, list("y"))
+	}
+
+	// And x coming back shrinks it again
+	a.evict("x")
+	a.insert("x")
+	if a.p != 0 || list("x") != arcT2 {
+		t.Errorf("after a B2 hit p = %d, x in list %d; want 0 and T2", a.p, list("x"))
+	}
+	if n := a.len(arcT1) + a.len(arcT2); n != 2 {
+		t.Errorf("T1+T2 = %d; want 2", n)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	var mu sync.Mutex
+	var evicted []string
+	c := New(WithMaxBytes(20), WithOnEvict(func(key, value string, reason EvictReason) {
+		mu.Lock()
+		defer mu.Unlock()
+		evicted = append(evicted, key+"="+value+" "+reason.String())
+	}))
+
+	c.Set("a", "123456789") // 10 bytes
+	c.Set("b", "123456789") // 20
+	c.Set("c", "1234")      // a goes
+	if got := present(c, "a", "b", "c"); !slices.Equal(got, []string{"b", "c"}) {
+		t.Errorf("have %v; want b and c", got)
+	}
+	c.Set("b", "1") // Shrinking makes room without evicting
+	c.Set("d", "12345678")
+	if st := c.Stats(); st.Bytes != 16 || st.Entries != 3 {
+		t.Errorf("Stats() = %+v; want 16 bytes in 3 entries", st)
+	}
+
+	// Too big for the whole cache: turned away without flushing the rest,
+	// and without reporting a value that was never stored
+	c.Set("e", "more than twenty bytes")
+	if got := present(c, "b", "c", "d", "e"); len(got) != 3 {
+		t.Errorf("have %v after an oversized Set; want b, c and d", got)
+	}
+	want := []string{"a=123456789 evicted"}
+	if !slices.Equal(evicted, want) {
+		t.Errorf("OnEvict got %q; want %q", evicted, want)
+	}
+	if st := c.Stats(); st.Evictions != 1 {
+		t.Errorf("Evictions = %d after an oversized Set; want 1", st.Evictions)
+	}
+
+	// Too big to replace c's value: the old one goes, with its own value
+	c.Set("c", "more than twenty bytes")
+	if got := present(c, "b", "c", "d"); !slices.Equal(got, []string{"b", "d"}) {
+		t.Errorf("have %v after an oversized overwrite; want b and d", got)
+	}
+	want = append(want, "c=1234 replaced")
+	if !slices.Equal(evicted, want) {
+		t.Errorf("OnEvict got %q; want %q", evicted, want)
+	}
+	if st := c.Stats(); st.Evictions != 1 || st.Bytes != 11 || st.Entries != 2 {
+		t.Errorf("Stats() = %+v after an oversized overwrite; want 1 eviction, 11 bytes in 2 entries", st)
+	}
+}
+
+func TestStats(t *testing.T) {
+	clock := newFakeClock()
+	var reasons []EvictReason
+	c := New(WithClock(clock), WithMaxEntries(2), WithPolicy(LFU), WithOnEvict(func(_, _ string, r EvictReason) {
+		reasons = append(reasons, r)
+	}))
+	defer c.Close()
+
+	c.Set("a", "1")
+	c.SetWithTTL("b", "2", time.Second)
+	c.Get("a")
+	c.Get("a")
+	c.Get("missing")
+	c.Set("c", "3") // b goes, it was never read
+	clock.Advance(time.Hour)
+	c.SetWithTTL("d", "4", time.Second)
+	clock.Advance(time.Hour)
+	c.Get("d") // Expired
+	c.Delete("a")
+
+	want := Stats{Hits: 2, Misses: 2, Evictions: 2, Expirations: 1, Entries: 0, Bytes: 0}
+	if st := c.Stats(); st != want {
+		t.Errorf("Stats() = %+v; want %+v", st, want)
+	}
+	if !slices.Equal(reasons, []EvictReason{Evicted, Evicted, Expired}) {
+		t.Errorf("OnEvict reasons = %v", reasons)
+	}
+
+	// Callbacks run unlocked and may use the cache
+	c = New(WithMaxEntries(1), WithOnEvict(func(key, value string, _ EvictReason) {
+		c.Len()
+	}))
+	c.Set("x", "1")
+	c.Set("y", "2")
+}
+
+func TestBoundedConcurrency(t *testing.T) {
+	for _, p := range []Policy{LRU, LFU, ARC} {
+		c := New(WithMaxEntries(50), WithMaxBytes(400), WithPolicy(p))
+		var wg sync.WaitGroup
+		for g := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range 1000 {
+					k := fmt.Sprint((g*31 + i*7) % 120)
+					if i%3 == 0 {
+						c.Set(k, "value")
+					} else if i%17 == 0 {
+						c.Delete(k)
+					} else {
+						c.Get(k)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if st := c.Stats(); st.Entries > 50 || st.Bytes > 400 {
+			t.Errorf("%v: %+v over its limits", p, st)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Loader fetches the value for a key the cache doesn't have.
+type Loader func(ctx context.Context, key string) (string, error)
+
+// A call is one load in flight, shared by everyone who missed the key.
+type call struct {
+	done  chan struct{}
+	value string
+	err   error
+}
+
+// A failure is a loader error kept for WithNegativeTTL.
+type failure struct {
+	err     error
+	expires time.Time
+}
+
+// WithNegativeTTL makes GetOrLoad remember a loader's error for ttl and
+// return it without calling the loader again. Context errors aren't kept.
+func WithNegativeTTL(ttl time.Duration) Option {
+	return func(c *Cache) { c.negativeTTL = ttl }
+}
+
+// WithStaleWhileRevalidate keeps expired entries for d more. Within that
+// window GetOrLoad returns the old value at once and refreshes it in the
+// background; Get treats them as missing.
+func WithStaleWhileRevalidate(d time.Duration) Option {
+	return func(c *Cache) { c.stale = d }
+}
+
+// GetOrLoad returns the cached value for key, or calls load and caches
+// the result with the default TTL. Concurrent misses on a key share one
+// call. The load outlives a caller whose ctx ends, who gets ctx's error,
+// so the others and the next caller still benefit.
+func (c *Cache) GetOrLoad(ctx context.Context, key string, load Loader) (string, error) {
+	if v, ok := c.Get(key); ok {
+		return v, nil
+	}
+
+	now := c.clock.Now()
+	c.mu.RLock()
+	e, cached := c.store[key]
+	f, failed := c.errs[key]
+	c.mu.RUnlock()
+	failed = failed && now.Before(f.expires)
+	if cached && e.expired(now) && !e.dead(now, c.stale) {
+		// A failed refresh leaves the stale value, and the cached error
+		// spaces out the retries
+		if !failed {
+			c.flight(ctx, key, load)
+		}
+		return e.value, nil
+	}
+	if failed {
+		return "", f.err
+	}
+
+	cl := c.flight(ctx, key, load)
+	select {
+	case <-cl.done:
+		return cl.value, cl.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// flight joins the load of key in progress, or starts one.
+func (c *Cache) flight(ctx context.Context, key string, load Loader) *call {
+	c.loadMu.Lock()
+	defer c.loadMu.Unlock()
+	if cl, ok := c.calls[key]; ok {
+		return cl
+	}
+	cl := &call{done: make(chan struct{})}
+	c.calls[key] = cl
+	go func() {
+		cl.value, cl.err = c.run(context.WithoutCancel(ctx), key, load)
+		switch {
+		case cl.err == nil:
+			c.Set(key, cl.value)
+		case c.negativeTTL > 0 && !errors.Is(cl.err, context.Canceled) && !errors.Is(cl.err, context.DeadlineExceeded):
+			c.mu.Lock()
+			c.errs[key] = failure{cl.err, c.clock.Now().Add(c.negativeTTL)}
+			c.mu.Unlock()
+			c.startJanitor()
+		}
+		// Cached before it's forgotten, so nobody misses both
+		c.loadMu.Lock()
+		delete(c.calls, key)
+		c.loadMu.Unlock()
+		close(cl.done)
+	}()
+	return cl
+}
+
+// run calls load, turning a panic into an error so waiters aren't stuck.
+func (c *Cache) run(ctx context.Context, key string, load Loader) (value string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cache: loading %q panicked: %v", key, r)
+		}
+	}()
+	return load(ctx, key)
+}
@@ -0,0 +1,201 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond for up to a second, for work done in the background
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestGetOrLoadCollapses(t *testing.T) {
+	c := New()
+	var calls atomic.Int32
+	release := make(chan struct{})
+	load := func(ctx context.Context, key string) (string, error) {
+		calls.Add(1)
+		<-release
+		return "loaded " + key, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]string, 20)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = c.GetOrLoad(context.Background(), "user:1", load)
+		}()
+	}
+	waitFor(t, "the load to start", func() bool { return calls.Load() > 0 })
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("loader called %d times; want 1", n)
+	}
+	for i, r := range results {
+		if r != "loaded user:1" {
+			t.Errorf("caller %d got %q", i, r)
+		}
+	}
+	if v, ok := c.Get("user:1"); !ok || v != "loaded user:1" {
+		t.Errorf("Get after the load = %q, %v", v, ok)
+	}
+}
+
+func TestGetOrLoadCancel(t *testing.T) {
+	c := New()
+	release := make(chan struct{})
+	loaderCtx := make(chan context.Context, 1)
+	load := func(ctx context.Context, key string) (string, error) {
+		loaderCtx <- ctx
+		<-release
+		return "v", nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		_, err := c.GetOrLoad(ctx, "k", load)
+		errc <- err
+	}()
+	lctx := <-loaderCtx
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("GetOrLoad after cancel = %v; want context.Canceled", err)
+	}
+	if lctx.Err() != nil {
+		t.Error("cancelling the caller cancelled the shared load")
+	}
+
+	// The load carries on and fills the cache
+	close(release)
+	waitFor(t, "the abandoned load to finish", func() bool { _, ok := c.Get("k"); return ok })
+}
+
+func TestNegativeCaching(t *testing.T) {
+	clock := newFakeClock()
+	c := New(WithClock(clock), WithNegativeTTL(10*time.Second))
+	defer c.Close()
+	var calls atomic.Int32
+	errDown := errors.New("database down")
+	fail := func(ctx context.Context, key string) (string, error) {
+		calls.Add(1)
+		return "", errDown
+	}
+	ctx := context.Background()
+
+	for range 3 {
+		if _, err := c.GetOrLoad(ctx, "k", fail); !errors.Is(err, errDown) {
+			t.Errorf("GetOrLoad = %v; want %v", err, errDown)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("loader called %d times within the negative TTL; want 1", n)
+	}
+	clock.Advance(10 * time.Second)
+	c.GetOrLoad(ctx, "k", fail)
+	if n := calls.Load(); n != 2 {
+		t.Errorf("loader called %d times after the negative TTL; want 2", n)
+	}
+
+	// Set replaces a cached error
+	c.Set("k", "fixed")
+	if v, err := c.GetOrLoad(ctx, "k", fail); err != nil || v != "fixed" {
+		t.Errorf("GetOrLoad after Set = %q, %v", v, err)
+	}
+
+	// A timeout says nothing about the key, so it isn't kept
+	timeout := func(ctx context.Context, key string) (string, error) {
+		calls.Add(1)
+		return "", context.DeadlineExceeded
+	}
+	c.GetOrLoad(ctx, "slow", timeout)
+	c.GetOrLoad(ctx, "slow", timeout)
+	if n := calls.Load(); n != 4 {
+		t.Errorf("loader called %d times; context errors were cached", n)
+	}
+
+	// Nor does a panic get anyone stuck
+	_, err := c.GetOrLoad(ctx, "boom", func(context.Context, string) (string, error) { panic("oops") })
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("GetOrLoad with a panicking loader = %v", err)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	clock := newFakeClock()
+	c := New(WithClock(clock), WithDefaultTTL(time.Minute), WithStaleWhileRevalidate(time.Minute), WithNegativeTTL(5*time.Second))
+	defer c.Close()
+	ctx := context.Background()
+
+	var version atomic.Int32
+	release := make(chan struct{}, 10)
+	var fail atomic.Bool
+	load := func(ctx context.Context, key string) (string, error) {
+		<-release
+		if fail.Load() {
+			return "", errors.New("unavailable")
+		}
+		return "v" + strconv.Itoa(int(version.Add(1))), nil
+	}
+
+	release <- struct{}{}
+	if v, _ := c.GetOrLoad(ctx, "k", load); v != "v1" {
+		t.Fatalf("first GetOrLoad = %q", v)
+	}
+
+	// Expired but stale: served at once while the refresh waits
+	clock.Advance(90 * time.Second)
+	if v, err := c.GetOrLoad(ctx, "k", load); v != "v1" || err != nil {
+		t.Errorf("stale GetOrLoad = %q, %v; want v1", v, err)
+	}
+	if _, ok := c.Get("k"); ok {
+		t.Error("Get returned a stale value")
+	}
+	c.DeleteExpired()
+	if c.Len() != 1 {
+		t.Error("the janitor removed a stale entry")
+	}
+	release <- struct{}{}
+	waitFor(t, "the refresh", func() bool { v, _ := c.Get("k"); return v == "v2" })
+
+	// A failed refresh keeps serving stale, retrying after the negative TTL
+	clock.Advance(90 * time.Second)
+	fail.Store(true)
+	release <- struct{}{}
+	if v, _ := c.GetOrLoad(ctx, "k", load); v != "v2" {
+		t.Errorf("stale GetOrLoad = %q; want v2", v)
+	}
+	waitFor(t, "the failed refresh", func() bool {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		_, failed := c.errs["k"]
+		return failed
+	})
+	if v, err := c.GetOrLoad(ctx, "k", load); v != "v2" || err != nil {
+		t.Errorf("GetOrLoad after a failed refresh = %q, %v; want v2", v, err)
+	}
+
+	// Past the window the value is gone and the load is synchronous
+	clock.Advance(time.Minute)
+	fail.Store(false)
+	release <- struct{}{}
+	if v, _ := c.GetOrLoad(ctx, "k", load); v != "v3" {
+		t.Errorf("GetOrLoad past the stale window = %q; want v3", v)
+	}
+}
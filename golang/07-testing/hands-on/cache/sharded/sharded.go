@@ -0,0 +1,245 @@
+// Package sharded is a generic in-memory cache built for many goroutines.
+// Keys are spread over shards by hash, so writers to different keys rarely
+// meet, and reads of existing keys take no lock at all.
+package sharded
+
+import (
+	"hash/maphash"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+type Cache[K comparable, V any] struct {
+	seed   maphash.Seed
+	mask   uint64
+	shards []shard[K, V]
+}
+
+type config struct {
+	shards int
+}
+
+// Option configures a Cache in New.
+type Option func(*config)
+
+// WithShards sets the number of shards, rounded up to a power of two.
+// The default is four per GOMAXPROCS.
+func WithShards(n int) Option {
+	return func(c *config) { c.shards = n }
+}
+
+func New[K comparable, V any](opts ...Option) *Cache[K, V] {
+	cfg := config{shards: 4 * runtime.GOMAXPROCS(0)}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	n := 1
+	for n < cfg.shards {
+		n <<= 1
+	}
+	c := &Cache[K, V]{seed: maphash.MakeSeed(), mask: uint64(n - 1), shards: make([]shard[K, V], n)}
+	for i := range c.shards {
+		c.shards[i].read.Store(&readOnly[K, V]{})
+	}
+	return c
+}
+
+func (c *Cache[K, V]) shard(key K) *shard[K, V] {
+	return &c.shards[maphash.Comparable(c.seed, key)&c.mask]
+}
+
+func (c *Cache[K, V]) Get(key K) (V, bool) { return c.shard(key).get(key) }
+
+func (c *Cache[K, V]) Set(key K, value V) { c.shard(key).set(key, value) }
+
+func (c *Cache[K, V]) Delete(key K) { c.shard(key).delete(key) }
+
+func (c *Cache[K, V]) Len() int {
+	n := 0
+	for i := range c.shards {
+		n += int(c.shards[i].n.Load())
+	}
+	return n
+}
+
+// Each shard is the read/dirty scheme sync.Map used before Go 1.24. read
+// is an immutable map swapped atomically; keys in it are read and updated
+// lock-free through their entry. New keys go to dirty under mu, and after
+// as many locked misses as dirty has keys, dirty becomes the new read.
+type shard[K comparable, V any] struct {
+	read   atomic.Pointer[readOnly[K, V]]
+	mu     sync.Mutex
+	dirty  map[K]*entry[V] // read's live keys plus the new ones; nil after a promotion
+	misses int
+	n      atomic.Int64
+
+	_ [64]byte // Keep neighbouring shards off each other's cache lines
+}
+
+type readOnly[K comparable, V any] struct {
+	m       map[K]*entry[V]
+	amended bool // dirty has keys m lacks
+}
+
+// An entry's pointer is nil once deleted, or an expunged item once
+// deleted and left out of dirty; it has to be put back in dirty before
+// taking a value again.
+type entry[V any] struct {
+	p atomic.Pointer[item[V]]
+}
+
+type item[V any] struct {
+	v        V
+	expunged bool
+}
+
+func (e *entry[V]) load() (V, bool) {
+	p := e.p.Load()
+	if p == nil || p.expunged {
+		var zero V
+		return zero, false
+	}
+	return p.v, true
+}
+
+// trySwap stores it unless the entry is expunged, returning what it held.
+func (e *entry[V]) trySwap(it *item[V]) (*item[V], bool) {
+	for {
+		p := e.p.Load()
+		if p != nil && p.expunged {
+			return nil, false
+		}
+		if e.p.CompareAndSwap(p, it) {
+			return p, true
+		}
+	}
+}
+
+// delete reports whether the entry held a value.
+func (e *entry[V]) delete() bool {
+	for {
+		p := e.p.Load()
+		if p == nil || p.expunged {
+			return false
+		}
+		if e.p.CompareAndSwap(p, nil) {
+			return true
+		}
+	}
+}
+
+func (e *entry[V]) unexpungeLocked() bool {
+	p := e.p.Load()
+	return p != nil && p.expunged && e.p.CompareAndSwap(p, nil)
+}
+
+func (e *entry[V]) tryExpungeLocked() bool {
+	p := e.p.Load()
+	for p == nil {
+		if e.p.CompareAndSwap(nil, &item[V]{expunged: true}) {
+			return true
+		}
+		p = e.p.Load()
+	}
+	return p.expunged
+}
+
+func (s *shard[K, V]) get(key K) (V, bool) {
+	read := s.read.Load()
+	e, ok := read.m[key]
+	if !ok && read.amended {
+		s.mu.Lock()
+		// Promoted while we waited for the lock?
+		read = s.read.Load()
+		if e, ok = read.m[key]; !ok && read.amended {
+			e, ok = s.dirty[key]
+			s.missLocked()
+		}
+		s.mu.Unlock()
+	}
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return e.load()
+}
+
+func (s *shard[K, V]) set(key K, value V) {
+	it := &item[V]{v: value}
+	if e, ok := s.read.Load().m[key]; ok {
+		if prev, ok := e.trySwap(it); ok {
+			if prev == nil {
+				s.n.Add(1)
+			}
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	read := s.read.Load()
+	if e, ok := read.m[key]; ok {
+		if e.unexpungeLocked() {
+			s.dirty[key] = e
+		}
+		if e.p.Swap(it) == nil {
+			s.n.Add(1)
+		}
+	} else if e, ok := s.dirty[key]; ok {
+		if e.p.Swap(it) == nil {
+			s.n.Add(1)
+		}
+	} else {
+		if !read.amended {
+			s.dirtyLocked()
+			s.read.Store(&readOnly[K, V]{m: read.m, amended: true})
+		}
+		e := new(entry[V])
+		e.p.Store(it)
+		s.dirty[key] = e
+		s.n.Add(1)
+	}
+}
+
+func (s *shard[K, V]) delete(key K) {
+	read := s.read.Load()
+	e, ok := read.m[key]
+	if !ok && read.amended {
+		s.mu.Lock()
+		read = s.read.Load()
+		if e, ok = read.m[key]; !ok && read.amended {
+			e, ok = s.dirty[key]
+			delete(s.dirty, key)
+			s.missLocked()
+		}
+		s.mu.Unlock()
+	}
+	if ok && e.delete() {
+		s.n.Add(-1)
+	}
+}
+
+func (s *shard[K, V]) missLocked() {
+	s.misses++
+	if s.misses < len(s.dirty) {
+		return
+	}
+	s.read.Store(&readOnly[K, V]{m: s.dirty})
+	s.dirty = nil
+	s.misses = 0
+}
+
+// dirtyLocked starts a dirty map from read, leaving out deleted keys.
+func (s *shard[K, V]) dirtyLocked() {
+	if s.dirty != nil {
+		return
+	}
+	read := s.read.Load()
+	s.dirty = make(map[K]*entry[V], len(read.m))
+	for k, e := range read.m {
+		if !e.tryExpungeLocked() {
+			s.dirty[k] = e
+		}
+	}
+}
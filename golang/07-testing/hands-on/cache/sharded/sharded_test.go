@@ -0,0 +1,164 @@
+package sharded
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"07-testing/hands-on/cache"
+)
+
+func TestCacheOperations(t *testing.T) {
+	c := New[string, int](WithShards(3))
+	if len(c.shards) != 4 {
+		t.Errorf("WithShards(3) made %d shards; want 4", len(c.shards))
+	}
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("a", 3)
+	if v, ok := c.Get("a"); !ok || v != 3 {
+		t.Errorf("Get(a) = %d, %v; want 3, true", v, ok)
+	}
+	if n := c.Len(); n != 2 {
+		t.Errorf("Len() = %d; want 2", n)
+	}
+	c.Delete("a")
+	c.Delete("a")
+	c.Delete("never")
+	if _, ok := c.Get("a"); ok || c.Len() != 1 {
+		t.Errorf("after Delete(a): found %v, Len() = %d", ok, c.Len())
+	}
+}
+
+// TestPromotion walks keys through read, dirty, deleted and expunged and
+// back, in a single shard so every step meets the last.
+func TestPromotion(t *testing.T) {
+	type point struct{ x, y int }
+	c := New[point, string](WithShards(1))
+	s := &c.shards[0]
+	for i := range 100 {
+		c.Set(point{i, i}, strconv.Itoa(i))
+	}
+	for i := range 100 { // Misses on read promote dirty part way through
+		c.Get(point{i, i})
+	}
+	if len(s.read.Load().m) != 100 || s.dirty != nil {
+		t.Fatalf("read has %d keys, dirty %d; want all promoted", len(s.read.Load().m), len(s.dirty))
+	}
+
+	for i := range 50 {
+		c.Delete(point{i, i}) // Lock-free: nil in read
+	}
+	c.Set(point{-1, -1}, "new") // Builds dirty, expunging the deleted
+	if len(s.dirty) != 51 {
+		t.Errorf("dirty has %d keys; want 51", len(s.dirty))
+	}
+	c.Set(point{0, 0}, "back") // Expunged, has to rejoin dirty
+	if len(s.dirty) != 52 {
+		t.Errorf("dirty has %d keys after re-setting an expunged one; want 52", len(s.dirty))
+	}
+	for range 60 {
+		c.Get(point{-2, -2})
+	}
+	if v, ok := c.Get(point{0, 0}); !ok || v != "back" || len(s.read.Load().m) != 52 {
+		t.Errorf("Get = %q, %v with %d keys in read", v, ok, len(s.read.Load().m))
+	}
+	if n := c.Len(); n != 52 {
+		t.Errorf("Len() = %d; want 52", n)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	c := New[int, int](WithShards(4))
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 2000 {
+				k := (g*7 + i) % 64
+				switch i % 4 {
+				case 0:
+					c.Set(k, i)
+				case 1:
+					c.Delete(k)
+				default:
+					c.Get(k)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	n := 0
+	for k := range 64 {
+		if _, ok := c.Get(k); ok {
+			n++
+		}
+	}
+	if c.Len() != n {
+		t.Errorf("Len() = %d; %d keys found", c.Len(), n)
+	}
+}
+
+// The parallel benchmarks compare with cache.Cache, one lock for all.
+// Run them with -cpu 1,2,4,8 to see how each scales.
+
+var keys = func() []string {
+	k := make([]string, 4096)
+	for i := range k {
+		k[i] = "key-" + strconv.Itoa(i)
+	}
+	return k
+}()
+
+type store interface {
+	Get(string) (string, bool)
+	Set(string, string)
+}
+
+func benchBoth(b *testing.B, op func(c store, i int)) {
+	for _, impl := range []struct {
+		name string
+		new  func() store
+	}{
+		{"cache", func() store { return cache.New() }},
+		{"sharded", func() store { return New[string, string]() }},
+	} {
+		b.Run(impl.name, func(b *testing.B) {
+			c := impl.new()
+			for _, k := range keys {
+				c.Set(k, "value")
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					op(c, i)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkParallelHotKey is TestConcurrency's pattern: everyone reads
+// the same key.
+func BenchmarkParallelHotKey(b *testing.B) {
+	benchBoth(b, func(c store, _ int) { c.Get("key-0") })
+}
+
+func BenchmarkParallelGet(b *testing.B) {
+	benchBoth(b, func(c store, i int) { c.Get(keys[i%len(keys)]) })
+}
+
+// BenchmarkParallelMixed is nine reads to each write.
+func BenchmarkParallelMixed(b *testing.B) {
+	benchBoth(b, func(c store, i int) {
+		k := keys[(i*7)%len(keys)]
+		if i%10 == 0 {
+			c.Set(k, "value")
+		} else {
+			c.Get(k)
+		}
+	})
+}
@@ -1,3 +1,21 @@
 module 12-capstones
 
 go 1.25.5
+
+require (
+	github.com/golang-jwt/jwt/v5 v5.3.0
+	github.com/spf13/cobra v1.10.2
+	golang.org/x/crypto v0.54.0
+	google.golang.org/grpc v1.84.0
+	google.golang.org/protobuf v1.36.12
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/spf13/pflag v1.0.9 // indirect
+	golang.org/x/net v0.57.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260706201446-f0a921348800 // indirect
+)
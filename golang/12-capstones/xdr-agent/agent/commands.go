@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// runCommand executes one response action pushed by the server and returns
+// a short description of what it did.
+func runCommand(action string, args map[string]string) (string, error) {
+	switch action {
+	case "ping":
+		return "pong", nil
+	case "kill_process":
+		return killProcess(args["pid"])
+	case "quarantine_file":
+		return quarantineFile(args["path"])
+	default:
+		// isolate_host needs firewall control the agent doesn't have yet
+		return "", fmt.Errorf("action %q is not supported by this agent", action)
+	}
+}
+
+func killProcess(arg string) (string, error) {
+	pid, err := strconv.Atoi(arg)
+	if err != nil || pid <= 1 {
+		return "", fmt.Errorf("invalid pid %q", arg)
+	}
+	if pid == os.Getpid() {
+		return "", fmt.Errorf("refusing to kill the agent itself")
+	}
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		return "", fmt.Errorf("killing %d: %w", pid, err)
+	}
+	return fmt.Sprintf("killed pid %d", pid), nil
+}
+
+// quarantineFile moves a file into the quarantine directory and strips its
+// permissions, so it can't run but is kept for analysis.
+func quarantineFile(path string) (string, error) {
+	if path == "" || !filepath.IsAbs(path) {
+		return "", fmt.Errorf("quarantine needs an absolute path, got %q", path)
+	}
+	if err := os.MkdirAll(cfg.QuarantineDir, 0700); err != nil {
+		return "", err
+	}
+
+	dst := filepath.Join(cfg.QuarantineDir, fmt.Sprintf("%d-%s", time.Now().UnixNano(), filepath.Base(path)))
+	if err := os.Rename(path, dst); err != nil {
+		// Different filesystem: copy, then remove the original
+		if err := copyFile(path, dst); err != nil {
+			return "", fmt.Errorf("quarantining %s: %w", path, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return "", fmt.Errorf("removing %s after copy: %w", path, err)
+		}
+	}
+	if err := os.Chmod(dst, 0); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("moved %s to %s", path, dst), nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
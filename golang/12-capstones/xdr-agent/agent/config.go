@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Config holds the agent settings. Every field has a default, so the agent
+// still runs without a config file.
+type Config struct {
+	ServerURL string `json:"server_url"` // Base URL, e.g. http://localhost:9090
+	// ServerURLs are the other nodes of a server cluster, tried in turn
+	// when the current one is down
+	ServerURLs        []string `json:"server_urls"`
+	AgentID           string   `json:"agent_id"`
+	APIKey            string   `json:"api_key"` // Role "agent" key; XDR_API_KEY overrides
+	NumWorkers        int      `json:"num_workers"`
+	HeartbeatInterval int      `json:"heartbeat_interval_sec"`
+	IntegrityInterval int      `json:"integrity_interval_sec"`
+	ManifestPath      string   `json:"manifest_path"` // Signed manifest of the binary + config
+	SpoolPath         string   `json:"spool_path"`    // Alerts the server didn't take
+	ShutdownTimeout   int      `json:"shutdown_timeout_sec"`
+	MetricsAddr       string   `json:"metrics_addr"` // Prometheus /metrics, empty to disable
+
+	// Transport is "http" (POST /audit) or "grpc" (acked stream + commands)
+	Transport     string   `json:"transport"`
+	GRPCAddr      string   `json:"grpc_addr"`
+	GRPCAddrs     []string `json:"grpc_addrs"`  // Other cluster nodes, as with ServerURLs
+	GRPCWindow    int      `json:"grpc_window"` // Max alerts in flight without an ack
+	QuarantineDir string   `json:"quarantine_dir"`
+
+	// Process start/exit events
+	ProcRoot        string `json:"proc_root"`
+	ProcessInterval int    `json:"process_interval_sec"`
+
+	// Command lines: ExecSource is "auto" (audit log, else /proc), "audit"
+	// or "proc". HistoryFiles are globs of shell history files to follow.
+	ExecSource      string   `json:"exec_source"`
+	ExecSampleMs    int      `json:"exec_sample_ms"`
+	HistoryFiles    []string `json:"history_files"`
+	HistoryInterval int      `json:"history_interval_sec"`
+
+	// Software inventory
+	InventoryInterval int      `json:"inventory_interval_sec"`
+	DpkgStatusPath    string   `json:"dpkg_status_path"`
+	RPMExportPath     string   `json:"rpm_export_path"` // See parseRPMExport for the format
+	GoBinaryDirs      []string `json:"go_binary_dirs"`
+
+	// Self-update
+	Group           string `json:"group"`            // Rollout group; empty is "default"
+	UpdateTrialMin  int    `json:"update_trial_min"` // A new build that fails within this long is rolled back
+	UpdateStatePath string `json:"update_state_path"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		ServerURL:         ServerURL,
+		AgentID:           AgentID,
+		NumWorkers:        NumWorkers,
+		HeartbeatInterval: 10,
+		IntegrityInterval: 30,
+		SpoolPath:         "xdr-spool.ndjson",
+		ShutdownTimeout:   10,
+		MetricsAddr:       "localhost:9464",
+		Transport:         "http",
+		GRPCAddr:          "localhost:9091",
+		GRPCWindow:        64,
+		QuarantineDir:     "/var/lib/xdr/quarantine",
+		ProcRoot:          "/proc",
+		ProcessInterval:   2,
+		ExecSource:        "auto",
+		ExecSampleMs:      100,
+		HistoryFiles:      []string{"/root/.bash_history", "/home/*/.bash_history"},
+		HistoryInterval:   5,
+		InventoryInterval: 3600,
+		DpkgStatusPath:    "/var/lib/dpkg/status",
+		RPMExportPath:     "/var/lib/xdr/rpm-packages.txt",
+		GoBinaryDirs:      []string{"/usr/local/bin", "/usr/bin", "/usr/sbin"},
+		UpdateTrialMin:    10,
+		UpdateStatePath:   "xdr-update.json",
+	}
+}
+
+// loadConfig reads a JSON config file on top of the defaults.
+// An empty path returns the defaults.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	cfg.APIKey = os.Getenv("XDR_API_KEY")
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("reading config: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+	if key := os.Getenv("XDR_API_KEY"); key != "" {
+		cfg.APIKey = key
+	}
+	if cfg.Transport != "http" && cfg.Transport != "grpc" {
+		return cfg, fmt.Errorf("unknown transport %q (want http or grpc)", cfg.Transport)
+	}
+	if cfg.ExecSource != "auto" && cfg.ExecSource != "audit" && cfg.ExecSource != "proc" {
+		return cfg, fmt.Errorf("unknown exec_source %q (want auto, audit or proc)", cfg.ExecSource)
+	}
+	return cfg, nil
+}
+
+// servers lists the server nodes to report to, ServerURL first.
+func (c Config) servers() []string {
+	return append([]string{c.ServerURL}, c.ServerURLs...)
+}
+
+func (c Config) grpcAddrs() []string {
+	return append([]string{c.GRPCAddr}, c.GRPCAddrs...)
+}
+
+// authorize adds the API key to a request for the server.
+func (c Config) authorize(req *http.Request) {
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+}
+
+func (c Config) heartbeatEvery() time.Duration {
+	return time.Duration(c.HeartbeatInterval) * time.Second
+}
+
+func (c Config) integrityEvery() time.Duration {
+	return time.Duration(c.IntegrityInterval) * time.Second
+}
+
+func (c Config) shutdownTimeout() time.Duration {
+	return time.Duration(c.ShutdownTimeout) * time.Second
+}
+
+func (c Config) inventoryEvery() time.Duration {
+	return time.Duration(c.InventoryInterval) * time.Second
+}
+
+func (c Config) processEvery() time.Duration {
+	return time.Duration(c.ProcessInterval) * time.Second
+}
+
+func (c Config) execSampleEvery() time.Duration {
+	return time.Duration(c.ExecSampleMs) * time.Millisecond
+}
+
+func (c Config) historyEvery() time.Duration {
+	return time.Duration(c.HistoryInterval) * time.Second
+}
+
+func (c Config) updateTrial() time.Duration {
+	return time.Duration(c.UpdateTrialMin) * time.Minute
+}
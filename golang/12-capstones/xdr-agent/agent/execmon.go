@@ -0,0 +1,827 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// envHighlights are the environment variables reported with a command:
+// loader hooks that inject code and proxies that reroute its traffic.
+var envHighlights = []string{
+	"LD_PRELOAD", "LD_LIBRARY_PATH", "LD_AUDIT",
+	"http_proxy", "https_proxy", "HTTP_PROXY", "HTTPS_PROXY", "ALL_PROXY", "all_proxy",
+}
+
+// execEvent is one program started with execve.
+type execEvent struct {
+	PID    int
+	PPID   int
+	UID    string
+	Time   time.Time // Of the execve, or the process start from /proc
+	Start  time.Time // Process start for pid reuse; zero from audit
+	Exe    string
+	Argv   []string
+	Env    map[string]string // Only envHighlights that are set
+	Source string            // "audit" or "proc"
+	// StdinPipe is set when the process reads its stdin from a pipe
+	StdinPipe bool
+}
+
+// pipeToShell matches a download fed straight into a shell:
+// "curl … | sh", "bash <(wget …)" and "sh -c "$(curl …)"".
+var pipeToShell = regexp.MustCompile(`\b(curl|wget|fetch)\b[^|;&]*\|\s*(sudo\s+(-\S+\s+)*)?(\S*/)?(ba|da|z|k)?sh\b` +
+	`|\b(ba|da|z|k)?sh\s+(-c\s+)?["']?(<\(|\$\()\s*(curl|wget|fetch)\b`)
+
+// commandFindings says what's suspicious about a command line and the
+// environment it ran with.
+func commandFindings(cmd string, env map[string]string) []string {
+	var out []string
+	if pipeToShell.MatchString(cmd) {
+		out = append(out, "download piped to a shell")
+	}
+	if v := env["LD_PRELOAD"]; v != "" {
+		out = append(out, "LD_PRELOAD="+v)
+	}
+	return out
+}
+
+// pipeWindow is how far apart the two halves of a pipeline may start.
+// The shell forks both before either execs, so they're milliseconds apart.
+const pipeWindow = 2 * time.Second
+
+// pipeCorrelator finds "curl … | sh" typed at a prompt, which audit and
+// /proc only see as two execs with the same parent: a downloader, and a
+// shell reading its script from a pipe. Either may exec first.
+type pipeCorrelator struct {
+	recent map[int][]execEvent // By PPID, within pipeWindow
+	// flagged are the PIDs whose own command line was the pipeline, as in
+	// sh -c "curl … | sh". Their children were reported with them.
+	flagged map[int]time.Time
+}
+
+func newPipeCorrelator() *pipeCorrelator {
+	return &pipeCorrelator{recent: make(map[int][]execEvent), flagged: make(map[int]time.Time)}
+}
+
+// isDownloader reports whether argv runs curl, wget or fetch.
+func isDownloader(argv []string) bool {
+	switch filepath.Base(argv[0]) {
+	case "curl", "wget", "fetch":
+		return true
+	}
+	return false
+}
+
+// readsScript reports whether argv is a shell that runs what's on its
+// stdin: no -c and no script file, as in "sh" or "bash -s -- --force".
+func readsScript(argv []string) bool {
+	switch filepath.Base(argv[0]) {
+	case "sh", "bash", "dash", "zsh", "ksh":
+	default:
+		return false
+	}
+	for _, a := range argv[1:] {
+		switch {
+		case a == "-s" || a == "--":
+			return true
+		case strings.HasPrefix(a, "-") && strings.Contains(a, "c") && !strings.HasPrefix(a, "--"):
+			return false
+		case !strings.HasPrefix(a, "-") && !strings.HasPrefix(a, "+"):
+			return false // A script file
+		}
+	}
+	return true
+}
+
+// match remembers e if it's one half of a download piped to a shell and
+// returns the downloader and the shell once both are seen.
+func (c *pipeCorrelator) match(e execEvent) (download, shell execEvent, ok bool) {
+	for ppid, evs := range c.recent {
+		evs = slices.DeleteFunc(evs, func(o execEvent) bool { return e.Time.Sub(o.Time) > pipeWindow })
+		if len(evs) == 0 {
+			delete(c.recent, ppid)
+		} else {
+			c.recent[ppid] = evs
+		}
+	}
+	for pid, t := range c.flagged {
+		if e.Time.Sub(t) > pipeWindow {
+			delete(c.flagged, pid)
+		}
+	}
+	if len(e.Argv) == 0 {
+		return execEvent{}, execEvent{}, false
+	}
+	if pipeToShell.MatchString(shellJoin(e.Argv)) {
+		c.flagged[e.PID] = e.Time
+	}
+	if _, ok := c.flagged[e.PPID]; ok {
+		return execEvent{}, execEvent{}, false
+	}
+	downloader := isDownloader(e.Argv)
+	if !downloader && !(e.StdinPipe && readsScript(e.Argv)) {
+		return execEvent{}, execEvent{}, false
+	}
+	evs := c.recent[e.PPID]
+	for i, o := range evs {
+		if isDownloader(o.Argv) == downloader || o.Time.Sub(e.Time).Abs() > pipeWindow {
+			continue
+		}
+		c.recent[e.PPID] = slices.Delete(evs, i, i+1)
+		if downloader {
+			return e, o, true
+		}
+		return o, e, true
+	}
+	c.recent[e.PPID] = append(evs, e)
+	return execEvent{}, execEvent{}, false
+}
+
+// pipedDownloadAlert raises SUSPICIOUS_COMMAND on the shell's side of a
+// download piped into it.
+func pipedDownloadAlert(download, shell execEvent) Alert {
+	a := execAlert(shell, shell.Time)
+	cmd := shellJoin(download.Argv) + " | " + a.Fields["cmdline"]
+	a.Fields["finding"] = "download piped to a shell"
+	a.Fields["seen_as"] = a.EventType
+	a.Fields["download_pid"] = strconv.Itoa(download.PID)
+	a.Fields["download_cmdline"] = shellJoin(download.Argv)
+	a.EventType = "SUSPICIOUS_COMMAND"
+	a.Details = fmt.Sprintf("%s: %s", a.Fields["finding"], cmd)
+	return a
+}
+
+// shellJoin renders argv as one line, quoting arguments that need it so
+// the word boundaries survive.
+func shellJoin(argv []string) string {
+	parts := make([]string, len(argv))
+	for i, a := range argv {
+		if a == "" || strings.ContainsAny(a, " \t\n'\"\\$`|&;<>()*?") {
+			a = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+		}
+		parts[i] = a
+	}
+	return strings.Join(parts, " ")
+}
+
+func execAlert(e execEvent, ts time.Time) Alert {
+	cmd := shellJoin(e.Argv)
+	argv, _ := json.Marshal(e.Argv)
+	fields := map[string]string{
+		"pid":     strconv.Itoa(e.PID),
+		"ppid":    strconv.Itoa(e.PPID),
+		"uid":     e.UID,
+		"exe":     e.Exe,
+		"cmdline": cmd,
+		"argv":    string(argv),
+		"source":  e.Source,
+	}
+	if !e.Start.IsZero() {
+		fields["start"] = e.Start.UTC().Format(time.RFC3339Nano)
+	}
+	for k, v := range e.Env {
+		fields["env."+k] = v
+	}
+	if e.StdinPipe {
+		fields["stdin"] = "pipe"
+	}
+	return Alert{
+		AgentID:   cfg.AgentID,
+		EventType: "PROCESS_EXEC",
+		Details:   fmt.Sprintf("Command '%s' run (PID: %d, PPID: %d)", cmd, e.PID, e.PPID),
+		Timestamp: ts.Unix(),
+		Fields:    fields,
+	}
+}
+
+// suspiciousAlerts raises SUSPICIOUS_COMMAND for each finding on a
+// PROCESS_EXEC or SHELL_COMMAND alert, keeping its fields.
+func suspiciousAlerts(a Alert, cmd string, env map[string]string) []Alert {
+	var out []Alert
+	for _, f := range commandFindings(cmd, env) {
+		fields := make(map[string]string, len(a.Fields)+2)
+		for k, v := range a.Fields {
+			fields[k] = v
+		}
+		fields["finding"] = f
+		fields["seen_as"] = a.EventType
+		out = append(out, Alert{
+			AgentID:   a.AgentID,
+			EventType: "SUSPICIOUS_COMMAND",
+			Details:   fmt.Sprintf("%s: %s", f, cmd),
+			Timestamp: a.Timestamp,
+			Fields:    fields,
+		})
+	}
+	return out
+}
+
+// --- /proc sampling ---
+
+// readArgv reads /proc/<pid>/cmdline with the argument boundaries intact.
+func readArgv(dir string) ([]string, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "cmdline"))
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimSuffix(b, []byte{0})
+	if len(b) == 0 {
+		return nil, nil // Kernel thread, or a zombie
+	}
+	return strings.Split(string(b), "\x00"), nil
+}
+
+// readEnvHighlights picks envHighlights out of /proc/<pid>/environ. Other
+// users' processes are unreadable without root, which yields nothing.
+func readEnvHighlights(dir string) map[string]string {
+	b, err := os.ReadFile(filepath.Join(dir, "environ"))
+	if err != nil {
+		return nil
+	}
+	var env map[string]string
+	for _, kv := range bytes.Split(b, []byte{0}) {
+		k, v, ok := strings.Cut(string(kv), "=")
+		if !ok || v == "" {
+			continue
+		}
+		for _, h := range envHighlights {
+			if k == h {
+				if env == nil {
+					env = make(map[string]string)
+				}
+				env[k] = v
+			}
+		}
+	}
+	return env
+}
+
+// readStdinPipe reports whether /proc/<pid>/fd/0 is a pipe. Like the
+// environment, other users' descriptors need root.
+func readStdinPipe(dir string) bool {
+	target, err := os.Readlink(filepath.Join(dir, "fd", "0"))
+	return err == nil && strings.HasPrefix(target, "pipe:")
+}
+
+func fileOwner(info os.FileInfo) string {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return strconv.FormatUint(uint64(st.Uid), 10)
+	}
+	return ""
+}
+
+// execSampler finds new PIDs under procRoot. It runs far more often than
+// procMonitor and reads only the processes it hasn't seen, so it catches
+// most commands that exit within a second. A PID that's reused between
+// two samples is still missed; audit records don't have that gap.
+type execSampler struct {
+	root string
+	boot time.Time
+	seen map[int]bool // nil until the first scan
+}
+
+// scan returns the processes started since the last scan. The first scan
+// only learns what's already running; procMonitor reports those.
+func (s *execSampler) scan() ([]execEvent, error) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+	first := s.seen == nil
+	current := make(map[int]bool, len(entries))
+	var out []execEvent
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		current[pid] = true
+		if first || s.seen[pid] {
+			continue
+		}
+		ev, err := s.read(pid)
+		if err != nil || len(ev.Argv) == 0 {
+			continue
+		}
+		out = append(out, ev)
+	}
+	s.seen = current
+	sort.Slice(out, func(i, j int) bool { return out[i].PID < out[j].PID })
+	return out, nil
+}
+
+func (s *execSampler) read(pid int) (execEvent, error) {
+	p, err := readProc(s.root, pid, s.boot)
+	if err != nil {
+		return execEvent{}, err
+	}
+	dir := filepath.Join(s.root, strconv.Itoa(pid))
+	ev := execEvent{PID: pid, PPID: p.PPID, Time: p.Start, Start: p.Start, Exe: p.Exe, Source: "proc"}
+	if ev.Argv, err = readArgv(dir); err != nil {
+		return execEvent{}, err
+	}
+	ev.Env = readEnvHighlights(dir)
+	ev.StdinPipe = readStdinPipe(dir)
+	if info, err := os.Stat(dir); err == nil {
+		ev.UID = fileOwner(info)
+	}
+	return ev, nil
+}
+
+// --- Audit netlink ---
+
+// Audit record types and the netlink details from linux/audit.h
+const (
+	netlinkAudit      = 9 // NETLINK_AUDIT
+	auditNlgrpReadlog = 1 // Read-only multicast group, needs CAP_AUDIT_READ
+	auditSyscall      = 1300
+	auditExecve       = 1309
+	auditEOE          = 1320
+	maxPendingAudit   = 1024
+)
+
+// auditAssembler joins the records of one audit event (SYSCALL, EXECVE,
+// …, EOE share a serial number) into an execEvent.
+type auditAssembler struct {
+	procRoot string
+	pending  map[string]*auditEvent
+}
+
+type auditEvent struct {
+	ev     execEvent
+	execve bool
+	args   map[int]string
+	parts  map[int]map[int]string // Arguments too long for one field
+}
+
+func newAuditAssembler(procRoot string) *auditAssembler {
+	return &auditAssembler{procRoot: procRoot, pending: make(map[string]*auditEvent)}
+}
+
+// add takes one record and returns the finished event once its EOE
+// arrives. Events without an EXECVE record are dropped.
+func (a *auditAssembler) add(typ uint16, msg string) (execEvent, bool) {
+	// audit(1772352000.123:456): key=value ...
+	head, body, ok := strings.Cut(strings.TrimRight(msg, "\x00\n"), "): ")
+	if !ok || !strings.HasPrefix(head, "audit(") {
+		return execEvent{}, false
+	}
+	stamp, serial, _ := strings.Cut(strings.TrimPrefix(head, "audit("), ":")
+
+	e, ok := a.pending[serial]
+	if !ok {
+		if typ == auditEOE {
+			return execEvent{}, false
+		}
+		if len(a.pending) >= maxPendingAudit {
+			clear(a.pending) // Lost EOEs; don't grow forever
+		}
+		e = &auditEvent{ev: execEvent{Source: "audit"}, args: make(map[int]string), parts: make(map[int]map[int]string)}
+		// Seconds and milliseconds, "1772352000.123"
+		secs, millis, _ := strings.Cut(stamp, ".")
+		if s, err := strconv.ParseInt(secs, 10, 64); err == nil {
+			ms, _ := strconv.ParseInt(millis, 10, 64)
+			e.ev.Time = time.Unix(s, ms*int64(time.Millisecond))
+		}
+		a.pending[serial] = e
+	}
+
+	switch typ {
+	case auditSyscall:
+		for k, v := range auditFields(body) {
+			switch k {
+			case "pid":
+				e.ev.PID, _ = strconv.Atoi(v)
+			case "ppid":
+				e.ev.PPID, _ = strconv.Atoi(v)
+			case "uid":
+				e.ev.UID = v
+			case "exe":
+				e.ev.Exe = auditString(v)
+			}
+		}
+	case auditExecve:
+		e.execve = true
+		for k, v := range auditFields(body) {
+			if k == "argc" || !strings.HasPrefix(k, "a") || strings.HasSuffix(k, "_len") {
+				continue
+			}
+			// a1=... or, for long arguments, a1[0]=... a1[1]=...
+			num, part, split := strings.Cut(k[1:], "[")
+			n, err := strconv.Atoi(num)
+			if err != nil {
+				continue
+			}
+			if !split {
+				e.args[n] = auditString(v)
+				continue
+			}
+			i, err := strconv.Atoi(strings.TrimSuffix(part, "]"))
+			if err != nil {
+				continue
+			}
+			if e.parts[n] == nil {
+				e.parts[n] = make(map[int]string)
+			}
+			e.parts[n][i] = auditString(v)
+		}
+	case auditEOE:
+		delete(a.pending, serial)
+		if !e.execve {
+			return execEvent{}, false
+		}
+		for n, parts := range e.parts {
+			var b strings.Builder
+			for i := range len(parts) {
+				b.WriteString(parts[i])
+			}
+			e.args[n] = b.String()
+		}
+		for i := range len(e.args) {
+			e.ev.Argv = append(e.ev.Argv, e.args[i])
+		}
+		// Audit doesn't log the environment. The process is usually still
+		// around to ask.
+		dir := filepath.Join(a.procRoot, strconv.Itoa(e.ev.PID))
+		e.ev.Env = readEnvHighlights(dir)
+		e.ev.StdinPipe = readStdinPipe(dir)
+		return e.ev, true
+	}
+	return execEvent{}, false
+}
+
+// auditFields splits "k=v k=v" record bodies. Values with spaces are
+// hex-encoded by the kernel, so splitting on spaces is safe.
+func auditFields(body string) map[string]string {
+	out := make(map[string]string)
+	for _, f := range strings.Fields(body) {
+		if k, v, ok := strings.Cut(f, "="); ok {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// auditString decodes a string field: quoted as-is, or hex when it
+// contains anything unusual.
+func auditString(v string) string {
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		return v[1 : len(v)-1]
+	}
+	if v == "(null)" {
+		return ""
+	}
+	if b, err := hex.DecodeString(v); err == nil {
+		return string(b)
+	}
+	return v
+}
+
+// auditSocket joins the audit read-only multicast group. It fails without
+// CAP_AUDIT_READ or on kernels older than 3.16.
+type auditSocket struct{ fd int }
+
+func openAuditSocket() (*auditSocket, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, netlinkAudit)
+	if err != nil {
+		return nil, fmt.Errorf("audit socket: %w", err)
+	}
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 1 << (auditNlgrpReadlog - 1)}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("joining the audit log group: %w", err)
+	}
+	// Wake up now and then to notice a cancelled context
+	tv := syscall.Timeval{Usec: 500_000}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &auditSocket{fd}, nil
+}
+
+// read returns the records of one datagram, or none on a timeout.
+func (s *auditSocket) read(buf []byte) ([]syscall.NetlinkMessage, error) {
+	n, _, err := syscall.Recvfrom(s.fd, buf, 0)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return syscall.ParseNetlinkMessage(buf[:n])
+}
+
+func (s *auditSocket) Close() error { return syscall.Close(s.fd) }
+
+// --- Monitors ---
+
+// emitExec sends a PROCESS_EXEC alert and any SUSPICIOUS_COMMAND it
+// warrants, alone or with an earlier exec. It returns false once ctx is
+// done.
+func emitExec(ctx context.Context, alerts chan<- Alert, pipes *pipeCorrelator, e execEvent) bool {
+	a := execAlert(e, e.Time)
+	out := append([]Alert{a}, suspiciousAlerts(a, a.Fields["cmdline"], e.Env)...)
+	if download, shell, ok := pipes.match(e); ok {
+		out = append(out, pipedDownloadAlert(download, shell))
+	}
+	for _, out := range out {
+		select {
+		case alerts <- out:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// execMonitor reports every command line with PROCESS_EXEC. Execve
+// records from the kernel audit log are the better source, but they need
+// CAP_AUDIT_READ and an audit rule that logs them, e.g.
+//
+//	auditctl -a always,exit -F arch=b64 -S execve
+//
+// With exec_source "auto" the monitor samples /proc every exec_sample_ms
+// until the first execve record shows the audit log works, then switches
+// to it.
+func execMonitor(ctx context.Context, wg *sync.WaitGroup, alerts chan<- Alert) {
+	defer wg.Done()
+	var audit <-chan execEvent
+	if cfg.ExecSource != "proc" {
+		sock, err := openAuditSocket()
+		switch {
+		case err == nil:
+			audit = auditEvents(ctx, sock)
+		case cfg.ExecSource == "audit":
+			fmt.Printf("⚠️  Command capture disabled: %v\n", err)
+			return
+		default:
+			fmt.Printf("⚠️  Audit log unavailable (%v), sampling /proc\n", err)
+		}
+	}
+
+	var sampler *execSampler
+	var tick <-chan time.Time
+	if cfg.ExecSource != "audit" {
+		boot, err := bootTime(cfg.ProcRoot)
+		if err != nil && audit == nil {
+			fmt.Printf("⚠️  Command capture disabled: %v\n", err)
+			return
+		}
+		if err == nil {
+			sampler = &execSampler{root: cfg.ProcRoot, boot: boot}
+			sampler.scan()
+			ticker := time.NewTicker(cfg.execSampleEvery())
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+	}
+	pipes := newPipeCorrelator()
+	if sampler != nil {
+		fmt.Println("Capturing Command Lines from /proc...")
+	} else {
+		fmt.Println("Capturing Command Lines from the Audit Log...")
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-audit:
+			if !ok {
+				audit = nil
+				if sampler == nil {
+					return
+				}
+				continue
+			}
+			if sampler != nil {
+				fmt.Println("Capturing Command Lines from the Audit Log...")
+				sampler, tick = nil, nil
+			}
+			if !emitExec(ctx, alerts, pipes, e) {
+				return
+			}
+		case <-tick:
+			now := time.Now()
+			events, err := sampler.scan()
+			timeScan("exec", now)
+			if err != nil {
+				fmt.Printf("⚠️  Command scan failed: %v\n", err)
+			}
+			for _, e := range events {
+				if !emitExec(ctx, alerts, pipes, e) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// auditEvents reads execve events from sock until ctx is done or the
+// socket fails, then closes both.
+func auditEvents(ctx context.Context, sock *auditSocket) <-chan execEvent {
+	out := make(chan execEvent)
+	go func() {
+		defer close(out)
+		defer sock.Close()
+		asm := newAuditAssembler(cfg.ProcRoot)
+		buf := make([]byte, 1<<16)
+		for ctx.Err() == nil {
+			msgs, err := sock.read(buf)
+			if err != nil {
+				fmt.Printf("⚠️  Audit read failed: %v\n", err)
+				return
+			}
+			for _, m := range msgs {
+				e, ok := asm.add(m.Header.Type, string(m.Data))
+				if !ok {
+					continue
+				}
+				select {
+				case out <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// --- Shell history ---
+
+// shellCommand is one line appended to a history file.
+type shellCommand struct {
+	File    string
+	User    string
+	Command string
+	Time    time.Time // From a "#<epoch>" line if HISTTIMEFORMAT is set, else when we read it
+}
+
+// historyTailer follows history files as they grow. Files present on the
+// first poll are read from their end, so old history isn't replayed;
+// files that show up later are read from the start.
+type historyTailer struct {
+	primed  bool
+	offsets map[string]int64
+	partial map[string]string // Last line without its newline yet
+	stamp   map[string]time.Time
+}
+
+func newHistoryTailer() *historyTailer {
+	return &historyTailer{offsets: make(map[string]int64), partial: make(map[string]string), stamp: make(map[string]time.Time)}
+}
+
+// poll reads what was appended to the files matching globs.
+func (h *historyTailer) poll(globs []string, now time.Time) []shellCommand {
+	var files []string
+	for _, g := range globs {
+		matches, _ := filepath.Glob(g)
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+
+	var out []shellCommand
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		off, known := h.offsets[path]
+		switch {
+		case !known && !h.primed:
+			h.offsets[path] = info.Size()
+			continue
+		case info.Size() < off:
+			// Truncated or rewritten (histappend off, history -w)
+			off = 0
+			h.partial[path] = ""
+		case info.Size() == off:
+			continue
+		}
+		cmds, next, err := h.read(path, off, now)
+		if err != nil {
+			continue
+		}
+		h.offsets[path] = next
+		owner := historyOwner(info)
+		for i := range cmds {
+			cmds[i].User = owner
+		}
+		out = append(out, cmds...)
+	}
+	h.primed = true
+	return out
+}
+
+func (h *historyTailer) read(path string, off int64, now time.Time) ([]shellCommand, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, off, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return nil, off, err
+	}
+	var out []shellCommand
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		off += int64(len(line))
+		if err != nil {
+			h.partial[path] += line
+			break
+		}
+		line = strings.TrimSuffix(h.partial[path]+line, "\n")
+		h.partial[path] = ""
+		if rest, ok := strings.CutPrefix(line, "#"); ok {
+			if secs, err := strconv.ParseInt(rest, 10, 64); err == nil {
+				h.stamp[path] = time.Unix(secs, 0)
+				continue
+			}
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		ts := now
+		if t, ok := h.stamp[path]; ok {
+			ts = t
+			delete(h.stamp, path)
+		}
+		out = append(out, shellCommand{File: path, Command: line, Time: ts})
+	}
+	return out, off, nil
+}
+
+// historyOwner names the user a history file belongs to.
+func historyOwner(info os.FileInfo) string {
+	uid := fileOwner(info)
+	if u, err := user.LookupId(uid); err == nil {
+		return u.Username
+	}
+	return uid
+}
+
+func shellCommandAlert(c shellCommand) Alert {
+	return Alert{
+		AgentID:   cfg.AgentID,
+		EventType: "SHELL_COMMAND",
+		Details:   fmt.Sprintf("User '%s' ran '%s'", c.User, c.Command),
+		Timestamp: c.Time.Unix(),
+		Fields: map[string]string{
+			"user":    c.User,
+			"file":    c.File,
+			"cmdline": c.Command,
+		},
+	}
+}
+
+// historyMonitor reports commands appended to shell history files. Bash
+// writes its history when the shell exits (or on every prompt with
+// PROMPT_COMMAND="history -a"), so this trails execMonitor but catches
+// whole pipelines the way the user typed them.
+func historyMonitor(ctx context.Context, wg *sync.WaitGroup, alerts chan<- Alert) {
+	defer wg.Done()
+	if len(cfg.HistoryFiles) == 0 {
+		return
+	}
+	fmt.Println("Watching Shell History...")
+	ticker := time.NewTicker(cfg.historyEvery())
+	defer ticker.Stop()
+
+	h := newHistoryTailer()
+	for {
+		for _, c := range h.poll(cfg.HistoryFiles, time.Now()) {
+			a := shellCommandAlert(c)
+			for _, out := range append([]Alert{a}, suspiciousAlerts(a, c.Command, nil)...) {
+				select {
+				case alerts <- out:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
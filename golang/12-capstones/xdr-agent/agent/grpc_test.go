@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+
+	"12-capstones/xdr-agent/xdrpb"
+)
+
+// gatedServer reports alerts as soon as they arrive but holds every ack
+// until the test releases it, or drops the stream instead.
+type gatedServer struct {
+	xdrpb.UnimplementedXDRServer
+	received chan string
+	release  chan bool // true acks the oldest alert, false drops the stream
+}
+
+func (g *gatedServer) StreamAlerts(stream xdrpb.XDR_StreamAlertsServer) error {
+	unacked := make(chan string, 10)
+	go func() {
+		defer close(unacked)
+		for {
+			a, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			g.received <- a.GetId()
+			unacked <- a.GetId()
+		}
+	}()
+
+	for id := range unacked {
+		if !<-g.release {
+			return errors.New("server going away")
+		}
+		if err := stream.Send(&xdrpb.AlertAck{Id: id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dialGated(t *testing.T, window int) (*grpcTransport, *gatedServer) {
+	t.Helper()
+	g := &gatedServer{received: make(chan string, 10), release: make(chan bool)}
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	xdrpb.RegisterXDRServer(gs, g)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+
+	tr, err := dialGRPC([]string{"passthrough:///bufnet"}, window,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tr.Close() })
+	return tr, g
+}
+
+func TestGRPCTransportWindow(t *testing.T) {
+	tr, g := dialGated(t, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	results := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			results <- tr.SendAlert(ctx, Alert{ID: fmt.Sprintf("a-%d", i), EventType: "TEST"})
+		}(i)
+	}
+
+	// Two alerts fill the window, the third waits for an ack
+	<-g.received
+	<-g.received
+	select {
+	case id := <-g.received:
+		t.Fatalf("alert %s was sent with 2 alerts unacked; window is 2", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+	g.release <- true
+	<-g.received
+	g.release <- true
+	g.release <- true
+
+	for i := 0; i < 3; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("SendAlert: %v", err)
+		}
+	}
+}
+
+func TestGRPCTransportStreamLoss(t *testing.T) {
+	tr, g := dialGated(t, 4)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// An alert that never gets acked is reported as failed, so the
+	// pipeline spools it
+	lost := make(chan error, 1)
+	go func() { lost <- tr.SendAlert(ctx, Alert{ID: "lost", EventType: "TEST"}) }()
+	<-g.received
+	g.release <- false
+	if err := <-lost; err == nil {
+		t.Fatal("SendAlert succeeded after the stream dropped; want an error")
+	}
+
+	// The next send opens a fresh stream
+	ok := make(chan error, 1)
+	go func() { ok <- tr.SendAlert(ctx, Alert{ID: "retry", EventType: "TEST"}) }()
+	if id := <-g.received; id != "retry" {
+		t.Fatalf("server got %s; want retry", id)
+	}
+	g.release <- true
+	if err := <-ok; err != nil {
+		t.Fatalf("SendAlert after reconnect: %v", err)
+	}
+}
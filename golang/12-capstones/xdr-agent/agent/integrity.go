@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// manifestPublicKey is the base64 Ed25519 key that signs integrity manifests.
+// It's baked in at build time so an attacker who can edit the config can't
+// swap it:
+//
+//	go build -ldflags "-X main.manifestPublicKey=<base64 key>"
+var manifestPublicKey = ""
+
+// ManifestFile pins one file to its expected SHA-256.
+type ManifestFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest is the signed list of files the agent checks for tampering.
+// The signature covers the JSON encoding of Files.
+type Manifest struct {
+	Files     []ManifestFile `json:"files"`
+	Signature string         `json:"signature"`
+}
+
+// loadManifest reads a manifest and verifies its signature.
+func loadManifest(path string, pub ed25519.PublicKey) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parsing manifest: %w", err)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("decoding manifest signature: %w", err)
+	}
+	payload, _ := json.Marshal(m.Files)
+	if !ed25519.Verify(pub, payload, sig) {
+		return nil, fmt.Errorf("manifest signature is invalid")
+	}
+	return &m, nil
+}
+
+// checkManifest hashes every pinned file and returns one message per
+// mismatch. An empty result means everything is intact. A binary put in
+// place by a self-update matches its signed release instead.
+func checkManifest(m *Manifest) []string {
+	var problems []string
+	for _, f := range m.Files {
+		sum, err := hashFile(f.Path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s unreadable: %v", f.Path, err))
+			continue
+		}
+		if sum != f.SHA256 && !signedRelease(f.Path, sum) {
+			problems = append(problems, fmt.Sprintf("%s modified (sha256 %s, expected %s)", f.Path, sum, f.SHA256))
+		}
+	}
+	return problems
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func parsePublicKey(b64 string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key is %d bytes, want %d", len(raw), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// verifyIntegrity runs a full check against the configured manifest.
+// ok is false only when tampering was detected; a disabled check is ok.
+func verifyIntegrity() (problems []string, ok bool) {
+	if cfg.ManifestPath == "" || manifestPublicKey == "" {
+		return nil, true
+	}
+
+	pub, err := parsePublicKey(manifestPublicKey)
+	if err != nil {
+		return []string{fmt.Sprintf("bad built-in manifest key: %v", err)}, false
+	}
+	m, err := loadManifest(cfg.ManifestPath, pub)
+	if err != nil {
+		return []string{err.Error()}, false
+	}
+	problems = checkManifest(m)
+	return problems, len(problems) == 0
+}
+
+// --- Monitor ---
+
+// integrityMonitor re-checks the binary and config against the signed
+// manifest. Each distinct problem is reported once, until it goes away.
+func integrityMonitor(ctx context.Context, wg *sync.WaitGroup, alerts chan<- Alert) {
+	defer wg.Done()
+	if cfg.ManifestPath == "" || manifestPublicKey == "" {
+		fmt.Println("⚠️  Integrity check disabled (no manifest or built-in key)")
+		return
+	}
+	fmt.Println("Checking Agent Integrity...")
+	ticker := time.NewTicker(cfg.integrityEvery())
+	defer ticker.Stop()
+
+	reported := make(map[string]bool)
+	check := func() {
+		start := time.Now()
+		problems, _ := verifyIntegrity()
+		timeScan("integrity", start)
+		recorder.Observe("integrity", map[string]any{"problems": problems})
+		current := make(map[string]bool)
+		for _, p := range problems {
+			current[p] = true
+			if reported[p] {
+				continue
+			}
+			alerts <- Alert{
+				AgentID:   cfg.AgentID,
+				EventType: "AGENT_TAMPER",
+				Details:   p,
+				Timestamp: time.Now().Unix(),
+			}
+		}
+		reported = current
+	}
+
+	check()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
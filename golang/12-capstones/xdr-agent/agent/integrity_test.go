@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeManifest signs a manifest for the given files and returns its path.
+func writeManifest(t *testing.T, priv ed25519.PrivateKey, files ...string) string {
+	t.Helper()
+	var m Manifest
+	for _, f := range files {
+		sum, err := hashFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Files = append(m.Files, ManifestFile{Path: f, SHA256: sum})
+	}
+	payload, _ := json.Marshal(m.Files)
+	m.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, payload))
+
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	data, _ := json.Marshal(m)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestManifestDetectsTampering(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	conf := filepath.Join(t.TempDir(), "agent.json")
+	os.WriteFile(conf, []byte(`{"agent_id":"a1"}`), 0644)
+	path := writeManifest(t, priv, conf)
+
+	m, err := loadManifest(path, pub)
+	if err != nil {
+		t.Fatalf("loadManifest: %v", err)
+	}
+	if problems := checkManifest(m); len(problems) != 0 {
+		t.Fatalf("untouched file reported: %v", problems)
+	}
+
+	// Edit the config
+	os.WriteFile(conf, []byte(`{"agent_id":"evil"}`), 0644)
+	if problems := checkManifest(m); len(problems) != 1 {
+		t.Fatalf("edited config: got %d problems, want 1", len(problems))
+	}
+}
+
+func TestManifestRejectsForgedSignature(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, attacker, _ := ed25519.GenerateKey(rand.Reader)
+	conf := filepath.Join(t.TempDir(), "agent.json")
+	os.WriteFile(conf, []byte(`{}`), 0644)
+
+	if _, err := loadManifest(writeManifest(t, attacker, conf), pub); err == nil {
+		t.Error("manifest signed with the wrong key was accepted")
+	}
+}
+
+func TestManifestAcceptsSignedUpdate(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, attacker, _ := ed25519.GenerateKey(rand.Reader)
+	old := releasePublicKey
+	releasePublicKey = base64.StdEncoding.EncodeToString(pub)
+	t.Cleanup(func() { releasePublicKey = old })
+
+	build := []byte("new build")
+	offer := signedOffer(key, "1.1.0", build)
+	u, _ := newTestUpdater(t, pub, map[string][]byte{offer.URL: build})
+	runAs(t, "1.0.0")
+	// The manifest pins the build the agent was deployed with
+	m, err := loadManifest(writeManifest(t, key, u.exe), pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.install(context.Background(), offer); err != nil {
+		t.Fatal(err)
+	}
+	if problems := checkManifest(m); len(problems) != 0 {
+		t.Fatalf("self-updated binary reported: %v", problems)
+	}
+
+	// A record only vouches for the build it was signed for
+	os.WriteFile(u.exe, []byte("new builf"), 0700)
+	if problems := checkManifest(m); len(problems) != 1 {
+		t.Errorf("binary not matching its release: got %d problems, want 1", len(problems))
+	}
+	os.WriteFile(u.exe, build, 0700)
+	forged := signedOffer(attacker, "1.1.0", build)
+	if err := saveReleaseRecord(u.exe, forged); err != nil {
+		t.Fatal(err)
+	}
+	if problems := checkManifest(m); len(problems) != 1 {
+		t.Errorf("release record signed with the wrong key: got %d problems, want 1", len(problems))
+	}
+	saveReleaseRecord(u.exe, offer)
+
+	// Rolled back, the deployed build matches the manifest again
+	if err := u.rollback("test"); err != nil {
+		t.Fatal(err)
+	}
+	if problems := checkManifest(m); len(problems) != 0 {
+		t.Errorf("rolled back binary reported: %v", problems)
+	}
+	if _, err := os.Stat(releaseRecordPath(u.exe)); !os.IsNotExist(err) {
+		t.Errorf("release record of the rolled back build kept: %v", err)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"debug/buildinfo"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Package is one installed piece of software. Ecosystem uses OSV names
+// ("Debian", "Ubuntu", "Red Hat", "Go", ...) so the server can match it
+// against an OSV database without translation.
+type Package struct {
+	Ecosystem  string `json:"ecosystem"`
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	Arch       string `json:"arch,omitempty"`
+	SrcPackage string `json:"src_package,omitempty"` // Debian source package, advisories use it
+	Source     string `json:"source"`                // "dpkg", "rpm" or the Go binary's path
+}
+
+func (p Package) key() string {
+	return p.Ecosystem + "|" + p.Name + "|" + p.Version + "|" + p.Source
+}
+
+// InventoryReport carries either a full snapshot or the diff since the
+// last report the server accepted.
+type InventoryReport struct {
+	AgentID   string    `json:"agent_id"`
+	Full      bool      `json:"full"`
+	Added     []Package `json:"added,omitempty"`
+	Removed   []Package `json:"removed,omitempty"`
+	Timestamp int64     `json:"timestamp"`
+}
+
+// --- Collectors ---
+
+// parseDpkgStatus reads /var/lib/dpkg/status: RFC 822-style stanzas
+// separated by blank lines. Only fully installed packages count.
+func parseDpkgStatus(r io.Reader, ecosystem string) ([]Package, error) {
+	var pkgs []Package
+	fields := make(map[string]string)
+	var last string
+
+	flush := func() {
+		if strings.HasSuffix(fields["Status"], " installed") && fields["Package"] != "" {
+			// "Source: openssl (3.0.2-0ubuntu1)", the version part is optional
+			src, _, _ := strings.Cut(fields["Source"], " ")
+			pkgs = append(pkgs, Package{
+				Ecosystem:  ecosystem,
+				Name:       fields["Package"],
+				Version:    fields["Version"],
+				Arch:       fields["Architecture"],
+				SrcPackage: src,
+				Source:     "dpkg",
+			})
+		}
+		fields = make(map[string]string)
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			flush()
+		case line[0] == ' ' || line[0] == '\t':
+			// Continuation of a multi-line field (Description, Conffiles)
+			fields[last] += "\n" + strings.TrimSpace(line)
+		default:
+			k, v, ok := strings.Cut(line, ":")
+			if ok {
+				last = k
+				fields[k] = strings.TrimSpace(v)
+			}
+		}
+	}
+	flush()
+	return pkgs, scanner.Err()
+}
+
+// parseRPMExport reads a package list exported from the rpm database,
+// one package per line, tab separated:
+//
+//	rpm -qa --qf '%{NAME}\t%|EPOCH?{%{EPOCH}:}:{}|%{VERSION}-%{RELEASE}\t%{ARCH}\n'
+//
+// The rpm database itself is a binary (BDB or SQLite) file, so we rely on
+// a cron job or package hook to keep this export fresh.
+func parseRPMExport(r io.Reader, ecosystem string) ([]Package, error) {
+	var pkgs []Package
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 2 || strings.HasPrefix(parts[0], "#") {
+			continue
+		}
+		p := Package{Ecosystem: ecosystem, Name: parts[0], Version: parts[1], Source: "rpm"}
+		if len(parts) > 2 {
+			p.Arch = parts[2]
+		}
+		pkgs = append(pkgs, p)
+	}
+	return pkgs, scanner.Err()
+}
+
+// goBinaryPackages reads the build info embedded in every Go binary in
+// dir: the toolchain (as OSV's "stdlib") plus each module dependency.
+func goBinaryPackages(dir string) []Package {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var pkgs []Package
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		bi, err := buildinfo.ReadFile(path)
+		if err != nil {
+			continue // Not a Go binary
+		}
+
+		add := func(name, version string) {
+			if version == "" || version == "(devel)" {
+				return
+			}
+			pkgs = append(pkgs, Package{Ecosystem: "Go", Name: name, Version: version, Source: path})
+		}
+		add("stdlib", strings.TrimPrefix(bi.GoVersion, "go"))
+		add(bi.Main.Path, bi.Main.Version)
+		for _, dep := range bi.Deps {
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			add(dep.Path, dep.Version)
+		}
+	}
+	return pkgs
+}
+
+// collectInventory runs every collector. Missing sources (no dpkg on an
+// RPM host, say) are skipped.
+func collectInventory() []Package {
+	distro := osReleaseID("/etc/os-release")
+	var all []Package
+
+	if f, err := os.Open(cfg.DpkgStatusPath); err == nil {
+		pkgs, err := parseDpkgStatus(f, dpkgEcosystem(distro))
+		f.Close()
+		if err != nil {
+			fmt.Printf("⚠️  Reading %s: %v\n", cfg.DpkgStatusPath, err)
+		}
+		all = append(all, pkgs...)
+	}
+
+	if f, err := os.Open(cfg.RPMExportPath); err == nil {
+		pkgs, err := parseRPMExport(f, rpmEcosystem(distro))
+		f.Close()
+		if err != nil {
+			fmt.Printf("⚠️  Reading %s: %v\n", cfg.RPMExportPath, err)
+		}
+		all = append(all, pkgs...)
+	}
+
+	for _, dir := range cfg.GoBinaryDirs {
+		all = append(all, goBinaryPackages(dir)...)
+	}
+	return all
+}
+
+// osReleaseID returns the ID= field of /etc/os-release ("debian", "rocky").
+func osReleaseID(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if v, ok := strings.CutPrefix(line, "ID="); ok {
+			return strings.Trim(v, `"`)
+		}
+	}
+	return ""
+}
+
+func dpkgEcosystem(distro string) string {
+	if distro == "ubuntu" {
+		return "Ubuntu"
+	}
+	return "Debian"
+}
+
+func rpmEcosystem(distro string) string {
+	switch distro {
+	case "rocky":
+		return "Rocky Linux"
+	case "almalinux":
+		return "AlmaLinux"
+	case "opensuse-leap", "opensuse-tumbleweed":
+		return "openSUSE"
+	case "sles":
+		return "SUSE"
+	}
+	return "Red Hat"
+}
+
+// diffInventory returns what appeared and disappeared between two
+// snapshots, sorted for stable reports.
+func diffInventory(old, cur []Package) (added, removed []Package) {
+	before := make(map[string]Package, len(old))
+	for _, p := range old {
+		before[p.key()] = p
+	}
+	now := make(map[string]bool, len(cur))
+	for _, p := range cur {
+		now[p.key()] = true
+		if _, ok := before[p.key()]; !ok {
+			added = append(added, p)
+		}
+	}
+	for k, p := range before {
+		if !now[k] {
+			removed = append(removed, p)
+		}
+	}
+	byKey := func(s []Package) func(i, j int) bool {
+		return func(i, j int) bool { return s[i].key() < s[j].key() }
+	}
+	sort.Slice(added, byKey(added))
+	sort.Slice(removed, byKey(removed))
+	return added, removed
+}
+
+// --- Background loop ---
+
+// inventoryLoop sends a full snapshot first, then only diffs. The baseline
+// only moves forward once the server accepts a report, so a failed send
+// is folded into the next diff.
+func inventoryLoop(ctx context.Context) {
+	ticker := time.NewTicker(cfg.inventoryEvery())
+	defer ticker.Stop()
+
+	var reported []Package
+	full := true
+	for {
+		start := time.Now()
+		cur := collectInventory()
+		timeScan("inventory", start)
+		report := InventoryReport{AgentID: cfg.AgentID, Full: full, Timestamp: time.Now().Unix()}
+		if full {
+			report.Added = cur
+		} else {
+			report.Added, report.Removed = diffInventory(reported, cur)
+		}
+
+		if full || len(report.Added)+len(report.Removed) > 0 {
+			switch status, err := postInventory(ctx, report); {
+			case err != nil:
+				fmt.Printf("⚠️  Failed to send inventory: %v\n", err)
+			case status == http.StatusConflict:
+				// Server lost our baseline (restart), resync
+				full = true
+				continue
+			default:
+				reported, full = cur, false
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func postInventory(ctx context.Context, report InventoryReport) (int, error) {
+	// Inventories stay on the node that took them. After a failover the new
+	// node answers 409 and the loop resends the full list.
+	data, _ := json.Marshal(report)
+	resp, err := servers.post(ctx, "/inventory", data)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusConflict {
+		return resp.StatusCode, fmt.Errorf("server returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
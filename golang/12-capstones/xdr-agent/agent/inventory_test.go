@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const dpkgStatus = `Package: libssl3
+Status: install ok installed
+Priority: optional
+Architecture: amd64
+Source: openssl
+Version: 3.0.2-0ubuntu1.10
+Description: Secure Sockets Layer toolkit
+ This package contains the openssl binary.
+
+Package: removed-tool
+Status: deinstall ok config-files
+Version: 1.0
+
+Package: bash
+Status: install ok installed
+Architecture: amd64
+Version: 5.1-6ubuntu1`
+
+func TestParseDpkgStatus(t *testing.T) {
+	pkgs, err := parseDpkgStatus(strings.NewReader(dpkgStatus), "Ubuntu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) != 2 {
+		t.Fatalf("got %d packages, want 2 (removed-tool isn't installed): %+v", len(pkgs), pkgs)
+	}
+	want := Package{Ecosystem: "Ubuntu", Name: "libssl3", Version: "3.0.2-0ubuntu1.10", Arch: "amd64", SrcPackage: "openssl", Source: "dpkg"}
+	if pkgs[0] != want {
+		t.Errorf("pkgs[0] = %+v; want %+v", pkgs[0], want)
+	}
+}
+
+func TestParseRPMExport(t *testing.T) {
+	export := "# exported by cron\nopenssl-libs\t1:3.0.7-24.el9\tx86_64\nbash\t5.1.8-6.el9\tx86_64\n"
+	pkgs, err := parseRPMExport(strings.NewReader(export), "Rocky Linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) != 2 || pkgs[0].Name != "openssl-libs" || pkgs[0].Version != "1:3.0.7-24.el9" {
+		t.Errorf("parseRPMExport = %+v", pkgs)
+	}
+}
+
+func TestGoBinaryPackages(t *testing.T) {
+	// The test binary is itself a Go binary
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	data, _ := os.ReadFile(exe)
+	os.WriteFile(filepath.Join(dir, "tool"), data, 0755)
+	os.WriteFile(filepath.Join(dir, "script.sh"), []byte("#!/bin/sh\n"), 0755)
+
+	pkgs := goBinaryPackages(dir)
+	if len(pkgs) == 0 || pkgs[0].Name != "stdlib" || pkgs[0].Ecosystem != "Go" {
+		t.Fatalf("goBinaryPackages = %+v; want stdlib first", pkgs)
+	}
+}
+
+func TestDiffInventory(t *testing.T) {
+	old := []Package{
+		{Ecosystem: "Debian", Name: "openssl", Version: "3.0.1", Source: "dpkg"},
+		{Ecosystem: "Debian", Name: "bash", Version: "5.1", Source: "dpkg"},
+	}
+	cur := []Package{
+		{Ecosystem: "Debian", Name: "openssl", Version: "3.0.2", Source: "dpkg"},
+		{Ecosystem: "Debian", Name: "bash", Version: "5.1", Source: "dpkg"},
+	}
+
+	added, removed := diffInventory(old, cur)
+	if len(added) != 1 || added[0].Version != "3.0.2" {
+		t.Errorf("added = %+v; want openssl 3.0.2", added)
+	}
+	if len(removed) != 1 || removed[0].Version != "3.0.1" {
+		t.Errorf("removed = %+v; want openssl 3.0.1", removed)
+	}
+}
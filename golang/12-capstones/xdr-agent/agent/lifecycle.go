@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// monitor is a producer: it pushes alerts until ctx is cancelled and then
+// calls wg.Done.
+type monitor func(ctx context.Context, wg *sync.WaitGroup, alerts chan<- Alert)
+
+// sendFunc delivers one alert to the server.
+type sendFunc func(ctx context.Context, a Alert) error
+
+// pipeline owns the agent lifecycle: monitors -> queue -> workers -> server,
+// with the spool catching whatever the server doesn't take.
+//
+// Shutdown order matters. Monitors are stopped and awaited before the queue
+// is closed (so nobody sends on a closed channel), then workers drain the
+// queue until the deadline, after which anything left goes to the spool.
+type pipeline struct {
+	queue chan Alert
+	send  sendFunc
+	spool *spool
+
+	ctx    context.Context // Cancelled to stop monitors and background loops
+	cancel context.CancelFunc
+	// sendCtx is cancelled when the shutdown deadline passes. In-flight
+	// sends are aborted and everything left is spooled.
+	sendCtx    context.Context
+	sendCancel context.CancelFunc
+
+	monitors sync.WaitGroup
+	workers  sync.WaitGroup
+}
+
+func newPipeline(queueSize int, send sendFunc, sp *spool) *pipeline {
+	p := &pipeline{
+		queue: make(chan Alert, queueSize),
+		send:  send,
+		spool: sp,
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.sendCtx, p.sendCancel = context.WithCancel(context.Background())
+	return p
+}
+
+// start launches the workers first, then the monitors.
+func (p *pipeline) start(workers int, monitors ...monitor) {
+	for i := 0; i < workers; i++ {
+		p.workers.Add(1)
+		go func(id int) {
+			defer p.workers.Done()
+			p.senderWorker(id)
+		}(i)
+	}
+	for _, m := range monitors {
+		p.monitors.Add(1)
+		go m(p.ctx, &p.monitors, p.queue)
+	}
+}
+
+// goBackground runs a non-producer loop (heartbeats, spool retries) that
+// stops together with the monitors.
+func (p *pipeline) goBackground(fn func(ctx context.Context)) {
+	p.monitors.Add(1)
+	go func() {
+		defer p.monitors.Done()
+		fn(p.ctx)
+	}()
+}
+
+// shutdown stops producers, drains the queue within deadline and finally
+// sends the given last alert (AGENT_STOPPING) straight to the server.
+func (p *pipeline) shutdown(deadline time.Duration, last Alert) {
+	timer := time.AfterFunc(deadline, p.sendCancel)
+	defer timer.Stop()
+
+	// 1. Stop producers and wait for them, they may be mid-send
+	p.cancel()
+	p.monitors.Wait()
+
+	// 2. No producers left: closing is safe, workers drain and exit
+	close(p.queue)
+	p.workers.Wait()
+
+	// 3. Last word to the server. Not spooled: replaying it after the
+	// next start would mark a running agent as stopped.
+	if p.sendCtx.Err() == nil {
+		last.ID = newAlertID()
+		recorder.Alert("agent", last)
+		if err := p.send(p.sendCtx, last); err != nil {
+			alertsDropped.With("shutdown").Inc()
+			fmt.Printf("⚠️  Failed to send %s: %v\n", last.EventType, err)
+		}
+	}
+	p.sendCancel()
+}
+
+// --- Workers (Consumers) ---
+
+func (p *pipeline) senderWorker(id int) {
+	for alert := range p.queue {
+		if alert.ID == "" {
+			alert.ID = newAlertID()
+		}
+		recorder.Alert("queue", alert)
+		if p.sendCtx.Err() == nil {
+			start := time.Now()
+			err := p.send(p.sendCtx, alert)
+			sendLatency.Observe(time.Since(start).Seconds())
+			if err == nil {
+				alertsSent.Inc()
+				continue
+			}
+			sendErrors.Inc()
+			fmt.Printf("⚠️  Failed to send alert, spooling: %v\n", err)
+		}
+		alertsSpooled.Inc()
+		if err := p.spool.Add(alert); err != nil {
+			alertsDropped.With("spool_write").Inc()
+			fmt.Printf("❌ Alert %s lost, spool write failed: %v\n", alert.ID, err)
+		}
+	}
+	fmt.Printf("Worker %d stopped.\n", id)
+}
+
+// spoolFlusher periodically retries spooled alerts.
+func (p *pipeline) spoolFlusher(every time.Duration) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			if n, err := p.spool.Flush(ctx, p.send); err != nil {
+				fmt.Printf("⚠️  Spool flush failed: %v\n", err)
+			} else if n > 0 {
+				alertsResent.Add(float64(n))
+				fmt.Printf("📤 Resent %d spooled alert(s)\n", n)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+}
+
+func newAlertID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer records every alert it accepts. failEvery makes it reject
+// every Nth TEST alert, like a flaky network.
+type fakeServer struct {
+	mu        sync.Mutex
+	received  []Alert
+	calls     int
+	failEvery int
+	block     bool // Hang until the send context is cancelled
+}
+
+func (f *fakeServer) send(ctx context.Context, a Alert) error {
+	if f.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if a.EventType == "TEST" {
+		f.calls++
+	}
+	if a.EventType == "TEST" && f.failEvery > 0 && f.calls%f.failEvery == 0 {
+		return errors.New("connection reset")
+	}
+	f.received = append(f.received, a)
+	return nil
+}
+
+// chattyMonitor keeps producing until cancelled, then pushes one last
+// alert, which is exactly what used to panic on a closed queue.
+func chattyMonitor(name string, produced *sync.Map) monitor {
+	return func(ctx context.Context, wg *sync.WaitGroup, alerts chan<- Alert) {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			a := Alert{ID: fmt.Sprintf("%s-%d", name, i), EventType: "TEST"}
+			produced.Store(a.ID, true)
+			alerts <- a
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+// checkExactlyOnce asserts every produced alert is either on the server or
+// in the spool, and nowhere twice.
+func checkExactlyOnce(t *testing.T, produced *sync.Map, srv *fakeServer, sp *spool) {
+	t.Helper()
+	spooled, err := sp.Alerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	where := make(map[string]int)
+	for _, a := range append(srv.received, spooled...) {
+		if a.EventType != "TEST" {
+			continue
+		}
+		where[a.ID]++
+	}
+
+	total := 0
+	produced.Range(func(k, _ any) bool {
+		total++
+		switch n := where[k.(string)]; n {
+		case 1:
+		case 0:
+			t.Errorf("alert %s lost", k)
+		default:
+			t.Errorf("alert %s delivered %d times", k, n)
+		}
+		return true
+	})
+	if total == 0 {
+		t.Fatal("monitors produced nothing")
+	}
+	if len(where) != total {
+		t.Errorf("delivered %d distinct alerts, produced %d", len(where), total)
+	}
+}
+
+func TestShutdownLosesNothing(t *testing.T) {
+	srv := &fakeServer{failEvery: 7}
+	sp := newSpool(filepath.Join(t.TempDir(), "spool.ndjson"))
+	p := newPipeline(10, srv.send, sp)
+
+	var produced sync.Map
+	p.start(3, chattyMonitor("a", &produced), chattyMonitor("b", &produced))
+	time.Sleep(20 * time.Millisecond)
+	p.shutdown(time.Second, Alert{EventType: "AGENT_STOPPING"})
+
+	checkExactlyOnce(t, &produced, srv, sp)
+
+	last := srv.received[len(srv.received)-1]
+	if last.EventType != "AGENT_STOPPING" {
+		t.Errorf("last alert sent = %s; want AGENT_STOPPING", last.EventType)
+	}
+}
+
+func TestShutdownDeadlineSpoolsTheRest(t *testing.T) {
+	srv := &fakeServer{block: true}
+	sp := newSpool(filepath.Join(t.TempDir(), "spool.ndjson"))
+	p := newPipeline(10, srv.send, sp)
+
+	var produced sync.Map
+	p.start(2, chattyMonitor("a", &produced))
+	time.Sleep(10 * time.Millisecond)
+
+	start := time.Now()
+	p.shutdown(50*time.Millisecond, Alert{EventType: "AGENT_STOPPING"})
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("shutdown took %v with a 50ms deadline", took)
+	}
+
+	checkExactlyOnce(t, &produced, srv, sp)
+	if len(srv.received) != 0 {
+		t.Errorf("hung server received %d alerts", len(srv.received))
+	}
+}
+
+func TestSpoolFlushResendsOnce(t *testing.T) {
+	sp := newSpool(filepath.Join(t.TempDir(), "spool.ndjson"))
+	for i := 0; i < 5; i++ {
+		sp.Add(Alert{ID: fmt.Sprint(i), EventType: "TEST"})
+	}
+
+	// Server dies after two alerts
+	down := &fakeServer{failEvery: 3}
+	if n, err := sp.Flush(context.Background(), down.send); err != nil || n != 2 {
+		t.Fatalf("Flush = %d, %v; want 2, nil", n, err)
+	}
+
+	up := &fakeServer{}
+	if n, err := sp.Flush(context.Background(), up.send); err != nil || n != 3 {
+		t.Fatalf("Flush = %d, %v; want 3, nil", n, err)
+	}
+	if left, _ := sp.Alerts(); len(left) != 0 {
+		t.Errorf("%d alerts left in spool after a full flush", len(left))
+	}
+
+	var produced sync.Map
+	for i := 0; i < 5; i++ {
+		produced.Store(fmt.Sprint(i), true)
+	}
+	both := &fakeServer{received: append(down.received, up.received...)}
+	checkExactlyOnce(t, &produced, both, sp)
+}
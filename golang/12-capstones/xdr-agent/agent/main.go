@@ -1,74 +1,200 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
+
+	"google.golang.org/grpc"
+
+	"12-capstones/xdr-agent/recording"
 )
 
-// Config
+// Defaults (override with -config)
 const (
-	ServerURL  = "http://localhost:9090/audit"
+	ServerURL  = "http://localhost:9090"
 	AgentID    = "agent-macbook-01"
 	NumWorkers = 3
 )
 
+// cfg is the active configuration, loaded once in main.
+var cfg = defaultConfig()
+
+var httpClient = &http.Client{Timeout: 5 * time.Second}
+
+// servers is where HTTP requests go, set up from cfg in main.
+var servers *serverPool
+
+// recorder captures alerts and raw monitor observations when -record is
+// set. It's nil (and a no-op) otherwise.
+var recorder *recording.Writer
+
 type Alert struct {
+	ID        string `json:"id,omitempty"` // Lets the server drop resends
 	AgentID   string `json:"agent_id"`
 	EventType string `json:"event_type"`
 	Details   string `json:"details"`
 	Timestamp int64  `json:"timestamp"`
+
+	// Structured data, e.g. pid/ppid/start for PROCESS_START
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+type Heartbeat struct {
+	AgentID   string `json:"agent_id"`
+	Timestamp int64  `json:"timestamp"`
+	Version   string `json:"version"`
+	Group     string `json:"group,omitempty"`
+}
+
+// heartbeatReply is the server's answer to a heartbeat
+type heartbeatReply struct {
+	Update *UpdateOffer `json:"update"`
 }
 
 func main() {
+	configPath := flag.String("config", "", "Path to the JSON config file")
+	watchdog := flag.Bool("watchdog", false, "Run as a supervisor that restarts the agent and reports tampering")
+	record := flag.String("record", "", "Record alerts and monitor observations to this NDJSON file")
+	flag.Parse()
+
+	var err error
+	cfg, err = loadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		os.Exit(1)
+	}
+	servers = newServerPool(cfg.servers(), httpClient, cfg.authorize)
+
+	if *watchdog {
+		os.Exit(runWatchdog(*configPath))
+	}
+
 	fmt.Println("🛡️  XDR Agent Starting...")
 
-	// 1. Setup Channels
-	alertQueue := make(chan Alert, 100)
-	var wg sync.WaitGroup
+	if *record != "" {
+		f, err := os.OpenFile(*record, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			fmt.Printf("❌ Cannot open recording: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		recorder = recording.NewWriter(f)
+		fmt.Printf("⏺️  Recording to %s\n", *record)
+	}
+
+	// 1. Pick the transport. gRPC also opens the command channel.
+	var send sendFunc = postAlert
+	var heartbeat heartbeatFunc = postHeartbeat
+	var gt *grpcTransport
+	if cfg.Transport == "grpc" {
+		var opts []grpc.DialOption
+		if cfg.APIKey != "" {
+			opts = append(opts, grpc.WithPerRPCCredentials(apiKeyCreds(cfg.APIKey)))
+		}
+		gt, err = dialGRPC(cfg.grpcAddrs(), cfg.GRPCWindow, opts...)
+		if err != nil {
+			fmt.Printf("❌ %v\n", err)
+			os.Exit(1)
+		}
+		defer gt.Close()
+		send, heartbeat = gt.SendAlert, gt.SendHeartbeat
+		fmt.Printf("🔌 Using gRPC transport (%s)\n", strings.Join(cfg.grpcAddrs(), ", "))
+	}
 
-	// 2. Start Worker Pool (Network Senders)
-	for i := 0; i < NumWorkers; i++ {
-		wg.Add(1)
-		go func(id int) {
-			defer wg.Done()
-			senderWorker(id, alertQueue)
-		}(i)
+	// A build that crashed during its trial is undone before anything starts
+	restart := make(chan string, 1)
+	updates, err := newAgentUpdater(restart)
+	if err != nil {
+		fmt.Printf("⚠️  Self-update disabled: %v\n", err)
+	}
+	if reason, err := updates.startup(); err != nil {
+		fmt.Printf("⚠️  Update state unusable: %v\n", err)
+	} else if reason != "" {
+		fmt.Printf("↩️  Agent %s %s, rolling back\n", agentVersion, reason)
+		if err := updates.rollback(reason); err != nil {
+			fmt.Printf("❌ Rollback failed: %v\n", err)
+		} else if err := execAgent(updates.exe); err != nil {
+			fmt.Printf("❌ Restart failed: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	// 3. Start Monitors
-	ctx, cancel := context.WithCancel(context.Background())
-	wg.Add(1)
-	go fileMonitor(ctx, &wg, alertQueue) // Monitor 1
-	wg.Add(1)
-	go processMonitor(ctx, &wg, alertQueue) // Monitor 2
+	// Setup Pipeline (queue + spool), retry anything left from last run
+	p := newPipeline(100, send, newSpool(cfg.SpoolPath))
+	registerPipelineMetrics(p)
+	if cfg.MetricsAddr != "" {
+		go serveMetrics(cfg.MetricsAddr)
+	}
 
-	// 4. Wait for Shutdown Signal
+	// 2. Start Worker Pool (Network Senders) and Monitors
+	monitors := []monitor{
+		fileMonitor,      // Monitor 1
+		processMonitor,   // Monitor 2
+		integrityMonitor, // Monitor 3
+		procMonitor,      // Monitor 4
+		execMonitor,      // Monitor 5
+		historyMonitor,   // Monitor 6
+	}
+	if updates != nil {
+		monitors = append(monitors, updates.monitor)
+	}
+	p.start(cfg.NumWorkers, monitors...)
+	p.goBackground(heartbeatLoop(heartbeat, updates))
+	if gt != nil {
+		p.goBackground(gt.commandLoop)
+	}
+	p.goBackground(inventoryLoop)
+	p.goBackground(p.spoolFlusher(30 * time.Second))
+
+	// 3. Wait for Shutdown Signal, or for a restart into another build
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-
-	fmt.Println("\n🛑 Shutdown signal received. Stopping monitors...")
-	cancel() // Stop monitors
+	var restartReason string
+	select {
+	case <-sigChan:
+		fmt.Println("\n🛑 Shutdown signal received. Stopping monitors...")
+	case restartReason = <-restart:
+		fmt.Printf("\n🔄 %s. Stopping monitors...\n", restartReason)
+	}
 
-	// Close queue after monitors are done (we need to wait for monitors aka "producers" to finish first ideally)
-	// But mostly monitors respect context.
-	// For simplicity, we'll give them a moment to cleanup or just close queue if we know they are done.
-	// Correct pattern: Wait for monitors to return, then close(alertQueue), then wait for workers.
-	// Implementing simple timeout for demo:
-	time.Sleep(1 * time.Second)
-	close(alertQueue)
+	// 4. Stop monitors, drain the queue, then say goodbye. The
+	// AGENT_STOPPING event tells the server the silence that follows
+	// isn't a killed agent.
+	last := Alert{
+		AgentID:   cfg.AgentID,
+		EventType: "AGENT_STOPPING",
+		Details:   "Agent shut down cleanly",
+		Timestamp: time.Now().Unix(),
+	}
+	if restartReason != "" {
+		last.EventType, last.Details = "AGENT_RESTARTING", restartReason
+	}
+	p.shutdown(cfg.shutdownTimeout(), last)
+	if restartReason == "" {
+		fmt.Println("Agent exited gracefully.")
+		return
+	}
 
-	wg.Wait()
-	fmt.Println("Agent exited gracefully.")
+	// 5. Become the build that's now in place
+	if err := execAgent(updates.exe); err != nil {
+		fmt.Printf("❌ Restart failed: %v\n", err)
+		if updates.rollback("it couldn't be started: "+err.Error()) == nil {
+			execAgent(updates.exe)
+		}
+		os.Exit(1)
+	}
 }
 
 // --- Monitors (Producers) ---
@@ -85,9 +211,11 @@ func fileMonitor(ctx context.Context, wg *sync.WaitGroup, alerts chan<- Alert) {
 			return
 		case <-ticker.C:
 			// Simulate finding a file change
-			if rand.Float32() < 0.3 {
+			roll := rand.Float32()
+			recorder.Observe("file", map[string]any{"path": "/etc/passwd", "roll": roll})
+			if roll < 0.3 {
 				alerts <- Alert{
-					AgentID:   AgentID,
+					AgentID:   cfg.AgentID,
 					EventType: "FILE_MODIFIED",
 					Details:   "/etc/passwd accessed by unknown user",
 					Timestamp: time.Now().Unix(),
@@ -109,9 +237,11 @@ func processMonitor(ctx context.Context, wg *sync.WaitGroup, alerts chan<- Alert
 			return
 		case <-ticker.C:
 			// Simulate a suspicious process
-			if rand.Float32() < 0.2 {
+			roll := rand.Float32()
+			recorder.Observe("process", map[string]any{"name": "miner_x", "pid": 9999, "roll": roll})
+			if roll < 0.2 {
 				alerts <- Alert{
-					AgentID:   AgentID,
+					AgentID:   cfg.AgentID,
 					EventType: "UNAUTHORIZED_ACCESS",
 					Details:   "Process 'miner_x' started (PID: 9999)",
 					Timestamp: time.Now().Unix(),
@@ -121,22 +251,78 @@ func processMonitor(ctx context.Context, wg *sync.WaitGroup, alerts chan<- Alert
 	}
 }
 
-// --- Workers (Consumers) ---
+// --- Delivery ---
 
-func senderWorker(id int, alerts <-chan Alert) {
-	for alert := range alerts {
-		sendAlert(alert)
+// postAlert sends one alert to the server. Anything but a 2xx is a failure,
+// so the alert gets spooled instead of silently dropped.
+func postAlert(ctx context.Context, alert Alert) error {
+	data, _ := json.Marshal(alert)
+	resp, err := servers.post(ctx, "/audit", data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned %s", resp.Status)
 	}
-	fmt.Printf("Worker %d stopped.\n", id)
+	return nil
 }
 
+// sendAlert is a best-effort send for callers outside the pipeline.
 func sendAlert(alert Alert) {
-	data, _ := json.Marshal(alert)
-	resp, err := http.Post(ServerURL, "application/json", bytes.NewBuffer(data))
-	if err != nil {
+	alert.ID = newAlertID()
+	if err := postAlert(context.Background(), alert); err != nil {
 		fmt.Printf("⚠️  Failed to send alert: %v\n", err)
-		return
+	}
+}
+
+// heartbeatFunc delivers one heartbeat to the server and returns the update
+// it offered, if any.
+type heartbeatFunc func(ctx context.Context, hb Heartbeat) (*UpdateOffer, error)
+
+// heartbeatLoop tells the server we're alive. A heartbeat that stops without
+// an AGENT_STOPPING event is how the server spots a killed agent.
+func heartbeatLoop(send heartbeatFunc, updates *updater) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		ticker := time.NewTicker(cfg.heartbeatEvery())
+		defer ticker.Stop()
+
+		beat := func() {
+			hb := Heartbeat{AgentID: cfg.AgentID, Timestamp: time.Now().Unix(), Version: agentVersion, Group: cfg.Group}
+			offer, err := send(ctx, hb)
+			if err != nil {
+				fmt.Printf("⚠️  Failed to send heartbeat: %v\n", err)
+				return
+			}
+			updates.heartbeat(offer)
+		}
+		beat()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				beat()
+			}
+		}
+	}
+}
+
+// postHeartbeat counts any 2xx as accepted. Servers from before
+// self-update answer with an empty body.
+func postHeartbeat(ctx context.Context, hb Heartbeat) (*UpdateOffer, error) {
+	data, _ := json.Marshal(hb)
+	resp, err := servers.post(ctx, "/heartbeat", data)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
-	// fmt.Printf("Sent alert: %s\n", alert.EventType)
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+	var reply heartbeatReply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("decoding heartbeat reply: %w", err)
+	}
+	return reply.Update, nil
 }
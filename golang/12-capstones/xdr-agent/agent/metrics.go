@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"12-capstones/xdr-agent/metrics"
+)
+
+// Agent metrics, served on metrics_addr
+var (
+	registry = metrics.NewRegistry()
+
+	alertsSent = registry.Counter("xdr_agent_alerts_sent_total",
+		"Alerts accepted by the server on the first try.")
+	alertsSpooled = registry.Counter("xdr_agent_alerts_spooled_total",
+		"Alerts written to the spool because sending failed.")
+	alertsResent = registry.Counter("xdr_agent_alerts_resent_total",
+		"Spooled alerts delivered on a later retry.")
+	alertsDropped = registry.CounterVec("xdr_agent_alerts_dropped_total",
+		"Alerts lost for good, by reason.", "reason")
+	sendErrors = registry.Counter("xdr_agent_send_errors_total",
+		"Failed attempts to send an alert.")
+	sendLatency = registry.Histogram("xdr_agent_send_duration_seconds",
+		"Time to deliver one alert, acked for gRPC.", metrics.DefBuckets)
+	scanDuration = registry.HistogramVec("xdr_agent_monitor_scan_duration_seconds",
+		"Time one monitor scan takes.", "monitor", []float64{.001, .01, .05, .1, .5, 1, 5, 30})
+)
+
+func init() {
+	registry.RegisterRuntime()
+}
+
+// registerPipelineMetrics exposes the queue and spool of the running
+// pipeline.
+func registerPipelineMetrics(p *pipeline) {
+	registry.GaugeFunc("xdr_agent_queue_depth", "Alerts waiting for a sender worker.",
+		func() float64 { return float64(len(p.queue)) })
+	registry.GaugeFunc("xdr_agent_queue_capacity", "Size of the alert queue.",
+		func() float64 { return float64(cap(p.queue)) })
+	registry.GaugeFunc("xdr_agent_spool_bytes", "Size of the spool file.", func() float64 {
+		fi, err := os.Stat(p.spool.path)
+		if err != nil {
+			return 0
+		}
+		return float64(fi.Size())
+	})
+}
+
+// timeScan records how long one monitor scan took.
+func timeScan(monitor string, start time.Time) {
+	scanDuration.With(monitor).Observe(time.Since(start).Seconds())
+}
+
+// serveMetrics serves /metrics until the process exits.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", registry.Handler())
+	fmt.Printf("📈 Metrics on http://%s/metrics\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fmt.Printf("⚠️  Metrics server stopped: %v\n", err)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of the start time in /proc/<pid>/stat.
+// It's 100 on every mainstream Linux build.
+const clockTicks = 100
+
+// procKey identifies a process instance. PIDs get reused, start times
+// don't.
+type procKey struct {
+	PID   int
+	Ticks uint64
+}
+
+// procInfo is what we read about one process from /proc.
+type procInfo struct {
+	PID     int
+	PPID    int
+	Ticks   uint64 // Start time in clock ticks since boot
+	Start   time.Time
+	Exe     string
+	Cmdline string
+}
+
+// bootTime reads the "btime" line of /proc/stat.
+func bootTime(procRoot string) (time.Time, error) {
+	f, err := os.Open(filepath.Join(procRoot, "stat"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "btime "); ok {
+			secs, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("bad btime %q", v)
+			}
+			return time.Unix(secs, 0), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no btime in %s/stat", procRoot)
+}
+
+// readProc parses /proc/<pid>/stat, cmdline and exe.
+func readProc(procRoot string, pid int, boot time.Time) (procInfo, error) {
+	dir := filepath.Join(procRoot, strconv.Itoa(pid))
+	stat, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return procInfo{}, err
+	}
+
+	// The command name is in parentheses and may itself contain spaces or
+	// parentheses, so split after the last ')'
+	end := bytes.LastIndexByte(stat, ')')
+	if end < 0 {
+		return procInfo{}, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	// fields[0] is the state (field 3 in proc(5)), so field N is fields[N-3]
+	if len(fields) < 20 {
+		return procInfo{}, fmt.Errorf("short stat for pid %d", pid)
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return procInfo{}, fmt.Errorf("bad ppid for pid %d", pid)
+	}
+	ticks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return procInfo{}, fmt.Errorf("bad start time for pid %d", pid)
+	}
+
+	p := procInfo{
+		PID:   pid,
+		PPID:  ppid,
+		Ticks: ticks,
+		Start: boot.Add(time.Duration(ticks) * time.Second / clockTicks),
+	}
+	if cmd, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		p.Cmdline = strings.TrimSpace(strings.ReplaceAll(string(cmd), "\x00", " "))
+	}
+	// Needs the same user or root; fine to go without
+	p.Exe, _ = os.Readlink(filepath.Join(dir, "exe"))
+	return p, nil
+}
+
+// scanProcs lists every process under procRoot. Processes that exit while
+// we read them are skipped.
+func scanProcs(procRoot string, boot time.Time) (map[procKey]procInfo, error) {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+	procs := make(map[procKey]procInfo)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		p, err := readProc(procRoot, pid, boot)
+		if err != nil {
+			continue
+		}
+		procs[procKey{p.PID, p.Ticks}] = p
+	}
+	return procs, nil
+}
+
+func processAlert(eventType string, p procInfo, ts time.Time) Alert {
+	verb := "started"
+	if eventType == "PROCESS_EXIT" {
+		verb = "exited"
+	}
+	name := p.Exe
+	if name == "" {
+		name = p.Cmdline
+	}
+	return Alert{
+		AgentID:   cfg.AgentID,
+		EventType: eventType,
+		Details:   fmt.Sprintf("Process '%s' %s (PID: %d, PPID: %d)", name, verb, p.PID, p.PPID),
+		Timestamp: ts.Unix(),
+		Fields: map[string]string{
+			"pid":     strconv.Itoa(p.PID),
+			"ppid":    strconv.Itoa(p.PPID),
+			"start":   p.Start.UTC().Format(time.RFC3339Nano),
+			"exe":     p.Exe,
+			"cmdline": p.Cmdline,
+		},
+	}
+}
+
+// procMonitor samples /proc and reports PROCESS_START and PROCESS_EXIT so
+// the server can rebuild process trees. The first scan reports everything
+// already running. Processes that live shorter than one interval are missed.
+func procMonitor(ctx context.Context, wg *sync.WaitGroup, alerts chan<- Alert) {
+	defer wg.Done()
+	boot, err := bootTime(cfg.ProcRoot)
+	if err != nil {
+		fmt.Printf("⚠️  Process events disabled: %v\n", err)
+		return
+	}
+	fmt.Println("Tracking Process Starts and Exits...")
+	ticker := time.NewTicker(cfg.processEvery())
+	defer ticker.Stop()
+
+	var known map[procKey]procInfo
+	scan := func() {
+		now := time.Now()
+		current, err := scanProcs(cfg.ProcRoot, boot)
+		timeScan("procs", now)
+		if err != nil {
+			fmt.Printf("⚠️  Process scan failed: %v\n", err)
+			return
+		}
+		recorder.Observe("procs", map[string]any{"count": len(current)})
+
+		for k, p := range current {
+			if _, ok := known[k]; ok {
+				continue
+			}
+			ts := p.Start
+			if known == nil {
+				ts = now // Snapshot of what was already running
+			}
+			select {
+			case alerts <- processAlert("PROCESS_START", p, ts):
+			case <-ctx.Done():
+				return
+			}
+		}
+		for k, p := range known {
+			if _, ok := current[k]; ok {
+				continue
+			}
+			select {
+			case alerts <- processAlert("PROCESS_EXIT", p, now):
+			case <-ctx.Done():
+				return
+			}
+		}
+		known = current
+	}
+
+	scan()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			scan()
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeProc writes a minimal /proc/<pid> with the given comm, ppid and
+// start ticks.
+func fakeProc(t *testing.T, root string, pid int, comm string, ppid int, ticks uint64, cmdline string) {
+	t.Helper()
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Fields 3..22 of proc(5); starttime is the last one here
+	stat := strconv.Itoa(pid) + " (" + comm + ") S " + strconv.Itoa(ppid) +
+		" 0 0 0 -1 0 0 0 0 0 0 0 0 0 20 0 1 0 " + strconv.FormatUint(ticks, 10) + " 0 0\n"
+	os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0644)
+	os.WriteFile(filepath.Join(dir, "cmdline"), []byte(cmdline), 0644)
+}
+
+func TestScanProcs(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "stat"), []byte("cpu  1 2 3\nbtime 1772352000\nprocesses 42\n"), 0644)
+	fakeProc(t, root, 1, "systemd", 0, 10, "/sbin/init\x00splash\x00")
+	fakeProc(t, root, 4100, "tmux: server (1)", 1, 360000, "tmux\x00")
+	os.MkdirAll(filepath.Join(root, "sys"), 0755) // Not a process
+
+	boot, err := bootTime(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	procs, err := scanProcs(root, boot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key     procKey
+		ppid    int
+		start   time.Time
+		cmdline string
+	}{
+		{procKey{1, 10}, 0, time.Unix(1772352000, 100_000_000), "/sbin/init splash"},
+		// Spaces and parentheses in the command name
+		{procKey{4100, 360000}, 1, time.Unix(1772352000+3600, 0), "tmux"},
+	}
+	if len(procs) != len(tests) {
+		t.Fatalf("found %d processes; want %d", len(procs), len(tests))
+	}
+	for _, tt := range tests {
+		p, ok := procs[tt.key]
+		if !ok {
+			t.Errorf("process %+v not found", tt.key)
+			continue
+		}
+		if p.PPID != tt.ppid || !p.Start.Equal(tt.start) || p.Cmdline != tt.cmdline {
+			t.Errorf("process %+v = ppid %d start %v cmdline %q; want %d %v %q",
+				tt.key, p.PPID, p.Start, p.Cmdline, tt.ppid, tt.start, tt.cmdline)
+		}
+	}
+
+	a := processAlert("PROCESS_START", procs[procKey{4100, 360000}], boot)
+	if a.Fields["pid"] != "4100" || a.Fields["ppid"] != "1" || a.Fields["start"] != "2026-03-01T09:00:00Z" {
+		t.Errorf("alert fields = %v", a.Fields)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// spool is an on-disk NDJSON buffer for alerts the server didn't accept.
+// Alerts keep their ID while spooled, so a resend after a crash is
+// recognised by the server as a duplicate.
+type spool struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newSpool(path string) *spool {
+	return &spool{path: path}
+}
+
+// Add appends one alert to the spool file.
+func (s *spool) Add(a Alert) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	line, _ := json.Marshal(a)
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Alerts returns everything currently spooled.
+func (s *spool) Alerts() ([]Alert, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read()
+}
+
+// Flush resends spooled alerts in order and stops at the first failure.
+// Whatever wasn't sent is written back.
+func (s *spool) Flush(ctx context.Context, send func(context.Context, Alert) error) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending, err := s.read()
+	if err != nil || len(pending) == 0 {
+		return 0, err
+	}
+
+	sent := 0
+	for _, a := range pending {
+		if err := send(ctx, a); err != nil {
+			break
+		}
+		sent++
+	}
+	return sent, s.rewrite(pending[sent:])
+}
+
+func (s *spool) read() ([]Alert, error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var alerts []Alert
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var a Alert
+		if err := json.Unmarshal(scanner.Bytes(), &a); err != nil {
+			// A torn last line from a crash mid-write; skip it.
+			continue
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, scanner.Err()
+}
+
+// rewrite atomically replaces the spool with the given alerts.
+func (s *spool) rewrite(alerts []Alert) error {
+	if len(alerts) == 0 {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, a := range alerts {
+		line, _ := json.Marshal(a)
+		buf.Write(append(line, '\n'))
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("writing spool: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Self-update. The server offers a build in its heartbeat reply. The agent
+// downloads it next to its own binary, checks the hash and the signature
+// against releasePublicKey, renames it over itself and re-executes. Only
+// newer versions install: an old build is signed too, and would bring
+// back whatever the newer one fixed. The new
+// build then runs on trial: if it crashes, or gets no heartbeat through
+// before the trial ends, the previous binary is put back and that version
+// is never installed again.
+
+// releasePublicKey is the base64 Ed25519 key agent builds are signed with.
+// Like manifestPublicKey it's baked in at build time, and without it the
+// agent never updates.
+var releasePublicKey = ""
+
+// agentVersion is this build's version, reported in every heartbeat:
+//
+//	go build -ldflags "-X main.agentVersion=1.4.0 -X main.releasePublicKey=<base64 key>"
+var agentVersion = "dev"
+
+// Largest build the agent will download
+const maxBuildSize = 256 << 20
+
+// errBadBuild marks an offer that will never install: retrying it on
+// every heartbeat would only repeat the alert.
+var errBadBuild = errors.New("rejected build")
+
+// UpdateOffer is the server telling the agent to run another build
+type UpdateOffer struct {
+	Version   string `json:"version"`
+	SHA256    string `json:"sha256"`
+	Size      int64  `json:"size"`
+	Signature string `json:"signature"`
+	URL       string `json:"url"`
+}
+
+// releaseSigned is what a build's signature covers, as JSON
+type releaseSigned struct {
+	Version string `json:"version"`
+	SHA256  string `json:"sha256"`
+	Size    int64  `json:"size"`
+}
+
+// updateState survives the restart into a new build, so that build knows
+// it's on trial, and the previous one can report why it's back.
+type updateState struct {
+	From       string    `json:"from,omitempty"`
+	To         string    `json:"to,omitempty"` // Build on trial
+	Deadline   time.Time `json:"deadline,omitzero"`
+	Starts     int       `json:"starts,omitempty"`      // Of To during the trial; a second one means it crashed
+	Failed     []string  `json:"failed,omitempty"`      // Builds rolled back from, never retried
+	RolledBack string    `json:"rolled_back,omitempty"` // Why, until the previous build reported it
+}
+
+func (st updateState) onTrial() bool { return st.To != "" }
+
+// signedBy checks the offer's signature.
+func (o UpdateOffer) signedBy(pub ed25519.PublicKey) bool {
+	sig, err := base64.StdEncoding.DecodeString(o.Signature)
+	if err != nil {
+		return false
+	}
+	payload, _ := json.Marshal(releaseSigned{o.Version, o.SHA256, o.Size})
+	return ed25519.Verify(pub, payload, sig)
+}
+
+// An update changes the binary's hash, which the integrity manifest pins.
+// So install keeps the signed offer a binary came from next to it, and
+// the integrity check accepts a binary that matches one. The previous
+// build's record moves with it to .prev, for a rollback.
+func releaseRecordPath(exe string) string { return exe + ".release.json" }
+
+func saveReleaseRecord(exe string, offer UpdateOffer) error {
+	offer.URL = ""
+	data, _ := json.MarshalIndent(offer, "", "  ")
+	tmp := releaseRecordPath(exe) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, releaseRecordPath(exe))
+}
+
+// signedRelease reports whether sum is the hash of a build installed at
+// path from an offer signed with the release key: the current one, or
+// the previous one a rollback puts back.
+func signedRelease(path, sum string) bool {
+	if releasePublicKey == "" {
+		return false
+	}
+	pub, err := parsePublicKey(releasePublicKey)
+	if err != nil {
+		return false
+	}
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	for _, exe := range []string{path, path + ".prev"} {
+		data, err := os.ReadFile(releaseRecordPath(exe))
+		if err != nil {
+			continue
+		}
+		var rec UpdateOffer
+		if json.Unmarshal(data, &rec) == nil && rec.SHA256 == sum && rec.signedBy(pub) {
+			return true
+		}
+	}
+	return false
+}
+
+// swapReleaseRecords moves the record from one binary's name to another's,
+// or removes the destination's when from has none.
+func swapReleaseRecords(from, to string) error {
+	err := os.Rename(releaseRecordPath(from), releaseRecordPath(to))
+	if errors.Is(err, os.ErrNotExist) {
+		err = os.Remove(releaseRecordPath(to))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+	}
+	return err
+}
+
+func loadUpdateState(path string) (updateState, error) {
+	var st updateState
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return st, nil
+}
+
+func saveUpdateState(path string, st updateState) error {
+	data, _ := json.MarshalIndent(st, "", "  ")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// rollbackUpdate puts the previous binary back over exe and records why.
+// The watchdog calls it too, for a build that dies before it can.
+func rollbackUpdate(exe, statePath, reason string) error {
+	st, err := loadUpdateState(statePath)
+	if err != nil {
+		return err
+	}
+	if !st.onTrial() {
+		return fmt.Errorf("no update on trial")
+	}
+	if err := os.Rename(exe+".prev", exe); err != nil {
+		return fmt.Errorf("restoring %s: %w", exe, err)
+	}
+	if err := swapReleaseRecords(exe+".prev", exe); err != nil {
+		return fmt.Errorf("restoring the release record of %s: %w", exe, err)
+	}
+	st.Failed = append(st.Failed, st.To)
+	st.RolledBack = fmt.Sprintf("rolled back from %s to %s: %s", st.To, st.From, reason)
+	st.From, st.To, st.Deadline, st.Starts = "", "", time.Time{}, 0
+	return saveUpdateState(statePath, st)
+}
+
+// newAgentUpdater sets up self-update of the running binary, or returns
+// nil when the build has no release key.
+func newAgentUpdater(restart chan<- string) (*updater, error) {
+	if releasePublicKey == "" || cfg.UpdateStatePath == "" {
+		fmt.Println("⚠️  Self-update disabled (no built-in release key)")
+		return nil, nil
+	}
+	pub, err := parsePublicKey(releasePublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("bad built-in release key: %w", err)
+	}
+	exe, err := agentExecutable()
+	if err != nil {
+		return nil, err
+	}
+	return newUpdater(exe, cfg.UpdateStatePath, pub, cfg.updateTrial(), downloadBuild, restart), nil
+}
+
+// agentExecutable is the binary file itself, which an update replaces,
+// rather than a symlink to it.
+func agentExecutable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+// updater installs offered builds and runs the trial of a fresh one. A
+// nil updater (no release key) ignores offers.
+type updater struct {
+	exe       string // Resolved path of the running binary
+	statePath string
+	pub       ed25519.PublicKey
+	trial     time.Duration
+	retry     time.Duration // Wait before trying a failed commit or rollback again
+	download  func(ctx context.Context, path string) (io.ReadCloser, error)
+	restart   chan<- string // Asks main to stop and exec exe, saying why
+
+	offers chan UpdateOffer
+	beatOK atomic.Bool // A heartbeat got through since this process started
+	mu     sync.Mutex  // Serializes state file updates
+}
+
+func newUpdater(exe, statePath string, pub ed25519.PublicKey, trial time.Duration,
+	download func(ctx context.Context, path string) (io.ReadCloser, error), restart chan<- string) *updater {
+	return &updater{
+		exe:       exe,
+		statePath: statePath,
+		pub:       pub,
+		trial:     trial,
+		retry:     time.Minute,
+		download:  download,
+		restart:   restart,
+		offers:    make(chan UpdateOffer, 1),
+	}
+}
+
+// heartbeat is told about every heartbeat the server accepted, with the
+// update it offered, if any.
+func (u *updater) heartbeat(offer *UpdateOffer) {
+	if u == nil {
+		return
+	}
+	u.beatOK.Store(true)
+	if offer == nil {
+		return
+	}
+	select {
+	case u.offers <- *offer:
+	default: // Still busy with the last one
+	}
+}
+
+// startup counts this start against a trial in progress. It returns why
+// the update must be rolled back right away, or "" to carry on.
+func (u *updater) startup() (string, error) {
+	if u == nil {
+		return "", nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	st, err := loadUpdateState(u.statePath)
+	if err != nil || !st.onTrial() {
+		return "", err
+	}
+	if st.To != agentVersion {
+		// The new binary never ran, e.g. it was reinstalled by hand
+		st.From, st.To, st.Deadline, st.Starts = "", "", time.Time{}, 0
+		os.Remove(u.exe + ".prev")
+		// Whatever it was installed from, it wasn't our offers
+		os.Remove(releaseRecordPath(u.exe))
+		os.Remove(releaseRecordPath(u.exe + ".prev"))
+		return "", saveUpdateState(u.statePath, st)
+	}
+	st.Starts++
+	if st.Starts == 1 {
+		// The trial runs from the first start, however long the restart took
+		st.Deadline = time.Now().Add(u.trial)
+	}
+	if err := saveUpdateState(u.statePath, st); err != nil {
+		return "", err
+	}
+	if st.Starts > 1 {
+		return "restarted during its trial", nil
+	}
+	return "", nil
+}
+
+// rollback restores the previous build; the caller restarts into it.
+func (u *updater) rollback(reason string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return rollbackUpdate(u.exe, u.statePath, reason)
+}
+
+// monitor reports rollbacks, ends the trial of a fresh build and installs
+// offered ones. It's a monitor so its alerts go through the pipeline.
+func (u *updater) monitor(ctx context.Context, wg *sync.WaitGroup, alerts chan<- Alert) {
+	defer wg.Done()
+	alert := func(eventType, details string) {
+		alerts <- Alert{AgentID: cfg.AgentID, EventType: eventType, Details: details, Timestamp: time.Now().Unix()}
+	}
+
+	u.mu.Lock()
+	st, err := loadUpdateState(u.statePath)
+	rolledBack := st.RolledBack
+	if err == nil && rolledBack != "" {
+		st.RolledBack = ""
+		err = saveUpdateState(u.statePath, st)
+	}
+	u.mu.Unlock()
+	if err != nil {
+		fmt.Printf("⚠️  Update state unusable: %v\n", err)
+	}
+	if rolledBack != "" {
+		alert("AGENT_UPDATE_FAILED", rolledBack)
+	}
+
+	var trialEnd <-chan time.Time
+	var timer *time.Timer
+	// The trial is judged once, when it ends. A failed commit or rollback
+	// is retried without judging it again.
+	judged, passed := false, false
+	if st.onTrial() {
+		fmt.Printf("🧪 Running %s on trial until %s\n", agentVersion, st.Deadline.Format(time.TimeOnly))
+		timer = time.NewTimer(time.Until(st.Deadline))
+		defer timer.Stop()
+		trialEnd = timer.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-trialEnd:
+			if !judged {
+				judged, passed = true, u.beatOK.Load()
+			}
+			if passed {
+				if err := u.commit(); err != nil {
+					fmt.Printf("⚠️  Failed to finish update, retrying in %s: %v\n", u.retry, err)
+					timer.Reset(u.retry)
+					continue
+				}
+				alert("AGENT_UPDATED", fmt.Sprintf("Updated from %s to %s", st.From, st.To))
+				continue
+			}
+			reason := "no heartbeat got through during its trial"
+			if err := u.rollback(reason); err != nil {
+				fmt.Printf("❌ Rollback failed, retrying in %s: %v\n", u.retry, err)
+				timer.Reset(u.retry)
+				continue
+			}
+			u.requestRestart("Rolling back " + st.To + ": " + reason)
+		case offer := <-u.offers:
+			installed, err := u.install(ctx, offer)
+			switch {
+			case errors.Is(err, errBadBuild):
+				u.markFailed(offer.Version)
+				alert("AGENT_UPDATE_FAILED", fmt.Sprintf("Update to %s %v", offer.Version, err))
+			case err != nil:
+				// Download trouble, the next heartbeat offers it again
+				fmt.Printf("⚠️  Update to %s failed: %v\n", offer.Version, err)
+			case installed:
+				u.requestRestart(fmt.Sprintf("Updating from %s to %s", agentVersion, offer.Version))
+			}
+		}
+	}
+}
+
+func (u *updater) requestRestart(reason string) {
+	select {
+	case u.restart <- reason:
+	default:
+	}
+}
+
+// commit ends a successful trial.
+func (u *updater) commit() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	st, err := loadUpdateState(u.statePath)
+	if err != nil {
+		return err
+	}
+	st.From, st.To, st.Deadline, st.Starts = "", "", time.Time{}, 0
+	if err := os.Remove(u.exe + ".prev"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	os.Remove(releaseRecordPath(u.exe + ".prev"))
+	return saveUpdateState(u.statePath, st)
+}
+
+func (u *updater) markFailed(version string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	st, err := loadUpdateState(u.statePath)
+	if err != nil {
+		return
+	}
+	st.Failed = append(st.Failed, version)
+	saveUpdateState(u.statePath, st)
+}
+
+// install downloads and checks an offered build, then swaps it in. It
+// skips a build that's running, on trial or failed before.
+func (u *updater) install(ctx context.Context, offer UpdateOffer) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	st, err := loadUpdateState(u.statePath)
+	if err != nil {
+		return false, err
+	}
+	if offer.Version == agentVersion || st.onTrial() || slices.Contains(st.Failed, offer.Version) {
+		return false, nil
+	}
+	if !newerVersion(offer.Version, agentVersion) {
+		return false, fmt.Errorf("%w: %s is not newer than %s", errBadBuild, offer.Version, agentVersion)
+	}
+
+	// 1. The offer must be signed before anything is downloaded
+	if offer.Size <= 0 || offer.Size > maxBuildSize {
+		return false, fmt.Errorf("%w: size %d", errBadBuild, offer.Size)
+	}
+	if !offer.signedBy(u.pub) {
+		return false, fmt.Errorf("%w: signature doesn't match the release key", errBadBuild)
+	}
+
+	// 2. Download next to the binary, so the swap is a same-directory rename
+	fmt.Printf("⬇️  Downloading agent %s\n", offer.Version)
+	body, err := u.download(ctx, offer.URL)
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+	tmp := u.exe + ".new"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0700)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp) // A no-op once renamed
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(body, offer.Size+1))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, fmt.Errorf("downloading: %w", err)
+	}
+	if n != offer.Size {
+		return false, fmt.Errorf("%w: got %d bytes, signed for %d", errBadBuild, n, offer.Size)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != offer.SHA256 {
+		return false, fmt.Errorf("%w: sha256 %s, signed for %s", errBadBuild, sum, offer.SHA256)
+	}
+
+	// 3. Keep the running binary for a rollback, record the trial, swap
+	os.Remove(u.exe + ".prev")
+	if err := os.Link(u.exe, u.exe+".prev"); err != nil {
+		if err := copyFile(u.exe, u.exe+".prev"); err != nil {
+			return false, fmt.Errorf("keeping the running binary: %w", err)
+		}
+		os.Chmod(u.exe+".prev", 0700)
+	}
+	if err := swapReleaseRecords(u.exe, u.exe+".prev"); err != nil {
+		return false, fmt.Errorf("keeping the running binary's release record: %w", err)
+	}
+	// Written before the swap, since until the integrity check sees it the
+	// new binary looks tampered with
+	if err := saveReleaseRecord(u.exe, offer); err != nil {
+		swapReleaseRecords(u.exe+".prev", u.exe)
+		return false, err
+	}
+	st.From, st.To, st.Deadline, st.Starts = agentVersion, offer.Version, time.Now().Add(u.trial), 0
+	if err := saveUpdateState(u.statePath, st); err != nil {
+		swapReleaseRecords(u.exe+".prev", u.exe)
+		return false, err
+	}
+	if err := os.Rename(tmp, u.exe); err != nil {
+		st.From, st.To, st.Deadline = "", "", time.Time{}
+		saveUpdateState(u.statePath, st)
+		swapReleaseRecords(u.exe+".prev", u.exe)
+		return false, err
+	}
+	fmt.Printf("✅ Installed agent %s, restarting\n", offer.Version)
+	return true, nil
+}
+
+// parseVersion reads a release version: semver, with or without a v.
+func parseVersion(v string) (core [3]int, pre []string, ok bool) {
+	v, _, _ = strings.Cut(strings.TrimPrefix(v, "v"), "+")
+	v, p, hasPre := strings.Cut(v, "-")
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return core, nil, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return core, nil, false
+		}
+		core[i] = n
+	}
+	if hasPre {
+		pre = strings.Split(p, ".")
+	}
+	return core, pre, true
+}
+
+// newerVersion reports whether release version a comes after b. A
+// version that isn't semver is never newer, and a build that isn't one,
+// like "dev", takes any release.
+func newerVersion(a, b string) bool {
+	coreA, preA, okA := parseVersion(a)
+	coreB, preB, okB := parseVersion(b)
+	if !okA || !okB {
+		return okA
+	}
+	if c := slices.Compare(coreA[:], coreB[:]); c != 0 {
+		return c > 0
+	}
+	// A pre-release comes before its release
+	switch {
+	case len(preA) == 0:
+		return len(preB) > 0
+	case len(preB) == 0:
+		return false
+	}
+	return slices.CompareFunc(preA, preB, func(x, y string) int {
+		nx, errX := strconv.Atoi(x)
+		ny, errY := strconv.Atoi(y)
+		switch {
+		case errX == nil && errY == nil:
+			return cmp.Compare(nx, ny)
+		case errX == nil:
+			return -1 // Numbers sort before words
+		case errY == nil:
+			return 1
+		}
+		return strings.Compare(x, y)
+	}) > 0
+}
+
+// execAgent replaces this process with the binary at exe. The PID stays,
+// so neither the watchdog nor a service manager sees the agent exit.
+func execAgent(exe string) error {
+	return syscall.Exec(exe, append([]string{exe}, os.Args[1:]...), os.Environ())
+}
+
+// downloadBuild fetches a build from the server.
+func downloadBuild(ctx context.Context, path string) (io.ReadCloser, error) {
+	resp, err := servers.get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+	return resp.Body, nil
+}
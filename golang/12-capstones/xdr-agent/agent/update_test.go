@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// signedOffer offers build as version, signed with key.
+func signedOffer(key ed25519.PrivateKey, version string, build []byte) UpdateOffer {
+	sum := sha256.Sum256(build)
+	o := UpdateOffer{Version: version, SHA256: hex.EncodeToString(sum[:]), Size: int64(len(build)), URL: "/agent-releases/" + version + "/binary"}
+	payload, _ := json.Marshal(releaseSigned{o.Version, o.SHA256, o.Size})
+	o.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload))
+	return o
+}
+
+// newTestUpdater returns an updater for a fake binary in a temp dir that
+// downloads from builds, keyed by URL.
+func newTestUpdater(t *testing.T, pub ed25519.PublicKey, builds map[string][]byte) (*updater, chan string) {
+	t.Helper()
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "xdr-agent")
+	if err := os.WriteFile(exe, []byte("old build"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	download := func(ctx context.Context, path string) (io.ReadCloser, error) {
+		b, ok := builds[path]
+		if !ok {
+			return nil, errors.New("404 Not Found")
+		}
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	restart := make(chan string, 1)
+	return newUpdater(exe, filepath.Join(dir, "update.json"), pub, time.Hour, download, restart), restart
+}
+
+func runAs(t *testing.T, version string) {
+	t.Helper()
+	old := agentVersion
+	agentVersion = version
+	t.Cleanup(func() { agentVersion = old })
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestUpdateChecksBuild(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	build := []byte("new build")
+	good := signedOffer(key, "1.1.0", build)
+	builds := map[string][]byte{good.URL: build}
+	u, _ := newTestUpdater(t, pub, builds)
+	runAs(t, "1.0.0")
+
+	forged := signedOffer(otherKey, "1.1.0", build)
+	// A build signed for another version can't be offered as this one
+	relabeled := signedOffer(key, "1.0.9", build)
+	relabeled.Version = "1.1.0"
+	tampered := good
+	tampered.URL = "/tampered"
+	builds["/tampered"] = []byte("new builf")
+	// An old release is validly signed, but installing it is a downgrade
+	downgrade := signedOffer(key, "0.9.0", []byte("older build"))
+	builds[downgrade.URL] = []byte("older build")
+
+	for name, offer := range map[string]UpdateOffer{"forged": forged, "relabeled": relabeled, "tampered": tampered, "downgrade": downgrade} {
+		installed, err := u.install(context.Background(), offer)
+		if installed || !errors.Is(err, errBadBuild) {
+			t.Errorf("%s offer: installed %v, err %v; want a rejected build", name, installed, err)
+		}
+	}
+	if got := readFile(t, u.exe); got != "old build" {
+		t.Fatalf("binary replaced by a rejected build: %q", got)
+	}
+	if _, err := os.Stat(u.exe + ".new"); !os.IsNotExist(err) {
+		t.Errorf("rejected download left behind: %v", err)
+	}
+
+	installed, err := u.install(context.Background(), good)
+	if !installed || err != nil {
+		t.Fatalf("good offer: installed %v, err %v", installed, err)
+	}
+	if readFile(t, u.exe) != "new build" || readFile(t, u.exe+".prev") != "old build" {
+		t.Errorf("after install: binary %q, previous %q", readFile(t, u.exe), readFile(t, u.exe+".prev"))
+	}
+	if st, _ := loadUpdateState(u.statePath); st.From != "1.0.0" || st.To != "1.1.0" {
+		t.Errorf("state after install = %+v", st)
+	}
+
+	// Nothing else installs while 1.1.0 is on trial
+	next := signedOffer(key, "1.2.0", []byte("newer build"))
+	builds[next.URL] = []byte("newer build")
+	if installed, err := u.install(context.Background(), next); installed || err != nil {
+		t.Errorf("install during a trial: installed %v, err %v", installed, err)
+	}
+}
+
+func TestNewerVersion(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want bool
+	}{
+		{"1.1.0", "1.0.0", true},
+		{"1.0.0", "1.1.0", false},
+		{"1.0.0", "1.0.0", false},
+		{"v1.10.0", "1.9.3", true},
+		{"2.0.0", "1.99.99", true},
+		{"1.0.0", "1.0.0-rc.1", true},
+		{"1.0.0-rc.1", "1.0.0", false},
+		{"1.0.0-rc.2", "1.0.0-rc.1", true},
+		{"1.0.0-rc.10", "1.0.0-rc.9", true},
+		{"1.0.0-rc", "1.0.0-1", true},
+		{"1.0.0+build.2", "1.0.0+build.1", false},
+		{"1.0.0", "dev", true},
+		{"dev", "1.0.0", false},
+		{"1.0", "0.9.0", false},
+	} {
+		if got := newerVersion(tc.a, tc.b); got != tc.want {
+			t.Errorf("newerVersion(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateCrashRollsBack(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	build := []byte("new build")
+	offer := signedOffer(key, "1.1.0", build)
+	u, _ := newTestUpdater(t, pub, map[string][]byte{offer.URL: build})
+	runAs(t, "1.0.0")
+	if _, err := u.install(context.Background(), offer); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new build's first start begins the trial, a second one is a crash
+	agentVersion = "1.1.0"
+	if reason, err := u.startup(); reason != "" || err != nil {
+		t.Fatalf("first start: %q, %v", reason, err)
+	}
+	reason, err := u.startup()
+	if reason == "" || err != nil {
+		t.Fatalf("second start during the trial: %q, %v; want a rollback", reason, err)
+	}
+	if err := u.rollback(reason); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, u.exe); got != "old build" {
+		t.Errorf("binary after rollback = %q", got)
+	}
+
+	// Back on 1.0.0: the rollback is reported once and 1.1.0 never retried
+	agentVersion = "1.0.0"
+	if reason, err := u.startup(); reason != "" || err != nil {
+		t.Fatalf("start after rollback: %q, %v", reason, err)
+	}
+	alerts := runUpdateMonitor(t, u, func() {})
+	if len(alerts) != 1 || alerts[0].EventType != "AGENT_UPDATE_FAILED" || !strings.Contains(alerts[0].Details, "rolled back from 1.1.0 to 1.0.0") {
+		t.Errorf("alerts after rollback = %+v", alerts)
+	}
+	if installed, err := u.install(context.Background(), offer); installed || err != nil {
+		t.Errorf("reinstalling a rolled back build: installed %v, err %v", installed, err)
+	}
+	if alerts := runUpdateMonitor(t, u, func() {}); len(alerts) != 0 {
+		t.Errorf("rollback reported again: %+v", alerts)
+	}
+}
+
+func TestUpdateTrial(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	build := []byte("new build")
+	offer := signedOffer(key, "1.1.0", build)
+
+	for _, healthy := range []bool{true, false} {
+		u, restart := newTestUpdater(t, pub, map[string][]byte{offer.URL: build})
+		u.trial = 50 * time.Millisecond
+		runAs(t, "1.0.0")
+		if _, err := u.install(context.Background(), offer); err != nil {
+			t.Fatal(err)
+		}
+		agentVersion = "1.1.0"
+		u.startup()
+
+		alerts := runUpdateMonitor(t, u, func() {
+			if healthy {
+				u.heartbeat(nil)
+			}
+			time.Sleep(150 * time.Millisecond)
+		})
+		st, _ := loadUpdateState(u.statePath)
+		if healthy {
+			if len(alerts) != 1 || alerts[0].EventType != "AGENT_UPDATED" {
+				t.Errorf("healthy trial alerts = %+v; want AGENT_UPDATED", alerts)
+			}
+			if st.onTrial() || readFile(t, u.exe) != "new build" {
+				t.Errorf("healthy trial not committed: %+v", st)
+			}
+			if _, err := os.Stat(u.exe + ".prev"); !os.IsNotExist(err) {
+				t.Errorf("previous binary kept after the trial: %v", err)
+			}
+			continue
+		}
+		select {
+		case reason := <-restart:
+			if !strings.Contains(reason, "Rolling back 1.1.0") {
+				t.Errorf("restart reason = %q", reason)
+			}
+		default:
+			t.Error("failed trial didn't restart the agent")
+		}
+		if readFile(t, u.exe) != "old build" || st.RolledBack == "" {
+			t.Errorf("failed trial: binary %q, state %+v", readFile(t, u.exe), st)
+		}
+	}
+}
+
+func TestUpdateCommitRetries(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	build := []byte("new build")
+	offer := signedOffer(key, "1.1.0", build)
+	u, _ := newTestUpdater(t, pub, map[string][]byte{offer.URL: build})
+	u.trial, u.retry = 50*time.Millisecond, 50*time.Millisecond
+	runAs(t, "1.0.0")
+	if _, err := u.install(context.Background(), offer); err != nil {
+		t.Fatal(err)
+	}
+	agentVersion = "1.1.0"
+	u.startup()
+
+	// A directory with something in it where the previous binary was
+	// makes removing it, and so the commit, fail
+	prev := u.exe + ".prev"
+	if err := os.Remove(prev); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(prev, "stuck"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	alerts := runUpdateMonitor(t, u, func() {
+		u.heartbeat(nil)
+		time.Sleep(80 * time.Millisecond)
+		if st, _ := loadUpdateState(u.statePath); !st.onTrial() {
+			t.Errorf("trial committed without removing the previous binary: %+v", st)
+		}
+		os.RemoveAll(prev)
+		time.Sleep(100 * time.Millisecond)
+	})
+	if len(alerts) != 1 || alerts[0].EventType != "AGENT_UPDATED" {
+		t.Errorf("alerts = %+v; want AGENT_UPDATED once the commit went through", alerts)
+	}
+	if st, _ := loadUpdateState(u.statePath); st.onTrial() {
+		t.Errorf("commit never retried: %+v", st)
+	}
+}
+
+// runUpdateMonitor runs u's monitor while during runs and returns the
+// alerts it raised.
+func runUpdateMonitor(t *testing.T, u *updater, during func()) []Alert {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	alerts := make(chan Alert, 10)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go u.monitor(ctx, &wg, alerts)
+	during()
+	// Give the monitor a moment to report before stopping it
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	wg.Wait()
+	close(alerts)
+	var out []Alert
+	for a := range alerts {
+		out = append(out, a)
+	}
+	return out
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const restartDelay = 2 * time.Second
+
+// runWatchdog starts the agent as a child process and keeps it running.
+//
+// The kernel never tells a parent who sent SIGKILL or SIGSTOP, so every
+// uncaught stop or kill is reported as AGENT_TAMPER. Legitimate shutdowns
+// (service manager, admin) go through SIGTERM, which the agent handles and
+// reports as AGENT_STOPPING.
+func runWatchdog(configPath string) int {
+	exe, err := agentExecutable()
+	if err != nil {
+		fmt.Printf("❌ Cannot locate agent binary: %v\n", err)
+		return 1
+	}
+	args := []string{exe}
+	if configPath != "" {
+		args = append(args, "-config", configPath)
+	}
+
+	fmt.Println("🐕 XDR Watchdog Starting...")
+
+	// 1. Forward shutdown signals to the agent instead of treating its
+	// exit as tampering.
+	var stopping atomic.Bool
+	var child atomic.Pointer[os.Process]
+	done := make(chan struct{})
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigChan
+		stopping.Store(true)
+		close(done)
+		if p := child.Load(); p != nil {
+			p.Signal(sig)
+		}
+	}()
+
+	// 2. Supervise: verify, start, wait, repeat.
+	for !stopping.Load() {
+		if problems, ok := verifyIntegrity(); !ok {
+			reportTamper("refusing to start agent: " + strings.Join(problems, "; "))
+			sleepOrDone(cfg.integrityEvery(), done)
+			continue
+		}
+
+		proc, err := os.StartProcess(exe, args, &os.ProcAttr{
+			Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+		})
+		if err != nil {
+			fmt.Printf("⚠️  Failed to start agent: %v\n", err)
+			sleepOrDone(restartDelay, done)
+			continue
+		}
+		child.Store(proc)
+		if stopping.Load() {
+			proc.Signal(syscall.SIGTERM) // Signal raced with the start
+		}
+
+		superviseChild(proc.Pid, &stopping)
+		child.Store(nil)
+		if !stopping.Load() {
+			rollbackCrashedUpdate(exe)
+		}
+		sleepOrDone(restartDelay, done)
+	}
+
+	fmt.Println("Watchdog exited gracefully.")
+	return 0
+}
+
+// superviseChild waits on the agent until it exits. Stops are reported and
+// undone with SIGCONT so the agent can't be silently frozen.
+func superviseChild(pid int, stopping *atomic.Bool) {
+	for {
+		var ws syscall.WaitStatus
+		_, err := syscall.Wait4(pid, &ws, syscall.WUNTRACED|syscall.WCONTINUED, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			fmt.Printf("⚠️  Lost track of agent (pid %d): %v\n", pid, err)
+			return
+		}
+
+		switch {
+		case ws.Stopped():
+			reportTamper(fmt.Sprintf("agent (pid %d) stopped by %s", pid, signalName(ws.StopSignal())))
+			syscall.Kill(pid, syscall.SIGCONT)
+		case ws.Continued():
+			// Our own SIGCONT, or someone else's. Either way it's running.
+		case ws.Signaled():
+			if !stopping.Load() {
+				reportTamper(fmt.Sprintf("agent (pid %d) killed by %s", pid, signalName(ws.Signal())))
+			}
+			return
+		case ws.Exited():
+			if !stopping.Load() {
+				fmt.Printf("⚠️  Agent exited with status %d, restarting...\n", ws.ExitStatus())
+			}
+			return
+		}
+	}
+}
+
+func reportTamper(details string) {
+	fmt.Printf("🚨 Tamper detected: %s\n", details)
+	sendAlert(Alert{
+		AgentID:   cfg.AgentID,
+		EventType: "AGENT_TAMPER",
+		Details:   details,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+// rollbackCrashedUpdate undoes an update whose build exited during its
+// trial. The build may have died before it could do that itself.
+func rollbackCrashedUpdate(exe string) {
+	st, err := loadUpdateState(cfg.UpdateStatePath)
+	if err != nil || !st.onTrial() {
+		return
+	}
+	if err := rollbackUpdate(exe, cfg.UpdateStatePath, "it exited during its trial"); err != nil {
+		fmt.Printf("❌ Rollback of agent %s failed: %v\n", st.To, err)
+		return
+	}
+	fmt.Printf("↩️  Agent %s exited during its trial, rolled back to %s\n", st.To, st.From)
+}
+
+func sleepOrDone(d time.Duration, done <-chan struct{}) {
+	select {
+	case <-time.After(d):
+	case <-done:
+	}
+}
+
+func signalName(sig syscall.Signal) string {
+	switch sig {
+	case syscall.SIGKILL:
+		return "SIGKILL"
+	case syscall.SIGSTOP:
+		return "SIGSTOP"
+	case syscall.SIGTSTP:
+		return "SIGTSTP"
+	case syscall.SIGTERM:
+		return "SIGTERM"
+	case syscall.SIGINT:
+		return "SIGINT"
+	}
+	return fmt.Sprintf("signal %d", int(sig))
+}
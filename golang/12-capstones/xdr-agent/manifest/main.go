@@ -0,0 +1,142 @@
+package main
+
+// manifest creates the signed integrity manifest the agent checks itself
+// against, and signs agent builds for self-update.
+//
+//	go run ./xdr-agent/manifest -genkey -key signing.key
+//	go run ./xdr-agent/manifest -key signing.key -out manifest.json /usr/local/bin/xdr-agent /etc/xdr/agent.json
+//	go run ./xdr-agent/manifest -key release.key -release 1.4.0 xdr-agent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+type ManifestFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+type Manifest struct {
+	Files     []ManifestFile `json:"files"`
+	Signature string         `json:"signature"`
+}
+
+// releaseSigned is what an agent build's signature covers, as JSON
+type releaseSigned struct {
+	Version string `json:"version"`
+	SHA256  string `json:"sha256"`
+	Size    int64  `json:"size"`
+}
+
+func main() {
+	keyPath := flag.String("key", "signing.key", "Ed25519 private key (base64)")
+	genKey := flag.Bool("genkey", false, "Generate a new key pair and print the public key")
+	out := flag.String("out", "manifest.json", "Where to write the manifest")
+	release := flag.String("release", "", "Sign the one given agent build as this version instead")
+	flag.Parse()
+
+	if *genKey {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			fail(err)
+		}
+		if err := os.WriteFile(*keyPath, []byte(base64.StdEncoding.EncodeToString(priv)), 0600); err != nil {
+			fail(err)
+		}
+		fmt.Println("Public key (build the agent with -ldflags \"-X main.manifestPublicKey=<key>\",")
+		fmt.Println("or main.releasePublicKey for a release key):")
+		fmt.Println(base64.StdEncoding.EncodeToString(pub))
+		return
+	}
+
+	if flag.NArg() == 0 {
+		fail(fmt.Errorf("no files given"))
+	}
+
+	// 1. Load the signing key
+	data, err := os.ReadFile(*keyPath)
+	if err != nil {
+		fail(err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil || len(raw) != ed25519.PrivateKeySize {
+		fail(fmt.Errorf("%s is not a base64 Ed25519 private key", *keyPath))
+	}
+
+	if *release != "" {
+		signRelease(ed25519.PrivateKey(raw), *release, flag.Args())
+		return
+	}
+
+	// 2. Hash every file (absolute paths, the agent may run from anywhere)
+	var m Manifest
+	for _, path := range flag.Args() {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			fail(err)
+		}
+		sum, err := hashFile(abs)
+		if err != nil {
+			fail(err)
+		}
+		m.Files = append(m.Files, ManifestFile{Path: abs, SHA256: sum})
+	}
+
+	// 3. Sign and write
+	payload, _ := json.Marshal(m.Files)
+	m.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(ed25519.PrivateKey(raw), payload))
+	encoded, _ := json.MarshalIndent(m, "", "  ")
+	if err := os.WriteFile(*out, encoded, 0644); err != nil {
+		fail(err)
+	}
+	fmt.Printf("✅ Signed manifest for %d file(s) written to %s\n", len(m.Files), *out)
+}
+
+// signRelease prints the signature to upload a build with:
+//
+//	curl -X PUT --data-binary @xdr-agent -H "X-Release-Signature: <sig>" .../agent-releases/1.4.0
+func signRelease(key ed25519.PrivateKey, version string, files []string) {
+	if len(files) != 1 {
+		fail(fmt.Errorf("-release signs exactly one build"))
+	}
+	info, err := os.Stat(files[0])
+	if err != nil {
+		fail(err)
+	}
+	sum, err := hashFile(files[0])
+	if err != nil {
+		fail(err)
+	}
+	payload, _ := json.Marshal(releaseSigned{Version: version, SHA256: sum, Size: info.Size()})
+	fmt.Printf("Signed %s as %s (sha256 %s). Upload it with the header:\n", files[0], version, sum)
+	fmt.Println("X-Release-Signature: " + base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload)))
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func fail(err error) {
+	fmt.Println("Error:", err)
+	os.Exit(1)
+}
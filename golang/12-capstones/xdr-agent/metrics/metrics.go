@@ -0,0 +1,376 @@
+// Package metrics is a small Prometheus registry: counters, gauges and
+// histograms, optionally split by one label, written in the text
+// exposition format. Agent and server each keep one Registry and serve it
+// on /metrics.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets suit latencies from a few milliseconds to ten seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is anything that can write its samples
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds metrics in registration order
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// add registers m. Registering a name twice is a programming error.
+func (r *Registry) add(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic("metrics: " + name + " registered twice")
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes every metric in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	ms := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range ms {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler serves the registry, e.g. on /metrics.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// --- Counter ---
+
+// Counter only goes up
+type Counter struct {
+	bits atomic.Uint64 // float64 bits
+}
+
+func (c *Counter) Inc() { c.Add(1) }
+
+func (c *Counter) Add(v float64) {
+	for {
+		old := c.bits.Load()
+		if c.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (c *Counter) Value() float64 { return math.Float64frombits(c.bits.Load()) }
+
+type counterMetric struct {
+	name, help string
+	c          *Counter
+}
+
+func (m *counterMetric) write(w *bufio.Writer) {
+	header(w, m.name, m.help, "counter")
+	sample(w, m.name, "", m.c.Value())
+}
+
+func (r *Registry) Counter(name, help string) *Counter {
+	c := &Counter{}
+	r.add(name, &counterMetric{name, help, c})
+	return c
+}
+
+// --- Gauge ---
+
+// Gauge goes up and down
+type Gauge struct {
+	Counter
+}
+
+func (g *Gauge) Set(v float64) { g.bits.Store(math.Float64bits(v)) }
+func (g *Gauge) Dec()          { g.Add(-1) }
+
+type gaugeMetric struct {
+	name, help string
+	g          *Gauge
+}
+
+func (m *gaugeMetric) write(w *bufio.Writer) {
+	header(w, m.name, m.help, "gauge")
+	sample(w, m.name, "", m.g.Value())
+}
+
+func (r *Registry) Gauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.add(name, &gaugeMetric{name, help, g})
+	return g
+}
+
+// funcMetric reads its value at scrape time, for state that already lives
+// elsewhere (queue lengths, file sizes, runtime stats)
+type funcMetric struct {
+	name, help, typ string
+	fn              func() float64
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	header(w, m.name, m.help, m.typ)
+	sample(w, m.name, "", m.fn())
+}
+
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.add(name, &funcMetric{name, help, "gauge", fn})
+}
+
+// CounterFunc is for a count kept by someone else; fn must never decrease.
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	r.add(name, &funcMetric{name, help, "counter", fn})
+}
+
+// funcVecMetric reads one value per label at scrape time
+type funcVecMetric struct {
+	name, help, label string
+	fn                func() map[string]float64
+}
+
+func (m *funcVecMetric) write(w *bufio.Writer) {
+	values := m.fn()
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	header(w, m.name, m.help, "gauge")
+	for _, k := range keys {
+		sample(w, m.name, m.label+`="`+escapeLabel(k)+`"`, values[k])
+	}
+}
+
+// GaugeVecFunc is GaugeFunc split by one label, e.g. agents by status.
+func (r *Registry) GaugeVecFunc(name, help, label string, fn func() map[string]float64) {
+	r.add(name, &funcVecMetric{name, help, label, fn})
+}
+
+// --- Histogram ---
+
+// Histogram counts observations into buckets
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64 // Upper bounds, ascending
+	counts  []uint64  // Per bucket, not cumulative; the last is +Inf
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &Histogram{buckets: b, counts: make([]uint64, len(b)+1)}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v) // First bound >= v
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+func (h *Histogram) write(w *bufio.Writer, name, labels string) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum := h.sum
+	h.mu.Unlock()
+
+	var cum uint64
+	for i, le := range h.buckets {
+		cum += counts[i]
+		sample(w, name+"_bucket", joinLabels(labels, `le="`+formatFloat(le)+`"`), float64(cum))
+	}
+	cum += counts[len(h.buckets)]
+	sample(w, name+"_bucket", joinLabels(labels, `le="+Inf"`), float64(cum))
+	sample(w, name+"_sum", labels, sum)
+	sample(w, name+"_count", labels, float64(cum))
+}
+
+type histogramMetric struct {
+	name, help string
+	h          *Histogram
+}
+
+func (m *histogramMetric) write(w *bufio.Writer) {
+	header(w, m.name, m.help, "histogram")
+	m.h.write(w, m.name, "")
+}
+
+func (r *Registry) Histogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	r.add(name, &histogramMetric{name, help, h})
+	return h
+}
+
+// --- Vectors (one label) ---
+
+// vec lazily creates one child per label value
+type vec[T any] struct {
+	name, help, typ, label string
+	mu                     sync.Mutex
+	children               map[string]*T
+	newChild               func() *T
+	writeChild             func(w *bufio.Writer, name, labels string, c *T)
+}
+
+func (v *vec[T]) with(value string) *T {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.children[value]
+	if !ok {
+		c = v.newChild()
+		v.children[value] = c
+	}
+	return c
+}
+
+func (v *vec[T]) write(w *bufio.Writer) {
+	v.mu.Lock()
+	values := make([]string, 0, len(v.children))
+	for k := range v.children {
+		values = append(values, k)
+	}
+	v.mu.Unlock()
+	sort.Strings(values)
+
+	header(w, v.name, v.help, v.typ)
+	for _, val := range values {
+		v.writeChild(w, v.name, v.label+`="`+escapeLabel(val)+`"`, v.with(val))
+	}
+}
+
+// CounterVec is a counter split by one label
+type CounterVec struct{ v *vec[Counter] }
+
+func (c *CounterVec) With(value string) *Counter { return c.v.with(value) }
+
+func (r *Registry) CounterVec(name, help, label string) *CounterVec {
+	v := &vec[Counter]{
+		name: name, help: help, typ: "counter", label: label,
+		children: make(map[string]*Counter),
+		newChild: func() *Counter { return &Counter{} },
+		writeChild: func(w *bufio.Writer, name, labels string, c *Counter) {
+			sample(w, name, labels, c.Value())
+		},
+	}
+	r.add(name, v)
+	return &CounterVec{v}
+}
+
+// HistogramVec is a histogram split by one label
+type HistogramVec struct{ v *vec[Histogram] }
+
+func (h *HistogramVec) With(value string) *Histogram { return h.v.with(value) }
+
+func (r *Registry) HistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	v := &vec[Histogram]{
+		name: name, help: help, typ: "histogram", label: label,
+		children: make(map[string]*Histogram),
+		newChild: func() *Histogram { return newHistogram(buckets) },
+		writeChild: func(w *bufio.Writer, name, labels string, h *Histogram) {
+			h.write(w, name, labels)
+		},
+	}
+	r.add(name, v)
+	return &HistogramVec{v}
+}
+
+// --- Runtime ---
+
+// runtimeMetric reads the memory stats once per scrape
+type runtimeMetric struct{}
+
+func (runtimeMetric) write(w *bufio.Writer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	header(w, "go_goroutines", "Number of goroutines that currently exist.", "gauge")
+	sample(w, "go_goroutines", "", float64(runtime.NumGoroutine()))
+	for _, g := range []struct {
+		name, help string
+		v          uint64
+	}{
+		{"go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", ms.Alloc},
+		{"go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", ms.HeapInuse},
+		{"go_memstats_sys_bytes", "Number of bytes obtained from system.", ms.Sys},
+	} {
+		header(w, g.name, g.help, "gauge")
+		sample(w, g.name, "", float64(g.v))
+	}
+	header(w, "go_gc_cycles_total", "Number of completed GC cycles.", "counter")
+	sample(w, "go_gc_cycles_total", "", float64(ms.NumGC))
+}
+
+// RegisterRuntime adds goroutine and memory stats under the names the
+// official Go client uses, so existing dashboards work.
+func (r *Registry) RegisterRuntime() {
+	r.add("go_runtime", runtimeMetric{})
+}
+
+// --- Exposition ---
+
+func header(w *bufio.Writer, name, help, typ string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sample(w *bufio.Writer, name, labels string, v float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	sent := r.Counter("xdr_sent_total", "Alerts sent.")
+	depth := r.Gauge("xdr_queue_depth", "Alerts waiting.")
+	rules := r.CounterVec("xdr_rule_matches_total", "Matches per rule.", "rule")
+	latency := r.Histogram("xdr_send_seconds", "Send latency.", []float64{0.1, 1})
+	scans := r.HistogramVec("xdr_scan_seconds", "Scan time.", "monitor", []float64{1})
+	r.GaugeFunc("xdr_spool_bytes", "Spool size.", func() float64 { return 2048 })
+
+	sent.Add(3)
+	depth.Set(7)
+	depth.Dec()
+	rules.With("xdr-002").Inc()
+	rules.With("xdr-001").Add(2)
+	rules.With(`odd"name`).Inc()
+	latency.Observe(0.05)
+	latency.Observe(0.1) // Bounds are inclusive
+	latency.Observe(3)
+	scans.With("integrity").Observe(0.5)
+
+	var b strings.Builder
+	if err := r.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP xdr_sent_total Alerts sent.
+# TYPE xdr_sent_total counter
+xdr_sent_total 3
+# HELP xdr_queue_depth Alerts waiting.
+# TYPE xdr_queue_depth gauge
+xdr_queue_depth 6
+# HELP xdr_rule_matches_total Matches per rule.
+# TYPE xdr_rule_matches_total counter
+xdr_rule_matches_total{rule="odd\"name"} 1
+xdr_rule_matches_total{rule="xdr-001"} 2
+xdr_rule_matches_total{rule="xdr-002"} 1
+# HELP xdr_send_seconds Send latency.
+# TYPE xdr_send_seconds histogram
+xdr_send_seconds_bucket{le="0.1"} 2
+xdr_send_seconds_bucket{le="1"} 2
+xdr_send_seconds_bucket{le="+Inf"} 3
+xdr_send_seconds_sum 3.15
+xdr_send_seconds_count 3
+# HELP xdr_scan_seconds Scan time.
+# TYPE xdr_scan_seconds histogram
+xdr_scan_seconds_bucket{monitor="integrity",le="1"} 1
+xdr_scan_seconds_bucket{monitor="integrity",le="+Inf"} 1
+xdr_scan_seconds_sum{monitor="integrity"} 0.5
+xdr_scan_seconds_count{monitor="integrity"} 1
+# HELP xdr_spool_bytes Spool size.
+# TYPE xdr_spool_bytes gauge
+xdr_spool_bytes 2048
+`
+	if b.String() != want {
+		t.Errorf("exposition:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestDuplicateNamePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice didn't panic")
+		}
+	}()
+	r := NewRegistry()
+	r.Counter("x_total", "")
+	r.Gauge("x_total", "")
+}
@@ -0,0 +1,952 @@
+// Package raft replicates a log of commands across a small cluster of
+// nodes with the Raft consensus algorithm: leader election, log
+// replication, and snapshots for followers that fall too far behind. A
+// command is applied to every node's state machine in the same order once
+// a majority has stored it.
+//
+// Nodes talk through a Transport. InmemNetwork connects nodes inside one
+// process (with partitions, for tests); HTTPTransport and Node.Handler
+// carry the same RPCs between servers.
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoLeader means the node doesn't know of a leader it can reach,
+	// e.g. during an election or on the minority side of a partition.
+	ErrNoLeader = errors.New("raft: no leader")
+	// ErrNotLeader is returned by a follower asked to append a command
+	ErrNotLeader = errors.New("raft: not the leader")
+	// ErrLost means the command was overwritten by a new leader before it
+	// committed. Proposing it again is safe.
+	ErrLost = errors.New("raft: command lost in a leader change")
+	// ErrUnknown means the command's slot was committed but its result is
+	// gone, e.g. because it arrived in a snapshot. It may or may not have
+	// been applied.
+	ErrUnknown = errors.New("raft: command outcome unknown")
+	// ErrStopped is returned once the node has been stopped
+	ErrStopped = errors.New("raft: node stopped")
+)
+
+// Role is a node's part in the current term
+type Role string
+
+const (
+	Follower  Role = "follower"
+	Candidate Role = "candidate"
+	Leader    Role = "leader"
+)
+
+// Defaults for the zero values in Config
+const (
+	DefaultElectionTimeout   = 1 * time.Second
+	DefaultHeartbeatInterval = 100 * time.Millisecond
+	DefaultSnapshotThreshold = 1024
+)
+
+const (
+	maxAppendBatch = 256  // Entries per AppendEntries
+	maxResults     = 4096 // Apply results kept for waiting proposers
+)
+
+// Entry is one slot of the replicated log. Entries with no Data are the
+// no-ops a new leader appends to commit its term; they never reach the FSM.
+type Entry struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+// FSM is the replicated state machine. Apply and Snapshot are called from a
+// single goroutine, never concurrently with each other or with Restore.
+type FSM interface {
+	Apply(data []byte) any
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
+
+// Config describes one node and its cluster
+type Config struct {
+	ID    string
+	Peers []string // IDs of every node in the cluster, this one included
+
+	// ElectionTimeout is the silence after which a follower stands for
+	// election. Each node waits a random time between one and two timeouts.
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+
+	// SnapshotThreshold is how many applied entries the log keeps before
+	// they are folded into a snapshot.
+	SnapshotThreshold int
+
+	Logger *slog.Logger
+}
+
+// Status is a point-in-time view of a node, for /cluster and tests
+type Status struct {
+	ID            string `json:"id"`
+	Role          Role   `json:"role"`
+	Term          uint64 `json:"term"`
+	Leader        string `json:"leader,omitempty"`
+	LastIndex     uint64 `json:"last_index"`
+	CommitIndex   uint64 `json:"commit_index"`
+	AppliedIndex  uint64 `json:"applied_index"`
+	SnapshotIndex uint64 `json:"snapshot_index"`
+	Peers         []Peer `json:"peers,omitempty"` // Leader only
+}
+
+// Peer is the leader's view of a follower
+type Peer struct {
+	ID          string    `json:"id"`
+	MatchIndex  uint64    `json:"match_index"`
+	LastContact time.Time `json:"last_contact"`
+}
+
+type applyResult struct {
+	term uint64
+	val  any
+}
+
+// Node is one member of a cluster
+type Node struct {
+	cfg    Config
+	peers  []string // The other nodes
+	fsm    FSM
+	trans  Transport
+	store  Storage
+	logger *slog.Logger
+
+	mu        sync.Mutex
+	role      Role
+	term      uint64
+	vote      string
+	leader    string
+	log       []Entry // log[0] stands for the snapshot: its index and term, no data
+	snapshot  []byte
+	restore   []byte // Snapshot from the leader the applier hasn't restored yet
+	commit    uint64
+	applied   uint64
+	deadline  time.Time // Election timeout
+	next      map[string]uint64
+	match     map[string]uint64
+	contact   map[string]time.Time
+	inflight  map[string]bool
+	results   map[uint64]applyResult
+	appliedCh chan struct{} // Closed and replaced whenever applied moves
+
+	commitCh chan struct{} // Wakes the applier
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewNode loads the node's saved state from store, restoring the FSM from
+// its snapshot if there is one. Call Start to join the cluster.
+func NewNode(cfg Config, fsm FSM, trans Transport, store Storage) (*Node, error) {
+	if cfg.ID == "" {
+		return nil, errors.New("raft: node needs an ID")
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = DefaultElectionTimeout
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if cfg.SnapshotThreshold <= 0 {
+		cfg.SnapshotThreshold = DefaultSnapshotThreshold
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	n := &Node{
+		cfg:       cfg,
+		fsm:       fsm,
+		trans:     trans,
+		store:     store,
+		logger:    cfg.Logger.With("node", cfg.ID),
+		role:      Follower,
+		log:       []Entry{{}},
+		results:   make(map[uint64]applyResult),
+		appliedCh: make(chan struct{}),
+		commitCh:  make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}
+	for _, p := range cfg.Peers {
+		if p != cfg.ID {
+			n.peers = append(n.peers, p)
+		}
+	}
+
+	hs, entries, snap, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("raft: loading state: %w", err)
+	}
+	n.term, n.vote = hs.Term, hs.Vote
+	if snap.Index > 0 {
+		if err := fsm.Restore(snap.Data); err != nil {
+			return nil, fmt.Errorf("raft: restoring snapshot: %w", err)
+		}
+		n.log[0] = Entry{Index: snap.Index, Term: snap.Term}
+		n.snapshot = snap.Data
+		n.commit, n.applied = snap.Index, snap.Index
+	}
+	for _, e := range entries {
+		if e.Index == n.lastIndex()+1 {
+			n.log = append(n.log, e)
+		}
+	}
+	return n, nil
+}
+
+// ID returns the node's ID.
+func (n *Node) ID() string { return n.cfg.ID }
+
+// Start runs the election timer, heartbeats and the applier.
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.resetDeadline()
+	n.mu.Unlock()
+	n.wg.Add(2)
+	go n.tickLoop()
+	go n.applyLoop()
+}
+
+// Stop halts the node. It stops answering RPCs and proposals fail with
+// ErrStopped.
+func (n *Node) Stop() {
+	n.mu.Lock()
+	n.haltLocked()
+	n.mu.Unlock()
+	n.wg.Wait()
+}
+
+// haltLocked tells the node's loops to stop, without waiting for them.
+// Callers hold mu.
+func (n *Node) haltLocked() {
+	if n.stopped() {
+		return
+	}
+	close(n.stop)
+	n.role, n.leader = Follower, ""
+}
+
+func (n *Node) stopped() bool {
+	select {
+	case <-n.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Status reports the node's role, term and log positions.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	st := Status{
+		ID:            n.cfg.ID,
+		Role:          n.role,
+		Term:          n.term,
+		Leader:        n.leader,
+		LastIndex:     n.lastIndex(),
+		CommitIndex:   n.commit,
+		AppliedIndex:  n.applied,
+		SnapshotIndex: n.log[0].Index,
+	}
+	if n.role == Leader {
+		for _, p := range n.peers {
+			st.Peers = append(st.Peers, Peer{ID: p, MatchIndex: n.match[p], LastContact: n.contact[p]})
+		}
+	}
+	return st
+}
+
+// IsLeader reports whether the node currently leads the cluster.
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == Leader
+}
+
+// --- Log ---
+
+func (n *Node) lastIndex() uint64 { return n.log[len(n.log)-1].Index }
+func (n *Node) lastTerm() uint64  { return n.log[len(n.log)-1].Term }
+
+// termAt returns the term of the entry at i, if the log still has it.
+// The snapshot's last entry counts.
+func (n *Node) termAt(i uint64) (uint64, bool) {
+	if i < n.log[0].Index || i > n.lastIndex() {
+		return 0, false
+	}
+	return n.log[i-n.log[0].Index].Term, true
+}
+
+// entriesFrom copies up to max entries starting at index i.
+func (n *Node) entriesFrom(i uint64, max int) []Entry {
+	rest := n.log[i-n.log[0].Index:]
+	return append([]Entry(nil), rest[:min(len(rest), max)]...)
+}
+
+func (n *Node) quorum() int { return (len(n.peers)+1)/2 + 1 }
+
+// setTerm moves to a newer term as a follower, with no vote cast yet.
+// An error means the term isn't on disk, and the caller mustn't answer
+// anyone in it.
+func (n *Node) setTerm(term uint64) error {
+	if n.role == Leader {
+		n.logger.Info("Stepping down", "term", term)
+	}
+	n.term, n.vote, n.role = term, "", Follower
+	return n.persistState()
+}
+
+func (n *Node) persistState() error {
+	err := n.store.SaveState(HardState{Term: n.term, Vote: n.vote})
+	if err != nil {
+		n.logger.Error("Failed to save raft state", "error", err)
+	}
+	return err
+}
+
+func (n *Node) resetDeadline() {
+	timeout := n.cfg.ElectionTimeout
+	n.deadline = time.Now().Add(timeout + rand.N(timeout))
+}
+
+// --- Proposals ---
+
+// Propose replicates data and returns what the FSM's Apply returned for it
+// on this node. A follower forwards the command to the leader and waits
+// until it has applied it too, so reads from this node see the change.
+func (n *Node) Propose(ctx context.Context, data []byte) (any, error) {
+	if len(data) == 0 {
+		return nil, errors.New("raft: empty command")
+	}
+	n.mu.Lock()
+	if n.stopped() {
+		n.mu.Unlock()
+		return nil, ErrStopped
+	}
+	var index, term uint64
+	if n.role == Leader {
+		var err error
+		index, term, err = n.appendLocked(data)
+		n.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		leader := n.leader
+		n.mu.Unlock()
+		if leader == "" {
+			return nil, ErrNoLeader
+		}
+		resp, err := n.trans.Forward(ctx, leader, ForwardRequest{Data: data})
+		if err != nil {
+			return nil, fmt.Errorf("%w: forwarding to %s: %v", ErrNoLeader, leader, err)
+		}
+		if resp.Error != "" {
+			return nil, fmt.Errorf("%w: %s", ErrNoLeader, resp.Error)
+		}
+		index, term = resp.Index, resp.Term
+	}
+	return n.wait(ctx, index, term)
+}
+
+// appendLocked adds a command to the leader's log and starts replicating
+// it. The leader counts itself towards the commit, so an entry it couldn't
+// store is dropped. Callers hold mu.
+func (n *Node) appendLocked(data []byte) (uint64, uint64, error) {
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term, Data: data}
+	if err := n.store.Append([]Entry{e}); err != nil {
+		n.logger.Error("Failed to save raft log", "error", err)
+		return 0, 0, fmt.Errorf("raft: saving the log: %w", err)
+	}
+	n.log = append(n.log, e)
+	n.advanceCommit() // A cluster of one commits straight away
+	n.broadcast()
+	return e.Index, e.Term, nil
+}
+
+// wait blocks until the entry at index is applied on this node.
+func (n *Node) wait(ctx context.Context, index, term uint64) (any, error) {
+	for {
+		n.mu.Lock()
+		if n.applied >= index {
+			r, ok := n.results[index]
+			n.mu.Unlock()
+			switch {
+			case !ok:
+				return nil, ErrUnknown
+			case r.term != term:
+				return nil, ErrLost
+			}
+			return r.val, nil
+		}
+		ch := n.appliedCh
+		n.mu.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-n.stop:
+			return nil, ErrStopped
+		}
+	}
+}
+
+// --- Timers ---
+
+func (n *Node) tickLoop() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		switch {
+		case n.role == Leader && !n.hasQuorumContact():
+			// Cut off from the majority, which has likely moved on. Step
+			// down so clients go elsewhere instead of waiting on us.
+			n.logger.Warn("Lost contact with the majority, stepping down", "term", n.term)
+			n.role, n.leader = Follower, ""
+			n.resetDeadline()
+		case n.role == Leader:
+			n.broadcast()
+		case time.Now().After(n.deadline):
+			n.campaign()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// hasQuorumContact reports whether the leader heard from a majority within
+// the last election timeout. Callers hold mu.
+func (n *Node) hasQuorumContact() bool {
+	heard := 1
+	for _, p := range n.peers {
+		if time.Since(n.contact[p]) < n.cfg.ElectionTimeout {
+			heard++
+		}
+	}
+	return heard >= n.quorum()
+}
+
+// --- Elections ---
+
+// campaign starts an election for the next term. Callers hold mu.
+func (n *Node) campaign() {
+	n.resetDeadline()
+	n.term++
+	n.role, n.vote, n.leader = Candidate, n.cfg.ID, ""
+	if n.persistState() != nil {
+		// The vote for ourselves isn't on disk; after a restart we could
+		// cast another in this term. Try again next timeout.
+		n.term--
+		n.role, n.vote = Follower, ""
+		return
+	}
+	n.logger.Info("Starting election", "term", n.term)
+
+	req := VoteRequest{Term: n.term, Candidate: n.cfg.ID, LastIndex: n.lastIndex(), LastTerm: n.lastTerm()}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, p := range n.peers {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+			defer cancel()
+			resp, err := n.trans.RequestVote(ctx, p, req)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.setTerm(resp.Term)
+				n.resetDeadline()
+				return
+			}
+			if n.role != Candidate || n.term != req.Term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+// becomeLeader takes over the cluster. The no-op entry commits the new
+// term, which also commits whatever earlier leaders left behind. Callers
+// hold mu.
+func (n *Node) becomeLeader() {
+	n.role, n.leader = Leader, n.cfg.ID
+	n.next = make(map[string]uint64)
+	n.match = make(map[string]uint64)
+	n.contact = make(map[string]time.Time)
+	n.inflight = make(map[string]bool)
+	now := time.Now()
+	for _, p := range n.peers {
+		n.next[p] = n.lastIndex() + 1
+		n.contact[p] = now // Grace period before check-quorum kicks in
+	}
+	n.logger.Info("Elected leader", "term", n.term)
+
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term}
+	if err := n.store.Append([]Entry{e}); err != nil {
+		// Without the no-op this term can't commit anything; let another
+		// node lead
+		n.logger.Error("Failed to save raft log", "error", err)
+		n.role, n.leader = Follower, ""
+		return
+	}
+	n.log = append(n.log, e)
+	n.advanceCommit()
+	n.broadcast()
+}
+
+// HandleVote answers a candidate's RequestVote.
+func (n *Node) HandleVote(req VoteRequest) VoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped() {
+		return VoteResponse{Term: n.term}
+	}
+	if req.Term > n.term {
+		n.leader = ""
+		if n.setTerm(req.Term) != nil {
+			return VoteResponse{Term: n.term}
+		}
+	}
+	if req.Term < n.term {
+		return VoteResponse{Term: n.term}
+	}
+
+	upToDate := req.LastTerm > n.lastTerm() ||
+		(req.LastTerm == n.lastTerm() && req.LastIndex >= n.lastIndex())
+	if (n.vote == "" || n.vote == req.Candidate) && upToDate {
+		prev := n.vote
+		n.vote = req.Candidate
+		if n.persistState() != nil {
+			n.vote = prev
+			return VoteResponse{Term: n.term}
+		}
+		n.resetDeadline()
+		return VoteResponse{Term: n.term, Granted: true}
+	}
+	return VoteResponse{Term: n.term}
+}
+
+// --- Replication ---
+
+// broadcast sends each follower what it's missing, or a heartbeat. A
+// follower that still has a request in flight is skipped; it gets the
+// rest when that one returns. Callers hold mu.
+func (n *Node) broadcast() {
+	for _, p := range n.peers {
+		if n.inflight[p] {
+			continue
+		}
+		n.inflight[p] = true
+		go n.replicate(p, n.term)
+	}
+}
+
+// replicate brings one follower up to date, sending a snapshot if the log
+// no longer reaches back far enough.
+func (n *Node) replicate(peer string, term uint64) {
+	defer func() {
+		n.mu.Lock()
+		n.inflight[peer] = false
+		n.mu.Unlock()
+	}()
+
+	for {
+		n.mu.Lock()
+		if n.role != Leader || n.term != term || n.stopped() {
+			n.mu.Unlock()
+			return
+		}
+		next := n.next[peer]
+		if next <= n.log[0].Index {
+			req := SnapshotRequest{Term: n.term, Leader: n.cfg.ID, Index: n.log[0].Index, LastTerm: n.log[0].Term, Data: n.snapshot}
+			n.mu.Unlock()
+			if !n.sendSnapshot(peer, req) {
+				return
+			}
+			continue
+		}
+
+		prevTerm, _ := n.termAt(next - 1)
+		req := AppendRequest{
+			Term:         n.term,
+			Leader:       n.cfg.ID,
+			PrevIndex:    next - 1,
+			PrevTerm:     prevTerm,
+			Entries:      n.entriesFrom(next, maxAppendBatch),
+			LeaderCommit: n.commit,
+		}
+		n.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+		resp, err := n.trans.AppendEntries(ctx, peer, req)
+		cancel()
+		if err != nil {
+			return
+		}
+
+		n.mu.Lock()
+		if resp.Term > n.term {
+			n.setTerm(resp.Term)
+			n.resetDeadline()
+			n.mu.Unlock()
+			return
+		}
+		if n.role != Leader || n.term != term {
+			n.mu.Unlock()
+			return
+		}
+		n.contact[peer] = time.Now()
+		if !resp.Success && resp.ConflictIndex == 0 {
+			n.mu.Unlock()
+			return // Refused without saying why, e.g. it's shutting down
+		}
+		if !resp.Success {
+			n.next[peer] = max(1, min(resp.ConflictIndex, n.next[peer]-1))
+			n.mu.Unlock()
+			continue
+		}
+		matched := req.PrevIndex + uint64(len(req.Entries))
+		if matched > n.match[peer] {
+			n.match[peer] = matched
+		}
+		n.next[peer] = matched + 1
+		n.advanceCommit()
+		done := n.next[peer] > n.lastIndex()
+		n.mu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+// sendSnapshot installs the leader's snapshot on a follower and reports
+// whether replication should carry on.
+func (n *Node) sendSnapshot(peer string, req SnapshotRequest) bool {
+	n.logger.Info("Sending snapshot", "peer", peer, "index", req.Index, "bytes", len(req.Data))
+	ctx, cancel := context.WithTimeout(context.Background(), 4*n.cfg.ElectionTimeout)
+	resp, err := n.trans.InstallSnapshot(ctx, peer, req)
+	cancel()
+	if err != nil {
+		n.logger.Warn("Snapshot not delivered", "peer", peer, "error", err)
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.setTerm(resp.Term)
+		n.resetDeadline()
+		return false
+	}
+	if n.role != Leader || n.term != req.Term || !resp.Success {
+		return false
+	}
+	n.contact[peer] = time.Now()
+	n.match[peer] = max(n.match[peer], req.Index)
+	n.next[peer] = req.Index + 1
+	return true
+}
+
+// advanceCommit commits the highest entry of this term a majority has
+// stored. Entries from earlier terms commit along with it. Callers hold mu.
+func (n *Node) advanceCommit() {
+	for i := n.lastIndex(); i > n.commit; i-- {
+		if t, _ := n.termAt(i); t != n.term {
+			break
+		}
+		count := 1
+		for _, p := range n.peers {
+			if n.match[p] >= i {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.setCommit(i)
+			return
+		}
+	}
+}
+
+func (n *Node) setCommit(i uint64) {
+	if i <= n.commit {
+		return
+	}
+	n.commit = i
+	select {
+	case n.commitCh <- struct{}{}:
+	default:
+	}
+}
+
+// HandleAppend answers the leader's AppendEntries, which doubles as its
+// heartbeat.
+func (n *Node) HandleAppend(req AppendRequest) AppendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped() || req.Term < n.term {
+		return AppendResponse{Term: n.term}
+	}
+	if n.followLocked(req.Term, req.Leader) != nil {
+		return AppendResponse{Term: n.term}
+	}
+
+	// Entries the snapshot already covers are committed, so they match
+	if req.PrevIndex < n.log[0].Index {
+		skip := n.log[0].Index - req.PrevIndex
+		if uint64(len(req.Entries)) <= skip {
+			return AppendResponse{Term: n.term, Success: true}
+		}
+		req.Entries = req.Entries[skip:]
+		req.PrevIndex, req.PrevTerm = n.log[0].Index, n.log[0].Term
+	}
+
+	if req.PrevIndex > n.lastIndex() {
+		return AppendResponse{Term: n.term, ConflictIndex: n.lastIndex() + 1}
+	}
+	if t, _ := n.termAt(req.PrevIndex); t != req.PrevTerm {
+		// Skip back over the whole conflicting term in one go
+		i := req.PrevIndex
+		for i > n.log[0].Index+1 {
+			if prev, _ := n.termAt(i - 1); prev != t {
+				break
+			}
+			i--
+		}
+		return AppendResponse{Term: n.term, ConflictIndex: i}
+	}
+
+	for k, e := range req.Entries {
+		if t, ok := n.termAt(e.Index); ok {
+			if t == e.Term {
+				continue
+			}
+			// A stale entry from a deposed leader, drop it and all after
+			log := append(slices.Clip(n.log[:e.Index-n.log[0].Index]), req.Entries[k:]...)
+			if err := n.store.Rewrite(log[1:]); err != nil {
+				// Nothing acked that isn't on disk; the leader retries
+				n.logger.Error("Failed to save raft log", "error", err)
+				return AppendResponse{Term: n.term}
+			}
+			n.log = log
+			break
+		}
+		if err := n.store.Append(req.Entries[k:]); err != nil {
+			n.logger.Error("Failed to save raft log", "error", err)
+			return AppendResponse{Term: n.term}
+		}
+		n.log = append(n.log, req.Entries[k:]...)
+		break
+	}
+
+	last := req.PrevIndex + uint64(len(req.Entries))
+	n.setCommit(min(req.LeaderCommit, last))
+	return AppendResponse{Term: n.term, Success: true}
+}
+
+// followLocked accepts leader as the leader of term. It fails if a newer
+// term couldn't be saved. Callers hold mu.
+func (n *Node) followLocked(term uint64, leader string) error {
+	if term > n.term {
+		if err := n.setTerm(term); err != nil {
+			return err
+		}
+	}
+	if n.leader != leader {
+		n.logger.Info("Following leader", "leader", leader, "term", term)
+	}
+	n.role, n.leader = Follower, leader
+	n.resetDeadline()
+	return nil
+}
+
+// HandleSnapshot answers InstallSnapshot. The snapshot replaces the log up
+// to its index; the applier restores it into the FSM.
+func (n *Node) HandleSnapshot(req SnapshotRequest) AppendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped() || req.Term < n.term {
+		return AppendResponse{Term: n.term}
+	}
+	if n.followLocked(req.Term, req.Leader) != nil {
+		return AppendResponse{Term: n.term}
+	}
+	if req.Index <= n.log[0].Index || req.Index <= n.applied {
+		return AppendResponse{Term: n.term, Success: true}
+	}
+
+	// Keep what follows the snapshot if our log agrees with it up to there
+	var rest []Entry
+	if t, ok := n.termAt(req.Index); ok && t == req.LastTerm {
+		rest = n.log[req.Index-n.log[0].Index+1:]
+	}
+	log := append([]Entry{{Index: req.Index, Term: req.LastTerm}}, rest...)
+	if err := n.store.SaveSnapshot(Snapshot{Index: req.Index, Term: req.LastTerm, Data: req.Data}, log[1:]); err != nil {
+		n.logger.Error("Failed to save snapshot", "error", err)
+		return AppendResponse{Term: n.term}
+	}
+	n.log = log
+	n.snapshot, n.restore = req.Data, req.Data
+	n.logger.Info("Installing snapshot from leader", "leader", req.Leader, "index", req.Index)
+	if req.Index > n.commit {
+		n.commit = req.Index
+	}
+	select {
+	case n.commitCh <- struct{}{}:
+	default:
+	}
+	return AppendResponse{Term: n.term, Success: true}
+}
+
+// HandleForward appends a follower's proposal to the leader's log. It
+// doesn't wait for the commit; the follower does that on its own log.
+func (n *Node) HandleForward(req ForwardRequest) ForwardResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped() || n.role != Leader {
+		return ForwardResponse{Error: ErrNotLeader.Error()}
+	}
+	if len(req.Data) == 0 {
+		return ForwardResponse{Error: "empty command"}
+	}
+	index, term, err := n.appendLocked(req.Data)
+	if err != nil {
+		return ForwardResponse{Error: err.Error()}
+	}
+	return ForwardResponse{Index: index, Term: term}
+}
+
+// --- Applying ---
+
+// applyLoop feeds committed entries to the FSM in log order and compacts
+// the log once enough of them have been applied.
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.commitCh:
+		}
+
+		n.mu.Lock()
+		if snap := n.restore; snap != nil {
+			index, term := n.log[0].Index, n.log[0].Term
+			n.restore = nil
+			n.mu.Unlock()
+			if err := n.fsm.Restore(snap); err != nil {
+				// The state is now neither the snapshot's nor what it
+				// was. Serving it would diverge from the cluster.
+				n.logger.Error("Failed to restore snapshot, stopping", "index", index, "error", err)
+				n.mu.Lock()
+				n.haltLocked()
+				n.mu.Unlock()
+				return
+			}
+			n.mu.Lock()
+			n.applied = max(n.applied, index)
+			n.results[index] = applyResult{term: term}
+			n.notifyApplied()
+		}
+		var batch []Entry
+		if n.commit > n.applied && n.applied >= n.log[0].Index {
+			batch = n.log[n.applied+1-n.log[0].Index : n.commit+1-n.log[0].Index]
+			batch = append([]Entry(nil), batch...)
+		}
+		n.mu.Unlock()
+
+		for _, e := range batch {
+			var val any
+			if e.Data != nil {
+				val = n.fsm.Apply(e.Data)
+			}
+			n.mu.Lock()
+			if n.restore != nil || e.Index != n.applied+1 {
+				n.mu.Unlock()
+				break // A snapshot from the leader supersedes the rest
+			}
+			n.applied = e.Index
+			n.results[e.Index] = applyResult{term: e.Term, val: val}
+			delete(n.results, e.Index-maxResults)
+			n.notifyApplied()
+			n.mu.Unlock()
+		}
+		if len(batch) > 0 {
+			n.maybeSnapshot()
+			// More may have committed while we were applying
+			select {
+			case n.commitCh <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// notifyApplied wakes everyone waiting on an apply. Callers hold mu.
+func (n *Node) notifyApplied() {
+	close(n.appliedCh)
+	n.appliedCh = make(chan struct{})
+}
+
+// maybeSnapshot folds the applied part of the log into a snapshot once it
+// passes the threshold. Runs on the applier, so the FSM is quiet.
+func (n *Node) maybeSnapshot() {
+	n.mu.Lock()
+	index := n.applied
+	if index-n.log[0].Index < uint64(n.cfg.SnapshotThreshold) || n.restore != nil {
+		n.mu.Unlock()
+		return
+	}
+	term, _ := n.termAt(index)
+	n.mu.Unlock()
+
+	data, err := n.fsm.Snapshot()
+	if err != nil {
+		n.logger.Error("Failed to snapshot state", "error", err)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if index <= n.log[0].Index {
+		return // A snapshot from the leader got there first
+	}
+	// The entries are only dropped once the snapshot is on disk
+	log := append([]Entry{{Index: index, Term: term}}, n.log[index-n.log[0].Index+1:]...)
+	if err := n.store.SaveSnapshot(Snapshot{Index: index, Term: term, Data: data}, log[1:]); err != nil {
+		n.logger.Error("Failed to save snapshot", "error", err)
+		return
+	}
+	n.log, n.snapshot = log, data
+	n.logger.Debug("Compacted log", "index", index, "bytes", len(data))
+}
@@ -0,0 +1,484 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listFSM appends every command to a list
+type listFSM struct {
+	mu       sync.Mutex
+	items    []string
+	restores int
+}
+
+func (f *listFSM) Apply(data []byte) any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.items = append(f.items, string(data))
+	return len(f.items)
+}
+
+func (f *listFSM) Snapshot() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return json.Marshal(f.items)
+}
+
+func (f *listFSM) Restore(data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.restores++
+	f.items = nil
+	return json.Unmarshal(data, &f.items)
+}
+
+func (f *listFSM) list() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.items)
+}
+
+type testCluster struct {
+	t     *testing.T
+	net   *InmemNetwork
+	nodes map[string]*Node
+	fsms  map[string]*listFSM
+}
+
+func newTestCluster(t *testing.T, size, snapshotThreshold int) *testCluster {
+	t.Helper()
+	c := &testCluster{t: t, net: NewInmemNetwork(), nodes: map[string]*Node{}, fsms: map[string]*listFSM{}}
+	var ids []string
+	for i := 1; i <= size; i++ {
+		ids = append(ids, fmt.Sprintf("n%d", i))
+	}
+	for _, id := range ids {
+		fsm := &listFSM{}
+		n, err := NewNode(Config{
+			ID:                id,
+			Peers:             ids,
+			ElectionTimeout:   50 * time.Millisecond,
+			HeartbeatInterval: 10 * time.Millisecond,
+			SnapshotThreshold: snapshotThreshold,
+			Logger:            slog.New(slog.NewTextHandler(io.Discard, nil)),
+		}, fsm, c.net.Transport(id), NewMemoryStorage())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.net.Add(n)
+		c.nodes[id], c.fsms[id] = n, fsm
+	}
+	for _, n := range c.nodes {
+		n.Start()
+	}
+	t.Cleanup(func() {
+		for _, n := range c.nodes {
+			n.Stop()
+		}
+	})
+	return c
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// leader waits for exactly one leader among the nodes not in skip.
+func (c *testCluster) leader(skip ...string) *Node {
+	c.t.Helper()
+	var found *Node
+	eventually(c.t, "a single leader", func() bool {
+		found = nil
+		leaders := 0
+		for id, n := range c.nodes {
+			if !slices.Contains(skip, id) && n.IsLeader() {
+				found = n
+				leaders++
+			}
+		}
+		return leaders == 1
+	})
+	return found
+}
+
+func (c *testCluster) follower(leader *Node) *Node {
+	for _, n := range c.nodes {
+		if n != leader {
+			return n
+		}
+	}
+	return nil
+}
+
+func (c *testCluster) propose(n *Node, cmd string) any {
+	c.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		v, err := n.Propose(ctx, []byte(cmd))
+		if errors.Is(err, ErrNoLeader) && ctx.Err() == nil {
+			time.Sleep(10 * time.Millisecond) // Mid-election
+			continue
+		}
+		if err != nil {
+			c.t.Fatalf("propose %q on %s: %v", cmd, n.ID(), err)
+		}
+		return v
+	}
+}
+
+// converged waits until every node in ids has applied want.
+func (c *testCluster) converged(want []string, ids ...string) {
+	c.t.Helper()
+	if len(ids) == 0 {
+		for id := range c.nodes {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		eventually(c.t, id+" to catch up", func() bool { return slices.Equal(c.fsms[id].list(), want) })
+	}
+}
+
+func TestReplication(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+
+	if got := c.propose(leader, "a"); got != 1 {
+		t.Errorf("Apply result on the leader = %v, want 1", got)
+	}
+	// A follower forwards to the leader and returns once it applied too
+	f := c.follower(leader)
+	if got := c.propose(f, "b"); got != 2 {
+		t.Errorf("Apply result on the follower = %v, want 2", got)
+	}
+	if got := c.fsms[f.ID()].list(); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("follower state right after its proposal = %v", got)
+	}
+	c.converged([]string{"a", "b"})
+}
+
+func TestLeaderFailover(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	old := c.leader()
+	c.propose(old, "before")
+
+	c.net.Disconnect(old.ID())
+	leader := c.leader(old.ID())
+	c.propose(leader, "after")
+
+	// The old leader can't reach a majority, so it steps down rather than
+	// take proposals it could never commit
+	eventually(t, "the cut-off leader to step down", func() bool { return !old.IsLeader() })
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := old.Propose(ctx, []byte("lost")); err == nil {
+		t.Error("a partitioned node committed a proposal")
+	}
+
+	c.net.Reconnect(old.ID())
+	c.converged([]string{"before", "after"})
+}
+
+func TestPartitionedNodeCatchesUpFromSnapshot(t *testing.T) {
+	c := newTestCluster(t, 3, 10)
+	leader := c.leader()
+	lagging := c.follower(leader)
+	c.net.Disconnect(lagging.ID())
+
+	var want []string
+	for i := range 50 {
+		cmd := fmt.Sprint(i)
+		c.propose(leader, cmd)
+		want = append(want, cmd)
+	}
+	if st := leader.Status(); st.SnapshotIndex == 0 {
+		t.Fatalf("leader didn't compact its log: %+v", st)
+	}
+
+	c.net.Reconnect(lagging.ID())
+	c.converged(want)
+	fsm := c.fsms[lagging.ID()]
+	fsm.mu.Lock()
+	restores := fsm.restores
+	fsm.mu.Unlock()
+	if restores == 0 {
+		t.Error("the lagging node replayed the log instead of installing a snapshot")
+	}
+
+	// And it keeps up normally afterwards
+	c.propose(c.leader(), "next")
+	c.converged(append(want, "next"))
+}
+
+func TestRestartFromFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	start := func() (*Node, *listFSM, *FileStorage) {
+		store, err := OpenFileStorage(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsm := &listFSM{}
+		nw := NewInmemNetwork()
+		n, err := NewNode(Config{
+			ID:                "solo",
+			Peers:             []string{"solo"},
+			ElectionTimeout:   20 * time.Millisecond,
+			HeartbeatInterval: 5 * time.Millisecond,
+			SnapshotThreshold: 5,
+			Logger:            logger,
+		}, fsm, nw.Transport("solo"), store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nw.Add(n)
+		n.Start()
+		return n, fsm, store
+	}
+
+	n, _, store := start()
+	var want []string
+	for i := range 12 {
+		cmd := fmt.Sprint(i)
+		eventually(t, "leadership", n.IsLeader)
+		if _, err := n.Propose(context.Background(), []byte(cmd)); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, cmd)
+	}
+	before := n.Status()
+	n.Stop()
+	store.Close()
+
+	n, fsm, store := start()
+	defer store.Close()
+	defer n.Stop()
+	eventually(t, "the log to be replayed", func() bool { return slices.Equal(fsm.list(), want) })
+	if st := n.Status(); st.Term <= before.Term || st.SnapshotIndex == 0 {
+		t.Errorf("after restart %+v, before %+v", st, before)
+	}
+}
+
+func TestFileStorageTornTail(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Append([]Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	// A crash mid-write leaves half a line, here one that even parses
+	for _, torn := range []string{`{"index":3,"te`, `{"index":3,"term":1}`} {
+		f, err := os.OpenFile(filepath.Join(dir, "log.ndjson"), os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(torn)
+		f.Close()
+
+		reopened, err := OpenFileStorage(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, entries, _, err := reopened.Load(); err != nil || len(entries) != 2 {
+			t.Fatalf("Load with a torn tail %q = %d entries, %v; want 2", torn, len(entries), err)
+		}
+		if err := reopened.Append([]Entry{{Index: 3, Term: 2}}); err != nil {
+			t.Fatal(err)
+		}
+		_, entries, _, err := reopened.Load()
+		reopened.Close()
+		if err != nil || len(entries) != 3 || entries[2].Term != 2 {
+			t.Fatalf("after appending past a torn tail: %+v, %v", entries, err)
+		}
+		// Back to two whole entries for the next case
+		if err := reopened.Rewrite(entries[:2]); err != nil {
+			t.Fatal(err)
+		}
+		reopened.Close()
+	}
+}
+
+// brokenStorage fails every write while broken is set, and snapshots
+// alone while noSnapshots is.
+type brokenStorage struct {
+	*MemoryStorage
+	broken      bool
+	noSnapshots bool
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (b *brokenStorage) SaveState(hs HardState) error {
+	if b.broken {
+		return errDiskFull
+	}
+	return b.MemoryStorage.SaveState(hs)
+}
+
+func (b *brokenStorage) Append(entries []Entry) error {
+	if b.broken {
+		return errDiskFull
+	}
+	return b.MemoryStorage.Append(entries)
+}
+
+func (b *brokenStorage) Rewrite(entries []Entry) error {
+	if b.broken {
+		return errDiskFull
+	}
+	return b.MemoryStorage.Rewrite(entries)
+}
+
+func (b *brokenStorage) SaveSnapshot(snap Snapshot, entries []Entry) error {
+	if b.broken || b.noSnapshots {
+		return errDiskFull
+	}
+	return b.MemoryStorage.SaveSnapshot(snap, entries)
+}
+
+// TestPersistBeforeReply checks a node that can't write says no: no vote,
+// no ack, no proposal, since it would forget all of them on a restart.
+func TestPersistBeforeReply(t *testing.T) {
+	store := &brokenStorage{MemoryStorage: NewMemoryStorage()}
+	nw := NewInmemNetwork()
+	n, err := NewNode(Config{
+		ID:     "n1",
+		Peers:  []string{"n1", "n2"},
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}, &listFSM{}, nw.Transport("n1"), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.broken = true
+	if resp := n.HandleVote(VoteRequest{Term: 2, Candidate: "n2"}); resp.Granted {
+		t.Error("vote granted without saving it")
+	}
+	entries := []Entry{{Index: 1, Term: 2, Data: []byte("x")}}
+	if resp := n.HandleAppend(AppendRequest{Term: 2, Leader: "n2", Entries: entries}); resp.Success || n.lastIndex() != 0 {
+		t.Errorf("append acked without saving it: %+v, last index %d", resp, n.lastIndex())
+	}
+	if resp := n.HandleSnapshot(SnapshotRequest{Term: 2, Leader: "n2", Index: 5, LastTerm: 2, Data: []byte("[]")}); resp.Success || n.log[0].Index != 0 {
+		t.Errorf("snapshot acked without saving it: %+v", resp)
+	}
+
+	store.broken = false
+	if resp := n.HandleVote(VoteRequest{Term: 2, Candidate: "n2"}); !resp.Granted {
+		t.Error("vote refused once the disk is back")
+	}
+	if resp := n.HandleAppend(AppendRequest{Term: 2, Leader: "n2", Entries: entries}); !resp.Success {
+		t.Errorf("append refused once the disk is back: %+v", resp)
+	}
+	hs, saved, _, _ := store.Load()
+	if hs != (HardState{Term: 2, Vote: "n2"}) || len(saved) != 1 {
+		t.Errorf("saved %+v and %d entries", hs, len(saved))
+	}
+
+	// A leader that can't store a proposal fails it
+	n.mu.Lock()
+	n.term++
+	n.becomeLeader()
+	store.broken = true
+	_, _, err = n.appendLocked([]byte("y"))
+	last := n.lastIndex()
+	n.mu.Unlock()
+	if !errors.Is(err, errDiskFull) || last != 2 {
+		t.Errorf("appendLocked on a broken disk = %v, last index %d; want an error and no entry", err, last)
+	}
+}
+
+// TestSnapshotKeptUntilSaved checks the log isn't compacted into a
+// snapshot that never reached the disk: a restart would lose the entries.
+func TestSnapshotKeptUntilSaved(t *testing.T) {
+	store := &brokenStorage{MemoryStorage: NewMemoryStorage(), noSnapshots: true}
+	c := &testCluster{t: t, net: NewInmemNetwork(), nodes: map[string]*Node{}, fsms: map[string]*listFSM{}}
+	fsm := &listFSM{}
+	n, err := NewNode(Config{
+		ID:                "n1",
+		Peers:             []string{"n1"},
+		ElectionTimeout:   50 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+		SnapshotThreshold: 2,
+		Logger:            slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}, fsm, c.net.Transport("n1"), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.nodes["n1"], c.fsms["n1"] = n, fsm
+	n.Start()
+	t.Cleanup(n.Stop)
+
+	c.leader()
+	for _, cmd := range []string{"a", "b", "c"} {
+		c.propose(n, cmd)
+	}
+	if st := n.Status(); st.SnapshotIndex != 0 {
+		t.Errorf("snapshot index %d after failed saves, want 0", st.SnapshotIndex)
+	}
+	_, entries, _, _ := store.Load()
+	if len(entries) != 4 { // The leader's no-op and three commands
+		t.Errorf("%d entries on disk, want 4", len(entries))
+	}
+
+	store.noSnapshots = false
+	c.propose(n, "d")
+	eventually(t, "a snapshot", func() bool { return n.Status().SnapshotIndex > 0 })
+	_, _, snap, _ := store.Load()
+	if snap.Index != n.Status().SnapshotIndex {
+		t.Errorf("snapshot at %d on disk, %d in memory", snap.Index, n.Status().SnapshotIndex)
+	}
+}
+
+// TestFailedRestoreStops checks a node whose FSM can't take the leader's
+// snapshot stops, instead of serving a state that matches nobody's.
+func TestFailedRestoreStops(t *testing.T) {
+	nw := NewInmemNetwork()
+	n, err := NewNode(Config{
+		ID:              "n1",
+		Peers:           []string{"n1", "n2"},
+		ElectionTimeout: time.Minute,
+		Logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}, &listFSM{}, nw.Transport("n1"), NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Start()
+	t.Cleanup(n.Stop)
+
+	if resp := n.HandleSnapshot(SnapshotRequest{Term: 2, Leader: "n2", Index: 5, LastTerm: 2, Data: []byte("not json")}); !resp.Success {
+		t.Fatalf("snapshot refused: %+v", resp)
+	}
+	eventually(t, "the node to stop", func() bool {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return n.stopped()
+	})
+	if st := n.Status(); st.AppliedIndex != 0 {
+		t.Errorf("applied index %d after a failed restore, want 0", st.AppliedIndex)
+	}
+	if _, err := n.Propose(context.Background(), []byte("x")); !errors.Is(err, ErrStopped) {
+		t.Errorf("Propose on a stopped node = %v, want ErrStopped", err)
+	}
+}
@@ -0,0 +1,291 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// HardState must survive a restart: a node that forgot its vote could vote
+// twice in one term.
+type HardState struct {
+	Term uint64 `json:"term"`
+	Vote string `json:"vote,omitempty"`
+}
+
+// Snapshot is the FSM's state as of Index
+type Snapshot struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data"`
+}
+
+// Storage keeps a node's term, vote, log and latest snapshot. Every write
+// must be durable before it returns.
+type Storage interface {
+	Load() (HardState, []Entry, Snapshot, error)
+	SaveState(HardState) error
+	Append(entries []Entry) error
+	// Rewrite replaces the entries after the snapshot, e.g. after a
+	// conflicting suffix was dropped.
+	Rewrite(entries []Entry) error
+	// SaveSnapshot stores snap and the entries that follow it.
+	SaveSnapshot(snap Snapshot, entries []Entry) error
+}
+
+// --- Memory ---
+
+// MemoryStorage keeps everything in memory. A node restarted from the same
+// MemoryStorage comes back as if from disk, which is what tests need.
+type MemoryStorage struct {
+	mu      sync.Mutex
+	state   HardState
+	entries []Entry
+	snap    Snapshot
+}
+
+func NewMemoryStorage() *MemoryStorage { return &MemoryStorage{} }
+
+func (m *MemoryStorage) Load() (HardState, []Entry, Snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state, slices.Clone(m.entries), m.snap, nil
+}
+
+func (m *MemoryStorage) SaveState(hs HardState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state = hs
+	return nil
+}
+
+func (m *MemoryStorage) Append(entries []Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, entries...)
+	return nil
+}
+
+func (m *MemoryStorage) Rewrite(entries []Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = slices.Clone(entries)
+	return nil
+}
+
+func (m *MemoryStorage) SaveSnapshot(snap Snapshot, entries []Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snap, m.entries = snap, slices.Clone(entries)
+	return nil
+}
+
+// --- Files ---
+
+// FileStorage keeps a node's state in a directory: state.json, the log as
+// NDJSON, and snapshot.json. Appends are synced; everything else is
+// replaced atomically.
+type FileStorage struct {
+	dir string
+	mu  sync.Mutex
+	log *os.File
+}
+
+// OpenFileStorage creates dir if needed.
+func OpenFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStorage{dir: dir}, nil
+}
+
+func (f *FileStorage) path(name string) string { return filepath.Join(f.dir, name) }
+
+func (f *FileStorage) Load() (HardState, []Entry, Snapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var hs HardState
+	var snap Snapshot
+	if err := readJSON(f.path("state.json"), &hs); err != nil {
+		return hs, nil, snap, err
+	}
+	if err := readJSON(f.path("snapshot.json"), &snap); err != nil {
+		return hs, nil, snap, err
+	}
+
+	var entries []Entry
+	file, err := os.OpenFile(f.path("log.ndjson"), os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return hs, nil, snap, nil
+	}
+	if err != nil {
+		return hs, nil, snap, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	var good int64 // End of the last whole entry
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break // A line without its newline is torn too, even if it parses
+		}
+		if err != nil {
+			return hs, nil, snap, err
+		}
+		var e Entry
+		if json.Unmarshal(line, &e) != nil {
+			break
+		}
+		good += int64(len(line))
+		if e.Index > snap.Index {
+			entries = append(entries, e)
+		}
+	}
+
+	// Cut off a torn write from a crash, or the next Append is glued to it
+	// and lost on the following restart
+	if info, err := file.Stat(); err != nil {
+		return hs, nil, snap, err
+	} else if info.Size() > good {
+		if err := file.Truncate(good); err != nil {
+			return hs, nil, snap, err
+		}
+		if err := file.Sync(); err != nil {
+			return hs, nil, snap, err
+		}
+	}
+	return hs, entries, snap, nil
+}
+
+func (f *FileStorage) SaveState(hs HardState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return writeJSON(f.path("state.json"), hs)
+}
+
+func (f *FileStorage) Append(entries []Entry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.log == nil {
+		file, err := os.OpenFile(f.path("log.ndjson"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		f.log = file
+	}
+	w := bufio.NewWriter(f.log)
+	for _, e := range entries {
+		if err := json.NewEncoder(w).Encode(e); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.log.Sync()
+}
+
+func (f *FileStorage) Rewrite(entries []Entry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rewriteLocked(entries)
+}
+
+func (f *FileStorage) SaveSnapshot(snap Snapshot, entries []Entry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := writeJSON(f.path("snapshot.json"), snap); err != nil {
+		return err
+	}
+	return f.rewriteLocked(entries)
+}
+
+// rewriteLocked replaces the log file. Callers hold mu.
+func (f *FileStorage) rewriteLocked(entries []Entry) error {
+	if f.log != nil {
+		f.log.Close()
+		f.log = nil
+	}
+	tmp := f.path("log.ndjson.tmp")
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path("log.ndjson"))
+}
+
+// Close releases the open log file.
+func (f *FileStorage) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.log == nil {
+		return nil
+	}
+	err := f.log.Close()
+	f.log = nil
+	return err
+}
+
+func readJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeJSON replaces path atomically and syncs it.
+func writeJSON(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,253 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// ErrUnreachable is returned by InmemNetwork for a node that's partitioned
+// off or not on the network
+var ErrUnreachable = errors.New("raft: peer unreachable")
+
+// VoteRequest asks for a vote in an election
+type VoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// AppendRequest carries log entries from the leader; with none it's a
+// heartbeat
+type AppendRequest struct {
+	Term         uint64  `json:"term"`
+	Leader       string  `json:"leader"`
+	PrevIndex    uint64  `json:"prev_index"`
+	PrevTerm     uint64  `json:"prev_term"`
+	Entries      []Entry `json:"entries,omitempty"`
+	LeaderCommit uint64  `json:"leader_commit"`
+}
+
+// AppendResponse answers AppendEntries and InstallSnapshot. On a mismatch
+// ConflictIndex says where the leader should retry from.
+type AppendResponse struct {
+	Term          uint64 `json:"term"`
+	Success       bool   `json:"success"`
+	ConflictIndex uint64 `json:"conflict_index,omitempty"`
+}
+
+// SnapshotRequest replaces a lagging follower's state with the leader's
+type SnapshotRequest struct {
+	Term     uint64 `json:"term"`
+	Leader   string `json:"leader"`
+	Index    uint64 `json:"index"`     // Last entry the snapshot covers
+	LastTerm uint64 `json:"last_term"` // and its term
+	Data     []byte `json:"data"`
+}
+
+// ForwardRequest hands a follower's proposal to the leader
+type ForwardRequest struct {
+	Data []byte `json:"data"`
+}
+
+// ForwardResponse says where the leader put the command
+type ForwardResponse struct {
+	Index uint64 `json:"index,omitempty"`
+	Term  uint64 `json:"term,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Transport delivers RPCs to other nodes by ID
+type Transport interface {
+	RequestVote(ctx context.Context, to string, req VoteRequest) (VoteResponse, error)
+	AppendEntries(ctx context.Context, to string, req AppendRequest) (AppendResponse, error)
+	InstallSnapshot(ctx context.Context, to string, req SnapshotRequest) (AppendResponse, error)
+	Forward(ctx context.Context, to string, req ForwardRequest) (ForwardResponse, error)
+}
+
+// --- In memory ---
+
+// InmemNetwork connects nodes in one process. Nodes can be cut off and
+// reconnected to simulate partitions.
+type InmemNetwork struct {
+	mu    sync.RWMutex
+	nodes map[string]*Node
+	cut   map[string]bool
+}
+
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{nodes: make(map[string]*Node), cut: make(map[string]bool)}
+}
+
+// Transport returns the endpoint the node with this ID sends from.
+func (nw *InmemNetwork) Transport(id string) Transport {
+	return &inmemTransport{nw: nw, from: id}
+}
+
+// Add puts a node on the network so it can receive RPCs.
+func (nw *InmemNetwork) Add(n *Node) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.nodes[n.ID()] = n
+}
+
+// Disconnect partitions a node from all the others.
+func (nw *InmemNetwork) Disconnect(id string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.cut[id] = true
+}
+
+// Reconnect heals a node's partition.
+func (nw *InmemNetwork) Reconnect(id string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	delete(nw.cut, id)
+}
+
+func (nw *InmemNetwork) route(from, to string) (*Node, error) {
+	nw.mu.RLock()
+	defer nw.mu.RUnlock()
+	n, ok := nw.nodes[to]
+	if !ok || nw.cut[from] || nw.cut[to] {
+		return nil, ErrUnreachable
+	}
+	return n, nil
+}
+
+type inmemTransport struct {
+	nw   *InmemNetwork
+	from string
+}
+
+// call delivers one RPC, failing like a network would if the context ends
+// or the partition appears before the reply.
+func call[Req, Resp any](ctx context.Context, t *inmemTransport, to string, req Req, handle func(*Node, Req) Resp) (Resp, error) {
+	var zero Resp
+	n, err := t.nw.route(t.from, to)
+	if err != nil {
+		return zero, err
+	}
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	resp := handle(n, req)
+	if _, err := t.nw.route(t.from, to); err != nil {
+		return zero, err
+	}
+	return resp, nil
+}
+
+func (t *inmemTransport) RequestVote(ctx context.Context, to string, req VoteRequest) (VoteResponse, error) {
+	return call(ctx, t, to, req, (*Node).HandleVote)
+}
+
+func (t *inmemTransport) AppendEntries(ctx context.Context, to string, req AppendRequest) (AppendResponse, error) {
+	return call(ctx, t, to, req, (*Node).HandleAppend)
+}
+
+func (t *inmemTransport) InstallSnapshot(ctx context.Context, to string, req SnapshotRequest) (AppendResponse, error) {
+	return call(ctx, t, to, req, (*Node).HandleSnapshot)
+}
+
+func (t *inmemTransport) Forward(ctx context.Context, to string, req ForwardRequest) (ForwardResponse, error) {
+	return call(ctx, t, to, req, (*Node).HandleForward)
+}
+
+// --- HTTP ---
+
+// HTTPTransport sends RPCs as JSON POSTs to each peer's /raft/ endpoints,
+// served by Node.Handler. Key, if set, goes in X-Raft-Key.
+type HTTPTransport struct {
+	Addrs  map[string]string // Node ID to base URL
+	Key    string
+	Client *http.Client
+}
+
+func (t *HTTPTransport) post(ctx context.Context, to, rpc string, req, resp any) error {
+	base, ok := t.Addrs[to]
+	if !ok {
+		return fmt.Errorf("raft: no address for %s", to)
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(ctx, "POST", base+"/raft/"+rpc, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if t.Key != "" {
+		r.Header.Set("X-Raft-Key", t.Key)
+	}
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("raft: %s %s returned %s", to, rpc, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+func (t *HTTPTransport) RequestVote(ctx context.Context, to string, req VoteRequest) (resp VoteResponse, err error) {
+	return resp, t.post(ctx, to, "vote", req, &resp)
+}
+
+func (t *HTTPTransport) AppendEntries(ctx context.Context, to string, req AppendRequest) (resp AppendResponse, err error) {
+	return resp, t.post(ctx, to, "append", req, &resp)
+}
+
+func (t *HTTPTransport) InstallSnapshot(ctx context.Context, to string, req SnapshotRequest) (resp AppendResponse, err error) {
+	return resp, t.post(ctx, to, "snapshot", req, &resp)
+}
+
+func (t *HTTPTransport) Forward(ctx context.Context, to string, req ForwardRequest) (resp ForwardResponse, err error) {
+	return resp, t.post(ctx, to, "forward", req, &resp)
+}
+
+// Handler serves the node's RPCs under /raft/. Requests without the
+// matching X-Raft-Key are refused when key is set.
+func (n *Node) Handler(key string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /raft/vote", serveRPC(n.HandleVote))
+	mux.HandleFunc("POST /raft/append", serveRPC(n.HandleAppend))
+	mux.HandleFunc("POST /raft/snapshot", serveRPC(n.HandleSnapshot))
+	mux.HandleFunc("POST /raft/forward", serveRPC(n.HandleForward))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Raft-Key")), []byte(key)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func serveRPC[Req, Resp any](handle func(Req) Resp) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req Req
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(handle(req))
+	}
+}
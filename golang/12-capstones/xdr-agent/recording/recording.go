@@ -0,0 +1,176 @@
+// Package recording captures what an XDR agent saw and sent as NDJSON, and
+// plays it back against a server with a simulated clock, so detections can
+// be reproduced without waiting on live monitors.
+package recording
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record kinds
+const (
+	KindAlert       = "alert"       // An alert as it left the agent
+	KindObservation = "observation" // Raw monitor input, alert or not
+)
+
+// Record is one line of a recording. Alert stays raw JSON so agent and
+// server can each decode it into their own Alert type.
+type Record struct {
+	Time   time.Time       `json:"time"`
+	Kind   string          `json:"kind"`
+	Source string          `json:"source"` // Monitor or component name
+	Alert  json.RawMessage `json:"alert,omitempty"`
+	Data   map[string]any  `json:"data,omitempty"`
+}
+
+// --- Writing ---
+
+// Writer appends records to an NDJSON stream. A nil *Writer is valid and
+// records nothing, so callers don't need to check whether recording is on.
+type Writer struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	Now func() time.Time
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{enc: json.NewEncoder(w), Now: time.Now}
+}
+
+// Alert records an alert. alert is anything that marshals to JSON.
+func (w *Writer) Alert(source string, alert any) error {
+	if w == nil {
+		return nil
+	}
+	raw, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	return w.write(Record{Kind: KindAlert, Source: source, Alert: raw})
+}
+
+// Observe records raw monitor input.
+func (w *Writer) Observe(source string, data map[string]any) error {
+	if w == nil {
+		return nil
+	}
+	return w.write(Record{Kind: KindObservation, Source: source, Data: data})
+}
+
+func (w *Writer) write(r Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r.Time = w.Now()
+	return w.enc.Encode(r)
+}
+
+// --- Reading ---
+
+// Read decodes a whole recording.
+func Read(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+func ReadFile(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// --- Replay ---
+
+// Clock is a simulated clock. The player moves it to each record's time
+// just before handing the record over.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// Player feeds records to a sink in order.
+type Player struct {
+	// Speed scales the gaps between records: 1 is original speed, 10 is
+	// ten times faster, 0 means no waiting at all.
+	Speed float64
+	// Sleep waits between records; defaults to a context-aware sleep.
+	Sleep func(ctx context.Context, d time.Duration) error
+}
+
+// Play advances clock to each record's time and passes the record to fn.
+// It stops at the first error from fn or when ctx is done.
+func (p Player) Play(ctx context.Context, records []Record, clock *Clock, fn func(Record) error) error {
+	sleep := p.Sleep
+	if sleep == nil {
+		sleep = sleepCtx
+	}
+
+	for i, rec := range records {
+		if p.Speed > 0 && i > 0 {
+			gap := rec.Time.Sub(records[i-1].Time)
+			if gap > 0 {
+				if err := sleep(ctx, time.Duration(float64(gap)/p.Speed)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if clock != nil {
+			clock.Set(rec.Time)
+		}
+		if err := fn(rec); err != nil {
+			return fmt.Errorf("record %d (%s at %s): %w", i+1, rec.Kind, rec.Time.Format(time.RFC3339Nano), err)
+		}
+	}
+	return nil
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,67 @@
+package recording
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWriteRead(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	w.Now = func() time.Time { return start }
+
+	w.Observe("process", map[string]any{"roll": 0.5})
+	w.Alert("queue", map[string]string{"event_type": "TEST"})
+
+	var nilWriter *Writer
+	if err := nilWriter.Alert("queue", "ignored"); err != nil {
+		t.Errorf("nil writer: %v", err)
+	}
+
+	records, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Kind != KindObservation || records[1].Kind != KindAlert {
+		t.Fatalf("records = %+v", records)
+	}
+	if string(records[1].Alert) != `{"event_type":"TEST"}` || !records[1].Time.Equal(start) {
+		t.Errorf("alert record = %+v", records[1])
+	}
+}
+
+func TestPlayerSpeedAndClock(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := []Record{
+		{Time: start, Kind: KindAlert},
+		{Time: start.Add(10 * time.Second), Kind: KindAlert},
+		{Time: start.Add(30 * time.Second), Kind: KindAlert},
+	}
+
+	var slept []time.Duration
+	clock := NewClock(time.Time{})
+	var seen []time.Time
+	p := Player{
+		Speed: 10,
+		Sleep: func(_ context.Context, d time.Duration) error { slept = append(slept, d); return nil },
+	}
+	err := p.Play(context.Background(), records, clock, func(r Record) error {
+		seen = append(seen, clock.Now())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(slept) != 2 || slept[0] != time.Second || slept[1] != 2*time.Second {
+		t.Errorf("slept %v; want [1s 2s] at 10x", slept)
+	}
+	for i, r := range records {
+		if !seen[i].Equal(r.Time) {
+			t.Errorf("clock at record %d = %v; want %v", i, seen[i], r.Time)
+		}
+	}
+}
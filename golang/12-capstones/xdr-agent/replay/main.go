@@ -0,0 +1,95 @@
+package main
+
+// replay feeds an agent recording (agent -record) to a server started with
+// -sim-clock. Each alert carries its recorded time in X-Replay-Time, so
+// detection windows behave as they did live even at -speed 100.
+//
+//	go run ./xdr-agent/replay -speed 10 session.ndjson
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"12-capstones/xdr-agent/recording"
+)
+
+func main() {
+	serverURL := flag.String("server", "http://localhost:9090", "XDR server base URL")
+	speed := flag.Float64("speed", 1, "Playback speed: 1 = original, 10 = ten times faster, 0 = no waiting")
+	verbose := flag.Bool("v", false, "Print every record, observations included")
+	apiKey := flag.String("api-key", os.Getenv("XDR_API_KEY"), "API key with the ingest permission (default $XDR_API_KEY)")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Println("Usage: replay [-server URL] [-speed N] recording.ndjson")
+		os.Exit(2)
+	}
+
+	records, err := recording.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	if len(records) == 0 {
+		fmt.Println("Recording is empty.")
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Printf("▶️  Replaying %d records spanning %s at %gx\n",
+		len(records), records[len(records)-1].Time.Sub(records[0].Time).Round(time.Second), *speed)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	sent := 0
+	player := recording.Player{Speed: *speed}
+	err = player.Play(ctx, records, nil, func(rec recording.Record) error {
+		if *verbose {
+			fmt.Printf("%s %-11s %-9s %s%v\n", rec.Time.Format(time.RFC3339), rec.Kind, rec.Source, rec.Alert, formatData(rec.Data))
+		}
+		if rec.Kind != recording.KindAlert {
+			return nil // Observations are context, the server never saw them
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "POST", *serverURL+"/audit", bytes.NewReader(rec.Alert))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Replay-Time", strconv.FormatInt(rec.Time.UnixNano(), 10))
+		if *apiKey != "" {
+			req.Header.Set("X-API-Key", *apiKey)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("server returned %s", resp.Status)
+		}
+		sent++
+		return nil
+	})
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("✅ Replayed %d alerts.\n", sent)
+}
+
+func formatData(data map[string]any) string {
+	if len(data) == 0 {
+		return ""
+	}
+	return fmt.Sprint(data)
+}
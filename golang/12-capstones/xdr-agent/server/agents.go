@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Agent states as seen by the server
+const (
+	AgentOnline  = "online"
+	AgentStopped = "stopped" // Sent AGENT_STOPPING, silence is expected
+	AgentLost    = "lost"    // Went silent without a clean shutdown
+)
+
+// Heartbeat is the periodic "still alive" ping from an agent
+type Heartbeat struct {
+	AgentID   string `json:"agent_id"`
+	Timestamp int64  `json:"timestamp"`
+	Version   string `json:"version,omitempty"` // Build the agent runs
+	Group     string `json:"group,omitempty"`   // For staged rollouts
+}
+
+type AgentInfo struct {
+	ID       string    `json:"id"`
+	Status   string    `json:"status"`
+	LastSeen time.Time `json:"last_seen"`
+	Version  string    `json:"version,omitempty"` // From the last heartbeat
+	Group    string    `json:"group,omitempty"`
+}
+
+// agentRegistry tracks when each agent was last heard from
+type agentRegistry struct {
+	mu     sync.Mutex
+	agents map[string]*AgentInfo
+}
+
+func newAgentRegistry() *agentRegistry {
+	return &agentRegistry{agents: make(map[string]*AgentInfo)}
+}
+
+// seen records any sign of life: a heartbeat or an alert.
+func (r *agentRegistry) seen(id string, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a, ok := r.agents[id]
+	if !ok {
+		a = &AgentInfo{ID: id}
+		r.agents[id] = a
+	}
+	a.LastSeen = now
+	a.Status = AgentOnline
+}
+
+// beat records a heartbeat and the build the agent says it runs.
+func (r *agentRegistry) beat(hb Heartbeat, now time.Time) {
+	r.seen(hb.AgentID, now)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a := r.agents[hb.AgentID]
+	a.Version, a.Group = hb.Version, hb.Group
+}
+
+// stopped marks a clean shutdown.
+func (r *agentRegistry) stopped(id string, now time.Time) {
+	r.seen(id, now)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.agents[id].Status = AgentStopped
+}
+
+// sweep marks online agents that have been silent for longer than timeout
+// as lost and returns the ones that changed on this call.
+func (r *agentRegistry) sweep(now time.Time, timeout time.Duration) []AgentInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var lost []AgentInfo
+	for _, a := range r.agents {
+		if a.Status == AgentOnline && now.Sub(a.LastSeen) > timeout {
+			a.Status = AgentLost
+			lost = append(lost, *a)
+		}
+	}
+	return lost
+}
+
+// restore replaces the registry with agents from a cluster snapshot.
+func (r *agentRegistry) restore(agents []AgentInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.agents = make(map[string]*AgentInfo, len(agents))
+	for _, a := range agents {
+		r.agents[a.ID] = &a
+	}
+}
+
+func (r *agentRegistry) list() []AgentInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]AgentInfo, 0, len(r.agents))
+	for _, a := range r.agents {
+		out = append(out, *a)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
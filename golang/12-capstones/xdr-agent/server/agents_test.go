@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestAgentRegistrySweep(t *testing.T) {
+	r := newAgentRegistry()
+	start := time.Now()
+	r.seen("killed", start)
+	r.stopped("clean", start)
+	r.seen("alive", start.Add(50*time.Second))
+
+	lost := r.sweep(start.Add(60*time.Second), 30*time.Second)
+	if len(lost) != 1 || lost[0].ID != "killed" {
+		t.Fatalf("sweep = %+v; want only 'killed'", lost)
+	}
+
+	// Already flagged agents aren't reported twice
+	if again := r.sweep(start.Add(90*time.Second), 30*time.Second); len(again) != 1 || again[0].ID != "alive" {
+		t.Fatalf("second sweep = %+v; want only 'alive'", again)
+	}
+
+	// A heartbeat brings a lost agent back
+	r.seen("killed", start.Add(95*time.Second))
+	for _, a := range r.list() {
+		if a.ID == "killed" && a.Status != AgentOnline {
+			t.Errorf("killed agent status = %s after heartbeat; want online", a.Status)
+		}
+	}
+}
+
+func TestLostAgentAlert(t *testing.T) {
+	s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	s.ingest(Alert{ID: "a1", AgentID: "web-1", EventType: "FILE_MODIFIED", Details: "/tmp/x modified"})
+
+	now = now.Add(heartbeatTimeout + time.Second)
+	s.sweepAgents()
+	s.sweepAgents()
+	td := s.tenant(defaultTenant)
+	incs := td.incidents.list()
+	if len(incs) != 1 || incs[0].AgentID != "web-1" || len(incs[0].Detections) != 1 || incs[0].Detections[0].RuleID != "xdr-010" {
+		t.Fatalf("incidents = %+v; want one xdr-010 detection for web-1", incs)
+	}
+	// The alert is the server's, not a sign of life
+	if agents := td.agents.list(); len(agents) != 1 || agents[0].Status != AgentLost {
+		t.Errorf("agents = %+v; want web-1 still lost", agents)
+	}
+}
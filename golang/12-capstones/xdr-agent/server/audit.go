@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errAuditWrite = errors.New("writing audit log")
+
+// FieldChange is one field edit recorded in the audit log
+type FieldChange struct {
+	Field string `json:"field"`
+	From  string `json:"from,omitempty"`
+	To    string `json:"to,omitempty"`
+}
+
+// AuditEntry is one record of the audit log. Each entry carries the hash
+// of the previous one, so editing or deleting a line breaks the chain.
+type AuditEntry struct {
+	Seq      int           `json:"seq"`
+	Time     time.Time     `json:"time"`
+	Tenant   string        `json:"tenant,omitempty"` // Empty in entries from before tenants
+	Actor    string        `json:"actor"`
+	Action   string        `json:"action"` // e.g. case.create, case.update, case.note
+	Target   string        `json:"target"` // e.g. CASE-0001
+	Changes  []FieldChange `json:"changes,omitempty"`
+	PrevHash string        `json:"prev_hash"`
+	Hash     string        `json:"hash"`
+}
+
+func (e AuditEntry) computeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditLog is append-only: entries are written to an NDJSON file (if
+// configured) and kept in memory for export. There is no way to change or
+// remove an entry.
+type auditLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries []AuditEntry
+}
+
+// openAuditLog continues the chain in path, or keeps the log in memory
+// only when path is empty.
+func openAuditLog(path string) (*auditLog, error) {
+	l := &auditLog{}
+	if path == "" {
+		return l, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for sc.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("audit log line %d: %w", len(l.entries)+1, err)
+		}
+		l.entries = append(l.entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if bad := verifyAuditChain(l.entries); bad >= 0 {
+		f.Close()
+		return nil, fmt.Errorf("audit log %s is broken at entry %d", path, bad+1)
+	}
+	l.file = f
+	return l, nil
+}
+
+func (l *auditLog) append(e AuditEntry) (AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Seq = len(l.entries) + 1
+	if n := len(l.entries); n > 0 {
+		e.PrevHash = l.entries[n-1].Hash
+	}
+	e.Hash = e.computeHash()
+	if l.file != nil {
+		line, _ := json.Marshal(e)
+		if _, err := l.file.Write(append(line, '\n')); err != nil {
+			return e, fmt.Errorf("%w: %v", errAuditWrite, err)
+		}
+	}
+	l.entries = append(l.entries, e)
+	return e, nil
+}
+
+// between returns the tenant's entries with from <= time < to, or every
+// tenant's when tenant is empty.
+func (l *auditLog) between(tenant string, from, to time.Time) []AuditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []AuditEntry{}
+	for _, e := range l.entries {
+		if tenant != "" && tenantOrDefault(e.Tenant) != tenant {
+			continue
+		}
+		if !e.Time.Before(from) && e.Time.Before(to) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// verifyAuditChain returns the index of the first entry whose hash or link
+// doesn't check out, or -1 if the chain is intact.
+func verifyAuditChain(entries []AuditEntry) int {
+	prev := ""
+	for i, e := range entries {
+		if e.Seq != i+1 || e.PrevHash != prev || e.Hash != e.computeHash() {
+			return i
+		}
+		prev = e.Hash
+	}
+	return -1
+}
+
+// --- Handlers ---
+
+// handleAuditExport serves GET /audit-log?from=&to=&format=ndjson|csv
+// Tenant admins get their tenant's entries; operators get everyone's, or
+// one tenant's with ?tenant=.
+func (s *server) handleAuditExport(w http.ResponseWriter, r *http.Request) {
+	p := s.principal(r)
+	tenant := p.Tenant
+	if p.operator() {
+		tenant = r.URL.Query().Get("tenant")
+	}
+	from, to := time.Unix(0, 0), time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, dst := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := r.URL.Query().Get(name); v != "" {
+			t, err := parseTimeParam(v)
+			if err != nil {
+				http.Error(w, name+": "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			*dst = t
+		}
+	}
+	entries := s.audit.between(tenant, from, to)
+
+	switch r.URL.Query().Get("format") {
+	case "", "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		for _, e := range entries {
+			enc.Encode(e)
+		}
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="xdr-audit.csv"`)
+		writeAuditCSV(w, entries)
+	default:
+		http.Error(w, "format must be ndjson or csv", http.StatusBadRequest)
+	}
+}
+
+// writeAuditCSV flattens entries to one row per field change.
+func writeAuditCSV(w io.Writer, entries []AuditEntry) {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"seq", "time", "tenant", "actor", "action", "target", "field", "from", "to", "hash"})
+	for _, e := range entries {
+		changes := e.Changes
+		if len(changes) == 0 {
+			changes = []FieldChange{{}}
+		}
+		for _, c := range changes {
+			cw.Write([]string{strconv.Itoa(e.Seq), e.Time.UTC().Format(time.RFC3339Nano), tenantOrDefault(e.Tenant), e.Actor, e.Action, e.Target, c.Field, c.From, c.To, e.Hash})
+		}
+	}
+	cw.Flush()
+}
+
+// handleAuditVerify checks the whole chain. It links every tenant's
+// entries, so only operators may run it.
+func (s *server) handleAuditVerify(w http.ResponseWriter, r *http.Request) {
+	if p := s.principal(r); !p.operator() {
+		s.denied(r, p, PermAuditExport, "not an operator")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	s.audit.mu.Lock()
+	entries := append([]AuditEntry(nil), s.audit.entries...)
+	s.audit.mu.Unlock()
+
+	res := map[string]any{"entries": len(entries), "intact": true}
+	if bad := verifyAuditChain(entries); bad >= 0 {
+		res["intact"] = false
+		res["first_bad_seq"] = bad + 1
+	}
+	writeJSON(w, res)
+}
@@ -0,0 +1,642 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles
+const (
+	RoleViewer    = "viewer"    // Read-only
+	RoleAnalyst   = "analyst"   // Works cases
+	RoleResponder = "responder" // Runs response actions on hosts
+	RoleAdmin     = "admin"
+	RoleAgent     = "agent" // Machine role for XDR agents, ingest only
+)
+
+// Permissions checked by the routes and handlers
+const (
+	PermRead           = "read"
+	PermIngest         = "ingest"
+	PermCasesWrite     = "cases.write"
+	PermBaselineAccept = "baseline.accept"
+	PermSuppress       = "suppressions.write"
+	PermHunt           = "hunts.write"    // Saved hunts; ad-hoc ones only need read
+	PermCommandsQueue  = "commands.queue" // Plus action.<name> for the action itself
+	PermAuditExport    = "audit.export"
+	PermFeedsReload    = "feeds.reload"
+	PermManageAccess   = "access.manage"
+	PermRulesWrite     = "rules.write"
+	PermReleases       = "releases.manage" // Agent builds and rollouts
+	PermReports        = "reports.manage"  // Scheduled reports, whose webhooks reach out from the server
+)
+
+// rolePermissions grants each role an explicit permission set. Admins get
+// everything, including ingest for testing.
+var rolePermissions = func() map[string][]string {
+	viewer := []string{PermRead}
+	analyst := append(slices.Clone(viewer), PermCasesWrite, PermBaselineAccept, PermSuppress, PermHunt, PermCommandsQueue, "action.ping")
+	responder := append(slices.Clone(analyst), "action.kill_process", "action.quarantine_file", "action.isolate_host")
+	admin := append(slices.Clone(responder), PermIngest, PermAuditExport, PermFeedsReload, PermManageAccess, PermRulesWrite, PermReleases, PermReports)
+	return map[string][]string{
+		RoleViewer:    viewer,
+		RoleAnalyst:   analyst,
+		RoleResponder: responder,
+		RoleAdmin:     admin,
+		RoleAgent:     {PermIngest},
+	}
+}()
+
+// How long a login token is valid
+const tokenTTL = time.Hour
+
+// Principal is whoever made a request
+type Principal struct {
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	Tenant string `json:"tenant"`
+	Via    string `json:"via"` // "token", "api_key" or "none" (-keyless-agents)
+}
+
+func (p Principal) can(perm string) bool {
+	return slices.Contains(rolePermissions[p.Role], perm)
+}
+
+// User logs in with a password
+type User struct {
+	Name         string `json:"name"`
+	PasswordHash string `json:"password_hash"` // bcrypt
+	Role         string `json:"role"`
+	Tenant       string `json:"tenant,omitempty"` // Empty is the default tenant
+}
+
+// APIKey authenticates agents and scripts. Only the key's SHA-256 is kept.
+// An agent's key is what puts its alerts in a tenant.
+type APIKey struct {
+	Name      string    `json:"name"`
+	KeySHA256 string    `json:"key_sha256"`
+	Role      string    `json:"role"`
+	Tenant    string    `json:"tenant,omitempty"` // Empty is the default tenant
+	Created   time.Time `json:"created"`
+}
+
+var errUnauthenticated = errors.New("missing or invalid credentials")
+
+// authStore holds users and API keys, persisted as one JSON file.
+type authStore struct {
+	mu     sync.RWMutex
+	path   string
+	secret []byte   // HS256 key for login tokens
+	Users  []User   `json:"users"`
+	Keys   []APIKey `json:"api_keys"`
+}
+
+// openAuthStore loads path, creating an empty store if it doesn't exist.
+// With an empty path the store is kept in memory.
+func openAuthStore(path string, secret []byte) (*authStore, error) {
+	s := &authStore{path: path, secret: secret}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// saveLocked writes the store atomically. Callers hold mu.
+func (s *authStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	data, _ := json.MarshalIndent(s, "", "  ")
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *authStore) empty() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.Users) == 0 && len(s.Keys) == 0
+}
+
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+var (
+	errOtherTenant = errors.New("name is taken in another tenant")
+	errNoAuth      = errors.New("authentication is disabled") // On a node started with -no-auth
+)
+
+// newUser checks a user and hashes their password.
+func newUser(name, password, role, tenant string) (User, error) {
+	if name == "" || len(password) < 12 || !validRole(role) || !validTenant(tenant) {
+		return User{}, fmt.Errorf("need a name, a password of 12+ characters, a known role and a valid tenant")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+	return User{Name: name, PasswordHash: string(hash), Role: role, Tenant: tenant}, nil
+}
+
+// addUser creates or replaces a user of the tenant.
+func (s *authStore) addUser(name, password, role, tenant string) error {
+	u, err := newUser(name, password, role, tenant)
+	if err != nil {
+		return err
+	}
+	return s.putUser(u)
+}
+
+// putUser stores a user made by newUser. A user of another tenant is
+// never replaced.
+func (s *authStore) putUser(u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.ContainsFunc(s.Users, func(x User) bool { return x.Name == u.Name && tenantOrDefault(x.Tenant) != tenantOrDefault(u.Tenant) }) {
+		return errOtherTenant
+	}
+	s.Users = slices.DeleteFunc(s.Users, func(x User) bool { return x.Name == u.Name })
+	s.Users = append(s.Users, u)
+	return s.saveLocked()
+}
+
+// newKey makes an API key: the plaintext to hand out, and the record that
+// keeps only its hash. This is the only time the plaintext key exists on
+// the server.
+func newKey(name, role, tenant string, now time.Time) (APIKey, string, error) {
+	if name == "" || !validRole(role) || !validTenant(tenant) {
+		return APIKey{}, "", fmt.Errorf("need a name, a known role and a valid tenant")
+	}
+	raw := make([]byte, 24)
+	rand.Read(raw)
+	key := "xdr_" + hex.EncodeToString(raw)
+	return APIKey{Name: name, KeySHA256: sha256Hex(key), Role: role, Tenant: tenant, Created: now}, key, nil
+}
+
+// addKey creates an API key and returns it.
+func (s *authStore) addKey(name, role, tenant string, now time.Time) (string, error) {
+	k, key, err := newKey(name, role, tenant, now)
+	if err != nil {
+		return "", err
+	}
+	return key, s.putKey(k)
+}
+
+// putKey stores a key made by newKey.
+func (s *authStore) putKey(k APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.ContainsFunc(s.Keys, func(x APIKey) bool { return x.Name == k.Name }) {
+		return fmt.Errorf("API key %q already exists", k.Name)
+	}
+	s.Keys = append(s.Keys, k)
+	return s.saveLocked()
+}
+
+// bootstrap stores the first admin key, and reports whether it did: it
+// doesn't once there is any user or key.
+func (s *authStore) bootstrap(k APIKey) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.Users) > 0 || len(s.Keys) > 0 {
+		return false, nil
+	}
+	s.Keys = append(s.Keys, k)
+	return true, s.saveLocked()
+}
+
+// deleteKey revokes a key of the tenant, or of any tenant when tenant is
+// empty.
+func (s *authStore) deleteKey(tenant, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.Keys)
+	s.Keys = slices.DeleteFunc(s.Keys, func(k APIKey) bool {
+		return k.Name == name && (tenant == "" || tenantOrDefault(k.Tenant) == tenant)
+	})
+	if len(s.Keys) == n {
+		return false, nil
+	}
+	return true, s.saveLocked()
+}
+
+// snapshot returns copies of the users and keys.
+func (s *authStore) snapshot() ([]User, []APIKey) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.Users), slices.Clone(s.Keys)
+}
+
+// restore replaces the users and keys, from a cluster snapshot.
+func (s *authStore) restore(users []User, keys []APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Users, s.Keys = slices.Clone(users), slices.Clone(keys)
+	return s.saveLocked()
+}
+
+// listKeys returns the tenant's keys, or every key when tenant is empty.
+func (s *authStore) listKeys(tenant string) []APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := []APIKey{}
+	for _, k := range s.Keys {
+		if tenant == "" || tenantOrDefault(k.Tenant) == tenant {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *authStore) checkKey(key string) (Principal, error) {
+	h := sha256Hex(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, k := range s.Keys {
+		if subtle.ConstantTimeCompare([]byte(k.KeySHA256), []byte(h)) == 1 {
+			return Principal{Name: k.Name, Role: k.Role, Tenant: tenantOrDefault(k.Tenant), Via: "api_key"}, nil
+		}
+	}
+	return Principal{}, errUnauthenticated
+}
+
+// login checks a password and issues a signed token.
+func (s *authStore) login(name, password string, now time.Time) (string, error) {
+	s.mu.RLock()
+	i := slices.IndexFunc(s.Users, func(u User) bool { return u.Name == name })
+	var u User
+	if i >= 0 {
+		u = s.Users[i]
+	}
+	s.mu.RUnlock()
+
+	if i < 0 || bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return "", errUnauthenticated
+	}
+	claims := jwt.MapClaims{
+		"username": u.Name,
+		"role":     u.Role,
+		"tenant":   tenantOrDefault(u.Tenant),
+		"exp":      now.Add(tokenTTL).Unix(),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.secret)
+}
+
+func (s *authStore) checkToken(tokenString string) (Principal, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		// Only accept the algorithm we sign with
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return s.secret, nil
+	})
+	if err != nil {
+		return Principal{}, errUnauthenticated
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return Principal{}, errUnauthenticated
+	}
+	name, _ := claims["username"].(string)
+	role, _ := claims["role"].(string)
+	tenant, _ := claims["tenant"].(string) // Tokens from before tenants have none
+	if name == "" || !validRole(role) {
+		return Principal{}, errUnauthenticated
+	}
+	return Principal{Name: name, Role: role, Tenant: tenantOrDefault(tenant), Via: "token"}, nil
+}
+
+// authenticate reads "Authorization: Bearer <token>" or "X-API-Key".
+func (s *authStore) authenticate(r *http.Request) (Principal, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return s.checkKey(key)
+	}
+	if tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		// Scrapers like Prometheus can only send a bearer token, so an API
+		// key is accepted there too
+		if strings.HasPrefix(tok, "xdr_") {
+			return s.checkKey(tok)
+		}
+		return s.checkToken(tok)
+	}
+	return Principal{}, errUnauthenticated
+}
+
+func applyPutUser(s *server, u User, now time.Time) (any, error) {
+	if s.auth == nil {
+		return nil, errNoAuth
+	}
+	return nil, s.auth.putUser(u)
+}
+
+func applyAddKey(s *server, k APIKey, now time.Time) (any, error) {
+	if s.auth == nil {
+		return nil, errNoAuth
+	}
+	return nil, s.auth.putKey(k)
+}
+
+func applyDeleteKey(s *server, ref storeRef, now time.Time) (any, error) {
+	if s.auth == nil {
+		return nil, errNoAuth
+	}
+	return s.auth.deleteKey(ref.Tenant, ref.ID)
+}
+
+func applyBootstrapKey(s *server, k APIKey, now time.Time) (any, error) {
+	if s.auth == nil {
+		return nil, errNoAuth
+	}
+	return s.auth.bootstrap(k)
+}
+
+// enableAuth loads the auth file and turns on checks. The token secret
+// comes from XDR_JWT_SECRET; without it tokens don't survive a restart,
+// and in a cluster they only work on the node that issued them.
+func (s *server) enableAuth(path string) error {
+	secret := []byte(os.Getenv("XDR_JWT_SECRET"))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		rand.Read(secret)
+		s.logger.Warn("XDR_JWT_SECRET not set, using a random secret; logins end on restart")
+	}
+	store, err := openAuthStore(path, secret)
+	if err != nil {
+		return err
+	}
+	s.auth = store
+	return nil
+}
+
+// bootstrapAuth creates an admin API key and prints it once, if there are
+// no users or keys in where. In a cluster the leader creates it through
+// the log, and only the node that made the key prints it; the others
+// return once it has reached them.
+func (s *server) bootstrapAuth(where string) error {
+	for s.auth.empty() {
+		if s.leader() {
+			k, key, err := newKey("bootstrap-admin", RoleAdmin, defaultTenant, s.now())
+			if err != nil {
+				return err
+			}
+			created, err := writeAs[bool](s, "auth.bootstrap", k)
+			if created {
+				// Straight to the terminal, never into the JSON log
+				fmt.Fprintf(os.Stderr, "No users or API keys in %s, created admin API key:\n\n  %s\n\nStore it now, it won't be shown again.\n", where, key)
+				return nil
+			}
+			if err != nil && !errors.Is(err, errNotCommitted) {
+				return err
+			}
+		}
+		time.Sleep(time.Second)
+	}
+	return nil
+}
+
+// --- Middleware ---
+
+type principalKey struct{}
+
+func principalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// require wraps a handler with authentication and a permission check.
+// With auth disabled (-no-auth) everything is allowed.
+func (s *server) require(perm string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.auth == nil {
+			h(w, r)
+			return
+		}
+		p, err := s.auth.authenticate(r)
+		if err != nil {
+			s.denied(r, Principal{}, perm, "unauthenticated")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="xdr"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !p.can(perm) {
+			s.denied(r, p, perm, "forbidden")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// requireAgent guards the HTTP endpoints agents post to. With
+// -keyless-agents, a request with no credentials at all counts as an
+// agent of the default tenant, so agents from before API keys keep
+// reporting until they have one. Wrong credentials still fail.
+func (s *server) requireAgent(h http.HandlerFunc) http.HandlerFunc {
+	keyed := s.require(PermIngest, h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.keyless && r.Header.Get("X-API-Key") == "" && r.Header.Get("Authorization") == "" {
+			p := Principal{Name: "keyless-agent", Role: RoleAgent, Tenant: defaultTenant, Via: "none"}
+			h(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+			return
+		}
+		keyed(w, r)
+	}
+}
+
+// authorize checks a second permission inside a handler, for decisions
+// that depend on the request body (e.g. the command action).
+func (s *server) authorize(w http.ResponseWriter, r *http.Request, perm string) bool {
+	if s.auth == nil {
+		return true
+	}
+	p, _ := principalFrom(r.Context())
+	if p.can(perm) {
+		return true
+	}
+	s.denied(r, p, perm, "forbidden")
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+// denied logs an access denial as a security event, so repeated failures
+// (guessing keys, probing admin endpoints) show up next to agent alerts.
+func (s *server) denied(r *http.Request, p Principal, perm, reason string) {
+	s.logDenied(p, perm, reason, r.Method, r.URL.Path, r.RemoteAddr)
+}
+
+func (s *server) logDenied(p Principal, perm, reason, method, path, remote string) {
+	s.logger.Warn("Access denied",
+		"event_type", "ACCESS_DENIED",
+		"reason", reason,
+		"principal", p.Name,
+		"role", p.Role,
+		"tenant", p.Tenant,
+		"permission", perm,
+		"method", method,
+		"path", path,
+		"remote", remote,
+	)
+}
+
+// --- Handlers ---
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (s *server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if s.auth == nil {
+		http.Error(w, "Authentication is disabled", http.StatusNotFound)
+		return
+	}
+	var req loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	token, err := s.auth.login(req.Username, req.Password, time.Now())
+	if err != nil {
+		s.denied(r, Principal{Name: req.Username}, "login", "bad password")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, map[string]any{"token": token, "expires_in": int(tokenTTL.Seconds())})
+}
+
+// accessTenant is the tenant a user or key is created in: the caller's
+// own, unless an operator names another one.
+func (s *server) accessTenant(w http.ResponseWriter, r *http.Request, asked string) (string, bool) {
+	p := s.principal(r)
+	if asked == "" || asked == p.Tenant {
+		return p.Tenant, true
+	}
+	if !p.operator() {
+		s.denied(r, p, PermManageAccess, "other tenant")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "", false
+	}
+	return asked, true
+}
+
+// scopeOf is the tenant whose keys the caller manages, or "" for every
+// tenant's.
+func (s *server) scopeOf(r *http.Request) string {
+	if p := s.principal(r); !p.operator() {
+		return p.Tenant
+	}
+	return ""
+}
+
+type userRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+	Tenant   string `json:"tenant"` // Operators only; default is the caller's
+}
+
+func (s *server) handleAddUser(w http.ResponseWriter, r *http.Request) {
+	var req userRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	tenant, ok := s.accessTenant(w, r, req.Tenant)
+	if !ok {
+		return
+	}
+	u, err := newUser(req.Name, req.Password, req.Role, tenant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, err = s.write("user.put", u)
+	if errors.Is(err, errOtherTenant) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if s.writeFailed(w, err, http.StatusBadRequest) {
+		return
+	}
+	s.logger.Info("User saved", "user", req.Name, "role", req.Role, "tenant", tenant, "by", analyst(r))
+	w.WriteHeader(http.StatusCreated)
+}
+
+type keyRequest struct {
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	Tenant string `json:"tenant"` // Operators only; default is the caller's
+}
+
+func (s *server) handleAddKey(w http.ResponseWriter, r *http.Request) {
+	var req keyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	tenant, ok := s.accessTenant(w, r, req.Tenant)
+	if !ok {
+		return
+	}
+	k, key, err := newKey(req.Name, req.Role, tenant, s.now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := s.write("key.add", k); s.writeFailed(w, err, http.StatusBadRequest) {
+		return
+	}
+	s.logger.Info("API key created", "name", req.Name, "role", req.Role, "tenant", tenant, "by", analyst(r))
+	writeJSONStatus(w, http.StatusCreated, map[string]string{"name": req.Name, "role": req.Role, "tenant": tenant, "key": key})
+}
+
+func (s *server) handleListKeys(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.auth.listKeys(s.scopeOf(r)))
+}
+
+func (s *server) handleDeleteKey(w http.ResponseWriter, r *http.Request) {
+	ok, err := writeAs[bool](s, "key.delete", storeRef{Tenant: s.scopeOf(r), ID: r.PathValue("name")})
+	if s.writeFailed(w, err, http.StatusInternalServerError) {
+		return
+	}
+	if !ok {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	s.logger.Info("API key revoked", "name", r.PathValue("name"), "by", analyst(r))
+	w.WriteHeader(http.StatusNoContent)
+}
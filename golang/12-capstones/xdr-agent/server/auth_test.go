@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newAuthServer returns a server with auth on and one API key per role.
+// Denials are logged to the returned buffer.
+func newAuthServer(t *testing.T) (*server, map[string]string, *bytes.Buffer) {
+	t.Helper()
+	var logs bytes.Buffer
+	s := newServer(slog.New(slog.NewJSONHandler(&logs, nil)))
+	store, err := openAuthStore("", []byte("test-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.auth = store
+
+	keys := make(map[string]string)
+	for _, role := range []string{RoleViewer, RoleAnalyst, RoleResponder, RoleAdmin, RoleAgent} {
+		key, err := store.addKey(role+"-key", role, defaultTenant, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[role] = key
+	}
+	return s, keys, &logs
+}
+
+func TestRolePermissions(t *testing.T) {
+	s, keys, logs := newAuthServer(t)
+	handler := s.routes()
+
+	kill := `{"action":"kill_process","args":{"pid":"4242"}}`
+	ping := `{"action":"ping"}`
+	tests := []struct {
+		role     string // "" sends no credentials
+		method   string
+		url      string
+		body     string
+		wantCode int
+	}{
+		{"", "GET", "/agents", "", http.StatusUnauthorized},
+		{RoleViewer, "GET", "/agents", "", http.StatusOK},
+		{RoleAgent, "GET", "/agents", "", http.StatusForbidden},
+		{RoleAgent, "POST", "/heartbeat", `{"agent_id":"web-1"}`, http.StatusOK},
+		{RoleViewer, "POST", "/heartbeat", `{"agent_id":"web-1"}`, http.StatusForbidden},
+
+		// Cases: analysts and up
+		{RoleViewer, "POST", "/cases", `{"title":"x"}`, http.StatusForbidden},
+		{RoleAnalyst, "POST", "/cases", `{"title":"x"}`, http.StatusCreated},
+
+		// Commands are checked per action
+		{RoleViewer, "POST", "/agents/web-1/commands", ping, http.StatusForbidden},
+		{RoleAnalyst, "POST", "/agents/web-1/commands", ping, http.StatusAccepted},
+		{RoleAnalyst, "POST", "/agents/web-1/commands", kill, http.StatusForbidden},
+		{RoleResponder, "POST", "/agents/web-1/commands", kill, http.StatusAccepted},
+		{RoleAdmin, "POST", "/agents/web-1/commands", kill, http.StatusAccepted},
+
+		// Admin only
+		{RoleResponder, "GET", "/audit-log", "", http.StatusForbidden},
+		{RoleAdmin, "GET", "/audit-log", "", http.StatusOK},
+		{RoleResponder, "POST", "/api-keys", `{"name":"ci","role":"admin"}`, http.StatusForbidden},
+		{RoleAdmin, "GET", "/api-keys", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+		if tt.role != "" {
+			req.Header.Set("X-API-Key", keys[tt.role])
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.wantCode {
+			t.Errorf("%s %s %s as %q = %d; want %d", tt.method, tt.url, tt.body, tt.role, rr.Code, tt.wantCode)
+		}
+	}
+
+	// Only the responder's and admin's kills made it into the queue
+	queued := s.tenant(defaultTenant).commands.list("web-1")
+	if len(queued) != 3 {
+		t.Errorf("queued %d commands; want 3 (1 ping, 2 kills)", len(queued))
+	}
+
+	// The analyst's attempted kill is a logged security event
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var rec map[string]any
+		json.Unmarshal([]byte(line), &rec)
+		if rec["event_type"] == "ACCESS_DENIED" && rec["principal"] == "analyst-key" && rec["permission"] == "action.kill_process" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("analyst kill_process denial not logged:\n%s", logs)
+	}
+}
+
+func TestKeylessAgents(t *testing.T) {
+	s, keys, _ := newAuthServer(t)
+	handler := s.routes()
+	do := func(method, url, key, body string) int {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	alert := `{"id":"old-1","agent_id":"legacy-1","event_type":"FILE_MODIFIED","details":"/etc/hosts modified"}`
+	if code := do("POST", "/audit", "", alert); code != http.StatusUnauthorized {
+		t.Fatalf("keyless POST /audit = %d; want 401 without -keyless-agents", code)
+	}
+
+	s.keyless = true
+	tests := []struct {
+		method, url, key, body string
+		wantCode               int
+	}{
+		{"POST", "/audit", "", alert, http.StatusOK},
+		{"POST", "/heartbeat", "", `{"agent_id":"legacy-1"}`, http.StatusOK},
+		// Only the agent endpoints, and a wrong key isn't taken as none
+		{"GET", "/agents", "", "", http.StatusUnauthorized},
+		{"POST", "/audit", "not-a-key", alert, http.StatusUnauthorized},
+		{"POST", "/audit", keys[RoleViewer], alert, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if code := do(tt.method, tt.url, tt.key, tt.body); code != tt.wantCode {
+			t.Errorf("%s %s with key %q = %d; want %d", tt.method, tt.url, tt.key, code, tt.wantCode)
+		}
+	}
+	if agents := s.tenant(defaultTenant).agents.list(); len(agents) != 1 || agents[0].ID != "legacy-1" {
+		t.Errorf("default tenant agents = %+v; want legacy-1", agents)
+	}
+}
+
+func TestLoginTokens(t *testing.T) {
+	s, _, _ := newAuthServer(t)
+	handler := s.routes()
+	if err := s.auth.addUser("alice", "correct horse battery", RoleAnalyst, defaultTenant); err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(password string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(loginRequest{Username: "alice", Password: password})
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/login", bytes.NewReader(body)))
+		return rr
+	}
+	if rr := login("wrong password!"); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("login with bad password = %d; want 401", rr.Code)
+	}
+	rr := login("correct horse battery")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("login = %d %s", rr.Code, rr.Body)
+	}
+	var res struct{ Token string }
+	json.NewDecoder(rr.Body).Decode(&res)
+
+	// An unsigned token claiming admin must not pass
+	forged, _ := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{
+		"username": "alice", "role": RoleAdmin, "exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	expired, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"username": "alice", "role": RoleAnalyst, "exp": time.Now().Add(-time.Minute).Unix(),
+	}).SignedString([]byte("test-secret"))
+
+	tests := []struct {
+		name     string
+		token    string
+		body     string
+		wantCode int
+	}{
+		{"valid", res.Token, `{"title":"Phishing"}`, http.StatusCreated},
+		{"forged alg none", forged, `{"title":"Phishing"}`, http.StatusUnauthorized},
+		{"expired", expired, `{"title":"Phishing"}`, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/cases", strings.NewReader(tt.body))
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		req.Header.Set("X-Analyst", "mallory") // Ignored once authenticated
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.wantCode {
+			t.Errorf("%s: POST /cases = %d; want %d", tt.name, rr.Code, tt.wantCode)
+		}
+	}
+
+	// The audit log names the logged-in user, not the header
+	entries := s.audit.between("", time.Unix(0, 0), time.Now().Add(time.Hour))
+	if len(entries) != 1 || entries[0].Actor != "alice" {
+		t.Errorf("audit entries = %+v; want one by alice", entries)
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Feature kinds the baseline learns
+const (
+	FeatureProcess     = "process"      // Executable name, e.g. "nginx"
+	FeatureParentChild = "parent_child" // e.g. "sshd>bash"
+	FeatureListenPort  = "listen_port"  // e.g. "tcp/22"
+	FeatureLogin       = "login"        // User and source, e.g. "alice@203.0.113.7"
+)
+
+// fleetScope keys the baseline across all hosts. It can't clash with an
+// agent ID a sane deployment would use.
+const fleetScope = "*"
+
+// Anomaly reasons
+const (
+	ReasonFirstSeenFleet = "first_seen_fleet"
+	ReasonFirstSeenHost  = "first_seen_host"
+	ReasonRare           = "rare"
+)
+
+// Defaults, overridden by flags in main
+const (
+	defaultLearningWindow   = 7 * 24 * time.Hour
+	defaultAnomalyThreshold = 80
+)
+
+// Below this many events of a kind, frequencies mean little and only
+// first-seen values are flagged.
+const minRareSamples = 20
+
+const maxAnomalies = 1000
+
+// Feature is one observable fact about a host
+type Feature struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+// features pulls what the baseline tracks out of an alert:
+//
+//	PROCESS_START  fields exe (and the parent's exe from the process tree)
+//	NETWORK_LISTEN fields port, proto (default tcp)
+//	AUTH_SUCCESS   fields user, src_ip
+//
+// Call it after the process table has seen the alert.
+func (s *server) features(td *tenantData, a Alert) []Feature {
+	f := a.Fields
+	switch a.EventType {
+	case "PROCESS_START":
+		if f["exe"] == "" {
+			return nil
+		}
+		child := path.Base(f["exe"])
+		out := []Feature{{FeatureProcess, child}}
+		if pid, start, err := processKey(a); err == nil {
+			if chain := td.procs.ancestry(a.AgentID, pid, start); len(chain) > 1 && chain[1].Exe != "" {
+				out = append(out, Feature{FeatureParentChild, path.Base(chain[1].Exe) + ">" + child})
+			}
+		}
+		return out
+	case "NETWORK_LISTEN":
+		if f["port"] == "" {
+			return nil
+		}
+		proto := f["proto"]
+		if proto == "" {
+			proto = "tcp"
+		}
+		return []Feature{{FeatureListenPort, proto + "/" + f["port"]}}
+	case "AUTH_SUCCESS":
+		if f["user"] == "" {
+			return nil
+		}
+		return []Feature{{FeatureLogin, f["user"] + "@" + f["src_ip"]}}
+	}
+	return nil
+}
+
+// featureStats is what the baseline knows about one value
+type featureStats struct {
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first_seen,omitzero"`
+	LastSeen  time.Time `json:"last_seen,omitzero"`
+	Accepted  bool      `json:"accepted,omitempty"` // Marked normal by an analyst
+}
+
+// scopeBaseline is the baseline of one host, or of the fleet
+type scopeBaseline struct {
+	Started  time.Time                           `json:"started"` // Learning runs from here
+	Totals   map[string]int                      `json:"totals"`  // Events per kind
+	Features map[string]map[string]*featureStats `json:"features"`
+}
+
+func newScopeBaseline(now time.Time) *scopeBaseline {
+	return &scopeBaseline{
+		Started:  now,
+		Totals:   make(map[string]int),
+		Features: make(map[string]map[string]*featureStats),
+	}
+}
+
+func (b *scopeBaseline) stats(f Feature) *featureStats {
+	return b.Features[f.Kind][f.Value]
+}
+
+func (b *scopeBaseline) count(f Feature) int {
+	if st := b.stats(f); st != nil {
+		return st.Count
+	}
+	return 0
+}
+
+func (b *scopeBaseline) accepted(f Feature) bool {
+	st := b.stats(f)
+	return st != nil && st.Accepted
+}
+
+func (b *scopeBaseline) statsOrNew(f Feature) *featureStats {
+	vals := b.Features[f.Kind]
+	if vals == nil {
+		vals = make(map[string]*featureStats)
+		b.Features[f.Kind] = vals
+	}
+	st := vals[f.Value]
+	if st == nil {
+		st = &featureStats{}
+		vals[f.Value] = st
+	}
+	return st
+}
+
+func (b *scopeBaseline) record(f Feature, now time.Time) {
+	st := b.statsOrNew(f)
+	if st.Count == 0 {
+		st.FirstSeen = now
+	}
+	st.Count++
+	st.LastSeen = now
+	b.Totals[f.Kind]++
+}
+
+// Anomaly is a feature that doesn't fit the learned baseline
+type Anomaly struct {
+	AgentID string    `json:"agent_id"`
+	Kind    string    `json:"kind"`
+	Value   string    `json:"value"`
+	Score   int       `json:"score"` // 0-100, higher is rarer
+	Reason  string    `json:"reason"`
+	AlertID string    `json:"alert_id,omitempty"` // Alert that carried the feature
+	Time    time.Time `json:"time"`
+}
+
+// rarity is 1 for a value never seen and 0 for one that makes up every
+// event of its kind. The log scale keeps a value seen 5 times in 10,000
+// far rarer than one seen 500 times.
+func rarity(count, total int) float64 {
+	if count == 0 {
+		return 1
+	}
+	return 1 - math.Log1p(float64(count))/math.Log1p(float64(total))
+}
+
+// baselineStore learns features per host and fleet-wide. A scope is
+// scored only after its learning window has passed; until then it just
+// counts.
+type baselineStore struct {
+	mu        sync.Mutex
+	path      string
+	learn     time.Duration
+	threshold int
+	scopes    map[string]*scopeBaseline
+	anomalies []Anomaly // Most recent maxAnomalies
+	dirty     bool      // Changed since the last save
+}
+
+func newBaselineStore(learn time.Duration, threshold int) *baselineStore {
+	return &baselineStore{learn: learn, threshold: threshold, scopes: make(map[string]*scopeBaseline)}
+}
+
+// openBaselineStore loads a saved baseline from path, if there is one.
+func openBaselineStore(path string, learn time.Duration, threshold int) (*baselineStore, error) {
+	b := newBaselineStore(learn, threshold)
+	b.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &b.scopes); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return b, nil
+}
+
+// save writes the baseline if it changed. The file is replaced atomically.
+func (b *baselineStore) save() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.path == "" || !b.dirty {
+		return nil
+	}
+	data, err := json.Marshal(b.scopes)
+	if err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		return err
+	}
+	b.dirty = false
+	return nil
+}
+
+// baselineState is what a cluster snapshot carries of the baseline
+type baselineState struct {
+	Scopes    map[string]*scopeBaseline `json:"scopes"`
+	Anomalies []Anomaly                 `json:"anomalies"`
+}
+
+func (b *baselineStore) marshal() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return json.Marshal(baselineState{Scopes: b.scopes, Anomalies: b.anomalies})
+}
+
+func (b *baselineStore) unmarshal(data []byte) error {
+	var st baselineState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+	if st.Scopes == nil {
+		st.Scopes = make(map[string]*scopeBaseline)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.scopes, b.anomalies, b.dirty = st.Scopes, st.Anomalies, true
+	return nil
+}
+
+func (b *baselineStore) scope(name string, now time.Time) *scopeBaseline {
+	sb := b.scopes[name]
+	if sb == nil {
+		sb = newScopeBaseline(now)
+		b.scopes[name] = sb
+	}
+	return sb
+}
+
+func (b *baselineStore) learning(sb *scopeBaseline, now time.Time) bool {
+	return now.Sub(sb.Started) < b.learn
+}
+
+// observe scores an alert's features against what the host and fleet have
+// seen so far, then learns them.
+func (b *baselineStore) observe(agentID, alertID string, feats []Feature, now time.Time) []Anomaly {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	host, fleet := b.scope(agentID, now), b.scope(fleetScope, now)
+	var out []Anomaly
+	for _, f := range feats {
+		if !b.learning(host, now) && !host.accepted(f) && !fleet.accepted(f) {
+			if a, ok := b.score(host, fleet, f); ok {
+				a.AgentID, a.AlertID, a.Time = agentID, alertID, now
+				out = append(out, a)
+			}
+		}
+		host.record(f, now)
+		fleet.record(f, now)
+	}
+
+	b.anomalies = append(b.anomalies, out...)
+	if n := len(b.anomalies); n > maxAnomalies {
+		b.anomalies = append([]Anomaly(nil), b.anomalies[n-maxAnomalies:]...)
+	}
+	b.dirty = b.dirty || len(feats) > 0
+	return out
+}
+
+// score weighs host rarity above fleet rarity: a process common across the
+// fleet but new to this host is still worth a look.
+func (b *baselineStore) score(host, fleet *scopeBaseline, f Feature) (Anomaly, bool) {
+	hc, hn := host.count(f), host.Totals[f.Kind]
+	fc, fn := fleet.count(f), fleet.Totals[f.Kind]
+	a := Anomaly{
+		Kind:  f.Kind,
+		Value: f.Value,
+		Score: int(math.Round(100 * (0.6*rarity(hc, hn) + 0.4*rarity(fc, fn)))),
+	}
+
+	switch {
+	case fc == 0:
+		a.Reason = ReasonFirstSeenFleet
+	case hc == 0:
+		a.Reason = ReasonFirstSeenHost
+	case hn >= minRareSamples && a.Score >= b.threshold:
+		a.Reason = ReasonRare
+	default:
+		return a, false
+	}
+	return a, true
+}
+
+// accept marks a value as normal for one host, or for the whole fleet when
+// agentID is empty. It is never flagged there again.
+func (b *baselineStore) accept(agentID string, f Feature, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if agentID == "" {
+		agentID = fleetScope
+	}
+	b.scope(agentID, now).statsOrNew(f).Accepted = true
+	b.dirty = true
+}
+
+// baselineSummary is the view of one scope served by GET /baseline
+type baselineSummary struct {
+	Scope         string                              `json:"scope"`
+	Learning      bool                                `json:"learning"`
+	LearningUntil time.Time                           `json:"learning_until"`
+	Totals        map[string]int                      `json:"totals"`
+	Features      map[string]map[string]*featureStats `json:"features"`
+}
+
+func (b *baselineStore) summary(scope string, now time.Time) (baselineSummary, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sb := b.scopes[scope]
+	if sb == nil {
+		return baselineSummary{}, false
+	}
+
+	// Deep copy, the store keeps learning while this is encoded
+	features := make(map[string]map[string]*featureStats, len(sb.Features))
+	for kind, vals := range sb.Features {
+		features[kind] = make(map[string]*featureStats, len(vals))
+		for v, st := range vals {
+			c := *st
+			features[kind][v] = &c
+		}
+	}
+	totals := make(map[string]int, len(sb.Totals))
+	for k, n := range sb.Totals {
+		totals[k] = n
+	}
+	return baselineSummary{
+		Scope:         scope,
+		Learning:      b.learning(sb, now),
+		LearningUntil: sb.Started.Add(b.learn),
+		Totals:        totals,
+		Features:      features,
+	}, true
+}
+
+func (b *baselineStore) recent(agentID string) []Anomaly {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := []Anomaly{}
+	for _, a := range b.anomalies {
+		if agentID == "" || a.AgentID == agentID {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// checkBaseline turns an alert's anomalies into BEHAVIOR_ANOMALY alerts, so
+// they go through detection and correlation like everything else.
+func (s *server) checkBaseline(td *tenantData, a Alert, now time.Time) {
+	feats := s.features(td, a)
+	if len(feats) == 0 {
+		return
+	}
+	for _, an := range td.baseline.observe(a.AgentID, a.ID, feats, now) {
+		s.metrics.anomalies.With(an.Kind).Inc()
+		s.logger.Warn("Behavior anomaly",
+			"tenant", td.id,
+			"agent", an.AgentID,
+			"kind", an.Kind,
+			"value", an.Value,
+			"score", an.Score,
+			"reason", an.Reason,
+		)
+		s.ingestAt(Alert{
+			AgentID:   an.AgentID,
+			Tenant:    td.id,
+			EventType: "BEHAVIOR_ANOMALY",
+			Details:   fmt.Sprintf("%s %s %q on %s (score %d)", anomalyLabel[an.Reason], an.Kind, an.Value, an.AgentID, an.Score),
+			Timestamp: an.Time.Unix(),
+			Fields: map[string]string{
+				"kind":         an.Kind,
+				"value":        an.Value,
+				"score":        fmt.Sprint(an.Score),
+				"reason":       an.Reason,
+				"source_alert": an.AlertID,
+			},
+		}, now)
+	}
+}
+
+var anomalyLabel = map[string]string{
+	ReasonFirstSeenFleet: "First-seen in fleet:",
+	ReasonFirstSeenHost:  "First-seen on host:",
+	ReasonRare:           "Rare:",
+}
+
+// --- Handlers ---
+
+// handleBaseline serves GET /baseline?agent= (the fleet when empty).
+func (s *server) handleBaseline(w http.ResponseWriter, r *http.Request) {
+	scope := r.URL.Query().Get("agent")
+	if scope == "" {
+		scope = fleetScope
+	}
+	sum, ok := s.data(r).baseline.summary(scope, s.now())
+	if !ok {
+		http.Error(w, "No baseline for "+scope, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, sum)
+}
+
+func (s *server) handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	out := s.data(r).baseline.recent(r.URL.Query().Get("agent"))
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	writeJSON(w, out)
+}
+
+type acceptRequest struct {
+	AgentID string `json:"agent_id"` // Empty accepts fleet-wide
+	Feature
+}
+
+// baselineAccept is a baseline.accept write's arguments
+type baselineAccept struct {
+	Tenant string `json:"tenant"`
+	acceptRequest
+}
+
+func applyAcceptBaseline(s *server, a baselineAccept, now time.Time) (any, error) {
+	td := s.tenant(a.Tenant)
+	td.baseline.accept(a.AgentID, a.Feature, now)
+	if err := td.baseline.save(); err != nil {
+		s.logger.Error("Failed to save baseline", "tenant", td.id, "error", err)
+	}
+	return nil, nil
+}
+
+// handleAcceptBaseline serves POST /baseline/accept, the "this is normal"
+// button. It is recorded in the audit log.
+func (s *server) handleAcceptBaseline(w http.ResponseWriter, r *http.Request) {
+	var req acceptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Value == "" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	switch req.Kind {
+	case FeatureProcess, FeatureParentChild, FeatureListenPort, FeatureLogin:
+	default:
+		http.Error(w, fmt.Sprintf("Unknown feature kind %q", req.Kind), http.StatusBadRequest)
+		return
+	}
+	scope := req.AgentID
+	if scope == "" {
+		scope = fleetScope
+	}
+
+	who, now, td := analyst(r), s.now(), s.data(r)
+	if _, err := s.audit.append(AuditEntry{
+		Time:    now,
+		Tenant:  td.id,
+		Actor:   who,
+		Action:  "baseline.accept",
+		Target:  scope,
+		Changes: []FieldChange{{Field: req.Kind, To: req.Value}},
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := s.write("baseline.accept", baselineAccept{td.id, req}); s.writeFailed(w, err, http.StatusInternalServerError) {
+		return
+	}
+	s.logger.Info("Baseline value accepted", "tenant", td.id, "scope", scope, "kind", req.Kind, "value", req.Value, "by", who)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBaselineScoring(t *testing.T) {
+	t0 := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	b := newBaselineStore(time.Hour, 80)
+	proc := func(name string) []Feature { return []Feature{{FeatureProcess, name}} }
+
+	// Learning: web-1 runs mostly sshd and nginx, cron once; web-2 only sshd
+	for i := range 30 {
+		at := t0.Add(time.Duration(i) * time.Minute)
+		for _, name := range []string{"sshd", "nginx"} {
+			if got := b.observe("web-1", "", proc(name), at); len(got) != 0 {
+				t.Fatalf("anomaly while learning: %+v", got)
+			}
+		}
+		b.observe("web-2", "", proc("sshd"), at)
+	}
+	b.observe("web-1", "", proc("cron"), t0.Add(10*time.Minute))
+
+	after := t0.Add(2 * time.Hour)
+	tests := []struct {
+		agent      string
+		process    string
+		wantReason string // "" means not flagged
+		minScore   int
+	}{
+		{"web-1", "sshd", "", 0},
+		{"web-1", "xmrig", ReasonFirstSeenFleet, 100},
+		{"web-2", "nginx", ReasonFirstSeenHost, 60},
+		{"web-1", "cron", ReasonRare, 80},
+		{"web-1", "xmrig", ReasonRare, 80}, // Seen once now, still rare
+	}
+	for _, tt := range tests {
+		got := b.observe(tt.agent, "", proc(tt.process), after)
+		switch {
+		case tt.wantReason == "" && len(got) != 0:
+			t.Errorf("%s %s flagged: %+v", tt.agent, tt.process, got)
+		case tt.wantReason != "" && (len(got) != 1 || got[0].Reason != tt.wantReason || got[0].Score < tt.minScore):
+			t.Errorf("%s %s = %+v; want %s with score >= %d", tt.agent, tt.process, got, tt.wantReason, tt.minScore)
+		}
+	}
+
+	// Accepting fleet-wide silences it on every host, even one that never ran it
+	b.accept("", Feature{FeatureProcess, "xmrig"}, after)
+	for _, agent := range []string{"web-1", "web-2"} {
+		if got := b.observe(agent, "", proc("xmrig"), after); len(got) != 0 {
+			t.Errorf("accepted value flagged on %s: %+v", agent, got)
+		}
+	}
+}
+
+func TestBaselinePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "baseline.json")
+	t0 := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	b, err := openBaselineStore(path, time.Hour, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.observe("web-1", "", []Feature{{FeatureListenPort, "tcp/22"}}, t0)
+	b.accept("web-1", Feature{FeatureListenPort, "tcp/8080"}, t0)
+	if err := b.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart keeps what was learned, when learning started, and what was
+	// accepted, so the server doesn't start learning from scratch
+	b, err = openBaselineStore(path, time.Hour, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := t0.Add(2 * time.Hour)
+	for _, port := range []string{"tcp/22", "tcp/8080"} {
+		if got := b.observe("web-1", "", []Feature{{FeatureListenPort, port}}, after); len(got) != 0 {
+			t.Errorf("%s flagged after reload: %+v", port, got)
+		}
+	}
+	if got := b.observe("web-1", "", []Feature{{FeatureListenPort, "tcp/4444"}}, after); len(got) != 1 {
+		t.Errorf("new port after reload = %+v; want one anomaly", got)
+	}
+}
+
+func TestBaselineAnomalyOpensIncident(t *testing.T) {
+	s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s.tenant(defaultTenant).baseline = newBaselineStore(0, 80) // No learning window
+	start := time.Now().UTC()
+
+	s.ingest(procEvent("PROCESS_START", 812, 1, start, start, "/usr/sbin/sshd"))
+	s.ingest(procEvent("PROCESS_START", 4100, 812, start.Add(time.Second), start, "/usr/bin/bash"))
+
+	var kinds []string
+	for _, a := range s.tenant(defaultTenant).baseline.recent("host") {
+		kinds = append(kinds, a.Kind+":"+a.Value)
+	}
+	want := "process:sshd process:bash parent_child:sshd>bash"
+	if strings.Join(kinds, " ") != want {
+		t.Errorf("anomalies = %v; want %s", kinds, want)
+	}
+	incs := s.tenant(defaultTenant).incidents.list()
+	if len(incs) != 1 || incs[0].Severity != "low" {
+		t.Errorf("incidents = %+v; want one low-severity incident from xdr-006", incs)
+	}
+
+	// Accepting is audited
+	req := httptest.NewRequest("POST", "/baseline/accept", strings.NewReader(`{"kind":"parent_child","value":"sshd>bash"}`))
+	req.Header.Set("X-Analyst", "alice")
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("accept = %d %s", rr.Code, rr.Body)
+	}
+	entries := s.audit.between("", time.Unix(0, 0), time.Now().Add(time.Hour))
+	if len(entries) != 1 || entries[0].Action != "baseline.accept" || entries[0].Actor != "alice" || entries[0].Target != fleetScope {
+		t.Errorf("audit = %+v; want one baseline.accept by alice on the fleet", entries)
+	}
+}
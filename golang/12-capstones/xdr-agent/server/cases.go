@@ -0,0 +1,474 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Case statuses
+const (
+	CaseNew       = "new"
+	CaseTriaging  = "triaging"
+	CaseContained = "contained"
+	CaseClosed    = "closed"
+)
+
+// caseTransitions lists the allowed status moves. A closed case can be
+// reopened for triage.
+var caseTransitions = map[string][]string{
+	CaseNew:       {CaseTriaging, CaseContained, CaseClosed},
+	CaseTriaging:  {CaseContained, CaseClosed},
+	CaseContained: {CaseTriaging, CaseClosed},
+	CaseClosed:    {CaseTriaging},
+}
+
+var (
+	errCaseNotFound    = errors.New("case not found")
+	errVersionMismatch = errors.New("case was changed by someone else, reload and retry")
+	errBadTransition   = errors.New("status change not allowed")
+)
+
+// Note is an analyst comment on a case
+type Note struct {
+	Author string    `json:"author"`
+	Text   string    `json:"text"`
+	Time   time.Time `json:"time"`
+}
+
+// Case is the unit of analyst work, built around one or more incidents
+type Case struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant"`
+	Title     string    `json:"title"`
+	Status    string    `json:"status"`
+	Severity  string    `json:"severity"`
+	Assignee  string    `json:"assignee,omitempty"`
+	Incidents []string  `json:"incidents"`
+	Alerts    []string  `json:"alerts"`
+	Tags      []string  `json:"tags"`
+	Notes     []Note    `json:"notes"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+	Closed    time.Time `json:"closed,omitzero"` // Cleared when the case reopens
+	Version   int       `json:"version"`         // Bumped on every change, served as the ETag
+}
+
+func (c *Case) etag() string { return strconv.Quote(strconv.Itoa(c.Version)) }
+
+func (c *Case) clone() Case {
+	out := *c
+	out.Incidents = slices.Clone(c.Incidents)
+	out.Alerts = slices.Clone(c.Alerts)
+	out.Tags = slices.Clone(c.Tags)
+	out.Notes = slices.Clone(c.Notes)
+	return out
+}
+
+// caseStore keeps cases, persisted as one JSON file, and writes every
+// change to the audit log under the same lock, so the log order matches
+// the change order.
+type caseStore struct {
+	mu    sync.Mutex
+	path  string
+	seq   int
+	cases map[string]*Case
+	order []*Case
+	audit *auditLog
+}
+
+// newCaseStore keeps cases in memory only. Numbering continues from the
+// audit log, so IDs stay unique across restarts.
+func newCaseStore(audit *auditLog) *caseStore {
+	s := &caseStore{cases: make(map[string]*Case), audit: audit}
+	for _, e := range audit.entries {
+		if e.Action == "case.create" {
+			s.seq++
+		}
+	}
+	return s
+}
+
+// openCaseStore loads the cases saved at path, or keeps them in memory
+// only when path is empty.
+func openCaseStore(path string, audit *auditLog) (*caseStore, error) {
+	s := newCaseStore(audit)
+	s.path = path
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.order); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, c := range s.order {
+		s.cases[c.ID] = c
+		var n int
+		fmt.Sscanf(c.ID, "CASE-%d", &n)
+		s.seq = max(s.seq, n)
+	}
+	return s, nil
+}
+
+// saveLocked writes the cases atomically. A failed save leaves the change
+// in memory and in the audit log, and the next save writes it. Callers
+// hold mu.
+func (s *caseStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	data, _ := json.MarshalIndent(s.order, "", "  ")
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *caseStore) create(c Case, actor string, now time.Time) (Case, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	c.ID = fmt.Sprintf("CASE-%04d", s.seq)
+	c.Status, c.Version, c.Created, c.Updated = CaseNew, 1, now, now
+	c.Incidents, c.Alerts, c.Tags = orEmpty(c.Incidents), orEmpty(c.Alerts), orEmpty(c.Tags)
+	c.Notes = []Note{}
+
+	_, err := s.audit.append(AuditEntry{
+		Time: now, Tenant: c.Tenant, Actor: actor, Action: "case.create", Target: c.ID,
+		Changes: []FieldChange{
+			{Field: "title", To: c.Title},
+			{Field: "severity", To: c.Severity},
+			{Field: "assignee", To: c.Assignee},
+			{Field: "incidents", To: strings.Join(c.Incidents, ",")},
+			{Field: "alerts", To: strings.Join(c.Alerts, ",")},
+			{Field: "tags", To: strings.Join(c.Tags, ",")},
+		},
+	})
+	if err != nil {
+		return Case{}, err
+	}
+	s.cases[c.ID] = &c
+	s.order = append(s.order, &c)
+	return c.clone(), s.saveLocked()
+}
+
+// update applies fn to a copy of the tenant's case if its version still
+// matches. version 0 skips the check. Nothing changes when fn or the audit
+// write fails.
+func (s *caseStore) update(tenant, id string, version int, actor, action string, now time.Time, fn func(c *Case) ([]FieldChange, error)) (Case, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cur, ok := s.cases[id]
+	if !ok || cur.Tenant != tenant {
+		return Case{}, errCaseNotFound
+	}
+	if version != 0 && version != cur.Version {
+		return cur.clone(), errVersionMismatch
+	}
+
+	next := cur.clone()
+	changes, err := fn(&next)
+	if err != nil {
+		return cur.clone(), err
+	}
+	if len(changes) == 0 {
+		return cur.clone(), nil
+	}
+	next.Version++
+	next.Updated = now
+	if next.Status != cur.Status {
+		next.Closed = time.Time{}
+		if next.Status == CaseClosed {
+			next.Closed = now
+		}
+	}
+	if _, err := s.audit.append(AuditEntry{Time: now, Tenant: tenant, Actor: actor, Action: action, Target: id, Changes: changes}); err != nil {
+		return cur.clone(), err
+	}
+	*cur = next
+	return cur.clone(), s.saveLocked()
+}
+
+func (s *caseStore) get(tenant, id string) (Case, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.cases[id]
+	if !ok || c.Tenant != tenant {
+		return Case{}, false
+	}
+	return c.clone(), true
+}
+
+// list returns the tenant's cases matching every non-empty filter.
+func (s *caseStore) list(tenant, status, assignee, tag string) []Case {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []Case{}
+	for _, c := range s.order {
+		if c.Tenant == tenant &&
+			(status == "" || c.Status == status) &&
+			(assignee == "" || c.Assignee == assignee) &&
+			(tag == "" || slices.Contains(c.Tags, tag)) {
+			out = append(out, c.clone())
+		}
+	}
+	return out
+}
+
+func orEmpty(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// --- Patch ---
+
+// casePatch is the body of PATCH /cases/{id}. Absent fields are left
+// alone; lists are edited with add/remove so concurrent edits of different
+// entries don't need the full list.
+type casePatch struct {
+	Title         *string  `json:"title"`
+	Status        *string  `json:"status"`
+	Severity      *string  `json:"severity"`
+	Assignee      *string  `json:"assignee"`
+	AddTags       []string `json:"add_tags"`
+	RemoveTags    []string `json:"remove_tags"`
+	LinkAlerts    []string `json:"link_alerts"`
+	LinkIncidents []string `json:"link_incidents"`
+}
+
+func (p casePatch) apply(c *Case) ([]FieldChange, error) {
+	var changes []FieldChange
+	set := func(field string, dst *string, v *string) {
+		if v != nil && *v != *dst {
+			changes = append(changes, FieldChange{Field: field, From: *dst, To: *v})
+			*dst = *v
+		}
+	}
+
+	if p.Status != nil && *p.Status != c.Status {
+		if !slices.Contains(caseTransitions[c.Status], *p.Status) {
+			return nil, fmt.Errorf("%w: %s -> %s", errBadTransition, c.Status, *p.Status)
+		}
+	}
+	if p.Severity != nil && severityRank[*p.Severity] == 0 {
+		return nil, fmt.Errorf("unknown severity %q", *p.Severity)
+	}
+	set("title", &c.Title, p.Title)
+	set("status", &c.Status, p.Status)
+	set("severity", &c.Severity, p.Severity)
+	set("assignee", &c.Assignee, p.Assignee)
+
+	for _, t := range p.AddTags {
+		if !slices.Contains(c.Tags, t) {
+			c.Tags = append(c.Tags, t)
+			changes = append(changes, FieldChange{Field: "tags", To: t})
+		}
+	}
+	for _, t := range p.RemoveTags {
+		if i := slices.Index(c.Tags, t); i >= 0 {
+			c.Tags = slices.Delete(c.Tags, i, i+1)
+			changes = append(changes, FieldChange{Field: "tags", From: t})
+		}
+	}
+	for _, a := range p.LinkAlerts {
+		if !slices.Contains(c.Alerts, a) {
+			c.Alerts = append(c.Alerts, a)
+			changes = append(changes, FieldChange{Field: "alerts", To: a})
+		}
+	}
+	for _, id := range p.LinkIncidents {
+		if !slices.Contains(c.Incidents, id) {
+			c.Incidents = append(c.Incidents, id)
+			changes = append(changes, FieldChange{Field: "incidents", To: id})
+		}
+	}
+	return changes, nil
+}
+
+// --- Handlers ---
+
+// analyst names whoever made the request, for the audit log. Without auth
+// (-no-auth) the client may say who it is with X-Analyst.
+func analyst(r *http.Request) string {
+	if p, ok := principalFrom(r.Context()); ok {
+		return p.Name
+	}
+	if a := r.Header.Get("X-Analyst"); a != "" {
+		return a
+	}
+	return "anonymous"
+}
+
+// ifMatchVersion parses an If-Match header holding a case ETag.
+func ifMatchVersion(r *http.Request) (int, bool) {
+	v, err := strconv.Unquote(strings.TrimPrefix(r.Header.Get("If-Match"), "W/"))
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil && n > 0
+}
+
+func writeCase(w http.ResponseWriter, c Case, status int) {
+	w.Header().Set("ETag", c.etag())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(c)
+}
+
+type caseCreateRequest struct {
+	Title     string   `json:"title"`
+	Severity  string   `json:"severity"`
+	Assignee  string   `json:"assignee"`
+	Incidents []string `json:"incidents"`
+	Alerts    []string `json:"alerts"`
+	Tags      []string `json:"tags"`
+}
+
+func (s *server) handleCreateCase(w http.ResponseWriter, r *http.Request) {
+	var req caseCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Title == "" {
+		http.Error(w, "Bad request (title is required)", http.StatusBadRequest)
+		return
+	}
+
+	// Severity defaults to the worst linked incident
+	td := s.data(r)
+	for _, id := range req.Incidents {
+		inc, ok := td.incidents.get(id)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown incident %s", id), http.StatusBadRequest)
+			return
+		}
+		if req.Severity == "" || severityRank[inc.Severity] > severityRank[req.Severity] {
+			req.Severity = inc.Severity
+		}
+	}
+	if req.Severity == "" {
+		req.Severity = "medium"
+	}
+	if severityRank[req.Severity] == 0 {
+		http.Error(w, fmt.Sprintf("Unknown severity %q", req.Severity), http.StatusBadRequest)
+		return
+	}
+
+	c, err := s.cases.create(Case{
+		Tenant:    td.id,
+		Title:     req.Title,
+		Severity:  req.Severity,
+		Assignee:  req.Assignee,
+		Incidents: req.Incidents,
+		Alerts:    req.Alerts,
+		Tags:      req.Tags,
+	}, analyst(r), s.now())
+	if err != nil {
+		s.logger.Error("Failed to create case", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info("Case opened", "case", c.ID, "analyst", analyst(r))
+	w.Header().Set("Location", "/cases/"+c.ID)
+	writeCase(w, c, http.StatusCreated)
+}
+
+func (s *server) handleListCases(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	writeJSON(w, s.cases.list(s.tenantOf(r), q.Get("status"), q.Get("assignee"), q.Get("tag")))
+}
+
+func (s *server) handleGetCase(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.cases.get(s.tenantOf(r), r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Case not found", http.StatusNotFound)
+		return
+	}
+	if r.Header.Get("If-None-Match") == c.etag() {
+		w.Header().Set("ETag", c.etag())
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeCase(w, c, http.StatusOK)
+}
+
+// handlePatchCase requires If-Match, so an analyst can't overwrite a change
+// they haven't seen.
+func (s *server) handlePatchCase(w http.ResponseWriter, r *http.Request) {
+	version, ok := ifMatchVersion(r)
+	if !ok {
+		http.Error(w, "If-Match with the case ETag is required", http.StatusPreconditionRequired)
+		return
+	}
+	var p casePatch
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	td := s.data(r)
+	for _, id := range p.LinkIncidents {
+		if _, ok := td.incidents.get(id); !ok {
+			http.Error(w, fmt.Sprintf("Unknown incident %s", id), http.StatusBadRequest)
+			return
+		}
+	}
+
+	c, err := s.cases.update(td.id, r.PathValue("id"), version, analyst(r), "case.update", s.now(), p.apply)
+	s.writeCaseResult(w, c, err)
+}
+
+type noteRequest struct {
+	Text string `json:"text"`
+}
+
+// handleAddNote appends a note. Notes never overwrite anything, so
+// If-Match is optional here.
+func (s *server) handleAddNote(w http.ResponseWriter, r *http.Request) {
+	var req noteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Text) == "" {
+		http.Error(w, "Bad request (text is required)", http.StatusBadRequest)
+		return
+	}
+	version, _ := ifMatchVersion(r)
+	author, now := analyst(r), s.now()
+
+	c, err := s.cases.update(s.tenantOf(r), r.PathValue("id"), version, author, "case.note", now, func(c *Case) ([]FieldChange, error) {
+		c.Notes = append(c.Notes, Note{Author: author, Text: req.Text, Time: now})
+		return []FieldChange{{Field: "notes", To: req.Text}}, nil
+	})
+	s.writeCaseResult(w, c, err)
+}
+
+func (s *server) writeCaseResult(w http.ResponseWriter, c Case, err error) {
+	switch {
+	case err == nil:
+		writeCase(w, c, http.StatusOK)
+	case errors.Is(err, errCaseNotFound):
+		http.Error(w, "Case not found", http.StatusNotFound)
+	case errors.Is(err, errVersionMismatch):
+		w.Header().Set("ETag", c.etag())
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case errors.Is(err, errBadTransition):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errAuditWrite):
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
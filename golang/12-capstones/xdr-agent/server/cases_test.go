@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// caseClient sends requests to a test server as one analyst.
+type caseClient struct {
+	t       *testing.T
+	handler http.Handler
+	analyst string
+}
+
+func (c caseClient) do(method, url, ifMatch, body string) *httptest.ResponseRecorder {
+	c.t.Helper()
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("X-Analyst", c.analyst)
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	rr := httptest.NewRecorder()
+	c.handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCaseOptimisticConcurrency(t *testing.T) {
+	s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s.tenant(defaultTenant).incidents.add(Detection{RuleID: "xdr-001", Severity: "high", AgentID: "web-1", Time: time.Now()})
+	handler := s.routes()
+	alice := caseClient{t, handler, "alice"}
+	bob := caseClient{t, handler, "bob"}
+
+	rr := alice.do("POST", "/cases", "", `{"title":"Miner on web-1","incidents":["INC-0001"],"tags":["miner"]}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create = %d %s", rr.Code, rr.Body)
+	}
+	var c Case
+	json.NewDecoder(rr.Body).Decode(&c)
+	if c.ID != "CASE-0001" || c.Status != CaseNew || c.Severity != "high" {
+		t.Fatalf("created case = %+v; want CASE-0001, new, severity from incident", c)
+	}
+	etag := rr.Header().Get("ETag")
+
+	tests := []struct {
+		name     string
+		client   caseClient
+		method   string
+		url      string
+		ifMatch  string
+		body     string
+		wantCode int
+	}{
+		{"patch without If-Match", alice, "PATCH", "/cases/CASE-0001", "", `{"status":"triaging"}`, http.StatusPreconditionRequired},
+		{"alice takes it", alice, "PATCH", "/cases/CASE-0001", etag, `{"status":"triaging","assignee":"alice"}`, http.StatusOK},
+		{"bob with a stale ETag", bob, "PATCH", "/cases/CASE-0001", etag, `{"assignee":"bob"}`, http.StatusPreconditionFailed},
+		{"bob notes without If-Match", bob, "POST", "/cases/CASE-0001/notes", "", `{"text":"Saw the same hash on db-1"}`, http.StatusOK},
+		{"back to new is not allowed", alice, "PATCH", "/cases/CASE-0001", `"3"`, `{"status":"new"}`, http.StatusConflict},
+		{"unknown incident", alice, "PATCH", "/cases/CASE-0001", `"3"`, `{"link_incidents":["INC-9999"]}`, http.StatusBadRequest},
+		{"contain", alice, "PATCH", "/cases/CASE-0001", `"3"`, `{"status":"contained","add_tags":["contained-by-ir"],"link_alerts":["a2"]}`, http.StatusOK},
+		{"missing case", alice, "PATCH", "/cases/CASE-0404", `"1"`, `{"status":"closed"}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rr := tt.client.do(tt.method, tt.url, tt.ifMatch, tt.body)
+		if rr.Code != tt.wantCode {
+			t.Errorf("%s: %s %s = %d %s; want %d", tt.name, tt.method, tt.url, rr.Code, strings.TrimSpace(rr.Body.String()), tt.wantCode)
+		}
+	}
+
+	got, _ := s.cases.get(defaultTenant, "CASE-0001")
+	if got.Version != 4 || got.Assignee != "alice" || got.Status != CaseContained || len(got.Notes) != 1 || len(got.Tags) != 2 {
+		t.Errorf("final case = %+v", got)
+	}
+
+	// A conditional GET with the current ETag is a 304
+	rr = alice.do("GET", "/cases/CASE-0001", "", "")
+	cur := rr.Header().Get("ETag")
+	req := httptest.NewRequest("GET", "/cases/CASE-0001", nil)
+	req.Header.Set("If-None-Match", cur)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("conditional GET = %d; want 304", rr.Code)
+	}
+
+	// Create, triage+assign, note, contain: rejected requests leave no trace
+	var actions []string
+	for _, e := range s.audit.between("", time.Unix(0, 0), time.Now().Add(time.Hour)) {
+		actions = append(actions, e.Actor+":"+e.Action)
+	}
+	want := "alice:case.create alice:case.update bob:case.note alice:case.update"
+	if strings.Join(actions, " ") != want {
+		t.Errorf("audit log = %v; want %s", actions, want)
+	}
+}
+
+func TestAuditLogChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.ndjson")
+	l, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	for i, actor := range []string{"alice", "bob", "carol"} {
+		l.append(AuditEntry{Time: now.Add(time.Duration(i) * time.Minute), Actor: actor, Action: "case.update", Target: "CASE-0001"})
+	}
+	l.file.Close()
+
+	// Reopening continues the chain and the case numbering
+	l, err = openAuditLog(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	e, _ := l.append(AuditEntry{Time: now.Add(time.Hour), Actor: "dave", Action: "case.create", Target: "CASE-0001"})
+	if e.Seq != 4 || e.PrevHash != l.entries[2].Hash {
+		t.Errorf("appended entry = %+v; want seq 4 linked to entry 3", e)
+	}
+	if next, _ := newCaseStore(l).create(Case{Title: "x"}, "dave", now); next.ID != "CASE-0002" {
+		t.Errorf("case after restart = %s; want CASE-0002", next.ID)
+	}
+	l.file.Close()
+
+	// Rewriting history is caught on open
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, []byte(strings.Replace(string(data), `"actor":"bob"`, `"actor":"mallory"`, 1)), 0600)
+	if _, err := openAuditLog(path); err == nil || !strings.Contains(err.Error(), "broken at entry 2") {
+		t.Errorf("open after tampering: %v; want broken at entry 2", err)
+	}
+}
+
+func TestCasesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	audit, err := openAuditLog(filepath.Join(dir, "audit.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.file.Close()
+	path := filepath.Join(dir, "cases.json")
+	st, err := openCaseStore(path, audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	c, _ := st.create(Case{Tenant: defaultTenant, Title: "Miner on web-1", Tags: []string{"miner"}}, "alice", now)
+	closed := "closed"
+	if _, err := st.update(defaultTenant, c.ID, 1, "alice", "case.update", now.Add(time.Hour), casePatch{Status: &closed}.apply); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err = openCaseStore(path, audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := st.get(defaultTenant, c.ID)
+	if !ok || got.Status != CaseClosed || !got.Closed.Equal(now.Add(time.Hour)) || got.Version != 2 || got.Tags[0] != "miner" {
+		t.Errorf("case after restart = %+v, %v", got, ok)
+	}
+	if len(st.list(defaultTenant, "", "", "")) != 1 {
+		t.Error("list after restart lost the case")
+	}
+	if next, _ := st.create(Case{Tenant: defaultTenant, Title: "x"}, "bob", now); next.ID != "CASE-0002" {
+		t.Errorf("next case = %s; want CASE-0002", next.ID)
+	}
+}
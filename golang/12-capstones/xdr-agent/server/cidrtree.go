@@ -0,0 +1,69 @@
+package main
+
+import "net/netip"
+
+// cidrTree is a binary radix tree over address bits. A lookup walks one
+// path from the root and collects every prefix containing the address, so
+// it costs at most 32 (IPv4) or 128 (IPv6) steps however many networks
+// are loaded.
+type cidrTree struct {
+	v4, v6 cidrNode
+	size   int
+}
+
+type cidrNode struct {
+	child      [2]*cidrNode
+	indicators []*Indicator // Prefixes ending at this node
+}
+
+func (t *cidrTree) root(a netip.Addr) *cidrNode {
+	if a.Is4() {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+// insert adds ind under prefix. A single address is inserted as /32 or /128.
+func (t *cidrTree) insert(p netip.Prefix, ind *Indicator) {
+	p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-unmappedBits(p.Addr())).Masked()
+	n := t.root(p.Addr())
+	bytes := p.Addr().AsSlice()
+	for i := 0; i < p.Bits(); i++ {
+		b := bit(bytes, i)
+		if n.child[b] == nil {
+			n.child[b] = &cidrNode{}
+		}
+		n = n.child[b]
+	}
+	n.indicators = append(n.indicators, ind)
+	t.size++
+}
+
+// lookup returns the indicators of every prefix containing a, broadest
+// first.
+func (t *cidrTree) lookup(a netip.Addr) []*Indicator {
+	a = a.Unmap()
+	n := t.root(a)
+	bytes := a.AsSlice()
+	out := append([]*Indicator(nil), n.indicators...)
+	for i := 0; i < a.BitLen(); i++ {
+		if n = n.child[bit(bytes, i)]; n == nil {
+			break
+		}
+		out = append(out, n.indicators...)
+	}
+	return out
+}
+
+func bit(b []byte, i int) int {
+	return int(b[i/8]>>(7-i%8)) & 1
+}
+
+// unmappedBits is how many prefix bits an IPv4-mapped IPv6 address loses
+// when unmapped (::ffff:10.0.0.0/104 is 10.0.0.0/8).
+func unmappedBits(a netip.Addr) int {
+	if a.Is4In6() {
+		return 96
+	}
+	return 0
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"12-capstones/xdr-agent/raft"
+)
+
+// How long an agent's request waits for its alert to commit before it's
+// told to try another node
+const proposeTimeout = 5 * time.Second
+
+// clusterCommand is one entry of the replicated log. Everything built from
+// alerts (timelines, process trees, the baseline, incidents, agent status)
+// is derived by applying these in log order on every node, and so is
+// everything alerts are judged by (see replicatedWrites).
+type clusterCommand struct {
+	Op      string    `json:"op"`   // "alert", "heartbeat" or "write"
+	Time    time.Time `json:"time"` // When the receiving node took it
+	Alert   *Alert    `json:"alert,omitempty"`
+	Tenant  string    `json:"tenant,omitempty"` // Of a heartbeat; an alert carries its own
+	AgentID string    `json:"agent_id,omitempty"`
+	Version string    `json:"version,omitempty"`
+	Group   string    `json:"group,omitempty"`
+
+	Write string          `json:"write,omitempty"` // Which of replicatedWrites
+	Args  json.RawMessage `json:"args,omitempty"`
+}
+
+// errNotCommitted wraps a write this node couldn't get into the cluster
+// log. Nothing changed, and another node may be able to take it.
+var errNotCommitted = errors.New("not committed to the cluster")
+
+// cluster is this server's seat in a replicated cluster
+type cluster struct {
+	node    *raft.Node
+	handler http.Handler // The other nodes' RPCs, on /raft/
+}
+
+// joinCluster makes s a node of the cluster in peers, given as
+// "n1=http://10.0.0.1:9090,n2=...". The node keeps its log in dir, and
+// nodes authenticate to each other with key.
+func (s *server) joinCluster(id, peers, dir, key string) error {
+	addrs, err := parsePeers(peers)
+	if err != nil {
+		return err
+	}
+	if _, ok := addrs[id]; !ok {
+		return fmt.Errorf("node %q is not in -peers", id)
+	}
+	store, err := raft.OpenFileStorage(dir)
+	if err != nil {
+		return err
+	}
+	trans := &raft.HTTPTransport{Addrs: addrs, Key: key, Client: &http.Client{Timeout: 10 * time.Second}}
+	cfg := raft.Config{ID: id, Peers: slices.Sorted(maps.Keys(addrs)), Logger: s.logger}
+	node, err := s.startCluster(cfg, trans, store)
+	if err != nil {
+		return err
+	}
+	s.cluster.handler = node.Handler(key)
+	return nil
+}
+
+// startCluster runs s as a raft node over any transport, which is how the
+// tests build a cluster in memory.
+func (s *server) startCluster(cfg raft.Config, trans raft.Transport, store raft.Storage) (*raft.Node, error) {
+	node, err := raft.NewNode(cfg, replicatedState{s}, trans, store)
+	if err != nil {
+		return nil, err
+	}
+	s.cluster = &cluster{node: node}
+	node.Start()
+	return node, nil
+}
+
+// parsePeers reads "id=url,id=url".
+func parsePeers(v string) (map[string]string, error) {
+	addrs := make(map[string]string)
+	for part := range strings.SplitSeq(v, ",") {
+		id, url, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || id == "" || url == "" {
+			return nil, fmt.Errorf("bad peer %q, want id=http://host:port", part)
+		}
+		addrs[id] = strings.TrimSuffix(url, "/")
+	}
+	if len(addrs) < 3 {
+		return nil, errors.New("a cluster needs at least 3 nodes to survive losing one")
+	}
+	return addrs, nil
+}
+
+// leader reports whether this node should do the cluster's periodic work,
+// like scheduled hunts. A standalone server always does.
+func (s *server) leader() bool {
+	return s.cluster == nil || s.cluster.node.IsLeader()
+}
+
+// accept takes an alert from outside the replicated state: an agent, an
+// inventory scan, a hunt. In a cluster it's ingested once a majority of
+// nodes have it in their log. It returns false for a duplicate.
+func (s *server) accept(alert Alert) (bool, error) {
+	if s.cluster == nil {
+		return s.ingest(alert), nil
+	}
+	v, err := s.propose(clusterCommand{Op: "alert", Time: s.now(), Alert: &alert})
+	ok, _ := v.(bool)
+	return ok, err
+}
+
+// heartbeat records an agent's sign of life, on every node in a cluster.
+func (s *server) heartbeat(tenant string, hb Heartbeat) error {
+	if s.cluster == nil {
+		s.tenant(tenant).agents.beat(hb, s.now())
+		return nil
+	}
+	_, err := s.propose(clusterCommand{Op: "heartbeat", Time: s.now(), Tenant: tenant, AgentID: hb.AgentID, Version: hb.Version, Group: hb.Group})
+	return err
+}
+
+// propose appends cmd to the log and returns what applying it on this
+// node returned.
+func (s *server) propose(cmd clusterCommand) (any, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), proposeTimeout)
+	defer cancel()
+	return s.cluster.node.Propose(ctx, data)
+}
+
+// write changes state every node keeps a copy of. Standalone it's made
+// straight away; in a cluster it goes through the log and every node
+// makes it. It returns what the change returned on this node, or an
+// errNotCommitted.
+func (s *server) write(op string, args any) (any, error) {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	if s.cluster == nil {
+		return replicatedWrites[op](s, data, s.now())
+	}
+	v, err := s.propose(clusterCommand{Op: "write", Time: s.now(), Write: op, Args: data})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errNotCommitted, err)
+	}
+	res, ok := v.(writeResult)
+	if !ok {
+		return nil, fmt.Errorf("%s was rejected by the cluster", op)
+	}
+	return res.val, res.err
+}
+
+// writeAs is write for callers that want the result as a T.
+func writeAs[T any](s *server, op string, args any) (T, error) {
+	v, err := s.write(op, args)
+	t, _ := v.(T)
+	return t, err
+}
+
+// unavailable answers a request this node couldn't get committed. The
+// agent keeps the alert in its spool and tries the next node.
+func (s *server) unavailable(w http.ResponseWriter, err error) {
+	s.logger.Warn("Cluster unavailable", "error", err)
+	http.Error(w, "No cluster quorum, try another node", http.StatusServiceUnavailable)
+}
+
+// writeFailed answers a write that returned err: 503 if the cluster
+// didn't take it, otherwise code. It reports whether there was an error.
+func (s *server) writeFailed(w http.ResponseWriter, err error, code int) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, errNotCommitted):
+		s.unavailable(w, err)
+	default:
+		http.Error(w, err.Error(), code)
+	}
+	return true
+}
+
+// --- Replicated state ---
+
+// writeFunc applies one kind of write. In a cluster every node runs it at
+// the same point in the log, so it must depend only on its arguments,
+// now and the replicated state: no clock, no disk, no randomness.
+type writeFunc func(s *server, args json.RawMessage, now time.Time) (any, error)
+
+// replicatedWrites are the changes to state that must be the same on
+// every node: the rules, suppressions, feeds and baseline that alerts
+// are judged by, and the hunts, reports, credentials and command queues
+// that any node may be asked about.
+var replicatedWrites = map[string]writeFunc{
+	"rule.put":           writeOf(applyPutRule),
+	"rule.delete":        writeOf(applyDeleteRule),
+	"suppression.create": writeOf(applyCreateSuppression),
+	"suppression.delete": writeOf(applyDeleteSuppression),
+	"intel.load":         writeOf(applyLoadIntel),
+	"baseline.accept":    writeOf(applyAcceptBaseline),
+	"hunt.create":        writeOf(applyCreateHunt),
+	"hunt.delete":        writeOf(applyDeleteHunt),
+	"hunt.finished":      writeOf(applyHuntFinished),
+	"report.create":      writeOf(applyCreateReport),
+	"report.delete":      writeOf(applyDeleteReport),
+	"report.finished":    writeOf(applyReportFinished),
+	"user.put":           writeOf(applyPutUser),
+	"key.add":            writeOf(applyAddKey),
+	"key.delete":         writeOf(applyDeleteKey),
+	"auth.bootstrap":     writeOf(applyBootstrapKey),
+	"command.queue":      writeOf(applyQueueCommand),
+	"command.take":       writeOf(applyTakeCommands),
+	"command.complete":   writeOf(applyCompleteCommand),
+}
+
+// writeOf adapts a write taking typed arguments to a writeFunc.
+func writeOf[A any](fn func(s *server, args A, now time.Time) (any, error)) writeFunc {
+	return func(s *server, data json.RawMessage, now time.Time) (any, error) {
+		var args A
+		if err := json.Unmarshal(data, &args); err != nil {
+			return nil, err
+		}
+		return fn(s, args, now)
+	}
+}
+
+// storeRef names one tenant's record in a replicated store
+type storeRef struct {
+	Tenant string `json:"tenant"`
+	ID     string `json:"id"`
+}
+
+// writeResult carries a write's outcome back to the node that proposed it
+type writeResult struct {
+	val any
+	err error
+}
+
+// replicatedState applies the cluster log to the server: the raft FSM
+type replicatedState struct{ s *server }
+
+func (r replicatedState) Apply(data []byte) any {
+	var c clusterCommand
+	if err := json.Unmarshal(data, &c); err != nil {
+		r.s.logger.Error("Bad cluster command", "error", err)
+		return false
+	}
+	switch {
+	case c.Op == "alert" && c.Alert != nil:
+		return r.s.ingestAt(*c.Alert, c.Time)
+	case c.Op == "heartbeat":
+		r.s.tenant(c.Tenant).agents.beat(Heartbeat{AgentID: c.AgentID, Version: c.Version, Group: c.Group}, c.Time)
+		return true
+	case c.Op == "write" && replicatedWrites[c.Write] != nil:
+		val, err := replicatedWrites[c.Write](r.s, c.Args, c.Time)
+		return writeResult{val, err}
+	}
+	r.s.logger.Error("Unknown cluster command", "op", c.Op, "write", c.Write)
+	return false
+}
+
+// clusterSnapshot is the replicated state as of one log index
+type clusterSnapshot struct {
+	Tenants map[string]tenantSnapshot `json:"tenants"`
+	Shared  *sharedSnapshot           `json:"shared,omitempty"` // Missing from snapshots before replicated writes
+}
+
+// sharedSnapshot is the state replicatedWrites change outside tenantData
+type sharedSnapshot struct {
+	Rules          []Rule            `json:"rules"`
+	SuppressionSeq int               `json:"suppression_seq"`
+	Suppressions   []Suppression     `json:"suppressions"`
+	Intel          map[string][]byte `json:"intel,omitempty"` // Feed files as last loaded
+	IntelLoaded    time.Time         `json:"intel_loaded,omitzero"`
+	HuntSeq        int               `json:"hunt_seq"`
+	Hunts          []Hunt            `json:"hunts"`
+	ReportSeq      int               `json:"report_seq"`
+	Reports        []Report          `json:"reports"`
+	Users          []User            `json:"users,omitempty"`
+	Keys           []APIKey          `json:"api_keys,omitempty"`
+}
+
+// tenantSnapshot is one tenant's share of it
+type tenantSnapshot struct {
+	SeenAlerts  []string                   `json:"seen_alerts"`
+	Timeline    map[string][]TimelineEvent `json:"timeline"`
+	Processes   json.RawMessage            `json:"processes"`
+	Baseline    json.RawMessage            `json:"baseline"`
+	Agents      []AgentInfo                `json:"agents"`
+	IncidentSeq int                        `json:"incident_seq"`
+	Incidents   []Incident                 `json:"incidents"`
+	CommandSeq  int                        `json:"command_seq"`
+	Commands    map[string][]Command       `json:"commands,omitempty"`
+}
+
+func (r replicatedState) Snapshot() ([]byte, error) {
+	snap := clusterSnapshot{Tenants: make(map[string]tenantSnapshot)}
+	for _, td := range r.s.tenants.all() {
+		ts := tenantSnapshot{
+			SeenAlerts: td.seenAlerts.list(),
+			Timeline:   td.timeline.snapshot(),
+			Agents:     td.agents.list(),
+		}
+		ts.IncidentSeq, ts.Incidents = td.incidents.snapshot()
+		ts.CommandSeq, ts.Commands = td.commands.snapshot()
+		var err error
+		if ts.Processes, err = td.procs.marshal(); err != nil {
+			return nil, err
+		}
+		if ts.Baseline, err = td.baseline.marshal(); err != nil {
+			return nil, err
+		}
+		snap.Tenants[td.id] = ts
+	}
+	sh := &sharedSnapshot{Rules: r.s.detector.list("")}
+	sh.SuppressionSeq, sh.Suppressions = r.s.suppress.snapshot()
+	sh.Intel, sh.IntelLoaded = r.s.intel.feeds()
+	sh.HuntSeq, sh.Hunts = r.s.hunts.snapshot()
+	sh.ReportSeq, sh.Reports = r.s.reports.snapshot()
+	if r.s.auth != nil {
+		sh.Users, sh.Keys = r.s.auth.snapshot()
+	}
+	snap.Shared = sh
+	return json.Marshal(snap)
+}
+
+func (r replicatedState) Restore(data []byte) error {
+	s := r.s
+	var snap clusterSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	if snap.Tenants == nil {
+		// Taken before tenants existed, so it's all the default tenant's
+		var legacy tenantSnapshot
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return err
+		}
+		snap.Tenants = map[string]tenantSnapshot{defaultTenant: legacy}
+	}
+	// A tenant this node knows but the snapshot doesn't had no data yet
+	// as of the snapshot, so it's reset too
+	for _, td := range s.tenants.all() {
+		if _, ok := snap.Tenants[td.id]; !ok {
+			snap.Tenants[td.id] = tenantSnapshot{Processes: json.RawMessage("{}"), Baseline: json.RawMessage("{}")}
+		}
+	}
+	incidents := 0
+	for id, ts := range snap.Tenants {
+		td := s.tenant(id)
+		if err := td.procs.unmarshal(ts.Processes); err != nil {
+			return fmt.Errorf("%s processes: %w", id, err)
+		}
+		if err := td.baseline.unmarshal(ts.Baseline); err != nil {
+			return fmt.Errorf("%s baseline: %w", id, err)
+		}
+		td.seenAlerts.restore(ts.SeenAlerts)
+		td.timeline.restore(ts.Timeline)
+		td.agents.restore(ts.Agents)
+		td.incidents.restore(ts.IncidentSeq, ts.Incidents)
+		td.commands.restore(ts.CommandSeq, ts.Commands)
+		incidents += len(ts.Incidents)
+	}
+	if sh := snap.Shared; sh != nil {
+		if err := s.restoreShared(sh); err != nil {
+			return err
+		}
+	}
+	s.logger.Info("Restored cluster snapshot", "tenants", len(snap.Tenants), "incidents", incidents)
+	return nil
+}
+
+// restoreShared replaces the rules, suppressions, feeds, hunts, reports
+// and credentials with a snapshot's.
+func (s *server) restoreShared(sh *sharedSnapshot) error {
+	if err := s.detector.restore(sh.Rules); err != nil {
+		return fmt.Errorf("rules: %w", err)
+	}
+	if err := s.suppress.restore(sh.SuppressionSeq, sh.Suppressions); err != nil {
+		return fmt.Errorf("suppressions: %w", err)
+	}
+	if _, err := s.loadIntelFeeds(sh.Intel, sh.IntelLoaded); err != nil {
+		return fmt.Errorf("intel: %w", err)
+	}
+	if err := s.hunts.restore(sh.HuntSeq, sh.Hunts); err != nil {
+		return fmt.Errorf("hunts: %w", err)
+	}
+	if err := s.reports.restore(sh.ReportSeq, sh.Reports); err != nil {
+		return fmt.Errorf("reports: %w", err)
+	}
+	if s.auth != nil {
+		if err := s.auth.restore(sh.Users, sh.Keys); err != nil {
+			return fmt.Errorf("credentials: %w", err)
+		}
+	}
+	return nil
+}
+
+// --- Handlers ---
+
+// handleCluster serves GET /cluster: this node's role, term and log
+// positions, and the followers' progress when it leads.
+func (s *server) handleCluster(w http.ResponseWriter, r *http.Request) {
+	if s.cluster == nil {
+		http.Error(w, "Not running in a cluster", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s.cluster.node.Status())
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"12-capstones/xdr-agent/raft"
+)
+
+type testNode struct {
+	id      string
+	s       *server
+	node    *raft.Node
+	handler http.Handler
+}
+
+// newTestCluster starts size servers replicating over an in-memory network.
+func newTestCluster(t *testing.T, size int) ([]*testNode, *raft.InmemNetwork) {
+	t.Helper()
+	nw := raft.NewInmemNetwork()
+	var ids []string
+	for i := 1; i <= size; i++ {
+		ids = append(ids, fmt.Sprintf("n%d", i))
+	}
+	var nodes []*testNode
+	for _, id := range ids {
+		s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+		node, err := s.startCluster(raft.Config{
+			ID:                id,
+			Peers:             ids,
+			ElectionTimeout:   50 * time.Millisecond,
+			HeartbeatInterval: 10 * time.Millisecond,
+			SnapshotThreshold: 20,
+			Logger:            s.logger,
+		}, nw.Transport(id), raft.NewMemoryStorage())
+		if err != nil {
+			t.Fatal(err)
+		}
+		nw.Add(node)
+		t.Cleanup(node.Stop)
+		nodes = append(nodes, &testNode{id: id, s: s, node: node, handler: s.routes()})
+	}
+	return nodes, nw
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// clusterLeader waits until the nodes other than skip agree on a leader.
+func clusterLeader(t *testing.T, nodes []*testNode, skip *testNode) *testNode {
+	t.Helper()
+	var leader *testNode
+	waitFor(t, "a leader", func() bool {
+		leader = nil
+		for _, n := range nodes {
+			if n != skip && n.node.IsLeader() {
+				leader = n
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, n := range nodes {
+			if n != skip && n.node.Status().Leader != leader.id {
+				return false
+			}
+		}
+		return true
+	})
+	return leader
+}
+
+// post sends an alert to one node's /audit and returns the status code.
+func (n *testNode) post(path string, v any) int {
+	body, _ := json.Marshal(v)
+	rr := httptest.NewRecorder()
+	n.handler.ServeHTTP(rr, httptest.NewRequest("POST", path, strings.NewReader(string(body))))
+	return rr.Code
+}
+
+// do sends a request with an API key to one node.
+func (n *testNode) do(method, path, key string, v any) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(v)
+	req := httptest.NewRequest(method, path, strings.NewReader(string(body)))
+	req.Header.Set("X-API-Key", key)
+	rr := httptest.NewRecorder()
+	n.handler.ServeHTTP(rr, req)
+	return rr
+}
+
+// sameState waits until every node has the reference node's incidents,
+// timeline and agents.
+func sameState(t *testing.T, ref *testNode, nodes ...*testNode) {
+	t.Helper()
+	for _, n := range nodes {
+		waitFor(t, n.id+" to match "+ref.id, func() bool {
+			return reflect.DeepEqual(n.s.tenant(defaultTenant).incidents.list(), ref.s.tenant(defaultTenant).incidents.list()) &&
+				reflect.DeepEqual(n.s.tenant(defaultTenant).timeline.snapshot(), ref.s.tenant(defaultTenant).timeline.snapshot()) &&
+				reflect.DeepEqual(n.s.tenant(defaultTenant).agents.list(), ref.s.tenant(defaultTenant).agents.list())
+		})
+	}
+}
+
+func TestClusterReplicatesAlerts(t *testing.T) {
+	nodes, _ := newTestCluster(t, 3)
+	leader := clusterLeader(t, nodes, nil)
+	var follower *testNode
+	for _, n := range nodes {
+		if n != leader {
+			follower = n
+			break
+		}
+	}
+
+	// Agents may talk to any node; a follower forwards to the leader
+	if code := follower.post("/audit", Alert{ID: "a1", AgentID: "web-1", EventType: "UNAUTHORIZED_ACCESS", Details: "miner_x running", Timestamp: 1700000000}); code != http.StatusOK {
+		t.Fatalf("POST /audit on a follower = %d", code)
+	}
+	if code := leader.post("/audit", Alert{ID: "a2", AgentID: "web-1", EventType: "FILE_MODIFIED", Details: "/etc/passwd accessed by unknown user", Timestamp: 1700000001}); code != http.StatusOK {
+		t.Fatalf("POST /audit on the leader = %d", code)
+	}
+	follower.post("/audit", Alert{ID: "a1", AgentID: "web-1", EventType: "UNAUTHORIZED_ACCESS", Details: "miner_x running", Timestamp: 1700000000})
+	if code := follower.post("/heartbeat", Heartbeat{AgentID: "db-1"}); code != http.StatusOK {
+		t.Fatalf("POST /heartbeat on a follower = %d", code)
+	}
+
+	// The follower returned only after applying its own writes
+	incs := follower.s.tenant(defaultTenant).incidents.list()
+	if len(incs) != 1 || len(incs[0].Detections) != 2 {
+		t.Fatalf("incidents on the follower = %+v, want one with both detections", incs)
+	}
+	sameState(t, follower, nodes...)
+	for _, n := range nodes {
+		if got := len(n.s.tenant(defaultTenant).timeline.between("web-1", time.Unix(0, 0), time.Now())); got != 2 {
+			t.Errorf("%s has %d events for web-1, want 2 (the resend is a duplicate)", n.id, got)
+		}
+		if agents := n.s.tenant(defaultTenant).agents.list(); len(agents) != 2 {
+			t.Errorf("%s knows agents %+v, want web-1 and db-1", n.id, agents)
+		}
+	}
+}
+
+func TestClusterLeaderFailover(t *testing.T) {
+	nodes, nw := newTestCluster(t, 3)
+	old := clusterLeader(t, nodes, nil)
+	old.post("/audit", Alert{ID: "a1", AgentID: "web-1", EventType: "AGENT_TAMPER", Details: "binary replaced", Timestamp: 1700000000})
+
+	nw.Disconnect(old.id)
+	leader := clusterLeader(t, nodes, old)
+	if code := leader.post("/audit", Alert{ID: "a2", AgentID: "web-2", EventType: "AGENT_TAMPER", Details: "binary replaced", Timestamp: 1700000001}); code != http.StatusOK {
+		t.Fatalf("POST /audit on the new leader = %d", code)
+	}
+
+	// The cut-off node can't commit, so it sends the agent elsewhere
+	waitFor(t, "the old leader to step down", func() bool { return !old.node.IsLeader() })
+	if code := old.post("/audit", Alert{ID: "a3", AgentID: "web-3", EventType: "AGENT_TAMPER", Timestamp: 1700000002}); code != http.StatusServiceUnavailable {
+		t.Errorf("POST /audit on a partitioned node = %d, want 503", code)
+	}
+
+	nw.Reconnect(old.id)
+	sameState(t, leader, nodes...)
+	if incs := old.s.tenant(defaultTenant).incidents.list(); len(incs) != 2 {
+		t.Errorf("rejoined node has %d incidents, want 2", len(incs))
+	}
+}
+
+func TestClusterNodeCatchesUpFromSnapshot(t *testing.T) {
+	nodes, nw := newTestCluster(t, 3)
+	leader := clusterLeader(t, nodes, nil)
+	var lagging *testNode
+	for _, n := range nodes {
+		if n != leader {
+			lagging = n
+			break
+		}
+	}
+	nw.Disconnect(lagging.id)
+
+	rule := Rule{ID: "local-1", Name: "Shell started", EventType: "PROCESS_START", Severity: "low"}
+	if _, err := leader.s.write("rule.put", rule); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 60 {
+		leader.post("/audit", Alert{
+			ID:        fmt.Sprintf("a%d", i),
+			AgentID:   fmt.Sprintf("web-%d", i%3),
+			EventType: "PROCESS_START",
+			Details:   "sh started",
+			Timestamp: 1700000000 + int64(i),
+			Fields:    map[string]string{"pid": fmt.Sprint(100 + i), "ppid": "1", "start": time.Unix(1700000000+int64(i), 0).UTC().Format(time.RFC3339Nano), "exe": "/bin/sh"},
+		})
+		leader.post("/audit", Alert{ID: fmt.Sprintf("m%d", i), AgentID: fmt.Sprintf("web-%d", i%3), EventType: "UNAUTHORIZED_ACCESS", Details: "miner_x running", Timestamp: 1700000000 + int64(i)})
+	}
+	if st := leader.node.Status(); st.SnapshotIndex == 0 {
+		t.Fatalf("leader never compacted its log: %+v", st)
+	}
+
+	nw.Reconnect(lagging.id)
+	sameState(t, leader, lagging)
+	if st := lagging.node.Status(); st.SnapshotIndex == 0 {
+		t.Errorf("lagging node caught up without a snapshot: %+v", st)
+	}
+	if tree := lagging.s.tenant(defaultTenant).procs.ancestry("web-1", 101, time.Unix(1700000001, 0)); len(tree) != 1 {
+		t.Errorf("process table wasn't restored: %+v", tree)
+	}
+	if !slices.Contains(lagging.s.detector.list(""), rule) {
+		t.Error("rule written while the node was away wasn't restored")
+	}
+
+	// Back in step, it applies new alerts like everyone else
+	if code := lagging.post("/audit", Alert{ID: "late", AgentID: "web-9", EventType: "AGENT_TAMPER", Timestamp: 1700001000}); code != http.StatusOK {
+		t.Fatalf("POST /audit after catching up = %d", code)
+	}
+	sameState(t, lagging, nodes...)
+}
+
+func TestClusterStatusEndpoint(t *testing.T) {
+	s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/cluster", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("GET /cluster standalone = %d, want 404", rr.Code)
+	}
+
+	nodes, _ := newTestCluster(t, 3)
+	leader := clusterLeader(t, nodes, nil)
+	rr = httptest.NewRecorder()
+	leader.handler.ServeHTTP(rr, httptest.NewRequest("GET", "/cluster", nil))
+	var st raft.Status
+	if err := json.NewDecoder(rr.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Role != raft.Leader || st.Leader != leader.id || len(st.Peers) != 2 {
+		t.Errorf("GET /cluster on the leader = %+v", st)
+	}
+
+	if _, err := parsePeers("n1=http://a:9090,n2=http://b:9090"); err == nil {
+		t.Error("a two-node cluster was accepted")
+	}
+	if _, err := parsePeers("n1=http://a:9090,n2,n3=http://c:9090"); err == nil {
+		t.Error("a peer without an address was accepted")
+	}
+}
+
+// TestClusterReplicatesWrites checks that what one node is told to change
+// holds on every node: alerts are judged by the same rules and
+// suppressions everywhere, and keys, hunts and commands work through any
+// node.
+func TestClusterReplicatesWrites(t *testing.T) {
+	nodes, _ := newTestCluster(t, 3)
+	for _, n := range nodes {
+		n.s.auth, _ = openAuthStore("", []byte("test-secret"))
+	}
+	leader := clusterLeader(t, nodes, nil)
+	var a, b *testNode // Two followers
+	for _, n := range nodes {
+		switch {
+		case n == leader:
+		case a == nil:
+			a = n
+		default:
+			b = n
+		}
+	}
+	// Writes reach the other nodes a moment after the one that took them
+	everywhere := func(what, key string, valid bool) {
+		t.Helper()
+		waitFor(t, what, func() bool {
+			for _, n := range nodes {
+				if _, err := n.s.auth.checkKey(key); (err == nil) != valid {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	k, admin, _ := newKey("admin", RoleAdmin, defaultTenant, time.Now())
+	if _, err := a.s.write("key.add", k); err != nil {
+		t.Fatal(err)
+	}
+	everywhere("the admin key on every node", admin, true)
+
+	rule := Rule{ID: "local-1", Name: "Netcat listener", EventType: "PROCESS_START", Contains: "nc -l", Severity: "high"}
+	if rr := a.do("PUT", "/rules/local-1", admin, rule); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT /rules on a follower = %d %s", rr.Code, rr.Body)
+	}
+	if rr := b.do("POST", "/suppressions", admin, suppressionRequest{AgentID: "build-1", Reason: "CI runs nc"}); rr.Code != http.StatusCreated {
+		t.Fatalf("POST /suppressions = %d %s", rr.Code, rr.Body)
+	}
+	rr := leader.do("POST", "/api-keys", admin, keyRequest{Name: "agents", Role: RoleAgent})
+	var created map[string]string
+	if err := json.NewDecoder(rr.Body).Decode(&created); err != nil || rr.Code != http.StatusCreated {
+		t.Fatalf("POST /api-keys = %d %v", rr.Code, err)
+	}
+	everywhere("the agent key on every node", created["key"], true)
+
+	// The agent key from the leader works on a follower, and every node
+	// runs the new rule and the suppression
+	for _, al := range []Alert{
+		{ID: "a1", AgentID: "web-1", EventType: "PROCESS_START", Details: "nc -l 4444", Timestamp: 1700000000},
+		{ID: "a2", AgentID: "build-1", EventType: "PROCESS_START", Details: "nc -l 8080", Timestamp: 1700000001},
+	} {
+		if rr := b.do("POST", "/audit", created["key"], al); rr.Code != http.StatusOK {
+			t.Fatalf("POST /audit with a key from another node = %d", rr.Code)
+		}
+	}
+	sameState(t, b, nodes...)
+	for _, n := range nodes {
+		incs := n.s.tenant(defaultTenant).incidents.list()
+		if len(incs) != 1 || incs[0].AgentID != "web-1" || incs[0].Detections[0].RuleID != "local-1" {
+			t.Errorf("%s has incidents %+v, want one for web-1 from local-1", n.id, incs)
+		}
+	}
+
+	// A hunt saved on a follower is there for whichever node leads
+	if rr := a.do("POST", "/hunts", admin, huntSaveRequest{Name: "listeners", Query: `event_type=PROCESS_START`, Schedule: "1h"}); rr.Code != http.StatusCreated {
+		t.Fatalf("POST /hunts = %d %s", rr.Code, rr.Body)
+	}
+	waitFor(t, "the hunt on the leader", func() bool { return len(leader.s.hunts.list(defaultTenant)) == 1 })
+
+	// A command queued on one node reaches an agent streaming from another
+	if rr := a.do("POST", "/agents/web-1/commands", admin, commandRequest{Action: "ping"}); rr.Code != http.StatusAccepted {
+		t.Fatalf("POST /agents/web-1/commands = %d %s", rr.Code, rr.Body)
+	}
+	waitFor(t, "the command on the other follower", func() bool { return b.s.tenant(defaultTenant).commands.pending() == 1 })
+	sent, err := writeAs[[]Command](b.s, "command.take", commandWrite{Tenant: defaultTenant, AgentID: "web-1"})
+	if err != nil || len(sent) != 1 {
+		t.Fatalf("command.take = %+v, %v", sent, err)
+	}
+	waitFor(t, "the command to be sent everywhere", func() bool {
+		for _, n := range nodes {
+			if n.s.tenant(defaultTenant).commands.pending() != 0 {
+				return false
+			}
+		}
+		return true
+	})
+
+	// Revoking on one node locks the key out of all of them
+	if rr := leader.do("DELETE", "/api-keys/agents", admin, nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /api-keys = %d", rr.Code)
+	}
+	everywhere("the revocation on every node", created["key"], false)
+}
+
+// TestClusterBootstrapsOneKey checks a new cluster gets one admin key, not
+// one per node.
+func TestClusterBootstrapsOneKey(t *testing.T) {
+	nodes, _ := newTestCluster(t, 3)
+	errs := make(chan error, len(nodes))
+	for _, n := range nodes {
+		n.s.auth, _ = openAuthStore("", []byte("test-secret"))
+		go func() { errs <- n.s.bootstrapAuth("the cluster") }()
+	}
+	for range nodes {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	leader := clusterLeader(t, nodes, nil)
+	waitFor(t, "the key on every node", func() bool {
+		for _, n := range nodes {
+			if !reflect.DeepEqual(n.s.auth.listKeys(""), leader.s.auth.listKeys("")) {
+				return false
+			}
+		}
+		return true
+	})
+	if keys := leader.s.auth.listKeys(""); len(keys) != 1 || keys[0].Role != RoleAdmin {
+		t.Errorf("keys after bootstrap = %+v, want one admin key", keys)
+	}
+}
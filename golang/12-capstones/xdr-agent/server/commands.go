@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Command states
+const (
+	CommandQueued = "queued" // Waiting for the agent to connect
+	CommandSent   = "sent"   // Pushed to the agent, no result yet
+	CommandDone   = "done"
+	CommandFailed = "failed"
+)
+
+// Actions an agent understands
+var knownActions = map[string]bool{
+	"ping":            true,
+	"kill_process":    true, // args: pid
+	"quarantine_file": true, // args: path
+	"isolate_host":    true,
+}
+
+// Command is a response action queued for one agent
+type Command struct {
+	ID      string            `json:"id"`
+	AgentID string            `json:"agent_id"`
+	Action  string            `json:"action"`
+	Args    map[string]string `json:"args,omitempty"`
+	Status  string            `json:"status"`
+	Output  string            `json:"output,omitempty"`
+	Created time.Time         `json:"created"`
+	Updated time.Time         `json:"updated"`
+}
+
+// commandQueue holds commands per agent and wakes the agent's command
+// stream when something new is queued. Commands are delivered at most
+// once: one that was sent but never answered is not resent.
+type commandQueue struct {
+	mu     sync.Mutex
+	seq    int
+	cmds   map[string][]*Command
+	wakeup map[string]chan struct{}
+}
+
+func newCommandQueue() *commandQueue {
+	return &commandQueue{
+		cmds:   make(map[string][]*Command),
+		wakeup: make(map[string]chan struct{}),
+	}
+}
+
+func (q *commandQueue) enqueue(agentID, action string, args map[string]string, now time.Time) Command {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	c := &Command{
+		ID:      fmt.Sprintf("CMD-%05d", q.seq),
+		AgentID: agentID,
+		Action:  action,
+		Args:    args,
+		Status:  CommandQueued,
+		Created: now,
+		Updated: now,
+	}
+	q.cmds[agentID] = append(q.cmds[agentID], c)
+	if ch, ok := q.wakeup[agentID]; ok {
+		close(ch)
+		delete(q.wakeup, agentID)
+	}
+	return *c
+}
+
+// wait returns a channel that is closed the next time a command is queued
+// for the agent.
+func (q *commandQueue) wait(agentID string) <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ch, ok := q.wakeup[agentID]
+	if !ok {
+		ch = make(chan struct{})
+		q.wakeup[agentID] = ch
+	}
+	return ch
+}
+
+// takeQueued marks the agent's queued commands as sent and returns them.
+func (q *commandQueue) takeQueued(agentID string, now time.Time) []Command {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var out []Command
+	for _, c := range q.cmds[agentID] {
+		if c.Status == CommandQueued {
+			c.Status, c.Updated = CommandSent, now
+			out = append(out, *c)
+		}
+	}
+	return out
+}
+
+func (q *commandQueue) complete(agentID, id string, ok bool, output string, now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, c := range q.cmds[agentID] {
+		if c.ID == id {
+			c.Status, c.Output, c.Updated = CommandFailed, output, now
+			if ok {
+				c.Status = CommandDone
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot returns the ID sequence and copies of every agent's commands.
+func (q *commandQueue) snapshot() (int, map[string][]Command) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make(map[string][]Command, len(q.cmds))
+	for agentID, cmds := range q.cmds {
+		for _, c := range cmds {
+			out[agentID] = append(out[agentID], *c)
+		}
+	}
+	return q.seq, out
+}
+
+// restore replaces the commands, from a cluster snapshot, and wakes every
+// waiting stream to look for new ones.
+func (q *commandQueue) restore(seq int, cmds map[string][]Command) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.seq, q.cmds = seq, make(map[string][]*Command, len(cmds))
+	for agentID, list := range cmds {
+		for _, c := range list {
+			q.cmds[agentID] = append(q.cmds[agentID], &c)
+		}
+	}
+	for agentID, ch := range q.wakeup {
+		close(ch)
+		delete(q.wakeup, agentID)
+	}
+}
+
+// pending counts commands still waiting for their agent, across agents.
+func (q *commandQueue) pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, cmds := range q.cmds {
+		for _, c := range cmds {
+			if c.Status == CommandQueued {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func (q *commandQueue) list(agentID string) []Command {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make([]Command, 0, len(q.cmds[agentID]))
+	for _, c := range q.cmds[agentID] {
+		out = append(out, *c)
+	}
+	return out
+}
+
+// commandWrite is the arguments of the command.* writes
+type commandWrite struct {
+	Tenant  string            `json:"tenant"`
+	AgentID string            `json:"agent_id"`
+	Action  string            `json:"action,omitempty"` // command.queue
+	Args    map[string]string `json:"args,omitempty"`
+	ID      string            `json:"id,omitempty"` // command.complete
+	OK      bool              `json:"ok,omitempty"`
+	Output  string            `json:"output,omitempty"`
+}
+
+func applyQueueCommand(s *server, c commandWrite, now time.Time) (any, error) {
+	return s.tenant(c.Tenant).commands.enqueue(c.AgentID, c.Action, c.Args, now), nil
+}
+
+func applyTakeCommands(s *server, c commandWrite, now time.Time) (any, error) {
+	return s.tenant(c.Tenant).commands.takeQueued(c.AgentID, now), nil
+}
+
+func applyCompleteCommand(s *server, c commandWrite, now time.Time) (any, error) {
+	return s.tenant(c.Tenant).commands.complete(c.AgentID, c.ID, c.OK, c.Output, now), nil
+}
+
+// --- Handlers ---
+
+type commandRequest struct {
+	Action string            `json:"action"`
+	Args   map[string]string `json:"args"`
+}
+
+func (s *server) handleQueueCommand(w http.ResponseWriter, r *http.Request) {
+	var req commandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if !knownActions[req.Action] {
+		http.Error(w, fmt.Sprintf("Unknown action %q", req.Action), http.StatusBadRequest)
+		return
+	}
+	// Queuing is allowed per action: analysts can ping, only responders
+	// can touch processes and files
+	if !s.authorize(w, r, "action."+req.Action) {
+		return
+	}
+
+	td := s.data(r)
+	c, err := writeAs[Command](s, "command.queue", commandWrite{Tenant: td.id, AgentID: r.PathValue("id"), Action: req.Action, Args: req.Args})
+	if s.writeFailed(w, err, http.StatusInternalServerError) {
+		return
+	}
+	s.logger.Info("Command queued", "tenant", td.id, "agent", c.AgentID, "command", c.ID, "action", c.Action, "by", analyst(r))
+	writeJSONStatus(w, http.StatusAccepted, c)
+}
+
+func (s *server) handleListCommands(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.data(r).commands.list(r.PathValue("id")))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Detections on the same agent closer together than this belong to the
+// same incident.
+const incidentWindow = 30 * time.Minute
+
+// Incident groups related detections on one host
+type Incident struct {
+	ID         string      `json:"id"`
+	Tenant     string      `json:"tenant"`
+	AgentID    string      `json:"agent_id"`
+	Severity   string      `json:"severity"` // Highest of its detections
+	Tactics    []string    `json:"tactics"`
+	Detections []Detection `json:"detections"`
+	FirstSeen  time.Time   `json:"first_seen"`
+	LastSeen   time.Time   `json:"last_seen"`
+}
+
+// correlator folds detections into incidents. IDs are sequential so a
+// replayed recording yields the exact same incidents; each tenant has its
+// own correlator and numbering.
+type correlator struct {
+	mu     sync.Mutex
+	window time.Duration
+	seq    int
+	open   map[string]*Incident // Latest incident per agent
+	all    []*Incident
+}
+
+func newCorrelator(window time.Duration) *correlator {
+	return &correlator{window: window, open: make(map[string]*Incident)}
+}
+
+// add attaches d to the agent's current incident, or opens a new one if
+// the last detection is older than the window. It returns a copy of the
+// incident and whether it was just created.
+func (c *correlator) add(d Detection) (Incident, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	inc, ok := c.open[d.AgentID]
+	created := !ok || d.Time.Sub(inc.LastSeen) > c.window
+	if created {
+		c.seq++
+		inc = &Incident{
+			ID:        fmt.Sprintf("INC-%04d", c.seq),
+			Tenant:    d.Tenant,
+			AgentID:   d.AgentID,
+			Severity:  d.Severity,
+			FirstSeen: d.Time,
+		}
+		c.open[d.AgentID] = inc
+		c.all = append(c.all, inc)
+	}
+
+	inc.Detections = append(inc.Detections, d)
+	inc.LastSeen = d.Time
+	if severityRank[d.Severity] > severityRank[inc.Severity] {
+		inc.Severity = d.Severity
+	}
+	if d.Tactic != "" && !slices.Contains(inc.Tactics, d.Tactic) {
+		inc.Tactics = append(inc.Tactics, d.Tactic)
+	}
+	return inc.clone(), created
+}
+
+func (c *correlator) list() []Incident {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]Incident, len(c.all))
+	for i, inc := range c.all {
+		out[i] = inc.clone()
+	}
+	return out
+}
+
+func (c *correlator) get(id string) (Incident, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, inc := range c.all {
+		if inc.ID == id {
+			return inc.clone(), true
+		}
+	}
+	return Incident{}, false
+}
+
+// restore replaces every incident, e.g. from a cluster snapshot. seq is
+// the last ID handed out.
+func (c *correlator) restore(seq int, incidents []Incident) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq = seq
+	c.open = make(map[string]*Incident)
+	c.all = nil
+	for _, inc := range incidents {
+		inc := inc.clone()
+		c.open[inc.AgentID] = &inc // The last one per agent is the open one
+		c.all = append(c.all, &inc)
+	}
+}
+
+// snapshot returns the last ID handed out and every incident.
+func (c *correlator) snapshot() (int, []Incident) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]Incident, len(c.all))
+	for i, inc := range c.all {
+		out[i] = inc.clone()
+	}
+	return c.seq, out
+}
+
+func (inc *Incident) clone() Incident {
+	out := *inc
+	out.Tactics = append([]string(nil), inc.Tactics...)
+	out.Detections = append([]Detection(nil), inc.Detections...)
+	return out
+}
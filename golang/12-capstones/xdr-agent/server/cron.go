@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five-field cron expression: minute, hour, day of
+// month, month and day of week. Each field is a bit set of the values it
+// allows.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// With both day fields restricted, either one matching is enough, as
+	// in cron(8)
+	domAny, dowAny bool
+}
+
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseCron reads "m h dom mon dow" with *, lists, ranges, steps and
+// month and day names, or one of the @hourly/@daily/@weekly/@monthly
+// macros.
+func parseCron(expr string) (*cronSchedule, error) {
+	if m, ok := cronMacros[strings.TrimSpace(expr)]; ok {
+		expr = m
+	}
+	f := strings.Fields(expr)
+	if len(f) != 5 {
+		return nil, fmt.Errorf("cron expression %q needs 5 fields, has %d", expr, len(f))
+	}
+	c := &cronSchedule{domAny: f[2] == "*", dowAny: f[4] == "*"}
+	var err error
+	if c.minute, err = parseCronField(f[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if c.hour, err = parseCronField(f[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if c.dom, err = parseCronField(f[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if c.month, err = parseCronField(f[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	// 7 is Sunday too
+	if c.dow, err = parseCronField(f[4], 0, 7, dayNames); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// parseCronField turns one field into a bit set. names, if given, are the
+// values from lo upwards.
+func parseCronField(field string, lo, hi int, names []string) (uint64, error) {
+	value := func(s string) (int, error) {
+		for i, n := range names {
+			if strings.EqualFold(s, n) {
+				return lo + i, nil
+			}
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil || v < lo || v > hi {
+			return 0, fmt.Errorf("%q is not in %d-%d", s, lo, hi)
+		}
+		return v, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step %q", stepStr)
+			}
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = value(a); err != nil {
+				return 0, err
+			}
+			to = from
+			if isRange {
+				if to, err = value(b); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				to = hi // "5/15" is 5, 20, 35, 50
+			}
+			if to < from {
+				return 0, fmt.Errorf("range %q runs backwards", rng)
+			}
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// next returns the first time after after that the schedule fires, in
+// after's location, or the zero time if it never does (e.g. "0 0 31 2 *").
+// A time skipped by a daylight saving change fires just after the gap.
+func (c *cronSchedule) next(after time.Time) time.Time {
+	loc := after.Location()
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		y, mo, d := t.Date()
+		switch {
+		case c.month&(1<<int(mo)) == 0:
+			t = time.Date(y, mo+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = time.Date(y, mo, d+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<t.Hour()) == 0:
+			want := t.Hour() + 1
+			t = time.Date(y, mo, d, want, 0, 0, 0, loc)
+			// The clocks went forward over a wanted hour: fire after the
+			// gap rather than skip the day
+			if want < 24 && t.Hour() != want && c.hour&(1<<want) != 0 {
+				return time.Date(y, mo, d, want, bits.TrailingZeros64(c.minute), 0, 0, loc)
+			}
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no tzdata:", err)
+	}
+	// Monday 2026-03-02 09:30 UTC
+	mon := time.Date(2026, 3, 2, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		{"0 8 * * 1", mon, time.Date(2026, 3, 9, 8, 0, 0, 0, time.UTC)},
+		{"0 8 * * mon", mon.Add(-2 * time.Hour), time.Date(2026, 3, 2, 8, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", mon.Add(time.Second), time.Date(2026, 3, 2, 9, 45, 0, 0, time.UTC)},
+		{"5/20 9-10 * * *", mon, time.Date(2026, 3, 2, 9, 45, 0, 0, time.UTC)},
+		{"@monthly", mon, time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", mon, time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches once both are restricted: the 13th or a Friday
+		{"0 12 13 * 5", mon, time.Date(2026, 3, 6, 12, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", mon, time.Date(2026, 3, 8, 0, 0, 0, 0, time.UTC)},
+		// 02:30 doesn't exist on the day clocks go forward
+		{"30 2 * * *", time.Date(2026, 3, 28, 12, 0, 0, 0, berlin), time.Date(2026, 3, 29, 3, 30, 0, 0, berlin)},
+		{"0 0 31 2 *", mon, time.Time{}},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := c.next(tt.after); !got.Equal(tt.want) {
+			t.Errorf("%q after %v = %v; want %v", tt.expr, tt.after, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "0 0 0 * *", "* * * 13 *", "*/0 * * * *", "5-1 * * * *", "0 8 * * funday"} {
+		if _, err := parseCron(bad); err == nil {
+			t.Errorf("parseCron(%q) accepted", bad)
+		}
+	}
+}
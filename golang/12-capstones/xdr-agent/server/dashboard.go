@@ -0,0 +1,32 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The web console is compiled into the binary so the server needs nothing
+// else on disk, and nothing from the internet, to serve it.
+//
+//go:embed web
+var webAssets embed.FS
+
+// dashboardCSP keeps the console on same-origin scripts, styles and API
+// calls. It also stops a stray external URL from ever loading.
+const dashboardCSP = "default-src 'self'; img-src 'self' data:; frame-ancestors 'none'"
+
+// dashboardHandler serves the console under /ui/. The assets are public;
+// the API calls they make are authenticated as usual.
+func dashboardHandler() http.Handler {
+	assets, err := fs.Sub(webAssets, "web")
+	if err != nil {
+		panic(err)
+	}
+	files := http.StripPrefix("/ui/", http.FileServerFS(assets))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", dashboardCSP)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		files.ServeHTTP(w, r)
+	})
+}
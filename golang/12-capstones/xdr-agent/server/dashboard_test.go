@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDashboardServed(t *testing.T) {
+	handler := newServer(slog.New(slog.NewTextHandler(io.Discard, nil))).routes()
+	get := func(url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+		return rr
+	}
+
+	if rr := get("/"); rr.Code != http.StatusFound || rr.Header().Get("Location") != "/ui/" {
+		t.Errorf("GET / = %d to %q; want a redirect to /ui/", rr.Code, rr.Header().Get("Location"))
+	}
+	rr := get("/ui/")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `<script src="app.js">`) {
+		t.Fatalf("GET /ui/ = %d:\n%s", rr.Code, rr.Body)
+	}
+	if csp := rr.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "default-src 'self'") {
+		t.Errorf("Content-Security-Policy = %q", csp)
+	}
+	for _, f := range []string{"app.js", "style.css"} {
+		if rr := get("/ui/" + f); rr.Code != http.StatusOK {
+			t.Errorf("GET /ui/%s = %d", f, rr.Code)
+		}
+	}
+}
+
+// The console has to work air-gapped, so no asset may pull anything from
+// another host.
+func TestDashboardHasNoExternalURLs(t *testing.T) {
+	external := regexp.MustCompile(`(?i)(https?:)?//[a-z0-9.-]+\.[a-z]{2,}`)
+	err := fs.WalkDir(webAssets, "web", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(webAssets, path)
+		if err != nil {
+			return err
+		}
+		for _, m := range external.FindAllString(string(data), -1) {
+			t.Errorf("%s references %s", filepath.Base(path), m)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRulesAPI(t *testing.T) {
+	s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s.detector.path = filepath.Join(t.TempDir(), "rules.json")
+	handler := s.routes()
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return rr
+	}
+	miner := Alert{AgentID: "web-1", EventType: "UNAUTHORIZED_ACCESS", Details: "miner_x running"}
+
+	if rr := do("PUT", "/rules/xdr-001", `{"name":"Miner","event_type":"UNAUTHORIZED_ACCESS","severity":"severe"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("PUT with a bad severity = %d; want 400", rr.Code)
+	}
+	if rr := do("PUT", "/rules/xdr-001", `{"name":"Miner","event_type":"UNAUTHORIZED_ACCESS","contains":"miner","severity":"high","disabled":true}`); rr.Code != http.StatusOK {
+		t.Fatalf("PUT = %d: %s", rr.Code, rr.Body)
+	}
+	if got := s.detector.detect(miner, s.now()); len(got) != 0 {
+		t.Errorf("disabled rule still fired: %+v", got)
+	}
+	rr := do("PUT", "/rules/custom-1", `{"name":"Netcat","event_type":"PROCESS_START","contains":"nc -l","severity":"medium"}`)
+	if rr.Code != http.StatusCreated {
+		t.Errorf("PUT new rule = %d; want 201", rr.Code)
+	}
+	// What the client saw, not the header map set after the status went out
+	if ct := rr.Result().Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("PUT new rule Content-Type = %q; want application/json", ct)
+	}
+	if rr := do("DELETE", "/rules/custom-1", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("DELETE = %d; want 204", rr.Code)
+	}
+	if rr := do("DELETE", "/rules/custom-1", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("second DELETE = %d; want 404", rr.Code)
+	}
+
+	var rules []Rule
+	json.NewDecoder(do("GET", "/rules", "").Body).Decode(&rules)
+	if len(rules) != len(defaultRules) || !rules[0].Disabled {
+		t.Errorf("GET /rules = %+v", rules)
+	}
+	if defaultRules[0].Disabled {
+		t.Error("editing a rule changed the built-in defaults")
+	}
+
+	// Edits survive a restart
+	d, err := openDetector(s.detector.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.list(""); len(got) != len(defaultRules) || !got[0].Disabled {
+		t.Errorf("reloaded rules = %+v", got)
+	}
+
+	var actions []string
+	for _, e := range s.audit.entries {
+		actions = append(actions, e.Action)
+	}
+	if want := "rule.update rule.create rule.delete"; strings.Join(actions, " ") != want {
+		t.Errorf("audit actions = %v; want %s", actions, want)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "sync"
+
+// recentIDs remembers the last N alert IDs so resends from an agent's spool
+// (after a timeout or crash) aren't processed twice.
+type recentIDs struct {
+	mu    sync.Mutex
+	max   int
+	seen  map[string]bool
+	order []string
+}
+
+func newRecentIDs(max int) *recentIDs {
+	return &recentIDs{max: max, seen: make(map[string]bool)}
+}
+
+// add records id and reports whether it was new. Empty IDs (older agents)
+// are always new.
+func (r *recentIDs) add(id string) bool {
+	if id == "" {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seen[id] {
+		return false
+	}
+	r.seen[id] = true
+	r.order = append(r.order, id)
+	if len(r.order) > r.max {
+		delete(r.seen, r.order[0])
+		r.order = r.order[1:]
+	}
+	return true
+}
+
+// list returns the remembered IDs, oldest first.
+func (r *recentIDs) list() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.order...)
+}
+
+// restore replaces what's remembered with ids, oldest first.
+func (r *recentIDs) restore(ids []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen = make(map[string]bool, len(ids))
+	r.order = nil
+	for _, id := range ids[max(0, len(ids)-r.max):] {
+		r.seen[id] = true
+		r.order = append(r.order, id)
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rule turns a matching alert into a detection
+type Rule struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	EventType string `json:"event_type"`
+	Contains  string `json:"contains,omitempty"` // Substring of Details, optional
+	Severity  string `json:"severity"`           // low, medium, high, critical
+	Tactic    string `json:"tactic,omitempty"`   // MITRE ATT&CK tactic
+	Disabled  bool   `json:"disabled,omitempty"`
+
+	// Tenant limits the rule to one tenant's alerts. Empty makes it a
+	// global rule, run for every tenant and managed by operators only.
+	Tenant string `json:"tenant,omitempty"`
+
+	// IntelConfidence makes this a threat-intel rule: it matches alerts with
+	// an indicator hit at least this confident. EventType is then optional.
+	IntelConfidence int `json:"intel_confidence,omitempty"`
+}
+
+func (r Rule) matches(a Alert) bool {
+	if r.Disabled || !r.visibleTo(a.Tenant) {
+		return false
+	}
+	if r.IntelConfidence > 0 {
+		return (r.EventType == "" || r.EventType == a.EventType) && maxIntelConfidence(a) >= r.IntelConfidence
+	}
+	return r.EventType == a.EventType && strings.Contains(a.Details, r.Contains)
+}
+
+// visibleTo reports whether the rule applies to, and can be seen by, the
+// tenant.
+func (r Rule) visibleTo(tenant string) bool {
+	return r.Tenant == "" || r.Tenant == tenantOrDefault(tenant)
+}
+
+func (r Rule) validate() error {
+	switch {
+	case r.ID == "" || strings.ContainsAny(r.ID, "/ "):
+		return fmt.Errorf("rule needs an id without spaces or slashes")
+	case r.Name == "":
+		return fmt.Errorf("rule needs a name")
+	case severityRank[r.Severity] == 0:
+		return fmt.Errorf("severity must be low, medium, high or critical")
+	case r.EventType == "" && r.IntelConfidence == 0:
+		return fmt.Errorf("rule needs an event_type or intel_confidence")
+	case r.IntelConfidence < 0 || r.IntelConfidence > 100:
+		return fmt.Errorf("intel_confidence must be 0-100")
+	case r.Tenant != "" && !validTenant(r.Tenant):
+		return fmt.Errorf("bad tenant %q", r.Tenant)
+	}
+	return nil
+}
+
+func maxIntelConfidence(a Alert) int {
+	best := 0
+	for _, m := range a.Intel {
+		best = max(best, m.Confidence)
+	}
+	return best
+}
+
+// defaultRules ship with the server
+var defaultRules = []Rule{
+	{ID: "xdr-001", Name: "Crypto-miner signature detected!", EventType: "UNAUTHORIZED_ACCESS", Contains: "miner", Severity: "high", Tactic: "Impact"},
+	{ID: "xdr-002", Name: "Agent tampering detected!", EventType: "AGENT_TAMPER", Severity: "critical", Tactic: "Defense Evasion"},
+	{ID: "xdr-003", Name: "Credential file accessed", EventType: "FILE_MODIFIED", Contains: "/etc/passwd", Severity: "medium", Tactic: "Credential Access"},
+	{ID: "xdr-004", Name: "Vulnerable package installed", EventType: "VULNERABLE_PACKAGE", Severity: "medium", Tactic: "Initial Access"},
+	{ID: "xdr-005", Name: "Known malicious indicator observed", IntelConfidence: 70, Severity: "high"},
+	{ID: "xdr-006", Name: "Unusual behavior for this host", EventType: "BEHAVIOR_ANOMALY", Severity: "low"},
+	{ID: "xdr-007", Name: "Threat hunt match", EventType: "HUNT_MATCH", Severity: "medium"},
+	{ID: "xdr-008", Name: "Download piped to a shell", EventType: "SUSPICIOUS_COMMAND", Contains: "download piped to a shell", Severity: "high", Tactic: "Execution"},
+	{ID: "xdr-009", Name: "Library preloaded into a command", EventType: "SUSPICIOUS_COMMAND", Contains: "LD_PRELOAD=", Severity: "high", Tactic: "Defense Evasion"},
+	{ID: "xdr-010", Name: "Agent went silent", EventType: "AGENT_LOST", Severity: "medium", Tactic: "Defense Evasion"},
+}
+
+var severityRank = map[string]int{"low": 1, "medium": 2, "high": 3, "critical": 4}
+
+// Detection is one rule match on one alert
+type Detection struct {
+	RuleID   string    `json:"rule_id"`
+	RuleName string    `json:"rule_name"`
+	Severity string    `json:"severity"`
+	Tactic   string    `json:"tactic,omitempty"`
+	AlertID  string    `json:"alert_id,omitempty"`
+	Tenant   string    `json:"tenant"`
+	AgentID  string    `json:"agent_id"`
+	Time     time.Time `json:"time"`
+}
+
+// errRuleConflict is a tenant rule and a global rule wanting the same ID.
+// Tenants may reuse each other's IDs, but never a global one, so a
+// detection's rule ID always means one rule to the tenant.
+var errRuleConflict = errors.New("a global rule and a tenant rule can't share an ID")
+
+// detector evaluates alerts against the rule set. With a path, rule edits
+// are saved there and survive a restart.
+type detector struct {
+	mu    sync.RWMutex
+	path  string
+	rules []Rule
+}
+
+func newDetector(rules []Rule) *detector {
+	return &detector{rules: rules}
+}
+
+func (d *detector) detect(a Alert, now time.Time) []Detection {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var out []Detection
+	for _, r := range d.rules {
+		if !r.matches(a) {
+			continue
+		}
+		out = append(out, Detection{
+			RuleID:   r.ID,
+			RuleName: r.Name,
+			Severity: r.Severity,
+			Tactic:   r.Tactic,
+			AlertID:  a.ID,
+			Tenant:   a.Tenant,
+			AgentID:  a.AgentID,
+			Time:     now,
+		})
+	}
+	return out
+}
+
+// openDetector loads the rules saved in path, or starts from the defaults
+// when there are none yet.
+func openDetector(path string) (*detector, error) {
+	d := newDetector(slices.Clone(defaultRules))
+	d.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &d.rules); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return d, nil
+}
+
+// saveLocked writes the rules atomically. Callers hold mu.
+func (d *detector) saveLocked() error {
+	if d.path == "" {
+		return nil
+	}
+	data, _ := json.MarshalIndent(d.rules, "", "  ")
+	tmp := d.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path)
+}
+
+// list returns the global rules and the tenant's own, or every rule when
+// tenant is empty.
+func (d *detector) list(tenant string) []Rule {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if tenant == "" {
+		return slices.Clone(d.rules)
+	}
+	out := []Rule{}
+	for _, r := range d.rules {
+		if r.visibleTo(tenant) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// put adds a rule or replaces the one with the same ID and tenant,
+// returning the old rule if there was one.
+func (d *detector) put(r Rule) (old Rule, replaced bool, err error) {
+	if err := r.validate(); err != nil {
+		return Rule{}, false, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, x := range d.rules {
+		if x.ID == r.ID && x.Tenant != r.Tenant && (x.Tenant == "" || r.Tenant == "") {
+			return Rule{}, false, errRuleConflict
+		}
+	}
+	if i := slices.IndexFunc(d.rules, func(x Rule) bool { return x.ID == r.ID && x.Tenant == r.Tenant }); i >= 0 {
+		old, replaced = d.rules[i], true
+		d.rules[i] = r
+	} else {
+		d.rules = append(d.rules, r)
+	}
+	return old, replaced, d.saveLocked()
+}
+
+// restore replaces every rule, from a cluster snapshot.
+func (d *detector) restore(rules []Rule) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rules = slices.Clone(rules)
+	return d.saveLocked()
+}
+
+// remove deletes a tenant's rule, or a global one when tenant is empty.
+func (d *detector) remove(tenant, id string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := len(d.rules)
+	d.rules = slices.DeleteFunc(d.rules, func(r Rule) bool { return r.ID == id && r.Tenant == tenant })
+	if len(d.rules) == n {
+		return false, nil
+	}
+	return true, d.saveLocked()
+}
+
+// rulePut is what a rule.put write returns
+type rulePut struct {
+	Old      Rule
+	Replaced bool
+}
+
+func applyPutRule(s *server, r Rule, now time.Time) (any, error) {
+	old, replaced, err := s.detector.put(r)
+	return rulePut{old, replaced}, err
+}
+
+func applyDeleteRule(s *server, ref storeRef, now time.Time) (any, error) {
+	return s.detector.remove(ref.Tenant, ref.ID)
+}
+
+// --- Handlers ---
+
+// handleRules lists the global rules and the caller's tenant's. Operators
+// see every tenant's.
+func (s *server) handleRules(w http.ResponseWriter, r *http.Request) {
+	p := s.principal(r)
+	if p.operator() {
+		writeJSON(w, s.detector.list(""))
+		return
+	}
+	writeJSON(w, s.detector.list(p.Tenant))
+}
+
+// ruleTenant is the tenant a rule write from p applies to. Operators pick
+// one (or none for a global rule) with the tenant field or parameter;
+// everyone else only writes their own tenant's rules.
+func (s *server) ruleTenant(w http.ResponseWriter, r *http.Request, p Principal, asked, id string) (string, bool) {
+	if p.operator() {
+		return asked, true
+	}
+	if asked != "" && asked != p.Tenant {
+		s.denied(r, p, PermRulesWrite, "other tenant")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "", false
+	}
+	if slices.ContainsFunc(s.detector.list(p.Tenant), func(x Rule) bool { return x.ID == id && x.Tenant == "" }) {
+		s.denied(r, p, PermRulesWrite, "global rule")
+		http.Error(w, "Global rules are managed by the server's operators", http.StatusForbidden)
+		return "", false
+	}
+	return p.Tenant, true
+}
+
+// ruleTestRequest is the body of POST /rules/test
+type ruleTestRequest struct {
+	Rules  []Rule  `json:"rules"`
+	Alerts []Alert `json:"alerts"`
+}
+
+// ruleTestResult is what one candidate rule would have done
+type ruleTestResult struct {
+	RuleID  string   `json:"rule_id"`
+	Error   string   `json:"error,omitempty"`
+	Matches []string `json:"matches"` // Alert IDs, or #index for alerts without one
+}
+
+// handleTestRules serves POST /rules/test. It validates candidate rules and
+// runs them over sample alerts without touching the live rule set. The
+// alerts get the same intel enrichment as on ingest, so intel rules can be
+// tried too.
+func (s *server) handleTestRules(w http.ResponseWriter, r *http.Request) {
+	var req ruleTestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	now := s.now()
+	for i := range req.Alerts {
+		req.Alerts[i].Intel = s.intel.match(req.Alerts[i], now)
+	}
+
+	out := make([]ruleTestResult, 0, len(req.Rules))
+	for _, rule := range req.Rules {
+		rule.Tenant = "" // A candidate is tried on the samples whichever tenant it's for
+		res := ruleTestResult{RuleID: rule.ID, Matches: []string{}}
+		if err := rule.validate(); err != nil {
+			res.Error = err.Error()
+			out = append(out, res)
+			continue
+		}
+		for i, a := range req.Alerts {
+			if !rule.matches(a) {
+				continue
+			}
+			id := a.ID
+			if id == "" {
+				id = fmt.Sprintf("#%d", i)
+			}
+			res.Matches = append(res.Matches, id)
+		}
+		out = append(out, res)
+	}
+	writeJSON(w, out)
+}
+
+// ruleChanges lists the fields that differ between two versions of a rule,
+// for the audit log.
+func ruleChanges(old, cur Rule) []FieldChange {
+	var out []FieldChange
+	for _, f := range []struct {
+		name     string
+		from, to any
+	}{
+		{"name", old.Name, cur.Name},
+		{"event_type", old.EventType, cur.EventType},
+		{"contains", old.Contains, cur.Contains},
+		{"severity", old.Severity, cur.Severity},
+		{"tactic", old.Tactic, cur.Tactic},
+		{"intel_confidence", old.IntelConfidence, cur.IntelConfidence},
+		{"disabled", old.Disabled, cur.Disabled},
+	} {
+		from, to := fmt.Sprint(f.from), fmt.Sprint(f.to)
+		if from != to {
+			out = append(out, FieldChange{Field: f.name, From: from, To: to})
+		}
+	}
+	return out
+}
+
+// handlePutRule serves PUT /rules/{id}, creating or replacing the rule.
+func (s *server) handlePutRule(w http.ResponseWriter, r *http.Request) {
+	var rule Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	rule.ID = r.PathValue("id")
+	p := s.principal(r)
+	var ok bool
+	if rule.Tenant, ok = s.ruleTenant(w, r, p, rule.Tenant, rule.ID); !ok {
+		return
+	}
+	put, err := writeAs[rulePut](s, "rule.put", rule)
+	if errors.Is(err, errRuleConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if s.writeFailed(w, err, http.StatusBadRequest) {
+		return
+	}
+	old, replaced := put.Old, put.Replaced
+
+	action := "rule.create"
+	if replaced {
+		action = "rule.update"
+	}
+	who := p.Name
+	if _, err := s.audit.append(AuditEntry{Time: s.now(), Tenant: tenantOrDefault(rule.Tenant), Actor: who, Action: action, Target: rule.ID, Changes: ruleChanges(old, rule)}); err != nil {
+		s.logger.Error("Failed to audit rule change", "rule", rule.ID, "error", err)
+	}
+	s.logger.Info("Rule saved", "rule", rule.ID, "tenant", rule.Tenant, "disabled", rule.Disabled, "by", who)
+	status := http.StatusOK
+	if !replaced {
+		status = http.StatusCreated
+	}
+	writeJSONStatus(w, status, rule)
+}
+
+// handleDeleteRule serves DELETE /rules/{id}. Operators delete a tenant's
+// rule with ?tenant=, a global one without.
+func (s *server) handleDeleteRule(w http.ResponseWriter, r *http.Request) {
+	id, p := r.PathValue("id"), s.principal(r)
+	tenant, ok := s.ruleTenant(w, r, p, r.URL.Query().Get("tenant"), id)
+	if !ok {
+		return
+	}
+	ok, err := writeAs[bool](s, "rule.delete", storeRef{Tenant: tenant, ID: id})
+	if s.writeFailed(w, err, http.StatusInternalServerError) {
+		return
+	}
+	if !ok {
+		http.Error(w, "Rule not found", http.StatusNotFound)
+		return
+	}
+	who := p.Name
+	if _, err := s.audit.append(AuditEntry{Time: s.now(), Tenant: tenantOrDefault(tenant), Actor: who, Action: "rule.delete", Target: id}); err != nil {
+		s.logger.Error("Failed to audit rule change", "rule", id, "error", err)
+	}
+	s.logger.Info("Rule deleted", "rule", id, "tenant", tenant, "by", who)
+	w.WriteHeader(http.StatusNoContent)
+}
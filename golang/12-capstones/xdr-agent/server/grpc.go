@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"12-capstones/xdr-agent/xdrpb"
+)
+
+// grpcService exposes the server over gRPC. It feeds the same ingest path
+// as the /audit endpoint, which stays up for older HTTP agents.
+type grpcService struct {
+	xdrpb.UnimplementedXDRServer
+	s *server
+}
+
+// StreamAlerts acks every alert once it's ingested. HTTP/2 flow control
+// pushes back on an agent that sends faster than we ingest.
+func (g *grpcService) StreamAlerts(stream xdrpb.XDR_StreamAlertsServer) error {
+	tenant := g.tenantOf(stream.Context())
+	for {
+		a, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		isNew, err := g.s.accept(Alert{
+			ID:        a.GetId(),
+			Tenant:    tenant,
+			AgentID:   a.GetAgentId(),
+			EventType: a.GetEventType(),
+			Details:   a.GetDetails(),
+			Timestamp: a.GetTimestamp(),
+			Fields:    a.GetFields(),
+		})
+		if err != nil {
+			// Unacked alerts stay in the agent's spool for another node
+			return status.Error(codes.Unavailable, err.Error())
+		}
+		if err := stream.Send(&xdrpb.AlertAck{Id: a.GetId(), Duplicate: !isNew}); err != nil {
+			return err
+		}
+	}
+}
+
+func (g *grpcService) SendHeartbeat(ctx context.Context, hb *xdrpb.Heartbeat) (*xdrpb.HeartbeatReply, error) {
+	if hb.GetAgentId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "agent_id is required")
+	}
+	beat := Heartbeat{AgentID: hb.GetAgentId(), Timestamp: hb.GetTimestamp(), Version: hb.GetVersion(), Group: hb.GetGroup()}
+	if err := g.s.heartbeat(g.tenantOf(ctx), beat); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	reply := &xdrpb.HeartbeatReply{}
+	if u := g.s.releases.offer(beat); u != nil {
+		reply.Update = &xdrpb.UpdateOffer{Version: u.Version, Sha256: u.SHA256, Size: u.Size, Signature: u.Signature, Url: u.URL}
+	}
+	return reply, nil
+}
+
+// Commands pushes queued commands to a connected agent and records the
+// results it sends back.
+func (g *grpcService) Commands(stream xdrpb.XDR_CommandsServer) error {
+	hello, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	agentID := hello.GetAgentId()
+	if agentID == "" {
+		return status.Error(codes.InvalidArgument, "first message must carry agent_id")
+	}
+	td := g.s.tenant(g.tenantOf(stream.Context()))
+	g.s.logger.Info("Agent command channel connected", "tenant", td.id, "agent", agentID)
+	defer g.s.logger.Info("Agent command channel closed", "tenant", td.id, "agent", agentID)
+
+	results := make(chan *xdrpb.CommandResult)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			r, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case results <- r:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		// Grab the wakeup channel before draining, so a command queued in
+		// between isn't missed.
+		wake := td.commands.wait(agentID)
+		cmds, err := writeAs[[]Command](g.s, "command.take", commandWrite{Tenant: td.id, AgentID: agentID})
+		if err != nil {
+			// Nothing was taken, so the agent gets them from the next node
+			return status.Error(codes.Unavailable, err.Error())
+		}
+		for _, c := range cmds {
+			err := stream.Send(&xdrpb.Command{
+				Id:      c.ID,
+				Action:  c.Action,
+				Args:    c.Args,
+				Created: c.Created.Unix(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-wake:
+		case r := <-results:
+			done := commandWrite{Tenant: td.id, AgentID: agentID, ID: r.GetCommandId(), OK: r.GetOk(), Output: r.GetOutput()}
+			if _, err := g.s.write("command.complete", done); err != nil {
+				g.s.logger.Error("Failed to record command result", "tenant", td.id, "agent", agentID, "command", r.GetCommandId(), "error", err)
+			}
+			g.s.logger.Info("Command result",
+				"tenant", td.id,
+				"agent", agentID,
+				"command", r.GetCommandId(),
+				"ok", r.GetOk(),
+				"output", r.GetOutput(),
+			)
+		case err := <-recvErr:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// --- Auth ---
+
+// All XDR RPCs are agent traffic, so every call needs the ingest
+// permission. Agents send their API key as "x-api-key" metadata, and the
+// key decides the tenant their alerts belong to.
+func (g *grpcService) checkKey(ctx context.Context, method string) (Principal, error) {
+	if g.s.auth == nil {
+		return Principal{Role: RoleAdmin, Tenant: defaultTenant}, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var remote string
+	if p, ok := peer.FromContext(ctx); ok {
+		remote = p.Addr.String()
+	}
+	deny := func(p Principal, reason string) {
+		g.s.logDenied(p, PermIngest, reason, "gRPC", method, remote)
+	}
+
+	keys := md.Get("x-api-key")
+	if len(keys) == 0 {
+		deny(Principal{}, "unauthenticated")
+		return Principal{}, status.Error(codes.Unauthenticated, "missing x-api-key")
+	}
+	p, err := g.s.auth.checkKey(keys[0])
+	if err != nil {
+		deny(Principal{}, "unauthenticated")
+		return Principal{}, status.Error(codes.Unauthenticated, "invalid API key")
+	}
+	if !p.can(PermIngest) {
+		deny(p, "forbidden")
+		return Principal{}, status.Error(codes.PermissionDenied, "API key may not send agent traffic")
+	}
+	return p, nil
+}
+
+// tenantOf is the tenant of the key that opened the call.
+func (g *grpcService) tenantOf(ctx context.Context) string {
+	p, _ := principalFrom(ctx)
+	return tenantOrDefault(p.Tenant)
+}
+
+func (g *grpcService) unaryAuth(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	p, err := g.checkKey(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(context.WithValue(ctx, principalKey{}, p), req)
+}
+
+func (g *grpcService) streamAuth(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	p, err := g.checkKey(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authedStream{ss, context.WithValue(ss.Context(), principalKey{}, p)})
+}
+
+// authedStream hands the handler a context carrying the caller
+type authedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authedStream) Context() context.Context { return s.ctx }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"12-capstones/xdr-agent/xdrpb"
+)
+
+// startGRPC serves s over an in-memory listener and returns a client.
+func startGRPC(t *testing.T, s *server) xdrpb.XDRClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	xdrpb.RegisterXDRServer(gs, &grpcService{s: s})
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return xdrpb.NewXDRClient(conn)
+}
+
+func TestGRPCAlertStreamAcks(t *testing.T) {
+	s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	client := startGRPC(t, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.StreamAlerts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id            string
+		wantDuplicate bool
+	}{
+		{"a-1", false},
+		{"a-2", false},
+		{"a-1", true}, // Resent from the spool
+	}
+	for _, tt := range tests {
+		err := stream.Send(&xdrpb.Alert{Id: tt.id, AgentId: "agent-1", EventType: "FILE_MODIFIED", Details: "/etc/passwd"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ack, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ack.GetId() != tt.id || ack.GetDuplicate() != tt.wantDuplicate {
+			t.Errorf("ack = %v; want id %s duplicate %v", ack, tt.id, tt.wantDuplicate)
+		}
+	}
+
+	if incs := s.tenant(defaultTenant).incidents.list(); len(incs) != 1 || len(incs[0].Detections) != 2 {
+		t.Errorf("incidents = %+v; want one incident with two detections", incs)
+	}
+}
+
+func TestGRPCCommandChannel(t *testing.T) {
+	s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	client := startGRPC(t, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Commands(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Queued before the agent registers, delivered once it does
+	early := s.tenant(defaultTenant).commands.enqueue("agent-1", "ping", nil, s.now())
+	if err := stream.Send(&xdrpb.CommandResult{AgentId: "agent-1"}); err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := stream.Recv()
+	if err != nil || cmd.GetId() != early.ID {
+		t.Fatalf("Recv = %v, %v; want %s", cmd, err, early.ID)
+	}
+
+	// Queued while connected, pushed right away
+	late := s.tenant(defaultTenant).commands.enqueue("agent-1", "kill_process", map[string]string{"pid": "4242"}, s.now())
+	cmd, err = stream.Recv()
+	if err != nil || cmd.GetId() != late.ID || cmd.GetArgs()["pid"] != "4242" {
+		t.Fatalf("Recv = %v, %v; want %s with pid 4242", cmd, err, late.ID)
+	}
+
+	stream.Send(&xdrpb.CommandResult{AgentId: "agent-1", CommandId: early.ID, Ok: true, Output: "pong"})
+	stream.Send(&xdrpb.CommandResult{AgentId: "agent-1", CommandId: late.ID, Ok: false, Output: "no such process"})
+	stream.CloseSend()
+
+	want := map[string]string{early.ID: CommandDone, late.ID: CommandFailed}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := map[string]string{}
+		for _, c := range s.tenant(defaultTenant).commands.list("agent-1") {
+			got[c.ID] = c.Status
+		}
+		if got[early.ID] == want[early.ID] && got[late.ID] == want[late.ID] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("command statuses = %v; want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHuntWindow = 24 * time.Hour // Ad-hoc hunts without a from
+	minHuntSchedule   = time.Minute
+	maxHuntEvents     = 1000 // Events returned by a hunt without stats
+	maxHuntAlerts     = 100  // Alerts one scheduled run may raise
+
+	// huntAgentID stands in for the agent of a result row without an
+	// agent_id column, e.g. "| stats count by exe"
+	huntAgentID = "xdr-server"
+)
+
+var errHuntNotFound = errors.New("hunt not found")
+
+// huntResult is the answer to a hunt. Without stats it lists the matching
+// alerts; with stats it lists the rows.
+type huntResult struct {
+	Scanned   int                 `json:"scanned"`
+	Matched   int                 `json:"matched"`
+	Truncated bool                `json:"truncated,omitempty"`
+	Events    []TimelineEvent     `json:"events,omitempty"`
+	Columns   []string            `json:"columns,omitempty"`
+	Rows      []map[string]string `json:"rows,omitempty"`
+}
+
+// hunt runs a query over the tenant's alerts stored with from <= time < to.
+// Hunt results can be excluded so a scheduled hunt doesn't match its own
+// output.
+func (s *server) hunt(td *tenantData, q *huntQuery, from, to time.Time, skipHuntMatches bool) huntResult {
+	var events []TimelineEvent
+	for _, id := range td.timeline.agents() {
+		events = append(events, td.timeline.between(id, from, to)...)
+	}
+	if skipHuntMatches {
+		events = slices.DeleteFunc(events, func(e TimelineEvent) bool { return e.EventType == "HUNT_MATCH" })
+	}
+	slices.SortStableFunc(events, func(a, b TimelineEvent) int { return a.Time.Compare(b.Time) })
+
+	records := make([]record, len(events))
+	for i := range events {
+		records[i] = eventRecord{&events[i]}
+	}
+	rows := q.run(records)
+
+	res := huntResult{Scanned: len(events), Matched: len(rows)}
+	if q.columns != nil {
+		res.Columns = q.columns
+		res.Rows = make([]map[string]string, len(rows))
+		for i, r := range rows {
+			res.Rows[i] = r.(rowRecord)
+		}
+		return res
+	}
+	if len(rows) > maxHuntEvents {
+		rows, res.Truncated = rows[:maxHuntEvents], true
+	}
+	res.Events = make([]TimelineEvent, len(rows))
+	for i, r := range rows {
+		res.Events[i] = *r.(eventRecord).ev
+	}
+	return res
+}
+
+// Hunt is a saved query. With a schedule it runs every interval over the
+// alerts stored since its last run, and raises a HUNT_MATCH alert per
+// result row. Alerts are placed by their own timestamp, so one that
+// arrives after its window was hunted is not picked up by the next run.
+type Hunt struct {
+	ID          string    `json:"id"`
+	Tenant      string    `json:"tenant,omitempty"` // Whose alerts it hunts; empty in hunts from before tenants
+	Name        string    `json:"name"`
+	Query       string    `json:"query"`
+	Schedule    string    `json:"schedule,omitempty"` // e.g. "15m"; empty runs only on demand
+	CreatedBy   string    `json:"created_by"`
+	Created     time.Time `json:"created"`
+	LastRun     time.Time `json:"last_run,omitzero"`
+	LastMatches int       `json:"last_matches"`
+	Runs        int       `json:"runs"`
+
+	query *huntQuery
+	every time.Duration
+}
+
+func (h *Hunt) compile() error {
+	q, err := parseHuntQuery(h.Query)
+	if err != nil {
+		return fmt.Errorf("query: %w", err)
+	}
+	h.query = q
+	if h.Schedule != "" {
+		d, err := time.ParseDuration(h.Schedule)
+		if err != nil {
+			return fmt.Errorf("schedule: %w", err)
+		}
+		if d < minHuntSchedule {
+			return fmt.Errorf("schedule must be at least %s", minHuntSchedule)
+		}
+		h.every = d
+	}
+	return nil
+}
+
+// window is the time range the next run covers: since the last run, or
+// one interval (a day for on-demand hunts) before the first.
+func (h *Hunt) window(now time.Time) (from, to time.Time) {
+	if !h.LastRun.IsZero() {
+		return h.LastRun, now
+	}
+	if h.every > 0 {
+		return now.Add(-h.every), now
+	}
+	return now.Add(-defaultHuntWindow), now
+}
+
+func (h *Hunt) due(now time.Time) bool {
+	return h.every > 0 && (h.LastRun.IsZero() || !now.Before(h.LastRun.Add(h.every)))
+}
+
+// huntStore keeps the saved hunts, persisted as one JSON file.
+type huntStore struct {
+	mu    sync.Mutex
+	path  string
+	seq   int
+	hunts []*Hunt
+}
+
+// openHuntStore loads path, or keeps hunts in memory only when path is
+// empty.
+func openHuntStore(path string) (*huntStore, error) {
+	st := &huntStore{path: path}
+	if path == "" {
+		return st, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &st.hunts); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, h := range st.hunts {
+		if err := h.compile(); err != nil {
+			return nil, fmt.Errorf("%s: %w", h.ID, err)
+		}
+		var n int
+		fmt.Sscanf(h.ID, "HUNT-%d", &n)
+		st.seq = max(st.seq, n)
+	}
+	return st, nil
+}
+
+// saveLocked writes the hunts atomically. Callers hold mu.
+func (st *huntStore) saveLocked() error {
+	if st.path == "" {
+		return nil
+	}
+	data, _ := json.MarshalIndent(st.hunts, "", "  ")
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path)
+}
+
+func (st *huntStore) create(h Hunt, now time.Time) (Hunt, error) {
+	if strings.TrimSpace(h.Name) == "" {
+		return h, fmt.Errorf("a name is required")
+	}
+	if err := h.compile(); err != nil {
+		return h, err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.seq++
+	h.ID = fmt.Sprintf("HUNT-%04d", st.seq)
+	h.Created, h.LastRun, h.LastMatches, h.Runs = now, time.Time{}, 0, 0
+	st.hunts = append(st.hunts, &h)
+	return h, st.saveLocked()
+}
+
+func (st *huntStore) delete(tenant, id string) (Hunt, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	i := slices.IndexFunc(st.hunts, func(h *Hunt) bool { return h.ID == id && tenantOrDefault(h.Tenant) == tenant })
+	if i < 0 {
+		return Hunt{}, errHuntNotFound
+	}
+	h := *st.hunts[i]
+	st.hunts = slices.Delete(st.hunts, i, i+1)
+	return h, st.saveLocked()
+}
+
+func (st *huntStore) get(tenant, id string) (Hunt, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, h := range st.hunts {
+		if h.ID == id && tenantOrDefault(h.Tenant) == tenant {
+			return *h, true
+		}
+	}
+	return Hunt{}, false
+}
+
+func (st *huntStore) list(tenant string) []Hunt {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := make([]Hunt, 0, len(st.hunts))
+	for _, h := range st.hunts {
+		if tenantOrDefault(h.Tenant) == tenant {
+			out = append(out, *h)
+		}
+	}
+	return out
+}
+
+func (st *huntStore) due(now time.Time) []Hunt {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var out []Hunt
+	for _, h := range st.hunts {
+		if h.due(now) {
+			out = append(out, *h)
+		}
+	}
+	return out
+}
+
+// finished records a run that ended at now.
+func (st *huntStore) finished(id string, now time.Time, matches int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, h := range st.hunts {
+		if h.ID == id {
+			h.LastRun, h.LastMatches = now, matches
+			h.Runs++
+			return st.saveLocked()
+		}
+	}
+	return errHuntNotFound
+}
+
+// snapshot returns the ID sequence and copies of the hunts.
+func (st *huntStore) snapshot() (int, []Hunt) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := make([]Hunt, len(st.hunts))
+	for i, h := range st.hunts {
+		out[i] = *h
+	}
+	return st.seq, out
+}
+
+// restore replaces the hunts, from a cluster snapshot.
+func (st *huntStore) restore(seq int, hunts []Hunt) error {
+	out := make([]*Hunt, len(hunts))
+	for i, h := range hunts {
+		if err := h.compile(); err != nil {
+			return fmt.Errorf("%s: %w", h.ID, err)
+		}
+		out[i] = &h
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.seq, st.hunts = seq, out
+	return st.saveLocked()
+}
+
+// huntRun is a hunt.finished write's arguments
+type huntRun struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"` // End of the window the run covered
+	Matches int       `json:"matches"`
+}
+
+func applyCreateHunt(s *server, h Hunt, now time.Time) (any, error) {
+	return s.hunts.create(h, now)
+}
+
+func applyDeleteHunt(s *server, ref storeRef, now time.Time) (any, error) {
+	return s.hunts.delete(ref.Tenant, ref.ID)
+}
+
+func applyHuntFinished(s *server, run huntRun, now time.Time) (any, error) {
+	return nil, s.hunts.finished(run.ID, run.Time, run.Matches)
+}
+
+// runSavedHunt runs h over the alerts since its last run and raises a
+// HUNT_MATCH alert for each result row.
+func (s *server) runSavedHunt(h Hunt) huntResult {
+	now, tenant := s.now(), tenantOrDefault(h.Tenant)
+	from, to := h.window(now)
+	res := s.hunt(s.tenant(tenant), h.query, from, to, true)
+
+	raised := 0
+	raise := func(agentID, details string, fields map[string]string) {
+		if raised == maxHuntAlerts {
+			return
+		}
+		fields["hunt"], fields["hunt_name"] = h.ID, h.Name
+		_, err := s.accept(Alert{
+			ID:        fmt.Sprintf("%s-%d-%d", h.ID, h.Runs+1, raised+1),
+			Tenant:    tenant,
+			AgentID:   agentID,
+			EventType: "HUNT_MATCH",
+			Details:   fmt.Sprintf("Hunt %q: %s", h.Name, details),
+			Timestamp: now.Unix(),
+			Fields:    fields,
+		})
+		if err != nil {
+			s.logger.Error("Failed to raise hunt alert", "hunt", h.ID, "error", err)
+		}
+		raised++
+	}
+	for _, row := range res.Rows {
+		var parts []string
+		fields := make(map[string]string, len(row)+2)
+		for _, c := range res.Columns {
+			parts = append(parts, c+"="+row[c])
+			fields[c] = row[c]
+		}
+		raise(firstNonEmpty(row["agent_id"], row["agent"], huntAgentID), strings.Join(parts, " "), fields)
+	}
+	for _, e := range res.Events {
+		raise(e.AgentID, e.Details, map[string]string{"source_alert": e.ID, "event_type": e.EventType})
+	}
+	if res.Matched > raised {
+		s.logger.Warn("Hunt matched more than it may alert on", "hunt", h.ID, "matches", res.Matched, "alerts", raised)
+	}
+
+	if _, err := s.write("hunt.finished", huntRun{h.ID, now, res.Matched}); err != nil && !errors.Is(err, errHuntNotFound) {
+		s.logger.Error("Failed to save hunt", "hunt", h.ID, "error", err)
+	}
+	s.logger.Info("Hunt ran", "hunt", h.ID, "tenant", tenant, "from", from, "to", to, "scanned", res.Scanned, "matches", res.Matched)
+	return res
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// huntLoop runs scheduled hunts as they come due. In a cluster only the
+// leader runs them, so each match is raised once.
+func (s *server) huntLoop() {
+	for range time.Tick(15 * time.Second) {
+		if !s.leader() {
+			continue
+		}
+		for _, h := range s.hunts.due(s.now()) {
+			s.runSavedHunt(h)
+		}
+	}
+}
+
+// --- Handlers ---
+
+type huntRequest struct {
+	Query string `json:"query"`
+	From  string `json:"from"` // RFC 3339 or unix seconds, default a day ago
+	To    string `json:"to"`   // Default now
+}
+
+// handleHunt serves POST /hunt, an ad-hoc query.
+func (s *server) handleHunt(w http.ResponseWriter, r *http.Request) {
+	var req huntRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	q, err := parseHuntQuery(req.Query)
+	if err != nil {
+		http.Error(w, "query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	to := s.now()
+	from := to.Add(-defaultHuntWindow)
+	for name, p := range map[string]struct {
+		v   string
+		dst *time.Time
+	}{"from": {req.From, &from}, "to": {req.To, &to}} {
+		if p.v == "" {
+			continue
+		}
+		if *p.dst, err = parseTimeParam(p.v); err != nil {
+			http.Error(w, name+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, s.hunt(s.data(r), q, from, to, false))
+}
+
+type huntSaveRequest struct {
+	Name     string `json:"name"`
+	Query    string `json:"query"`
+	Schedule string `json:"schedule"`
+}
+
+func (s *server) handleCreateHunt(w http.ResponseWriter, r *http.Request) {
+	var req huntSaveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	who, now := analyst(r), s.now()
+	h, err := writeAs[Hunt](s, "hunt.create", Hunt{Tenant: s.tenantOf(r), Name: req.Name, Query: req.Query, Schedule: req.Schedule, CreatedBy: who})
+	if s.writeFailed(w, err, http.StatusBadRequest) {
+		return
+	}
+
+	changes := []FieldChange{{Field: "name", To: h.Name}, {Field: "query", To: h.Query}}
+	if h.Schedule != "" {
+		changes = append(changes, FieldChange{Field: "schedule", To: h.Schedule})
+	}
+	if _, err := s.audit.append(AuditEntry{Time: now, Tenant: h.Tenant, Actor: who, Action: "hunt.create", Target: h.ID, Changes: changes}); err != nil {
+		s.logger.Error("Failed to audit hunt", "hunt", h.ID, "error", err)
+	}
+	s.logger.Info("Hunt saved", "hunt", h.ID, "schedule", h.Schedule, "by", who)
+	writeJSONStatus(w, http.StatusCreated, h)
+}
+
+func (s *server) handleListHunts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.hunts.list(s.tenantOf(r)))
+}
+
+// handleRunHunt serves POST /hunts/{id}/run: the same as a scheduled run,
+// alerts included, but now.
+func (s *server) handleRunHunt(w http.ResponseWriter, r *http.Request) {
+	h, ok := s.hunts.get(s.tenantOf(r), r.PathValue("id"))
+	if !ok {
+		http.Error(w, errHuntNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	s.logger.Info("Hunt run on demand", "hunt", h.ID, "by", analyst(r))
+	writeJSON(w, s.runSavedHunt(h))
+}
+
+func (s *server) handleDeleteHunt(w http.ResponseWriter, r *http.Request) {
+	h, err := writeAs[Hunt](s, "hunt.delete", storeRef{Tenant: s.tenantOf(r), ID: r.PathValue("id")})
+	if errors.Is(err, errHuntNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if s.writeFailed(w, err, http.StatusInternalServerError) {
+		return
+	}
+	who := analyst(r)
+	if _, err := s.audit.append(AuditEntry{Time: s.now(), Tenant: tenantOrDefault(h.Tenant), Actor: who, Action: "hunt.delete", Target: h.ID}); err != nil {
+		s.logger.Error("Failed to audit hunt", "hunt", h.ID, "error", err)
+	}
+	s.logger.Info("Hunt deleted", "hunt", h.ID, "by", who)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func huntEvents() []TimelineEvent {
+	t0 := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	ev := func(min int, agent, typ, details string, fields map[string]string) TimelineEvent {
+		a := Alert{ID: agent + "-" + details, AgentID: agent, EventType: typ, Details: details, Timestamp: t0.Unix(), Fields: fields}
+		return TimelineEvent{Time: t0.Add(time.Duration(min) * time.Minute), Category: eventCategory(typ), Alert: a}
+	}
+	return []TimelineEvent{
+		ev(0, "web-1", "PROCESS_START", "/tmp/x started", map[string]string{"exe": "/tmp/x", "pid": "900"}),
+		ev(1, "web-1", "PROCESS_START", "/tmp/.y started", map[string]string{"exe": "/tmp/.y", "pid": "77"}),
+		ev(2, "web-1", "PROCESS_START", "/usr/bin/ls started", map[string]string{"exe": "/usr/bin/ls", "pid": "1200"}),
+		ev(3, "db-1", "PROCESS_START", "/tmp/x started", map[string]string{"exe": "/tmp/x", "pid": "31"}),
+		ev(4, "db-1", "FILE_MODIFIED", "/etc/passwd changed", map[string]string{"path": "/etc/passwd"}),
+		ev(5, "db-1", "AUTH_FAILURE", "ssh login failed for root", map[string]string{"user": "root"}),
+	}
+}
+
+// huntRows runs a query over huntEvents and renders each result row as
+// one string: the details for events, col=value pairs for stats.
+func huntRows(t *testing.T, src string) []string {
+	t.Helper()
+	q, err := parseHuntQuery(src)
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	events := huntEvents()
+	records := make([]record, len(events))
+	for i := range events {
+		records[i] = eventRecord{&events[i]}
+	}
+	var out []string
+	for _, r := range q.run(records) {
+		if row, ok := r.(rowRecord); ok {
+			var parts []string
+			for _, c := range q.columns {
+				parts = append(parts, c+"="+row[c])
+			}
+			out = append(out, strings.Join(parts, " "))
+			continue
+		}
+		v, _ := r.get("agent_id")
+		d, _ := r.get("details")
+		out = append(out, v+" "+d)
+	}
+	return out
+}
+
+func TestHuntQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"web-1 /tmp/x started", "web-1 /tmp/.y started", "web-1 /usr/bin/ls started", "db-1 /tmp/x started", "db-1 /etc/passwd changed", "db-1 ssh login failed for root"}},
+		{"event_type:process_start AND exe:*/tmp/* AND agent_id:web-1", []string{"web-1 /tmp/x started", "web-1 /tmp/.y started"}},
+		{"exe:/tmp/? agent_id:db-1", []string{"db-1 /tmp/x started"}},
+		{"type:FILE_MODIFIED OR (type:AUTH_FAILURE AND user:root)", []string{"db-1 /etc/passwd changed", "db-1 ssh login failed for root"}},
+		{"category:process NOT exe:/tmp/*", []string{"web-1 /usr/bin/ls started"}},
+		{"pid>100 pid<=1200", []string{"web-1 /tmp/x started", "web-1 /usr/bin/ls started"}},
+		{"pid!=900 agent:web-1", []string{"web-1 /tmp/.y started", "web-1 /usr/bin/ls started"}},
+		{`"LOGIN FAILED"`, []string{"db-1 ssh login failed for root"}},
+		{`passwd`, []string{"db-1 /etc/passwd changed"}},
+		{`exe:"/tmp/*"`, nil},
+		{"time>=2026-03-01T12:04:00Z", []string{"db-1 /etc/passwd changed", "db-1 ssh login failed for root"}},
+		{`time<"2026-03-01T12:01:00Z"`, []string{"web-1 /tmp/x started"}},
+		{"type:PROCESS_START | stats count by agent_id", []string{"agent_id=db-1 count=1", "agent_id=web-1 count=3"}},
+		{"type:PROCESS_START | stats count, dc(exe), max(pid), avg(pid) by agent_id | where count > 1",
+			[]string{"agent_id=web-1 count=3 dc(exe)=3 max(pid)=1200 avg(pid)=725.6666666666666"}},
+		{"exe:/tmp/* | stats dc(agent_id) by exe | sort -dc(agent_id) | head 1", []string{"exe=/tmp/x dc(agent_id)=2"}},
+		{"nothing-matches | stats count", []string{"count=0"}},
+		{"| stats dc(exe) by agent_id | where dc(exe) >= 2", []string{"agent_id=web-1 dc(exe)=3"}},
+		{"| sort -pid | head 2", []string{"web-1 /usr/bin/ls started", "web-1 /tmp/x started"}},
+	}
+	for _, tt := range tests {
+		got := huntRows(t, tt.query)
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s\ngot  %q\nwant %q", tt.query, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{
+		"(type:A", "type:", "a ! b", `"open`, "| stats", "| stats dc", "| stats count by", "| frobnicate", "| head x", "a )",
+	} {
+		if _, err := parseHuntQuery(bad); err == nil {
+			t.Errorf("%q parsed without error", bad)
+		}
+	}
+}
+
+func TestScheduledHuntRaisesAlerts(t *testing.T) {
+	s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	handler := s.routes()
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return rr
+	}
+	start := func(id, agent, exe string) {
+		s.ingest(Alert{ID: id, AgentID: agent, EventType: "PROCESS_START", Details: exe + " started",
+			Timestamp: now.Unix(), Fields: map[string]string{"exe": exe}})
+	}
+
+	if rr := do("POST", "/hunts", `{"name": "Bad", "query": "(exe:x"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("hunt with a bad query = %d; want 400", rr.Code)
+	}
+	if rr := do("POST", "/hunts", `{"name": "Too often", "query": "exe:x", "schedule": "1s"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("hunt every second = %d; want 400", rr.Code)
+	}
+	rr := do("POST", "/hunts", `{"name": "Binaries run from /tmp", "query": "exe:/tmp/* | stats count by agent_id", "schedule": "10m"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("POST /hunts = %d: %s", rr.Code, rr.Body)
+	}
+
+	start("a1", "web-1", "/tmp/x")
+	start("a2", "web-1", "/tmp/y")
+	start("a3", "db-1", "/usr/bin/ls")
+	now = now.Add(time.Minute)
+
+	// Ad-hoc hunts see the same data without raising anything
+	rr = do("POST", "/hunt", `{"query": "exe:/tmp/* | stats count by agent_id"}`)
+	var res huntResult
+	json.NewDecoder(rr.Body).Decode(&res)
+	if rr.Code != http.StatusOK || len(res.Rows) != 1 || res.Rows[0]["count"] != "2" || res.Scanned != 3 {
+		t.Fatalf("POST /hunt = %d %+v", rr.Code, res)
+	}
+
+	due := s.hunts.due(now)
+	if len(due) != 1 {
+		t.Fatalf("due hunts = %d; want 1", len(due))
+	}
+	s.runSavedHunt(due[0])
+	matches := s.tenant(defaultTenant).timeline.between("web-1", now.Add(-time.Hour), now.Add(time.Hour))
+	last := matches[len(matches)-1]
+	if last.EventType != "HUNT_MATCH" || last.Fields["hunt"] != "HUNT-0001" || last.Fields["count"] != "2" {
+		t.Errorf("last web-1 event = %+v; want a HUNT_MATCH", last)
+	}
+	if incs := s.tenant(defaultTenant).incidents.list(); len(incs) != 1 || incs[0].Detections[0].RuleID != "xdr-007" {
+		t.Errorf("incidents = %+v; want one from the hunt rule", incs)
+	}
+
+	// The next run only covers what arrived since, and skips hunt output
+	if len(s.hunts.due(now)) != 0 {
+		t.Error("hunt is due again right after running")
+	}
+	start("a4", "db-1", "/tmp/z")
+	now = now.Add(10 * time.Minute)
+	h, _ := s.hunts.get(defaultTenant, "HUNT-0001")
+	if res := s.runSavedHunt(h); len(res.Rows) != 1 || res.Rows[0]["agent_id"] != "db-1" {
+		t.Errorf("second run rows = %+v; want only db-1", res.Rows)
+	}
+	if h, _ := s.hunts.get(defaultTenant, "HUNT-0001"); h.Runs != 2 || h.LastMatches != 1 {
+		t.Errorf("hunt after two runs = %+v", h)
+	}
+}
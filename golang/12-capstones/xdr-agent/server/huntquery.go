@@ -0,0 +1,721 @@
+package main
+
+// Hunting query language. A query is a filter over stored alerts,
+// optionally followed by pipeline stages:
+//
+//	event_type:PROCESS_START AND exe:*/tmp/* | stats count by agent_id | where count > 3
+//
+// Filter terms:
+//	field:value    equal, case-insensitive; * and ? are wildcards
+//	field=value    same as :
+//	field!=value   not equal (an alert without the field never matches)
+//	field>value    also >=, <, <=; numeric when both sides are numbers
+//	value          free text, searched in details
+// Terms combine with AND (or just a space), OR and NOT, grouped with
+// parentheses. Values with spaces, parentheses or commas go in quotes.
+//
+// Stages:
+//	stats count, dc(f), min(f), max(f), sum(f), avg(f) [by f1, f2]
+//	where <filter>   filter rows, e.g. after stats
+//	sort [-]f1, f2   - sorts descending
+//	head N
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// --- Lexer ---
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString // Quoted, never a keyword or wildcard pattern
+	tokOp     // : = != < <= > >=
+	tokLParen
+	tokRParen
+	tokPipe
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func isWordRune(r rune) bool {
+	return !unicode.IsSpace(r) && !strings.ContainsRune(`():|,"=!<>`, r)
+}
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	rs := []rune(src)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			toks = append(toks, token{tokLParen, "(", i})
+			i++
+		case r == ')':
+			toks = append(toks, token{tokRParen, ")", i})
+			i++
+		case r == '|':
+			toks = append(toks, token{tokPipe, "|", i})
+			i++
+		case r == ',':
+			toks = append(toks, token{tokComma, ",", i})
+			i++
+		case r == ':' || r == '=':
+			toks = append(toks, token{tokOp, string(r), i})
+			i++
+		case r == '!' || r == '<' || r == '>':
+			op := string(r)
+			if i+1 < len(rs) && rs[i+1] == '=' {
+				op += "="
+			}
+			if op == "!" {
+				return nil, fmt.Errorf("position %d: expected !=", i)
+			}
+			toks = append(toks, token{tokOp, op, i})
+			i += len(op)
+		case r == '"':
+			var b strings.Builder
+			start := i
+			for i++; ; i++ {
+				if i >= len(rs) {
+					return nil, fmt.Errorf("position %d: unterminated string", start)
+				}
+				if rs[i] == '\\' && i+1 < len(rs) {
+					i++
+				} else if rs[i] == '"' {
+					i++
+					break
+				}
+				b.WriteRune(rs[i])
+			}
+			toks = append(toks, token{tokString, b.String(), start})
+		default:
+			// A value after an operator may contain : = ! < >, so times
+			// and IPv6 addresses need no quotes
+			inValue := len(toks) > 0 && toks[len(toks)-1].kind == tokOp
+			start := i
+			for i < len(rs) && (isWordRune(rs[i]) || inValue && !unicode.IsSpace(rs[i]) && !strings.ContainsRune(`()|,"`, rs[i])) {
+				i++
+			}
+			toks = append(toks, token{tokWord, string(rs[start:i]), start})
+		}
+	}
+	return append(toks, token{tokEOF, "", len(rs)}), nil
+}
+
+// --- Records ---
+
+// record is what filters and stages read fields from: a stored alert, or
+// a row produced by stats.
+type record interface {
+	get(field string) (string, bool)
+}
+
+// eventRecord exposes an alert's fields. Names not built in are looked up
+// in the alert's structured fields, with or without a "fields." prefix.
+type eventRecord struct{ ev *TimelineEvent }
+
+func (r eventRecord) get(field string) (string, bool) {
+	e := r.ev
+	switch field {
+	case "id":
+		return e.ID, e.ID != ""
+	case "agent_id", "agent":
+		return e.AgentID, true
+	case "event_type", "type":
+		return e.EventType, true
+	case "details":
+		return e.Details, true
+	case "category":
+		return e.Category, true
+	case "time":
+		return e.Time.Format(time.RFC3339), true
+	case "timestamp":
+		return strconv.FormatInt(e.Timestamp, 10), true
+	case "suppressed":
+		return e.Suppressed, e.Suppressed != ""
+	case "intel_confidence":
+		c := maxIntelConfidence(e.Alert)
+		return strconv.Itoa(c), c > 0
+	}
+	v, ok := e.Fields[strings.TrimPrefix(field, "fields.")]
+	return v, ok
+}
+
+// rowRecord is one output row of stats
+type rowRecord map[string]string
+
+func (r rowRecord) get(field string) (string, bool) {
+	v, ok := r[field]
+	return v, ok
+}
+
+// compareValues orders numbers numerically and anything else as strings,
+// which also orders RFC 3339 times.
+func compareValues(a, b string) int {
+	x, errA := strconv.ParseFloat(a, 64)
+	y, errB := strconv.ParseFloat(b, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// --- Filter ---
+
+type filterNode interface {
+	match(r record) bool
+}
+
+type andNode struct{ l, r filterNode }
+type orNode struct{ l, r filterNode }
+type notNode struct{ x filterNode }
+
+func (n andNode) match(r record) bool { return n.l.match(r) && n.r.match(r) }
+func (n orNode) match(r record) bool  { return n.l.match(r) || n.r.match(r) }
+func (n notNode) match(r record) bool { return !n.x.match(r) }
+
+// termNode is one comparison. An empty field means free text in details.
+type termNode struct {
+	field string
+	op    string
+	value string
+	glob  *regexp.Regexp // For : = != with wildcards
+}
+
+// wildcardRegexp compiles a value with * and ? into an anchored,
+// case-insensitive pattern. Unlike path globs, * crosses slashes.
+func wildcardRegexp(v string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?is)^")
+	for _, r := range v {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+func (t termNode) equal(v string) bool {
+	if t.glob != nil {
+		return t.glob.MatchString(v)
+	}
+	return strings.EqualFold(v, t.value)
+}
+
+func (t termNode) match(r record) bool {
+	if t.field == "" {
+		details, _ := r.get("details")
+		if t.glob != nil {
+			return t.glob.MatchString(details)
+		}
+		return strings.Contains(strings.ToLower(details), strings.ToLower(t.value))
+	}
+	v, ok := r.get(t.field)
+	if !ok {
+		return false
+	}
+	switch t.op {
+	case ":", "=":
+		return t.equal(v)
+	case "!=":
+		return !t.equal(v)
+	case "<":
+		return compareValues(v, t.value) < 0
+	case "<=":
+		return compareValues(v, t.value) <= 0
+	case ">":
+		return compareValues(v, t.value) > 0
+	case ">=":
+		return compareValues(v, t.value) >= 0
+	}
+	return false
+}
+
+// --- Stages ---
+
+type stage interface {
+	apply(rows []record) []record
+}
+
+// aggregate is one stats function, e.g. dc(exe)
+type aggregate struct {
+	fn    string // count, dc, min, max, sum, avg
+	field string // Empty for a plain count
+}
+
+func (a aggregate) column() string {
+	if a.field == "" {
+		return a.fn
+	}
+	return a.fn + "(" + a.field + ")"
+}
+
+var aggregateFuncs = []string{"count", "dc", "min", "max", "sum", "avg"}
+
+type statsStage struct {
+	aggs []aggregate
+	by   []string
+}
+
+// accumulator holds the running state of one aggregate in one group
+type accumulator struct {
+	n      int
+	sum    float64
+	best   string
+	hasVal bool
+	seen   map[string]bool
+}
+
+func (acc *accumulator) add(a aggregate, r record) {
+	if a.field == "" {
+		acc.n++
+		return
+	}
+	v, ok := r.get(a.field)
+	if !ok {
+		return
+	}
+	switch a.fn {
+	case "count":
+		acc.n++
+	case "dc":
+		if acc.seen == nil {
+			acc.seen = make(map[string]bool)
+		}
+		acc.seen[v] = true
+	case "min", "max":
+		c := compareValues(v, acc.best)
+		if !acc.hasVal || (a.fn == "min" && c < 0) || (a.fn == "max" && c > 0) {
+			acc.best, acc.hasVal = v, true
+		}
+	case "sum", "avg":
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			acc.sum += f
+			acc.n++
+		}
+	}
+}
+
+func formatNumber(f float64) string {
+	if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func (acc *accumulator) result(a aggregate) string {
+	switch a.fn {
+	case "dc":
+		return strconv.Itoa(len(acc.seen))
+	case "min", "max":
+		return acc.best
+	case "sum":
+		return formatNumber(acc.sum)
+	case "avg":
+		if acc.n == 0 {
+			return ""
+		}
+		return formatNumber(acc.sum / float64(acc.n))
+	}
+	return strconv.Itoa(acc.n)
+}
+
+// apply groups rows by the by fields. Groups come out ordered by their
+// by values; a record missing a by field is grouped under "".
+func (s statsStage) apply(rows []record) []record {
+	type group struct {
+		keys []string
+		accs []accumulator
+	}
+	groups := make(map[string]*group)
+	for _, r := range rows {
+		keys := make([]string, len(s.by))
+		for i, f := range s.by {
+			keys[i], _ = r.get(f)
+		}
+		id := strings.Join(keys, "\x00")
+		g, ok := groups[id]
+		if !ok {
+			g = &group{keys: keys, accs: make([]accumulator, len(s.aggs))}
+			groups[id] = g
+		}
+		for i, a := range s.aggs {
+			g.accs[i].add(a, r)
+		}
+	}
+	// No by fields still yields one row, so "| stats count" reports 0
+	if len(s.by) == 0 && len(groups) == 0 {
+		groups[""] = &group{accs: make([]accumulator, len(s.aggs))}
+	}
+
+	ids := make([]string, 0, len(groups))
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	out := make([]record, 0, len(ids))
+	for _, id := range ids {
+		g := groups[id]
+		row := make(rowRecord, len(s.by)+len(s.aggs))
+		for i, f := range s.by {
+			row[f] = g.keys[i]
+		}
+		for i, a := range s.aggs {
+			row[a.column()] = g.accs[i].result(a)
+		}
+		out = append(out, row)
+	}
+	return out
+}
+
+func (s statsStage) columns() []string {
+	cols := slices.Clone(s.by)
+	for _, a := range s.aggs {
+		cols = append(cols, a.column())
+	}
+	return cols
+}
+
+type whereStage struct{ filter filterNode }
+
+func (s whereStage) apply(rows []record) []record {
+	return slices.DeleteFunc(rows, func(r record) bool { return !s.filter.match(r) })
+}
+
+type sortKey struct {
+	field string
+	desc  bool
+}
+
+type sortStage struct{ keys []sortKey }
+
+func (s sortStage) apply(rows []record) []record {
+	slices.SortStableFunc(rows, func(a, b record) int {
+		for _, k := range s.keys {
+			x, _ := a.get(k.field)
+			y, _ := b.get(k.field)
+			c := compareValues(x, y)
+			if k.desc {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+	return rows
+}
+
+type headStage struct{ n int }
+
+func (s headStage) apply(rows []record) []record {
+	return rows[:min(s.n, len(rows))]
+}
+
+// --- Parser ---
+
+// huntQuery is a parsed query
+type huntQuery struct {
+	src     string
+	filter  filterNode // nil matches everything
+	stages  []stage
+	columns []string // Output columns of the last stats stage, nil without one
+}
+
+// run filters records and runs the stages over them.
+func (q *huntQuery) run(rows []record) []record {
+	if q.filter != nil {
+		rows = slices.DeleteFunc(rows, func(r record) bool { return !q.filter.match(r) })
+	}
+	for _, st := range q.stages {
+		rows = st.apply(rows)
+	}
+	return rows
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) errorf(t token, format string, args ...any) error {
+	return fmt.Errorf("position %d: %s", t.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) isKeyword(word string) bool {
+	t := p.peek()
+	return t.kind == tokWord && t.text == word
+}
+
+// parseHuntQuery parses a query. Keywords (AND, OR, NOT) are upper case,
+// so the lower-case words can still be searched for.
+func parseHuntQuery(src string) (*huntQuery, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	q := &huntQuery{src: src}
+	if k := p.peek().kind; k != tokPipe && k != tokEOF {
+		if q.filter, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+	}
+	for p.peek().kind == tokPipe {
+		p.next()
+		st, err := p.parseStage()
+		if err != nil {
+			return nil, err
+		}
+		if ss, ok := st.(statsStage); ok {
+			q.columns = ss.columns()
+		}
+		q.stages = append(q.stages, st)
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %q", t.text)
+	}
+	return q, nil
+}
+
+// parseOr parses a filter until a pipe, closing parenthesis or the end.
+func (p *parser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (filterNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if p.isKeyword("AND") {
+			p.next()
+		} else if k := p.peek().kind; k == tokEOF || k == tokPipe || k == tokRParen || p.isKeyword("OR") {
+			return left, nil
+		}
+		// Anything else is an implicit AND
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+}
+
+func (p *parser) parseNot() (filterNode, error) {
+	if p.isKeyword("NOT") {
+		p.next()
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (filterNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokLParen:
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tokRParen {
+			return nil, p.errorf(c, "expected )")
+		}
+		return n, nil
+	case tokString:
+		return termNode{value: t.text}, nil
+	case tokWord:
+		field, err := p.aggregateName(t.text)
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != tokOp {
+			return newTerm("", ":", field, false), nil
+		}
+		op := p.next()
+		v := p.next()
+		if v.kind != tokWord && v.kind != tokString {
+			return nil, p.errorf(v, "expected a value after %s%s", field, op.text)
+		}
+		return newTerm(field, op.text, v.text, v.kind == tokString), nil
+	}
+	return nil, p.errorf(t, "expected a search term, got %q", t.text)
+}
+
+// newTerm builds a comparison. Quoted values are literal, so * and ? in
+// them are not wildcards.
+func newTerm(field, op, value string, quoted bool) termNode {
+	t := termNode{field: field, op: op, value: value}
+	if !quoted && (op == ":" || op == "=" || op == "!=") && strings.ContainsAny(value, "*?") {
+		t.glob = wildcardRegexp(value)
+	}
+	return t
+}
+
+// aggregateName completes a stats column name such as dc(exe), so where
+// and sort can refer to it. Other words are returned as they are.
+func (p *parser) aggregateName(word string) (string, error) {
+	if !slices.Contains(aggregateFuncs, strings.TrimPrefix(word, "-")) || p.peek().kind != tokLParen {
+		return word, nil
+	}
+	p.next()
+	f := p.next()
+	if f.kind != tokWord {
+		return "", p.errorf(f, "expected a field name")
+	}
+	if c := p.next(); c.kind != tokRParen {
+		return "", p.errorf(c, "expected )")
+	}
+	return word + "(" + f.text + ")", nil
+}
+
+// parseFieldList parses f1, f2, ... as bare words or stats columns.
+func (p *parser) parseFieldList() ([]string, error) {
+	var out []string
+	for {
+		t := p.next()
+		if t.kind != tokWord {
+			return nil, p.errorf(t, "expected a field name")
+		}
+		name, err := p.aggregateName(t.text)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, name)
+		if p.peek().kind != tokComma {
+			return out, nil
+		}
+		p.next()
+	}
+}
+
+func (p *parser) parseStage() (stage, error) {
+	t := p.next()
+	if t.kind != tokWord {
+		return nil, p.errorf(t, "expected a command after |")
+	}
+	switch t.text {
+	case "stats":
+		return p.parseStats()
+	case "where":
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return whereStage{f}, nil
+	case "sort":
+		fields, err := p.parseFieldList()
+		if err != nil {
+			return nil, err
+		}
+		var keys []sortKey
+		for _, f := range fields {
+			keys = append(keys, sortKey{field: strings.TrimPrefix(f, "-"), desc: strings.HasPrefix(f, "-")})
+		}
+		return sortStage{keys}, nil
+	case "head":
+		n := p.next()
+		v, err := strconv.Atoi(n.text)
+		if n.kind != tokWord || err != nil || v < 0 {
+			return nil, p.errorf(n, "head needs a count")
+		}
+		return headStage{v}, nil
+	}
+	return nil, p.errorf(t, "unknown command %q (want stats, where, sort or head)", t.text)
+}
+
+func (p *parser) parseStats() (stage, error) {
+	var st statsStage
+	for {
+		t := p.next()
+		if t.kind != tokWord || !slices.Contains(aggregateFuncs, t.text) {
+			return nil, p.errorf(t, "expected one of %s", strings.Join(aggregateFuncs, ", "))
+		}
+		a := aggregate{fn: t.text}
+		if p.peek().kind == tokLParen {
+			p.next()
+			f := p.next()
+			if f.kind != tokWord {
+				return nil, p.errorf(f, "expected a field name")
+			}
+			if c := p.next(); c.kind != tokRParen {
+				return nil, p.errorf(c, "expected )")
+			}
+			a.field = f.text
+		}
+		if a.field == "" && a.fn != "count" {
+			return nil, p.errorf(t, "%s needs a field, e.g. %s(exe)", a.fn, a.fn)
+		}
+		st.aggs = append(st.aggs, a)
+		if p.peek().kind != tokComma {
+			break
+		}
+		p.next()
+	}
+	if p.isKeyword("by") {
+		p.next()
+		by, err := p.parseFieldList()
+		if err != nil {
+			return nil, err
+		}
+		st.by = by
+	}
+	return st, nil
+}
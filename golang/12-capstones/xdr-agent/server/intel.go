@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Indicator types
+const (
+	IndicatorHash   = "hash"   // MD5, SHA-1, SHA-256 or SHA-512, lowercase hex
+	IndicatorIP     = "ip"     // A single address
+	IndicatorCIDR   = "cidr"   // A network
+	IndicatorDomain = "domain" // Also matches subdomains
+	IndicatorPath   = "path"   // Full path, or a bare file name matching any directory
+)
+
+// Used when a feed doesn't say how sure it is
+const defaultConfidence = 50
+
+// Indicator is one known-bad observable from a threat-intel feed
+type Indicator struct {
+	Type        string    `json:"type"`
+	Value       string    `json:"value"`
+	Source      string    `json:"source"`     // Feed file it came from
+	Confidence  int       `json:"confidence"` // 0-100
+	Expires     time.Time `json:"expires,omitzero"`
+	Description string    `json:"description,omitempty"`
+}
+
+func (i *Indicator) expired(now time.Time) bool {
+	return !i.Expires.IsZero() && !now.Before(i.Expires)
+}
+
+// IntelMatch is attached to an alert when one of its observables hits an
+// indicator.
+type IntelMatch struct {
+	Observable string `json:"observable"`
+	Indicator
+}
+
+// newIndicator validates and normalizes a feed entry.
+func newIndicator(typ, value, source string, confidence int, expires time.Time, desc string) (*Indicator, error) {
+	value = strings.TrimSpace(value)
+	ind := &Indicator{Type: typ, Source: source, Confidence: confidence, Expires: expires, Description: desc}
+	if confidence < 0 || confidence > 100 {
+		return nil, fmt.Errorf("confidence %d out of range", confidence)
+	}
+
+	switch typ {
+	case IndicatorHash:
+		value = strings.ToLower(value)
+		if !isHexHash(value) {
+			return nil, fmt.Errorf("%q is not an MD5/SHA hash", value)
+		}
+	case IndicatorIP, IndicatorCIDR:
+		p, err := parsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		ind.Type = IndicatorCIDR
+		if p.IsSingleIP() {
+			ind.Type = IndicatorIP
+		}
+		value = p.String()
+		if ind.Type == IndicatorIP {
+			value = p.Addr().String()
+		}
+	case IndicatorDomain:
+		value = strings.TrimSuffix(strings.ToLower(value), ".")
+		if value == "" || strings.ContainsAny(value, " /") {
+			return nil, fmt.Errorf("%q is not a domain", value)
+		}
+	case IndicatorPath:
+		if value == "" {
+			return nil, fmt.Errorf("empty path")
+		}
+	default:
+		return nil, fmt.Errorf("unknown indicator type %q", typ)
+	}
+	ind.Value = value
+	return ind, nil
+}
+
+// parsePrefix accepts an address or a CIDR.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return p.Masked(), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	a = a.Unmap()
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+func isHexHash(s string) bool {
+	switch len(s) {
+	case 32, 40, 64, 128:
+	default:
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// --- Index ---
+
+// intelIndex is an immutable lookup structure for one load of the feeds.
+// Hashes, domains and paths are hash sets; addresses and networks share a
+// radix tree.
+type intelIndex struct {
+	hashes  map[string][]*Indicator
+	domains map[string][]*Indicator
+	paths   map[string][]*Indicator
+	nets    cidrTree
+	count   int
+	byType  map[string]int
+	sources map[string]int
+}
+
+func newIntelIndex() *intelIndex {
+	return &intelIndex{
+		hashes:  make(map[string][]*Indicator),
+		domains: make(map[string][]*Indicator),
+		paths:   make(map[string][]*Indicator),
+		byType:  make(map[string]int),
+		sources: make(map[string]int),
+	}
+}
+
+func (x *intelIndex) add(ind *Indicator) {
+	switch ind.Type {
+	case IndicatorHash:
+		x.hashes[ind.Value] = append(x.hashes[ind.Value], ind)
+	case IndicatorDomain:
+		x.domains[ind.Value] = append(x.domains[ind.Value], ind)
+	case IndicatorPath:
+		x.paths[ind.Value] = append(x.paths[ind.Value], ind)
+	case IndicatorIP, IndicatorCIDR:
+		p, _ := parsePrefix(ind.Value)
+		x.nets.insert(p, ind)
+	}
+	x.count++
+	x.byType[ind.Type]++
+	x.sources[ind.Source]++
+}
+
+// lookup matches one observable. The observable's shape decides which
+// structure is consulted.
+func (x *intelIndex) lookup(obs string) []*Indicator {
+	if a, err := netip.ParseAddr(obs); err == nil {
+		return x.nets.lookup(a)
+	}
+	if ap, err := netip.ParseAddrPort(obs); err == nil {
+		return x.nets.lookup(ap.Addr())
+	}
+	if lower := strings.ToLower(obs); isHexHash(lower) {
+		return x.hashes[lower]
+	}
+	if strings.HasPrefix(obs, "/") {
+		// Bare file names in feeds match in any directory
+		return append(append([]*Indicator(nil), x.paths[obs]...), x.paths[path.Base(obs)]...)
+	}
+	if isDomainLike(obs) {
+		// evil.example matches cdn.evil.example too
+		var out []*Indicator
+		d := strings.TrimSuffix(strings.ToLower(obs), ".")
+		for {
+			out = append(out, x.domains[d]...)
+			i := strings.IndexByte(d, '.')
+			if i < 0 {
+				break
+			}
+			d = d[i+1:]
+		}
+		return out
+	}
+	return nil
+}
+
+func isDomainLike(s string) bool {
+	if !strings.Contains(s, ".") {
+		return false
+	}
+	letter := false
+	for _, c := range strings.ToLower(s) {
+		switch {
+		case 'a' <= c && c <= 'z':
+			letter = true
+		case '0' <= c && c <= '9', c == '.', c == '-':
+		default:
+			return false
+		}
+	}
+	return letter
+}
+
+// observables pulls candidate IOCs out of an alert: every field value and
+// every token of the details text. URLs and host:port pairs are reduced to
+// their host.
+func observables(a Alert) []string {
+	seen := make(map[string]bool)
+	var out []string
+	var add func(s string)
+	add = func(s string) {
+		s = strings.Trim(s, ".,:;'\"")
+		if s == "" || seen[s] {
+			return
+		}
+		seen[s] = true
+		out = append(out, s)
+		if strings.Contains(s, "://") {
+			if u, err := url.Parse(s); err == nil && u.Hostname() != "" {
+				add(u.Hostname())
+				add(u.Path)
+			}
+		} else if host, _, ok := strings.Cut(s, ":"); ok && isDomainLike(host) {
+			add(host)
+		}
+	}
+
+	split := func(r rune) bool { return strings.ContainsRune(" \t\n'\"()[]{}<>,;=|", r) }
+	keys := make([]string, 0, len(a.Fields))
+	for k := range a.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		add(a.Fields[k])
+		for _, tok := range strings.FieldsFunc(a.Fields[k], split) {
+			add(tok)
+		}
+	}
+	for _, tok := range strings.FieldsFunc(a.Details, split) {
+		add(tok)
+	}
+	return out
+}
+
+// --- Store ---
+
+// intelStore holds the active index. A reload builds a new index and swaps
+// it in, so matching never sees a half-loaded feed set.
+type intelStore struct {
+	mu       sync.RWMutex
+	index    *intelIndex
+	files    map[string][]byte // What index was built from, for cluster snapshots
+	loadedAt time.Time
+}
+
+func newIntelStore() *intelStore {
+	return &intelStore{index: newIntelIndex()}
+}
+
+func (s *intelStore) replace(x *intelIndex, files map[string][]byte, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index, s.files, s.loadedAt = x, files, now
+}
+
+// feeds returns the feed files the indicators were loaded from, and when.
+func (s *intelStore) feeds() (map[string][]byte, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.files, s.loadedAt
+}
+
+// match returns the unexpired indicators hit by the alert's observables.
+func (s *intelStore) match(a Alert, now time.Time) []IntelMatch {
+	s.mu.RLock()
+	x := s.index
+	s.mu.RUnlock()
+	if x.count == 0 {
+		return nil
+	}
+
+	var out []IntelMatch
+	hit := make(map[*Indicator]bool)
+	for _, obs := range observables(a) {
+		for _, ind := range x.lookup(obs) {
+			if hit[ind] || ind.expired(now) {
+				continue
+			}
+			hit[ind] = true
+			out = append(out, IntelMatch{Observable: obs, Indicator: *ind})
+		}
+	}
+	return out
+}
+
+type intelSummary struct {
+	Indicators int            `json:"indicators"`
+	ByType     map[string]int `json:"by_type"`
+	Sources    map[string]int `json:"sources"`
+	LoadedAt   time.Time      `json:"loaded_at,omitzero"`
+}
+
+func (s *intelStore) summary() intelSummary {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return intelSummary{Indicators: s.index.count, ByType: s.index.byType, Sources: s.index.sources, LoadedAt: s.loadedAt}
+}
+
+// reloadIntel reads the feeds in the intel directory and loads them, on
+// every node in a cluster.
+func (s *server) reloadIntel() error {
+	files, err := readIntelDir(s.intelDir)
+	if err != nil {
+		return err
+	}
+	stats, err := writeAs[intelLoadStats](s, "intel.load", files)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("Threat intel loaded",
+		"dir", s.intelDir,
+		"indicators", s.intel.summary().Indicators,
+		"expired", stats.Expired,
+		"invalid", stats.Invalid,
+	)
+	return nil
+}
+
+// loadIntelFeeds replaces the indicators with those in files, as of now.
+func (s *server) loadIntelFeeds(files map[string][]byte, now time.Time) (intelLoadStats, error) {
+	x, stats, err := parseIntelFeeds(files, now)
+	if err != nil {
+		return stats, err
+	}
+	s.intel.replace(x, files, now)
+	return stats, nil
+}
+
+func applyLoadIntel(s *server, files map[string][]byte, now time.Time) (any, error) {
+	return s.loadIntelFeeds(files, now)
+}
+
+// --- Handlers ---
+
+func (s *server) handleIntel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.intel.summary())
+}
+
+// handleIntelLookup serves GET /intel/lookup?value= for ad-hoc checks.
+func (s *server) handleIntelLookup(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query().Get("value")
+	if v == "" {
+		http.Error(w, "value is required", http.StatusBadRequest)
+		return
+	}
+	matches := s.intel.match(Alert{Details: v}, s.now())
+	if matches == nil {
+		matches = []IntelMatch{}
+	}
+	writeJSON(w, matches)
+}
+
+func (s *server) handleIntelReload(w http.ResponseWriter, r *http.Request) {
+	if s.intelDir == "" {
+		http.Error(w, "No intel directory configured (-intel-dir)", http.StatusConflict)
+		return
+	}
+	if err := s.reloadIntel(); err != nil {
+		s.logger.Error("Failed to reload threat intel", "error", err)
+		s.writeFailed(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, s.intel.summary())
+}
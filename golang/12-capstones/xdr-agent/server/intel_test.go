@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var intelNow = time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+
+func loadTestIntel(t *testing.T) *intelStore {
+	t.Helper()
+	x, stats, err := loadIntelDir("testdata/intel", intelNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.count != 10 || stats.Expired != 2 || stats.Invalid != 2 {
+		t.Fatalf("loaded %d indicators, %d expired, %d invalid; want 10, 2, 2", x.count, stats.Expired, stats.Invalid)
+	}
+	s := newIntelStore()
+	s.replace(x, nil, intelNow)
+	return s
+}
+
+func TestIntelMatch(t *testing.T) {
+	store := loadTestIntel(t)
+
+	tests := []struct {
+		name  string
+		alert Alert
+		want  []string // value@source/confidence
+	}{
+		{"ip inside CIDR and exact ip", Alert{Details: "connection to 203.0.113.7:3333"},
+			[]string{"203.0.113.0/24@stix-bundle.json/75", "203.0.113.7@abuse.csv/60"}},
+		{"hash in fields, any case", Alert{Fields: map[string]string{"sha256": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}},
+			[]string{"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855@stix-bundle.json/85"}},
+		{"full path", Alert{Details: "Process '/tmp/.x/miner_x' started"},
+			[]string{"/tmp/.x/miner_x@abuse.csv/95"}},
+		{"bare file name in any directory", Alert{Fields: map[string]string{"exe": "/usr/bin/kworkerds"}},
+			[]string{"kworkerds@misp-event.json/70"}},
+		{"subdomain", Alert{Details: "dns query cdn.c2.evil.example"},
+			[]string{"c2.evil.example@misp-event.json/70"}},
+		{"domain in URL", Alert{Details: "curl http://pool.evil.example/miner"},
+			[]string{"pool.evil.example@stix-bundle.json/75"}},
+		{"IPv6 from composite attribute", Alert{Details: "dst=2001:db8::dead"},
+			[]string{"2001:db8::dead@misp-event.json/70"}},
+		{"expired indicator", Alert{Details: "beacon to 198.51.100.9"}, nil},
+		{"not flagged to_ids", Alert{Details: "benign.example"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, m := range store.match(tt.alert, intelNow) {
+				got = append(got, m.Value+"@"+m.Source+"/"+strconv.Itoa(m.Confidence))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matches = %v; want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Expiry is checked at match time too
+	if m := store.match(Alert{Details: "203.0.113.50"}, time.Date(2027, 2, 1, 0, 0, 0, 0, time.UTC)); len(m) != 0 {
+		t.Errorf("match after valid_until = %v; want none", m)
+	}
+}
+
+func TestCIDRTreeLongestLast(t *testing.T) {
+	var tree cidrTree
+	for _, p := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.3/32", "::ffff:10.0.0.0/104", "2001:db8::/32"} {
+		tree.insert(netip.MustParsePrefix(p), &Indicator{Value: p})
+	}
+
+	tests := []struct {
+		addr string
+		want []string
+	}{
+		{"10.1.2.3", []string{"10.0.0.0/8", "::ffff:10.0.0.0/104", "10.1.0.0/16", "10.1.2.3/32"}},
+		{"::ffff:10.9.9.9", []string{"10.0.0.0/8", "::ffff:10.0.0.0/104"}},
+		{"2001:db8:1::1", []string{"2001:db8::/32"}},
+		{"192.168.1.1", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, ind := range tree.lookup(netip.MustParseAddr(tt.addr)) {
+			got = append(got, ind.Value)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lookup(%s) = %v; want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestIngestEnrichesWithIntel(t *testing.T) {
+	s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s.now = func() time.Time { return intelNow }
+	s.intel = loadTestIntel(t)
+
+	s.ingest(Alert{ID: "n1", AgentID: "web-1", EventType: "NETWORK_CONNECT", Details: "miner_x -> 203.0.113.7:3333", Timestamp: intelNow.Unix()})
+
+	events := s.tenant(defaultTenant).timeline.between("web-1", intelNow, intelNow.Add(time.Second))
+	if len(events) != 1 || len(events[0].Intel) != 2 {
+		t.Fatalf("timeline = %+v; want one event with 2 intel matches", events)
+	}
+	incs := s.tenant(defaultTenant).incidents.list()
+	if len(incs) != 1 || incs[0].Detections[0].RuleID != "xdr-005" {
+		t.Fatalf("incidents = %+v; want one from xdr-005", incs)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// intelLoadStats counts what a load skipped
+type intelLoadStats struct {
+	Expired int
+	Invalid int
+}
+
+// loadIntelDir parses every feed in dir.
+func loadIntelDir(dir string, now time.Time) (*intelIndex, intelLoadStats, error) {
+	files, err := readIntelDir(dir)
+	if err != nil {
+		return nil, intelLoadStats{}, err
+	}
+	return parseIntelFeeds(files, now)
+}
+
+// readIntelDir reads the feeds in dir by file name: STIX 2.1 bundles and
+// MISP exports (*.json) and CSV files (*.csv).
+func readIntelDir(dir string) (map[string][]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte)
+	for _, e := range entries {
+		name := e.Name()
+		ext := strings.ToLower(filepath.Ext(name))
+		if e.IsDir() || (ext != ".json" && ext != ".csv") {
+			continue
+		}
+		if files[name], err = os.ReadFile(filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// parseIntelFeeds builds an index from feed files, in name order. Entries
+// that are invalid or already expired are skipped; a file that can't be
+// parsed at all fails the load.
+func parseIntelFeeds(files map[string][]byte, now time.Time) (*intelIndex, intelLoadStats, error) {
+	var stats intelLoadStats
+	x := newIntelIndex()
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		data := files[name]
+		var inds []*Indicator
+		var invalid int
+		var err error
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".json":
+			inds, invalid, err = parseIntelJSON(data, name)
+		case ".csv":
+			inds, invalid, err = parseIntelCSV(bytes.NewReader(data), name)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, stats, fmt.Errorf("%s: %w", name, err)
+		}
+		stats.Invalid += invalid
+		for _, ind := range inds {
+			if ind.expired(now) {
+				stats.Expired++
+				continue
+			}
+			x.add(ind)
+		}
+	}
+	return x, stats, nil
+}
+
+// parseIntelJSON tells a STIX bundle from a MISP export by its shape.
+func parseIntelJSON(data []byte, source string) ([]*Indicator, int, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		return parseMISP(trimmed, source)
+	}
+	var probe struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(trimmed, &probe); err != nil {
+		return nil, 0, err
+	}
+	if probe.Type == "bundle" {
+		return parseSTIX(trimmed, source)
+	}
+	return parseMISP(trimmed, source)
+}
+
+// --- STIX 2.1 ---
+
+type stixObject struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Pattern     string `json:"pattern"`
+	PatternType string `json:"pattern_type"`
+	ValidUntil  string `json:"valid_until"`
+	Confidence  *int   `json:"confidence"`
+	Revoked     bool   `json:"revoked"`
+}
+
+// stixComparison matches one equality test in a STIX pattern, e.g.
+// [file:hashes.'SHA-256' = 'abc...'].
+var stixComparison = regexp.MustCompile(`([a-z0-9-]+):([A-Za-z0-9_.'-]+)\s*=\s*'((?:[^'\\]|\\.)*)'`)
+
+// stixType maps an object path in a pattern to our indicator type.
+func stixType(object, property string) string {
+	switch {
+	case object == "file" && strings.HasPrefix(property, "hashes."):
+		return IndicatorHash
+	case object == "file" && property == "name":
+		return IndicatorPath
+	case (object == "ipv4-addr" || object == "ipv6-addr") && property == "value":
+		return IndicatorIP
+	case object == "domain-name" && property == "value":
+		return IndicatorDomain
+	}
+	return ""
+}
+
+// parseSTIX reads the indicator objects of a STIX 2.1 bundle. Only "="
+// comparisons are used; every one in a pattern becomes its own indicator,
+// which treats AND like OR. That over-matches but never misses.
+func parseSTIX(data []byte, source string) ([]*Indicator, int, error) {
+	var bundle struct {
+		Objects []stixObject `json:"objects"`
+	}
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, 0, err
+	}
+
+	var out []*Indicator
+	invalid := 0
+	for _, o := range bundle.Objects {
+		if o.Type != "indicator" || o.Revoked || (o.PatternType != "" && o.PatternType != "stix") {
+			continue
+		}
+		var expires time.Time
+		if o.ValidUntil != "" {
+			t, err := time.Parse(time.RFC3339, o.ValidUntil)
+			if err != nil {
+				invalid++
+				continue
+			}
+			expires = t
+		}
+		confidence := defaultConfidence
+		if o.Confidence != nil {
+			confidence = *o.Confidence
+		}
+		desc := o.Name
+		if desc == "" {
+			desc = o.Description
+		}
+
+		for _, m := range stixComparison.FindAllStringSubmatch(o.Pattern, -1) {
+			typ := stixType(m[1], m[2])
+			if typ == "" {
+				continue
+			}
+			value := strings.ReplaceAll(strings.ReplaceAll(m[3], `\'`, `'`), `\\`, `\`)
+			ind, err := newIndicator(typ, value, source, confidence, expires, desc)
+			if err != nil {
+				invalid++
+				continue
+			}
+			out = append(out, ind)
+		}
+	}
+	return out, invalid, nil
+}
+
+// --- MISP ---
+
+type mispAttribute struct {
+	Type    string `json:"type"`
+	Value   string `json:"value"`
+	Comment string `json:"comment"`
+	ToIDS   bool   `json:"to_ids"`
+	Deleted bool   `json:"deleted"`
+}
+
+type mispEvent struct {
+	Info          string          `json:"info"`
+	ThreatLevelID string          `json:"threat_level_id"`
+	Attribute     []mispAttribute `json:"Attribute"`
+	Object        []struct {
+		Attribute []mispAttribute `json:"Attribute"`
+	} `json:"Object"`
+}
+
+type mispWrapper struct {
+	Event mispEvent `json:"Event"`
+}
+
+// MISP has no per-indicator confidence, so the event threat level stands in
+var mispConfidence = map[string]int{"1": 90, "2": 70, "3": 50}
+
+// mispTypes maps MISP attribute types to ours. Composite types like
+// "filename|sha256" carry one value per part.
+var mispTypes = map[string]string{
+	"md5": IndicatorHash, "sha1": IndicatorHash, "sha256": IndicatorHash, "sha512": IndicatorHash,
+	"ip-src": IndicatorIP, "ip-dst": IndicatorIP,
+	"domain": IndicatorDomain, "hostname": IndicatorDomain,
+	"filename": IndicatorPath,
+}
+
+// parseMISP reads a MISP JSON export: one {"Event": ...}, a list of them,
+// or a REST search result {"response": [...]}. Only attributes flagged
+// to_ids are used, as MISP intends.
+func parseMISP(data []byte, source string) ([]*Indicator, int, error) {
+	var events []mispWrapper
+	switch {
+	case data[0] == '[':
+		if err := json.Unmarshal(data, &events); err != nil {
+			return nil, 0, err
+		}
+	default:
+		var doc struct {
+			Event    *mispEvent    `json:"Event"`
+			Response []mispWrapper `json:"response"`
+		}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, 0, err
+		}
+		if doc.Event == nil && doc.Response == nil {
+			return nil, 0, fmt.Errorf("neither a STIX bundle nor a MISP export")
+		}
+		events = doc.Response
+		if doc.Event != nil {
+			events = append(events, mispWrapper{Event: *doc.Event})
+		}
+	}
+
+	var out []*Indicator
+	invalid := 0
+	for _, w := range events {
+		ev := w.Event
+		confidence, ok := mispConfidence[ev.ThreatLevelID]
+		if !ok {
+			confidence = defaultConfidence
+		}
+		attrs := ev.Attribute
+		for _, o := range ev.Object {
+			attrs = append(attrs, o.Attribute...)
+		}
+
+		for _, a := range attrs {
+			if !a.ToIDS || a.Deleted {
+				continue
+			}
+			desc := ev.Info
+			if a.Comment != "" {
+				desc += ": " + a.Comment
+			}
+			types := strings.Split(a.Type, "|")
+			values := strings.Split(a.Value, "|")
+			if len(types) != len(values) {
+				invalid++
+				continue
+			}
+			for i, t := range types {
+				typ, ok := mispTypes[t]
+				if !ok {
+					continue // e.g. the port of ip-dst|port
+				}
+				ind, err := newIndicator(typ, values[i], source, confidence, time.Time{}, desc)
+				if err != nil {
+					invalid++
+					continue
+				}
+				out = append(out, ind)
+			}
+		}
+	}
+	return out, invalid, nil
+}
+
+// --- CSV ---
+
+// parseIntelCSV reads a CSV feed with a header row. "type" and "value" are
+// required; "confidence", "expires" (RFC 3339) and "description" are
+// optional. Lines starting with # are comments.
+//
+//	type,value,confidence,expires,description
+//	ip,203.0.113.7,80,2026-12-31T00:00:00Z,Mining pool
+func parseIntelCSV(r io.Reader, source string) ([]*Indicator, int, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading header: %w", err)
+	}
+	col := make(map[string]int)
+	for i, h := range header {
+		col[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	if _, ok := col["type"]; !ok {
+		return nil, 0, fmt.Errorf("header has no type column")
+	}
+	if _, ok := col["value"]; !ok {
+		return nil, 0, fmt.Errorf("header has no value column")
+	}
+	get := func(rec []string, name string) string {
+		if i, ok := col[name]; ok && i < len(rec) {
+			return strings.TrimSpace(rec[i])
+		}
+		return ""
+	}
+
+	var out []*Indicator
+	invalid := 0
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		confidence := defaultConfidence
+		if v := get(rec, "confidence"); v != "" {
+			if confidence, err = strconv.Atoi(v); err != nil {
+				invalid++
+				continue
+			}
+		}
+		var expires time.Time
+		if v := get(rec, "expires"); v != "" {
+			if expires, err = time.Parse(time.RFC3339, v); err != nil {
+				invalid++
+				continue
+			}
+		}
+		typ := strings.ToLower(get(rec, "type"))
+		switch typ {
+		case "md5", "sha1", "sha256", "sha512":
+			typ = IndicatorHash
+		}
+		ind, err := newIndicator(typ, get(rec, "value"), source, confidence, expires, get(rec, "description"))
+		if err != nil {
+			invalid++
+			continue
+		}
+		out = append(out, ind)
+	}
+	return out, invalid, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Package is one installed piece of software on a host, as reported by
+// the agent's inventory collector.
+type Package struct {
+	Ecosystem  string `json:"ecosystem"`
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	Arch       string `json:"arch,omitempty"`
+	SrcPackage string `json:"src_package,omitempty"`
+	Source     string `json:"source"` // "dpkg", "rpm" or a Go binary path
+}
+
+func (p Package) key() string {
+	return p.Ecosystem + "|" + p.Name + "|" + p.Version + "|" + p.Source
+}
+
+// InventoryReport is a full snapshot or a diff against the last one
+type InventoryReport struct {
+	AgentID   string    `json:"agent_id"`
+	Full      bool      `json:"full"`
+	Added     []Package `json:"added,omitempty"`
+	Removed   []Package `json:"removed,omitempty"`
+	Timestamp int64     `json:"timestamp"`
+}
+
+var errNoBaseline = errors.New("no inventory baseline for agent, send a full report")
+
+// trackedFinding remembers when a finding first showed up on a host
+type trackedFinding struct {
+	VulnFinding
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+// inventoryStore keeps the current package set and open vulnerability
+// findings per agent.
+type inventoryStore struct {
+	mu       sync.Mutex
+	hosts    map[string]map[string]Package
+	findings map[string]map[string]trackedFinding
+}
+
+func newInventoryStore() *inventoryStore {
+	return &inventoryStore{
+		hosts:    make(map[string]map[string]Package),
+		findings: make(map[string]map[string]trackedFinding),
+	}
+}
+
+// apply folds a report into the host's package set. A diff for a host we
+// have no snapshot of (e.g. after a server restart) is rejected.
+func (s *inventoryStore) apply(r InventoryReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pkgs, ok := s.hosts[r.AgentID]
+	if r.Full || !ok {
+		if !r.Full {
+			return errNoBaseline
+		}
+		pkgs = make(map[string]Package)
+		s.hosts[r.AgentID] = pkgs
+	}
+	for _, p := range r.Removed {
+		delete(pkgs, p.key())
+	}
+	for _, p := range r.Added {
+		pkgs[p.key()] = p
+	}
+	return nil
+}
+
+func (s *inventoryStore) packages(agentID string) []Package {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Package, 0, len(s.hosts[agentID]))
+	for _, p := range s.hosts[agentID] {
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].key() < out[j].key() })
+	return out
+}
+
+func (s *inventoryStore) agentIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.hosts))
+	for id := range s.hosts {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// setFindings replaces a host's findings and returns the ones that are new.
+// Findings that disappear (package upgraded or removed) are closed.
+func (s *inventoryStore) setFindings(agentID string, found []VulnFinding, now time.Time) []VulnFinding {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.findings[agentID]
+	cur := make(map[string]trackedFinding, len(found))
+	var fresh []VulnFinding
+	for _, f := range found {
+		if prev, ok := old[f.key()]; ok {
+			cur[f.key()] = prev
+			continue
+		}
+		cur[f.key()] = trackedFinding{VulnFinding: f, FirstSeen: now}
+		fresh = append(fresh, f)
+	}
+	s.findings[agentID] = cur
+	return fresh
+}
+
+// findingsSince returns the open findings first seen at or after since,
+// per agent.
+func (s *inventoryStore) findingsSince(since time.Time) map[string][]trackedFinding {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string][]trackedFinding)
+	for agent, findings := range s.findings {
+		for _, f := range findings {
+			if !f.FirstSeen.Before(since) {
+				out[agent] = append(out[agent], f)
+			}
+		}
+	}
+	return out
+}
+
+func (s *inventoryStore) openFindings(agentID string) []trackedFinding {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]trackedFinding, 0, len(s.findings[agentID]))
+	for _, f := range s.findings[agentID] {
+		out = append(out, f)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].key() < out[j].key() })
+	return out
+}
+
+// --- Matching ---
+
+// scanHost matches a host's packages against the OSV database and raises
+// a VULNERABLE_PACKAGE alert for each finding not seen before.
+func (s *server) scanHost(td *tenantData, agentID string) {
+	found := s.vulns.match(td.inventory.packages(agentID))
+	for _, f := range td.inventory.setFindings(agentID, found, s.now()) {
+		details := fmt.Sprintf("%s %s (%s) is affected by %s", f.Package.Name, f.Package.Version, f.Package.Source, f.VulnID)
+		if len(f.Aliases) > 0 {
+			details += " [" + strings.Join(f.Aliases, ", ") + "]"
+		}
+		if len(f.FixedIn) > 0 {
+			details += ", fixed in " + strings.Join(f.FixedIn, ", ")
+		}
+		_, err := s.accept(Alert{
+			AgentID:   agentID,
+			Tenant:    td.id,
+			EventType: "VULNERABLE_PACKAGE",
+			Details:   details,
+			Timestamp: s.now().Unix(),
+		})
+		if err != nil {
+			s.logger.Error("Failed to raise vulnerability alert", "tenant", td.id, "agent", agentID, "vuln", f.VulnID, "error", err)
+		}
+	}
+}
+
+func (s *server) reloadVulnDB() error {
+	if err := s.vulns.loadDir(s.osvDir); err != nil {
+		return err
+	}
+	s.logger.Info("OSV database loaded", "dir", s.osvDir, "entries", s.vulns.size())
+	for _, td := range s.tenants.all() {
+		for _, id := range td.inventory.agentIDs() {
+			s.scanHost(td, id)
+		}
+	}
+	return nil
+}
+
+// --- Handlers ---
+
+func (s *server) handleInventory(w http.ResponseWriter, r *http.Request) {
+	var report InventoryReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil || report.AgentID == "" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	td := s.data(r)
+	if err := td.inventory.apply(report); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	s.logger.Info("Inventory received",
+		"tenant", td.id,
+		"agent", report.AgentID,
+		"full", report.Full,
+		"added", len(report.Added),
+		"removed", len(report.Removed),
+	)
+	s.scanHost(td, report.AgentID)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *server) handlePackages(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.data(r).inventory.packages(r.PathValue("id")))
+}
+
+func (s *server) handleVulnerabilities(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.data(r).inventory.openFindings(r.PathValue("id")))
+}
+
+func (s *server) handleVulnDBReload(w http.ResponseWriter, r *http.Request) {
+	if s.osvDir == "" {
+		http.Error(w, "No OSV directory configured (-osv-dir)", http.StatusConflict)
+		return
+	}
+	if err := s.reloadVulnDB(); err != nil {
+		s.logger.Error("Failed to reload OSV database", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]int{"entries": s.vulns.size()})
+}
@@ -1,51 +1,534 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
+	"flag"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"12-capstones/xdr-agent/recording"
+	"12-capstones/xdr-agent/xdrpb"
 )
 
+// An agent that misses heartbeats for this long without saying goodbye
+// is flagged as lost.
+const heartbeatTimeout = 30 * time.Second
+
 // Alert represents a security event sent by an agent
 type Alert struct {
+	ID        string `json:"id,omitempty"`
 	AgentID   string `json:"agent_id"`
 	EventType string `json:"event_type"` // e.g., "PROCESS_START", "FILE_MODIFIED"
 	Details   string `json:"details"`
 	Timestamp int64  `json:"timestamp"`
+
+	// Structured data, e.g. pid/ppid/start for PROCESS_START
+	Fields map[string]string `json:"fields,omitempty"`
+
+	// Threat-intel hits, filled in by the server on ingest
+	Intel []IntelMatch `json:"intel,omitempty"`
+
+	// ID of the suppression that hid this alert, set on ingest
+	Suppressed string `json:"suppressed,omitempty"`
+
+	// Set by the server from the sender's credentials, never trusted from
+	// the agent
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// server holds the shared state behind the HTTP handlers
+type server struct {
+	logger     *slog.Logger
+	now        func() time.Time // Real or simulated (replay) clock
+	simClock   *recording.Clock // Set when replaying, driven by X-Replay-Time
+	tenants    *tenantSet       // What each tenant's agents reported
+	vulns      *vulnDB
+	osvDir     string
+	detector   *detector
+	intel      *intelStore
+	intelDir   string
+	reportsDir string // Where reports without a webhook go; empty disables them
+	audit      *auditLog
+	cases      *caseStore
+	auth       *authStore // nil when started with -no-auth
+	keyless    bool       // Agents may post without a key (-keyless-agents, deprecated)
+	suppress   *suppressionStore
+	hunts      *huntStore
+	reports    *reportStore
+	releases   *releaseStore
+	cluster    *cluster // nil when standalone
+	metrics    *serverMetrics
+}
+
+func newServer(logger *slog.Logger) *server {
+	audit, _ := openAuditLog("") // In memory until main opens the file
+	s := &server{
+		logger:   logger,
+		now:      time.Now,
+		tenants:  newTenantSet(logger),
+		vulns:    newVulnDB(),
+		detector: newDetector(slices.Clone(defaultRules)),
+		intel:    newIntelStore(),
+		audit:    audit,
+		cases:    newCaseStore(audit),
+		suppress: &suppressionStore{},
+		hunts:    &huntStore{},
+		reports:  &reportStore{},
+		releases: &releaseStore{builds: make(map[string][]byte)},
+	}
+	s.metrics = newServerMetrics(s)
+	return s
+}
+
+// useSimClock makes the server run on replayed time instead of wall time.
+func (s *server) useSimClock(c *recording.Clock) {
+	s.simClock = c
+	s.now = c.Now
 }
 
 func main() {
+	osvDir := flag.String("osv-dir", "", "Directory of OSV JSON files (or .zip exports) to match inventories against")
+	simClock := flag.Bool("sim-clock", false, "Take time from the X-Replay-Time header (for the replay tool)")
+	intelDir := flag.String("intel-dir", "", "Directory of threat-intel feeds (STIX 2.1 / MISP JSON, CSV)")
+	auditPath := flag.String("audit-log", "xdr-audit.ndjson", "Append-only audit log of case changes (empty keeps it in memory)")
+	grpcAddr := flag.String("grpc-addr", ":9091", "Listen address for the gRPC transport (empty to disable)")
+	authPath := flag.String("auth-file", "xdr-auth.json", "Users and API keys")
+	noAuth := flag.Bool("no-auth", false, "Serve the API without authentication (lab use only)")
+	keyless := flag.Bool("keyless-agents", false, "Accept /audit, /heartbeat and /inventory posts without an API key, as the default tenant. Deprecated: agents from before API keys need it until they're given one")
+	baselinePath := flag.String("baseline-file", "xdr-baseline.json", "Learned behavior baseline; tenants other than the default get one alongside (empty keeps them in memory)")
+	learn := flag.Duration("baseline-learn", defaultLearningWindow, "How long a host is only learned before anomalies are flagged")
+	suppressPath := flag.String("suppressions-file", "xdr-suppressions.json", "Alert suppression rules and their hit counters (empty keeps them in memory)")
+	casesPath := flag.String("cases-file", "xdr-cases.json", "Cases and their notes (empty keeps them in memory)")
+	huntsPath := flag.String("hunts-file", "xdr-hunts.json", "Saved and scheduled hunting queries (empty keeps them in memory)")
+	reportsPath := flag.String("reports-file", "xdr-reports.json", "Scheduled reports (empty keeps them in memory)")
+	reportsDir := flag.String("reports-dir", "xdr-reports", "Directory reports without a webhook are written to, one subdirectory per tenant")
+	rulesPath := flag.String("rules-file", "xdr-rules.json", "Detection rules edited through the API (defaults are used until it exists)")
+	releasesDir := flag.String("releases-dir", "xdr-releases", "Uploaded agent builds and rollouts (empty keeps them in memory)")
+	releaseKey := flag.String("release-key", "", "Base64 Ed25519 public key that must have signed uploaded agent builds")
+	addr := flag.String("addr", ":9090", "Listen address for the HTTP API")
+	nodeID := flag.String("node-id", "", "This node's ID in a cluster (empty runs standalone)")
+	peers := flag.String("peers", "", "Every cluster node, this one included, as id=http://host:port,...")
+	raftDir := flag.String("raft-dir", "xdr-raft", "Directory for this node's replicated log and snapshots")
+	threshold := flag.Int("anomaly-threshold", defaultAnomalyThreshold, "Score (0-100) from which a seen-before value counts as rare")
+	flag.Parse()
+
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 	slog.SetDefault(logger)
 
-	http.HandleFunc("/audit", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
+	s := newServer(logger)
+	s.osvDir = *osvDir
+	s.intelDir = *intelDir
+	if *auditPath != "" {
+		audit, err := openAuditLog(*auditPath)
+		if err != nil {
+			logger.Error("Failed to open audit log", "path", *auditPath, "error", err)
+			os.Exit(1)
+		}
+		s.audit = audit
+	}
+	if *nodeID != "" {
+		// The replicated log rebuilds the baseline, rules, suppressions,
+		// hunts, reports and credentials; files of their own would have
+		// every replayed change made twice
+		*baselinePath, *rulesPath, *suppressPath, *huntsPath, *reportsPath, *authPath = "", "", "", "", "", ""
+	}
+	s.tenants.baselinePath, s.tenants.learn, s.tenants.threshold = *baselinePath, *learn, *threshold
+	if _, err := s.tenants.open(defaultTenant); err != nil {
+		logger.Error("Failed to load baseline", "path", *baselinePath, "error", err)
+		os.Exit(1)
+	}
+	var err error
+	if s.cases, err = openCaseStore(*casesPath, s.audit); err != nil {
+		logger.Error("Failed to load cases", "path", *casesPath, "error", err)
+		os.Exit(1)
+	}
+	if s.suppress, err = openSuppressionStore(*suppressPath); err != nil {
+		logger.Error("Failed to load suppressions", "path", *suppressPath, "error", err)
+		os.Exit(1)
+	}
+	if s.hunts, err = openHuntStore(*huntsPath); err != nil {
+		logger.Error("Failed to load hunts", "path", *huntsPath, "error", err)
+		os.Exit(1)
+	}
+	if s.reports, err = openReportStore(*reportsPath); err != nil {
+		logger.Error("Failed to load reports", "path", *reportsPath, "error", err)
+		os.Exit(1)
+	}
+	s.reportsDir = *reportsDir
+	if s.detector, err = openDetector(*rulesPath); err != nil {
+		logger.Error("Failed to load rules", "path", *rulesPath, "error", err)
+		os.Exit(1)
+	}
+	var releasePub ed25519.PublicKey
+	if *releaseKey != "" {
+		if releasePub, err = parsePublicKey(*releaseKey); err != nil {
+			logger.Error("Bad release key", "error", err)
+			os.Exit(1)
+		}
+	}
+	if s.releases, err = openReleaseStore(*releasesDir, releasePub); err != nil {
+		logger.Error("Failed to load agent releases", "dir", *releasesDir, "error", err)
+		os.Exit(1)
+	}
+	if *noAuth {
+		logger.Warn("Authentication disabled, every request is treated as admin")
+	} else if err := s.enableAuth(*authPath); err != nil {
+		logger.Error("Failed to load auth file", "path", *authPath, "error", err)
+		os.Exit(1)
+	} else if *keyless {
+		s.keyless = true
+		logger.Warn("Agents may post without an API key; give them keys and drop -keyless-agents")
+	}
+	if *simClock {
+		s.useSimClock(recording.NewClock(time.Unix(0, 0)))
+		logger.Warn("Simulated clock enabled, time follows X-Replay-Time")
+	}
+	if s.osvDir != "" {
+		if err := s.reloadVulnDB(); err != nil {
+			logger.Error("Failed to load OSV database", "dir", s.osvDir, "error", err)
+		}
+	}
+
+	if *nodeID != "" {
+		key := os.Getenv("XDR_CLUSTER_KEY")
+		if key == "" && !*noAuth {
+			logger.Warn("XDR_CLUSTER_KEY is not set, cluster RPCs are unauthenticated")
+		}
+		if err := s.joinCluster(*nodeID, *peers, *raftDir, key); err != nil {
+			logger.Error("Failed to join cluster", "node", *nodeID, "error", err)
+			os.Exit(1)
 		}
+		logger.Info("Cluster node started", "node", *nodeID, "peers", *peers)
+	}
+	if s.auth != nil && s.cluster == nil {
+		if err := s.bootstrapAuth(*authPath); err != nil {
+			logger.Error("Failed to create the first API key", "error", err)
+			os.Exit(1)
+		}
+	} else if s.auth != nil {
+		go func() {
+			if err := s.bootstrapAuth("the cluster"); err != nil {
+				logger.Error("Failed to create the first API key", "error", err)
+			}
+		}()
+	}
+
+	go s.watchHeartbeats()
+	go s.pruneProcesses()
+	go s.saveStateLoop()
+	go s.huntLoop()
+	go s.reportLoop()
 
-		var alert Alert
-		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
-			logger.Error("Failed to decode alert", "error", err)
-			http.Error(w, "Bad request", http.StatusBadRequest)
-			return
+	if *grpcAddr != "" {
+		lis, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			logger.Error("Failed to listen for gRPC", "addr", *grpcAddr, "error", err)
+			os.Exit(1)
 		}
+		svc := &grpcService{s: s}
+		gs := grpc.NewServer(
+			grpc.UnaryInterceptor(svc.unaryAuth),
+			grpc.StreamInterceptor(svc.streamAuth),
+		)
+		xdrpb.RegisterXDRServer(gs, svc)
+		logger.Info("XDR gRPC listening on " + *grpcAddr)
+		go gs.Serve(lis)
+	}
+
+	logger.Info("XDR Server listening on " + *addr)
+	logger.Info("Web console on http://localhost" + *addr + "/ui/")
+	http.ListenAndServe(*addr, s.routes())
+}
+
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("GET /{$}", http.RedirectHandler("/ui/", http.StatusFound))
+	mux.Handle("GET /ui/", dashboardHandler())
+	mux.HandleFunc("POST /login", s.handleLogin)
+	if s.cluster != nil && s.cluster.handler != nil {
+		mux.Handle("POST /raft/", s.cluster.handler)
+	}
+	mux.HandleFunc("GET /cluster", s.require(PermRead, s.serverWide(s.handleCluster)))
+	mux.HandleFunc("GET /metrics", s.require(PermRead, s.serverWide(s.metrics.reg.Handler().ServeHTTP)))
+	mux.HandleFunc("/audit", s.requireAgent(s.handleAudit))
+	mux.HandleFunc("/heartbeat", s.requireAgent(s.handleHeartbeat))
+	mux.HandleFunc("/agents", s.require(PermRead, s.handleAgents))
+	mux.HandleFunc("POST /inventory", s.requireAgent(s.handleInventory))
+	mux.HandleFunc("GET /agents/{id}/packages", s.require(PermRead, s.handlePackages))
+	mux.HandleFunc("GET /agents/{id}/vulnerabilities", s.require(PermRead, s.handleVulnerabilities))
+	mux.HandleFunc("POST /vulndb/reload", s.require(PermFeedsReload, s.serverWide(s.handleVulnDBReload)))
+	mux.HandleFunc("GET /incidents", s.require(PermRead, s.handleIncidents))
+	mux.HandleFunc("GET /incidents/{id}", s.require(PermRead, s.handleIncident))
+	mux.HandleFunc("POST /agents/{id}/commands", s.require(PermCommandsQueue, s.handleQueueCommand))
+	mux.HandleFunc("GET /agents/{id}/commands", s.require(PermRead, s.handleListCommands))
+	mux.HandleFunc("GET /agents/{id}/process-tree", s.require(PermRead, s.handleProcessTree))
+	mux.HandleFunc("GET /agents/{id}/timeline", s.require(PermRead, s.handleTimeline))
+	mux.HandleFunc("GET /intel", s.require(PermRead, s.handleIntel))
+	mux.HandleFunc("GET /intel/lookup", s.require(PermRead, s.handleIntelLookup))
+	mux.HandleFunc("POST /intel/reload", s.require(PermFeedsReload, s.serverWide(s.handleIntelReload)))
+	mux.HandleFunc("POST /cases", s.require(PermCasesWrite, s.handleCreateCase))
+	mux.HandleFunc("GET /cases", s.require(PermRead, s.handleListCases))
+	mux.HandleFunc("GET /cases/{id}", s.require(PermRead, s.handleGetCase))
+	mux.HandleFunc("PATCH /cases/{id}", s.require(PermCasesWrite, s.handlePatchCase))
+	mux.HandleFunc("POST /cases/{id}/notes", s.require(PermCasesWrite, s.handleAddNote))
+	mux.HandleFunc("GET /audit-log", s.require(PermAuditExport, s.handleAuditExport))
+	mux.HandleFunc("GET /audit-log/verify", s.require(PermAuditExport, s.handleAuditVerify))
+	mux.HandleFunc("GET /baseline", s.require(PermRead, s.handleBaseline))
+	mux.HandleFunc("GET /anomalies", s.require(PermRead, s.handleAnomalies))
+	mux.HandleFunc("POST /baseline/accept", s.require(PermBaselineAccept, s.handleAcceptBaseline))
+	mux.HandleFunc("GET /alerts/stream", s.require(PermRead, s.handleAlertStream))
+	mux.HandleFunc("GET /suppressions", s.require(PermRead, s.handleListSuppressions))
+	mux.HandleFunc("POST /suppressions", s.require(PermSuppress, s.handleCreateSuppression))
+	mux.HandleFunc("DELETE /suppressions/{id}", s.require(PermSuppress, s.handleDeleteSuppression))
+	mux.HandleFunc("POST /hunt", s.require(PermRead, s.handleHunt))
+	mux.HandleFunc("GET /hunts", s.require(PermRead, s.handleListHunts))
+	mux.HandleFunc("POST /hunts", s.require(PermHunt, s.handleCreateHunt))
+	mux.HandleFunc("POST /hunts/{id}/run", s.require(PermHunt, s.handleRunHunt))
+	mux.HandleFunc("DELETE /hunts/{id}", s.require(PermHunt, s.handleDeleteHunt))
+	mux.HandleFunc("GET /reports", s.require(PermRead, s.handleListReports))
+	mux.HandleFunc("GET /reports/preview", s.require(PermRead, s.handlePreviewReport))
+	mux.HandleFunc("POST /reports", s.require(PermReports, s.handleCreateReport))
+	mux.HandleFunc("POST /reports/{id}/run", s.require(PermReports, s.handleRunReport))
+	mux.HandleFunc("DELETE /reports/{id}", s.require(PermReports, s.handleDeleteReport))
+	mux.HandleFunc("GET /rules", s.require(PermRead, s.handleRules))
+	mux.HandleFunc("POST /rules/test", s.require(PermRead, s.handleTestRules))
+	mux.HandleFunc("PUT /rules/{id}", s.require(PermRulesWrite, s.handlePutRule))
+	mux.HandleFunc("DELETE /rules/{id}", s.require(PermRulesWrite, s.handleDeleteRule))
+	mux.HandleFunc("POST /users", s.require(PermManageAccess, s.handleAddUser))
+	mux.HandleFunc("GET /api-keys", s.require(PermManageAccess, s.handleListKeys))
+	mux.HandleFunc("POST /api-keys", s.require(PermManageAccess, s.handleAddKey))
+	mux.HandleFunc("DELETE /api-keys/{name}", s.require(PermManageAccess, s.handleDeleteKey))
+	mux.HandleFunc("GET /agent-releases", s.require(PermRead, s.serverWide(s.handleListReleases)))
+	mux.HandleFunc("PUT /agent-releases/{version}", s.require(PermReleases, s.serverWide(s.handleUploadRelease)))
+	mux.HandleFunc("DELETE /agent-releases/{version}", s.require(PermReleases, s.serverWide(s.handleDeleteRelease)))
+	mux.HandleFunc("GET /agent-releases/{version}/binary", s.require(PermIngest, s.handleDownloadRelease))
+	mux.HandleFunc("GET /rollouts", s.require(PermRead, s.serverWide(s.handleListRollouts)))
+	mux.HandleFunc("PUT /rollouts/{group}", s.require(PermReleases, s.serverWide(s.handlePutRollout)))
+	mux.HandleFunc("DELETE /rollouts/{group}", s.require(PermReleases, s.serverWide(s.handleDeleteRollout)))
+	return mux
+}
+
+func (s *server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var alert Alert
+	if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+		s.logger.Error("Failed to decode alert", "error", err)
+		s.metrics.rejected.Inc()
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	s.advanceSimClock(r)
+	alert.Tenant = s.tenantOf(r)
+	if _, err := s.accept(alert); err != nil {
+		s.unavailable(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-		// Simulate "Analysis"
-		logger.Info("Security Alert Received",
+// ingest is the single entry point for alerts, whether they come from an
+// agent or are produced by the server itself (e.g. vulnerability findings).
+// It returns false for an alert that was already ingested.
+func (s *server) ingest(alert Alert) bool {
+	return s.ingestAt(alert, s.now())
+}
+
+// ingestAt ingests an alert as if it arrived at now. A cluster replays
+// alerts with the time the receiving node took them, so every node builds
+// the same incidents no matter when it applies them.
+func (s *server) ingestAt(alert Alert, now time.Time) bool {
+	td := s.tenant(alert.Tenant)
+	alert.Tenant = td.id
+	if !td.seenAlerts.add(alert.ID) {
+		// Resent from the agent's spool, we already have it
+		s.metrics.duplicates.Inc()
+		return false
+	}
+	start := time.Now()
+	defer func() { s.metrics.ingestLatency.Observe(time.Since(start).Seconds()) }()
+	s.metrics.ingested.With(alert.EventType).Inc()
+
+	// Enrich with threat intel before anything stores the alert
+	alert.Intel = s.intel.match(alert, now)
+
+	// Allow-listed alerts are kept for the host's record and nothing else
+	alert.Suppressed = s.suppress.match(alert, now)
+	if alert.Suppressed != "" {
+		s.metrics.suppressed.With(alert.Suppressed).Inc()
+		s.logger.Debug("Alert suppressed",
 			"agent", alert.AgentID,
 			"type", alert.EventType,
-			"details", alert.Details,
+			"suppression", alert.Suppressed,
 		)
+	} else {
+		s.logAlert(alert)
+	}
 
-		if alert.EventType == "UNAUTHORIZED_ACCESS" {
-			logger.Warn("Crypto-miner signature detected!", "agent", alert.AgentID)
+	// Host context for analysts
+	td.timeline.add(alert)
+	if alert.EventType == "PROCESS_START" || alert.EventType == "PROCESS_EXIT" {
+		if err := td.procs.apply(alert); err != nil {
+			s.logger.Error("Bad process event", "agent", alert.AgentID, "error", err)
 		}
+	}
+
+	switch alert.EventType {
+	case "AGENT_STOPPING":
+		td.agents.stopped(alert.AgentID, now)
+	case "VULNERABLE_PACKAGE", "BEHAVIOR_ANOMALY", "HUNT_MATCH", "AGENT_LOST":
+		// Server-side finding, not a sign of life from the agent
+	default:
+		td.agents.seen(alert.AgentID, now)
+	}
+	if alert.Suppressed != "" {
+		return true
+	}
+
+	// Detection and correlation
+	s.checkBaseline(td, alert, now)
+	for _, d := range s.detector.detect(alert, now) {
+		s.logger.Warn(d.RuleName, "tenant", td.id, "agent", alert.AgentID, "rule", d.RuleID, "details", alert.Details)
+		s.metrics.ruleMatches.With(d.RuleID).Inc()
+		inc, created := td.incidents.add(d)
+		if created {
+			s.logger.Warn("Incident opened", "tenant", td.id, "incident", inc.ID, "agent", inc.AgentID, "severity", inc.Severity)
+		}
+	}
+	td.stream.publish(alert)
+	return true
+}
+
+func (s *server) logAlert(alert Alert) {
+	// Simulate "Analysis"
+	s.logger.Info("Security Alert Received",
+		"tenant", alert.Tenant,
+		"agent", alert.AgentID,
+		"type", alert.EventType,
+		"details", alert.Details,
+	)
+	for _, m := range alert.Intel {
+		s.logger.Warn("Threat intel match",
+			"agent", alert.AgentID,
+			"observable", m.Observable,
+			"indicator", m.Value,
+			"source", m.Source,
+			"confidence", m.Confidence,
+		)
+	}
+}
+
+// advanceSimClock moves the simulated clock to the replayed event's time.
+// Without -sim-clock the header is ignored.
+func (s *server) advanceSimClock(r *http.Request) {
+	if s.simClock == nil {
+		return
+	}
+	if ns, err := strconv.ParseInt(r.Header.Get("X-Replay-Time"), 10, 64); err == nil {
+		s.simClock.Set(time.Unix(0, ns))
+	}
+}
+
+func (s *server) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-		w.WriteHeader(http.StatusOK)
-	})
+	var hb Heartbeat
+	if err := json.NewDecoder(r.Body).Decode(&hb); err != nil || hb.AgentID == "" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	s.advanceSimClock(r)
+	if err := s.heartbeat(s.tenantOf(r), hb); err != nil {
+		s.unavailable(w, err)
+		return
+	}
+	writeJSON(w, heartbeatReply{Update: s.releases.offer(hb)})
+}
+
+func (s *server) handleAgents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.data(r).agents.list())
+}
+
+// watchHeartbeats flags agents that went silent without an AGENT_STOPPING
+// event: killed, frozen, or cut off from the network.
+func (s *server) watchHeartbeats() {
+	ticker := time.NewTicker(heartbeatTimeout / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.sweepAgents()
+	}
+}
+
+// sweepAgents marks agents lost and raises an AGENT_LOST alert for each.
+// Every node marks them, only the leader raises the alert.
+func (s *server) sweepAgents() {
+	for _, td := range s.tenants.all() {
+		for _, a := range td.agents.sweep(s.now(), heartbeatTimeout) {
+			s.logger.Warn("Agent heartbeat lost without clean shutdown",
+				"tenant", td.id,
+				"agent", a.ID,
+				"last_seen", a.LastSeen,
+			)
+			if !s.leader() {
+				continue
+			}
+			_, err := s.accept(Alert{
+				ID:        fmt.Sprintf("lost-%s-%d", a.ID, a.LastSeen.Unix()),
+				Tenant:    td.id,
+				AgentID:   a.ID,
+				EventType: "AGENT_LOST",
+				Details:   fmt.Sprintf("No heartbeat from %s since %s", a.ID, a.LastSeen.UTC().Format(time.RFC3339)),
+				Timestamp: s.now().Unix(),
+				Fields:    map[string]string{"last_seen": a.LastSeen.UTC().Format(time.RFC3339)},
+			})
+			if err != nil {
+				s.logger.Error("Failed to raise agent lost alert", "agent", a.ID, "error", err)
+			}
+		}
+	}
+}
+
+func (s *server) handleIncidents(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.data(r).incidents.list())
+}
+
+func (s *server) handleIncident(w http.ResponseWriter, r *http.Request) {
+	inc, ok := s.data(r).incidents.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Incident not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, inc)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
 
-	logger.Info("XDR Server listening on :9090")
-	http.ListenAndServe(":9090", nil)
+// writeJSONStatus is writeJSON with another status. The header has to be
+// set before WriteHeader, or the client never sees it.
+func writeJSONStatus(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
 }
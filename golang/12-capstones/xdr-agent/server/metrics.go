@@ -0,0 +1,88 @@
+package main
+
+import (
+	"12-capstones/xdr-agent/metrics"
+)
+
+// serverMetrics are served on /metrics. Counters are updated on the ingest
+// path; gauges read the server's state at scrape time.
+type serverMetrics struct {
+	reg           *metrics.Registry
+	ingested      *metrics.CounterVec
+	duplicates    *metrics.Counter
+	rejected      *metrics.Counter
+	suppressed    *metrics.CounterVec
+	ruleMatches   *metrics.CounterVec
+	anomalies     *metrics.CounterVec
+	ingestLatency *metrics.Histogram
+}
+
+func newServerMetrics(s *server) *serverMetrics {
+	reg := metrics.NewRegistry()
+	m := &serverMetrics{
+		reg: reg,
+		ingested: reg.CounterVec("xdr_server_alerts_ingested_total",
+			"Alerts ingested, by event type. Duplicates are not counted.", "event_type"),
+		duplicates: reg.Counter("xdr_server_alerts_duplicate_total",
+			"Alerts dropped as resends of one already ingested."),
+		rejected: reg.Counter("xdr_server_alerts_rejected_total",
+			"Alerts dropped because they couldn't be decoded."),
+		suppressed: reg.CounterVec("xdr_server_alerts_suppressed_total",
+			"Alerts hidden by a suppression rule, by rule.", "suppression"),
+		ruleMatches: reg.CounterVec("xdr_server_rule_matches_total",
+			"Detections, by rule.", "rule"),
+		anomalies: reg.CounterVec("xdr_server_anomalies_total",
+			"Behavior anomalies, by feature kind.", "kind"),
+		ingestLatency: reg.Histogram("xdr_server_ingest_duration_seconds",
+			"Time to enrich, store and run detection on one alert.",
+			[]float64{.0001, .0005, .001, .005, .01, .05, .1, .5}),
+	}
+
+	reg.GaugeFunc("xdr_server_command_queue_depth", "Commands waiting for their agent to connect.",
+		s.sumTenants(func(td *tenantData) int { return td.commands.pending() }))
+	reg.GaugeVecFunc("xdr_server_agents", "Known agents, by status.", "status", func() map[string]float64 {
+		out := map[string]float64{AgentOnline: 0, AgentStopped: 0, AgentLost: 0}
+		for _, td := range s.tenants.all() {
+			for _, a := range td.agents.list() {
+				out[a.Status]++
+			}
+		}
+		return out
+	})
+	reg.GaugeFunc("xdr_server_incidents", "Incidents since the server started.",
+		s.sumTenants(func(td *tenantData) int { return len(td.incidents.list()) }))
+	reg.GaugeFunc("xdr_server_tenants", "Tenants that have sent data or been queried.",
+		func() float64 { return float64(len(s.tenants.all())) })
+	reg.GaugeFunc("xdr_server_stream_subscribers", "Clients on /alerts/stream.",
+		s.sumTenants(func(td *tenantData) int { return td.stream.subscribers() }))
+	reg.CounterFunc("xdr_server_stream_dropped_total", "Alerts a slow /alerts/stream client missed.",
+		s.sumTenants(func(td *tenantData) int { return int(td.stream.dropped.Load()) }))
+	reg.GaugeFunc("xdr_server_cluster_leader", "1 if this node leads its cluster (or runs standalone).",
+		func() float64 {
+			if s.leader() {
+				return 1
+			}
+			return 0
+		})
+	reg.GaugeFunc("xdr_server_cluster_applied_index", "Last replicated log entry applied on this node.",
+		func() float64 {
+			if s.cluster == nil {
+				return 0
+			}
+			return float64(s.cluster.node.Status().AppliedIndex)
+		})
+	reg.RegisterRuntime()
+	return m
+}
+
+// sumTenants makes a gauge of f added up over every tenant. Metrics are
+// for whoever runs the server, so they don't break down by tenant.
+func (s *server) sumTenants(f func(*tenantData) int) func() float64 {
+	return func() float64 {
+		n := 0
+		for _, td := range s.tenants.all() {
+			n += f(td)
+		}
+		return float64(n)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s.suppress.create(Suppression{AgentID: "lab-1", Reason: "Red team box"}, time.Now())
+
+	s.ingest(Alert{ID: "a1", AgentID: "web-1", EventType: "FILE_MODIFIED", Details: "/etc/passwd accessed by unknown user"})
+	s.ingest(Alert{ID: "a1", AgentID: "web-1", EventType: "FILE_MODIFIED", Details: "/etc/passwd accessed by unknown user"})
+	s.ingest(Alert{ID: "a2", AgentID: "web-1", EventType: "UNAUTHORIZED_ACCESS", Details: "miner_x running"})
+	s.ingest(Alert{ID: "a3", AgentID: "lab-1", EventType: "UNAUTHORIZED_ACCESS", Details: "miner_x running"})
+	s.tenant(defaultTenant).commands.enqueue("web-1", "ping", nil, time.Now())
+
+	handler := s.routes()
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/audit", strings.NewReader("{not json")))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	body := rr.Body.String()
+	for _, want := range []string{
+		`xdr_server_alerts_ingested_total{event_type="FILE_MODIFIED"} 1`,
+		`xdr_server_alerts_ingested_total{event_type="UNAUTHORIZED_ACCESS"} 2`,
+		`xdr_server_alerts_duplicate_total 1`,
+		`xdr_server_alerts_rejected_total 1`,
+		`xdr_server_alerts_suppressed_total{suppression="SUP-0001"} 1`,
+		`xdr_server_rule_matches_total{rule="xdr-001"} 1`,
+		`xdr_server_rule_matches_total{rule="xdr-003"} 1`,
+		`xdr_server_ingest_duration_seconds_count 3`,
+		`xdr_server_command_queue_depth 1`,
+		`xdr_server_agents{status="online"} 2`,
+		"# TYPE go_goroutines gauge",
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("/metrics is missing %q", want)
+		}
+	}
+}
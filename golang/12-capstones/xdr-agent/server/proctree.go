@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Exited processes are forgotten after this long
+const processRetention = 24 * time.Hour
+
+// maxAncestry stops the walk on a corrupt (cyclic) parent chain
+const maxAncestry = 64
+
+// Process is one process instance on a host. PIDs get reused, so an
+// instance is identified by its PID and start time together.
+type Process struct {
+	PID     int        `json:"pid"`
+	PPID    int        `json:"ppid"`
+	Start   time.Time  `json:"start"`
+	Exit    *time.Time `json:"exit,omitempty"`
+	Exe     string     `json:"exe,omitempty"`
+	Cmdline string     `json:"cmdline,omitempty"`
+}
+
+func (p *Process) aliveAt(t time.Time) bool {
+	return !p.Start.After(t) && (p.Exit == nil || !p.Exit.Before(t))
+}
+
+// processTable rebuilds process ancestry from PROCESS_START and
+// PROCESS_EXIT events.
+type processTable struct {
+	mu    sync.Mutex
+	hosts map[string]map[int][]*Process // agent -> pid -> instances, oldest first
+}
+
+func newProcessTable() *processTable {
+	return &processTable{hosts: make(map[string]map[int][]*Process)}
+}
+
+// processKey reads the pid and start time of a process event. The start
+// time is zero if missing.
+func processKey(a Alert) (int, time.Time, error) {
+	pid, err := strconv.Atoi(a.Fields["pid"])
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("%s without a valid pid", a.EventType)
+	}
+	start, _ := time.Parse(time.RFC3339Nano, a.Fields["start"])
+	return pid, start, nil
+}
+
+// apply folds one process event into the agent's table.
+func (t *processTable) apply(a Alert) error {
+	pid, start, err := processKey(a)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pids, ok := t.hosts[a.AgentID]
+	if !ok {
+		pids = make(map[int][]*Process)
+		t.hosts[a.AgentID] = pids
+	}
+
+	switch a.EventType {
+	case "PROCESS_START":
+		if start.IsZero() {
+			return fmt.Errorf("PROCESS_START for pid %d without a start time", pid)
+		}
+		ppid, _ := strconv.Atoi(a.Fields["ppid"])
+		t.start(pids, &Process{PID: pid, PPID: ppid, Start: start, Exe: a.Fields["exe"], Cmdline: a.Fields["cmdline"]})
+	case "PROCESS_EXIT":
+		exit := time.Unix(a.Timestamp, 0)
+		for i := len(pids[pid]) - 1; i >= 0; i-- {
+			p := pids[pid][i]
+			if p.Exit == nil && (start.IsZero() || p.Start.Equal(start)) {
+				p.Exit = &exit
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (t *processTable) start(pids map[int][]*Process, p *Process) {
+	instances := pids[p.PID]
+	for _, old := range instances {
+		if old.Start.Equal(p.Start) {
+			return // Resent or re-snapshotted
+		}
+	}
+	instances = append(instances, p)
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Start.Before(instances[j].Start) })
+
+	// A later process with the same PID means the earlier one is gone, even
+	// if we missed its exit
+	for i, old := range instances[:len(instances)-1] {
+		if old.Exit == nil {
+			exit := instances[i+1].Start
+			old.Exit = &exit
+		}
+	}
+	pids[p.PID] = instances
+}
+
+// find returns the instance of pid alive at the given time, or the most
+// recent one when at is zero.
+func (t *processTable) find(pids map[int][]*Process, pid int, at time.Time) *Process {
+	instances := pids[pid]
+	for i := len(instances) - 1; i >= 0; i-- {
+		if at.IsZero() || instances[i].aliveAt(at) {
+			return instances[i]
+		}
+	}
+	return nil
+}
+
+// ancestry returns the process followed by its parent, grandparent and so
+// on. Each parent is the instance of PPID that was alive when the child
+// started, so a reused PID never produces the wrong parent.
+func (t *processTable) ancestry(agentID string, pid int, at time.Time) []Process {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pids := t.hosts[agentID]
+
+	var chain []Process
+	for p := t.find(pids, pid, at); p != nil && len(chain) < maxAncestry; {
+		chain = append(chain, *p)
+		if p.PPID == 0 || p.PPID == p.PID {
+			break
+		}
+		p = t.find(pids, p.PPID, p.Start)
+	}
+	return chain
+}
+
+// children returns the processes started by the given instance.
+func (t *processTable) children(agentID string, parent Process) []Process {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var out []Process
+	for _, instances := range t.hosts[agentID] {
+		for _, p := range instances {
+			if p.PPID == parent.PID && parent.aliveAt(p.Start) {
+				out = append(out, *p)
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Start.Before(out[j].Start) })
+	return out
+}
+
+// prune drops processes that exited before the cutoff.
+func (t *processTable) prune(cutoff time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, pids := range t.hosts {
+		for pid, instances := range pids {
+			kept := instances[:0]
+			for _, p := range instances {
+				if p.Exit == nil || p.Exit.After(cutoff) {
+					kept = append(kept, p)
+				}
+			}
+			if len(kept) == 0 {
+				delete(pids, pid)
+			} else {
+				pids[pid] = kept
+			}
+		}
+	}
+}
+
+// marshal and unmarshal carry the table in a cluster snapshot.
+func (t *processTable) marshal() ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return json.Marshal(t.hosts)
+}
+
+func (t *processTable) unmarshal(data []byte) error {
+	hosts := make(map[string]map[int][]*Process)
+	if err := json.Unmarshal(data, &hosts); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.hosts = hosts
+	return nil
+}
+
+// pruneProcesses forgets long-exited processes once an hour.
+func (s *server) pruneProcesses() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, td := range s.tenants.all() {
+			td.procs.prune(s.now().Add(-processRetention))
+		}
+	}
+}
+
+// --- Handlers ---
+
+type processTreeResponse struct {
+	AgentID  string    `json:"agent_id"`
+	Ancestry []Process `json:"ancestry"` // The process first, then its parents
+	Children []Process `json:"children"`
+}
+
+// handleProcessTree serves GET /agents/{id}/process-tree?pid=&at=
+// "at" picks the instance alive at that time when the PID was reused.
+func (s *server) handleProcessTree(w http.ResponseWriter, r *http.Request) {
+	pid, err := strconv.Atoi(r.URL.Query().Get("pid"))
+	if err != nil {
+		http.Error(w, "pid is required", http.StatusBadRequest)
+		return
+	}
+	var at time.Time
+	if v := r.URL.Query().Get("at"); v != "" {
+		if at, err = parseTimeParam(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	agentID, procs := r.PathValue("id"), s.data(r).procs
+	chain := procs.ancestry(agentID, pid, at)
+	if len(chain) == 0 {
+		http.Error(w, "Process not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, processTreeResponse{
+		AgentID:  agentID,
+		Ancestry: chain,
+		Children: procs.children(agentID, chain[0]),
+	})
+}
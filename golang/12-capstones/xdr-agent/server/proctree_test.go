@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func procEvent(eventType string, pid, ppid int, start, at time.Time, exe string) Alert {
+	return Alert{
+		AgentID:   "host",
+		EventType: eventType,
+		Timestamp: at.Unix(),
+		Fields: map[string]string{
+			"pid":   strconv.Itoa(pid),
+			"ppid":  strconv.Itoa(ppid),
+			"start": start.Format(time.RFC3339Nano),
+			"exe":   exe,
+		},
+	}
+}
+
+func TestProcessAncestryWithPIDReuse(t *testing.T) {
+	t0 := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	minute := func(n int) time.Time { return t0.Add(time.Duration(n) * time.Minute) }
+
+	pt := newProcessTable()
+	for _, a := range []Alert{
+		procEvent("PROCESS_START", 1, 0, t0, t0, "init"),
+		procEvent("PROCESS_START", 100, 1, minute(1), minute(1), "sshd"),
+		procEvent("PROCESS_START", 200, 100, minute(2), minute(2), "bash"),
+		procEvent("PROCESS_START", 300, 200, minute(3), minute(3), "curl"),
+		procEvent("PROCESS_EXIT", 200, 100, minute(2), minute(4), "bash"),
+		// PID 200 reused by an unrelated cron job
+		procEvent("PROCESS_START", 200, 1, minute(5), minute(5), "cron"),
+		procEvent("PROCESS_START", 400, 200, minute(6), minute(6), "backup"),
+		// PID 500 reused without us seeing the first one exit
+		procEvent("PROCESS_START", 500, 1, minute(7), minute(7), "old"),
+		procEvent("PROCESS_START", 500, 100, minute(8), minute(8), "new"),
+		procEvent("PROCESS_START", 600, 500, minute(9), minute(9), "child-of-new"),
+	} {
+		if err := pt.apply(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		pid  int
+		at   time.Time
+		want []string
+	}{
+		{"parent before reuse", 300, time.Time{}, []string{"curl", "bash", "sshd", "init"}},
+		{"parent after reuse", 400, time.Time{}, []string{"backup", "cron", "init"}},
+		{"latest instance by default", 200, time.Time{}, []string{"cron", "init"}},
+		{"instance picked by time", 200, minute(3), []string{"bash", "sshd", "init"}},
+		{"missed exit", 600, time.Time{}, []string{"child-of-new", "new", "sshd", "init"}},
+		{"unknown pid", 999, time.Time{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, p := range pt.ancestry("host", tt.pid, tt.at) {
+				got = append(got, p.Exe)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ancestry = %v; want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("ancestry = %v; want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTimelineOrdersLateEvents(t *testing.T) {
+	tl := newTimelineStore()
+	for _, a := range []Alert{
+		{ID: "1", AgentID: "host", EventType: "PROCESS_START", Timestamp: 100},
+		{ID: "3", AgentID: "host", EventType: "NETWORK_CONNECT", Timestamp: 300},
+		{ID: "2", AgentID: "host", EventType: "AUTH_FAILURE", Timestamp: 200}, // Spooled, arrives late
+		{ID: "4", AgentID: "host", EventType: "FILE_MODIFIED", Timestamp: 300},
+		{ID: "x", AgentID: "other", EventType: "FILE_MODIFIED", Timestamp: 200},
+	} {
+		tl.add(a)
+	}
+
+	got := ""
+	for _, e := range tl.between("host", time.Unix(100, 0), time.Unix(301, 0)) {
+		got += e.ID + ":" + e.Category + " "
+	}
+	if want := "1:process 2:auth 3:network 4:file "; got != want {
+		t.Errorf("timeline = %q; want %q", got, want)
+	}
+	if n := len(tl.between("host", time.Unix(101, 0), time.Unix(300, 0))); n != 1 {
+		t.Errorf("between(101, 300) returned %d events; want 1", n)
+	}
+}
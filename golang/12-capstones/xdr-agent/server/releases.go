@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Agent self-update. Builds are signed offline with the release key
+// (go run ./xdr-agent/manifest -release <version> ...) and uploaded here;
+// agents check the signature against the key built into them, so the
+// server only decides who runs what, it can't make agents run its own
+// binaries.
+
+// Largest agent build the server takes
+const maxReleaseSize = 256 << 20
+
+// Agents that don't say which group they're in
+const defaultGroup = "default"
+
+var versionPattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z._+-]{0,63}$`)
+
+var (
+	errReleaseExists = errors.New("release already uploaded; versions can't be replaced")
+	errNoRelease     = errors.New("no such release")
+	errReleaseInUse  = errors.New("release is the target of a rollout")
+)
+
+// Release is one uploaded agent build
+type Release struct {
+	Version    string    `json:"version"`
+	SHA256     string    `json:"sha256"`
+	Size       int64     `json:"size"`
+	Signature  string    `json:"signature"` // Ed25519 over releaseSigned, base64
+	Uploaded   time.Time `json:"uploaded"`
+	UploadedBy string    `json:"uploaded_by"`
+}
+
+// releaseSigned is what a release signature covers, as JSON. The version
+// is in it so a build can't be offered as another version than it was
+// signed for.
+type releaseSigned struct {
+	Version string `json:"version"`
+	SHA256  string `json:"sha256"`
+	Size    int64  `json:"size"`
+}
+
+// Rollout moves the agents of one group to a release. Percent of them get
+// it, picked by hashing each agent ID with the version: raising the
+// percentage only ever adds agents, and each release starts on different
+// ones.
+type Rollout struct {
+	Group     string    `json:"group"`
+	Version   string    `json:"version"`
+	Percent   int       `json:"percent"`
+	Updated   time.Time `json:"updated"`
+	UpdatedBy string    `json:"updated_by"`
+}
+
+// selects reports whether agentID is within the rollout's percentage.
+func (r Rollout) selects(agentID string) bool {
+	h := fnv.New32a()
+	io.WriteString(h, r.Version+"/"+agentID)
+	return int(h.Sum32()%100) < r.Percent
+}
+
+// UpdateOffer tells an agent, in the heartbeat reply, which build to run
+type UpdateOffer struct {
+	Version   string `json:"version"`
+	SHA256    string `json:"sha256"`
+	Size      int64  `json:"size"`
+	Signature string `json:"signature"`
+	URL       string `json:"url"` // Download path on this server
+}
+
+// heartbeatReply answers POST /heartbeat. Older agents ignore the body.
+type heartbeatReply struct {
+	Update *UpdateOffer `json:"update,omitempty"`
+}
+
+// releaseStore keeps agent builds in dir, next to a JSON index of them
+// and of the rollouts. Releases are immutable once uploaded.
+type releaseStore struct {
+	mu       sync.Mutex
+	dir      string            // Empty keeps everything in memory
+	pub      ed25519.PublicKey // Checks uploads when set; agents always check
+	Releases []Release         `json:"releases"`
+	Rollouts []Rollout         `json:"rollouts"`
+	builds   map[string][]byte // The binaries, when dir is empty
+}
+
+// openReleaseStore loads the index in dir, or keeps releases in memory
+// only when dir is empty. pub may be nil.
+func openReleaseStore(dir string, pub ed25519.PublicKey) (*releaseStore, error) {
+	st := &releaseStore{dir: dir, pub: pub, builds: make(map[string][]byte)}
+	if dir == "" {
+		return st, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "releases.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("parsing %s index: %w", dir, err)
+	}
+	return st, nil
+}
+
+// saveLocked writes the index atomically. Callers hold mu.
+func (st *releaseStore) saveLocked() error {
+	if st.dir == "" {
+		return nil
+	}
+	data, _ := json.MarshalIndent(st, "", "  ")
+	path := filepath.Join(st.dir, "releases.json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (st *releaseStore) buildPath(version string) string {
+	return filepath.Join(st.dir, version+".bin")
+}
+
+// verify checks a release's signature against the store's key, if any.
+func (st *releaseStore) verify(rel Release) error {
+	if st.pub == nil {
+		return nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(rel.Signature)
+	if err != nil {
+		return fmt.Errorf("decoding signature: %w", err)
+	}
+	payload, _ := json.Marshal(releaseSigned{rel.Version, rel.SHA256, rel.Size})
+	if !ed25519.Verify(st.pub, payload, sig) {
+		return fmt.Errorf("signature doesn't match the release key")
+	}
+	return nil
+}
+
+func parsePublicKey(b64 string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key is %d bytes, want %d", len(raw), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// add stores a build. The hash and size come from data, never from the
+// uploader.
+func (st *releaseStore) add(rel Release, data []byte) (Release, error) {
+	if !versionPattern.MatchString(rel.Version) {
+		return rel, fmt.Errorf("invalid version %q", rel.Version)
+	}
+	sum := sha256.Sum256(data)
+	rel.SHA256, rel.Size = hex.EncodeToString(sum[:]), int64(len(data))
+	if err := st.verify(rel); err != nil {
+		return rel, err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.findLocked(rel.Version); ok {
+		return rel, errReleaseExists
+	}
+	if st.dir == "" {
+		st.builds[rel.Version] = data
+	} else {
+		tmp := st.buildPath(rel.Version) + ".tmp"
+		if err := os.WriteFile(tmp, data, 0600); err != nil {
+			return rel, err
+		}
+		if err := os.Rename(tmp, st.buildPath(rel.Version)); err != nil {
+			return rel, err
+		}
+	}
+	st.Releases = append(st.Releases, rel)
+	return rel, st.saveLocked()
+}
+
+func (st *releaseStore) findLocked(version string) (Release, bool) {
+	for _, rel := range st.Releases {
+		if rel.Version == version {
+			return rel, true
+		}
+	}
+	return Release{}, false
+}
+
+func (st *releaseStore) list() []Release {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return slices.Clone(st.Releases)
+}
+
+// open returns a release and its binary.
+func (st *releaseStore) open(version string) (Release, io.ReadSeekCloser, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	rel, ok := st.findLocked(version)
+	if !ok {
+		return rel, nil, errNoRelease
+	}
+	if st.dir == "" {
+		return rel, nopCloser{bytes.NewReader(st.builds[version])}, nil
+	}
+	f, err := os.Open(st.buildPath(version))
+	return rel, f, err
+}
+
+type nopCloser struct{ io.ReadSeeker }
+
+func (nopCloser) Close() error { return nil }
+
+// remove deletes a release no rollout points at.
+func (st *releaseStore) remove(version string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	i := slices.IndexFunc(st.Releases, func(rel Release) bool { return rel.Version == version })
+	if i < 0 {
+		return errNoRelease
+	}
+	if slices.ContainsFunc(st.Rollouts, func(r Rollout) bool { return r.Version == version }) {
+		return errReleaseInUse
+	}
+	st.Releases = slices.Delete(st.Releases, i, i+1)
+	delete(st.builds, version)
+	if st.dir != "" {
+		if err := os.Remove(st.buildPath(version)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return st.saveLocked()
+}
+
+// setRollout creates or replaces the rollout of r.Group and returns the
+// one it replaced.
+func (st *releaseStore) setRollout(r Rollout) (old Rollout, replaced bool, err error) {
+	if !tenantPattern.MatchString(r.Group) {
+		return old, false, fmt.Errorf("invalid group %q", r.Group)
+	}
+	if r.Percent < 0 || r.Percent > 100 {
+		return old, false, fmt.Errorf("percent must be between 0 and 100")
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.findLocked(r.Version); !ok {
+		return old, false, errNoRelease
+	}
+	i := slices.IndexFunc(st.Rollouts, func(o Rollout) bool { return o.Group == r.Group })
+	if i < 0 {
+		st.Rollouts = append(st.Rollouts, r)
+		slices.SortFunc(st.Rollouts, func(a, b Rollout) int { return strings.Compare(a.Group, b.Group) })
+	} else {
+		old, replaced = st.Rollouts[i], true
+		st.Rollouts[i] = r
+	}
+	return old, replaced, st.saveLocked()
+}
+
+func (st *releaseStore) deleteRollout(group string) (Rollout, bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	i := slices.IndexFunc(st.Rollouts, func(o Rollout) bool { return o.Group == group })
+	if i < 0 {
+		return Rollout{}, false, nil
+	}
+	old := st.Rollouts[i]
+	st.Rollouts = slices.Delete(st.Rollouts, i, i+1)
+	return old, true, st.saveLocked()
+}
+
+func (st *releaseStore) rollouts() []Rollout {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return slices.Clone(st.Rollouts)
+}
+
+// offer returns the update an agent should install, or nil if it's on the
+// right build or not (yet) part of its group's rollout.
+func (st *releaseStore) offer(hb Heartbeat) *UpdateOffer {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	group := hb.Group
+	if group == "" {
+		group = defaultGroup
+	}
+	i := slices.IndexFunc(st.Rollouts, func(o Rollout) bool { return o.Group == group })
+	if i < 0 {
+		return nil
+	}
+	r := st.Rollouts[i]
+	if r.Version == hb.Version || !r.selects(hb.AgentID) {
+		return nil
+	}
+	rel, ok := st.findLocked(r.Version)
+	if !ok {
+		return nil
+	}
+	return &UpdateOffer{
+		Version:   rel.Version,
+		SHA256:    rel.SHA256,
+		Size:      rel.Size,
+		Signature: rel.Signature,
+		URL:       "/agent-releases/" + rel.Version + "/binary",
+	}
+}
+
+// --- HTTP ---
+
+func (s *server) handleListReleases(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.releases.list())
+}
+
+// handleUploadRelease takes the build as the request body and its
+// signature in the X-Release-Signature header.
+func (s *server) handleUploadRelease(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxReleaseSize))
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "Bad request: empty build", http.StatusBadRequest)
+		return
+	}
+	who := analyst(r)
+	rel, err := s.releases.add(Release{
+		Version:    r.PathValue("version"),
+		Signature:  r.Header.Get("X-Release-Signature"),
+		Uploaded:   s.now(),
+		UploadedBy: who,
+	}, data)
+	switch {
+	case errors.Is(err, errReleaseExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.auditRelease(who, "release.upload", rel.Version, []FieldChange{{Field: "sha256", To: rel.SHA256}})
+	s.logger.Info("Agent release uploaded", "version", rel.Version, "sha256", rel.SHA256, "size", rel.Size, "by", who)
+	writeJSONStatus(w, http.StatusCreated, rel)
+}
+
+// handleDownloadRelease serves a build to agents, with range requests so
+// a broken download can resume.
+func (s *server) handleDownloadRelease(w http.ResponseWriter, r *http.Request) {
+	rel, f, err := s.releases.open(r.PathValue("version"))
+	if errors.Is(err, errNoRelease) {
+		http.Error(w, "Release not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to open agent release", "version", rel.Version, "error", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", `"`+rel.SHA256+`"`)
+	http.ServeContent(w, r, "", rel.Uploaded, f)
+}
+
+func (s *server) handleDeleteRelease(w http.ResponseWriter, r *http.Request) {
+	version := r.PathValue("version")
+	switch err := s.releases.remove(version); {
+	case errors.Is(err, errNoRelease):
+		http.Error(w, "Release not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errReleaseInUse):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		s.logger.Error("Failed to delete agent release", "version", version, "error", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	who := analyst(r)
+	s.auditRelease(who, "release.delete", version, nil)
+	s.logger.Info("Agent release deleted", "version", version, "by", who)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rolloutStatus is a rollout with how far it got, over the agents of the
+// group that have sent a heartbeat.
+type rolloutStatus struct {
+	Rollout
+	Agents    int `json:"agents"`     // In the group
+	Selected  int `json:"selected"`   // Within the percentage
+	OnVersion int `json:"on_version"` // Reporting the target version
+}
+
+func (s *server) handleListRollouts(w http.ResponseWriter, r *http.Request) {
+	rollouts := s.releases.rollouts()
+	out := make([]rolloutStatus, len(rollouts))
+	for i, ro := range rollouts {
+		out[i].Rollout = ro
+	}
+	for _, td := range s.tenants.all() {
+		for _, a := range td.agents.list() {
+			group := a.Group
+			if group == "" {
+				group = defaultGroup
+			}
+			for i := range out {
+				if out[i].Group != group {
+					continue
+				}
+				out[i].Agents++
+				if out[i].selects(a.ID) {
+					out[i].Selected++
+				}
+				if a.Version == out[i].Version {
+					out[i].OnVersion++
+				}
+			}
+		}
+	}
+	writeJSON(w, out)
+}
+
+func (s *server) handlePutRollout(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Version string `json:"version"`
+		Percent int    `json:"percent"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	who := analyst(r)
+	ro := Rollout{Group: r.PathValue("group"), Version: req.Version, Percent: req.Percent, Updated: s.now(), UpdatedBy: who}
+	old, replaced, err := s.releases.setRollout(ro)
+	switch {
+	case errors.Is(err, errNoRelease):
+		http.Error(w, "Bad request: release "+req.Version+" not uploaded", http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var changes []FieldChange
+	if old.Version != ro.Version {
+		changes = append(changes, FieldChange{Field: "version", From: old.Version, To: ro.Version})
+	}
+	if !replaced || old.Percent != ro.Percent {
+		changes = append(changes, FieldChange{Field: "percent", From: percentOrEmpty(old, replaced), To: strconv.Itoa(ro.Percent)})
+	}
+	s.auditRelease(who, "rollout.set", ro.Group, changes)
+	s.logger.Info("Rollout set", "group", ro.Group, "version", ro.Version, "percent", ro.Percent, "by", who)
+	status := http.StatusOK
+	if !replaced {
+		status = http.StatusCreated
+	}
+	writeJSONStatus(w, status, ro)
+}
+
+func percentOrEmpty(r Rollout, ok bool) string {
+	if !ok {
+		return ""
+	}
+	return strconv.Itoa(r.Percent)
+}
+
+// handleDeleteRollout stops offering updates to a group. Agents stay on
+// whatever they run.
+func (s *server) handleDeleteRollout(w http.ResponseWriter, r *http.Request) {
+	group := r.PathValue("group")
+	_, ok, err := s.releases.deleteRollout(group)
+	if err != nil {
+		s.logger.Error("Failed to delete rollout", "group", group, "error", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Rollout not found", http.StatusNotFound)
+		return
+	}
+	who := analyst(r)
+	s.auditRelease(who, "rollout.delete", group, nil)
+	s.logger.Info("Rollout deleted", "group", group, "by", who)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// auditRelease records a change to what the fleet runs. Releases are the
+// server operators' business, so it goes to the default tenant's trail.
+func (s *server) auditRelease(who, action, target string, changes []FieldChange) {
+	if _, err := s.audit.append(AuditEntry{Time: s.now(), Tenant: defaultTenant, Actor: who, Action: action, Target: target, Changes: changes}); err != nil {
+		s.logger.Error("Failed to audit release change", "action", action, "target", target, "error", err)
+	}
+}
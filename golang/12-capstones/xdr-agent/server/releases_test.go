@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func signBuild(key ed25519.PrivateKey, version string, build []byte) string {
+	sum := sha256.Sum256(build)
+	payload, _ := json.Marshal(releaseSigned{version, hex.EncodeToString(sum[:]), int64(len(build))})
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload))
+}
+
+func TestReleaseUpload(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	var err error
+	if s.releases, err = openReleaseStore(t.TempDir(), pub); err != nil {
+		t.Fatal(err)
+	}
+	handler := s.routes()
+	upload := func(version, body, sig string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/agent-releases/"+version, strings.NewReader(body))
+		req.Header.Set("X-Release-Signature", sig)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	build := "agent build 1.1.0"
+	tests := []struct {
+		name, version, body, sig string
+		want                     int
+	}{
+		{"other key", "1.1.0", build, signBuild(otherKey, "1.1.0", []byte(build)), http.StatusBadRequest},
+		{"signed for another version", "1.1.0", build, signBuild(key, "1.0.0", []byte(build)), http.StatusBadRequest},
+		{"not what was signed", "1.1.0", build + "!", signBuild(key, "1.1.0", []byte(build)), http.StatusBadRequest},
+		{"bad version", "1.1.0..%2F", build, signBuild(key, "1.1.0../", []byte(build)), http.StatusBadRequest},
+		{"good", "1.1.0", build, signBuild(key, "1.1.0", []byte(build)), http.StatusCreated},
+		{"no replacing", "1.1.0", build, signBuild(key, "1.1.0", []byte(build)), http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if rr := upload(tt.version, tt.body, tt.sig); rr.Code != tt.want {
+			t.Errorf("%s: upload = %d %s; want %d", tt.name, rr.Code, rr.Body, tt.want)
+		}
+	}
+
+	// Agents download exactly what was signed, and it survives a restart
+	if s.releases, err = openReleaseStore(s.releases.dir, pub); err != nil {
+		t.Fatal(err)
+	}
+	handler = s.routes()
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/agent-releases/1.1.0/binary", nil))
+	sum := sha256.Sum256([]byte(build))
+	if rr.Code != http.StatusOK || rr.Body.String() != build || rr.Header().Get("ETag") != `"`+hex.EncodeToString(sum[:])+`"` {
+		t.Errorf("download = %d %q, ETag %s", rr.Code, rr.Body, rr.Header().Get("ETag"))
+	}
+}
+
+func TestRollout(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s.releases, _ = openReleaseStore("", pub)
+	handler := s.routes()
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return rr
+	}
+	for _, v := range []string{"1.0.0", "1.1.0"} {
+		build := []byte("agent build " + v)
+		if _, err := s.releases.add(Release{Version: v, Signature: signBuild(key, v, build)}, build); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if rr := do("PUT", "/rollouts/canary", `{"version":"9.9.9","percent":10}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("rollout of a missing release = %d; want 400", rr.Code)
+	}
+	if rr := do("PUT", "/rollouts/canary", `{"version":"1.1.0","percent":101}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("rollout to 101%% = %d; want 400", rr.Code)
+	}
+	if rr := do("PUT", "/rollouts/canary", `{"version":"1.1.0","percent":30}`); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT /rollouts/canary = %d %s", rr.Code, rr.Body)
+	}
+
+	// offered sends a heartbeat from each agent and returns the ones told
+	// to update
+	offered := func(group, version string) map[string]bool {
+		out := make(map[string]bool)
+		for i := range 200 {
+			id := fmt.Sprintf("web-%d", i)
+			rr := do("POST", "/heartbeat", fmt.Sprintf(`{"agent_id":%q,"version":%q,"group":%q}`, id, version, group))
+			var reply heartbeatReply
+			json.NewDecoder(rr.Body).Decode(&reply)
+			if reply.Update != nil {
+				if reply.Update.Version != "1.1.0" || reply.Update.URL != "/agent-releases/1.1.0/binary" {
+					t.Fatalf("offer = %+v", reply.Update)
+				}
+				out[id] = true
+			}
+		}
+		return out
+	}
+
+	if n := len(offered("", "1.0.0")); n != 0 {
+		t.Errorf("%d agents outside the group offered the update", n)
+	}
+	first := offered("canary", "1.0.0")
+	if len(first) < 40 || len(first) > 80 {
+		t.Errorf("30%% of 200 agents = %d", len(first))
+	}
+	do("PUT", "/rollouts/canary", `{"version":"1.1.0","percent":60}`)
+	wider := offered("canary", "1.0.0")
+	for id := range first {
+		if !wider[id] {
+			t.Errorf("%s dropped out of the rollout when it widened", id)
+		}
+	}
+	if n := len(offered("canary", "1.1.0")); n != 0 {
+		t.Errorf("%d agents already on 1.1.0 offered it again", n)
+	}
+
+	// Status counts the agents reporting the target version
+	var status []rolloutStatus
+	json.NewDecoder(do("GET", "/rollouts", "").Body).Decode(&status)
+	if len(status) != 1 || status[0].Agents != 200 || status[0].Selected != len(wider) || status[0].OnVersion != 200 {
+		t.Errorf("rollout status = %+v", status)
+	}
+	if agents := s.tenant(defaultTenant).agents.list(); agents[0].Version != "1.1.0" || agents[0].Group != "canary" {
+		t.Errorf("agent = %+v; want its version and group", agents[0])
+	}
+
+	if rr := do("DELETE", "/agent-releases/1.1.0", ""); rr.Code != http.StatusConflict {
+		t.Errorf("deleting the target of a rollout = %d; want 409", rr.Code)
+	}
+	if rr := do("DELETE", "/rollouts/canary", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("DELETE /rollouts/canary = %d", rr.Code)
+	}
+	if rr := do("DELETE", "/agent-releases/1.1.0", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("deleting an unused release = %d", rr.Code)
+	}
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+)
+
+const (
+	defaultReportPeriod = 7 * 24 * time.Hour
+	reportTopHosts      = 10
+)
+
+var errReportNotFound = errors.New("report not found")
+
+// Report templates are compiled into the binary, like the web console.
+//
+//go:embed templates
+var reportTemplates embed.FS
+
+var reportFuncs = map[string]any{
+	"date": func(t time.Time) string { return t.Format("2006-01-02 15:04 MST") },
+	"duration": func(d time.Duration) string {
+		d = d.Round(time.Minute)
+		if days := d / (24 * time.Hour); days > 0 {
+			return fmt.Sprintf("%dd %dh", days, (d%(24*time.Hour))/time.Hour)
+		}
+		return fmt.Sprintf("%dh %dm", d/time.Hour, (d%time.Hour)/time.Minute)
+	},
+	// cell keeps a value inside its Markdown table cell
+	"cell": func(s string) string {
+		return strings.NewReplacer("|", `\|`, "\n", " ", "\r", "").Replace(s)
+	},
+}
+
+var (
+	htmlReport = htmltemplate.Must(htmltemplate.New("report.html.tmpl").Funcs(reportFuncs).ParseFS(reportTemplates, "templates/report.html.tmpl"))
+	mdReport   = texttemplate.Must(texttemplate.New("report.md.tmpl").Funcs(reportFuncs).ParseFS(reportTemplates, "templates/report.md.tmpl"))
+)
+
+// reportCSP lets a previewed HTML report use its inline styles and
+// nothing else.
+const reportCSP = "default-src 'none'; style-src 'unsafe-inline'"
+
+// reportFormats maps a format to its content type and file extension.
+var reportFormats = map[string]struct{ contentType, ext string }{
+	"html":     {"text/html; charset=utf-8", ".html"},
+	"markdown": {"text/markdown; charset=utf-8", ".md"},
+}
+
+// --- Contents ---
+
+type hostCount struct {
+	AgentID    string
+	Alerts     int
+	Detections int
+}
+
+type keyCount struct {
+	Key   string
+	Count int
+}
+
+type reportVuln struct {
+	AgentID   string
+	VulnID    string
+	Package   string
+	Version   string
+	FixedIn   string
+	FirstSeen time.Time
+}
+
+// reportData is what the templates render: one tenant over [From, To).
+type reportData struct {
+	Name      string
+	Tenant    string
+	From, To  time.Time
+	Generated time.Time
+
+	Alerts     int // Not suppressed
+	Detections int
+	Incidents  int
+	TopHosts   []hostCount
+	BySeverity []keyCount // Every severity, highest first
+	ByTactic   []keyCount // Most detections first
+
+	CasesOpened     int
+	CasesClosed     int
+	CasesOpen       int // Still open at To
+	MeanTimeToClose time.Duration
+
+	NewVulns []reportVuln
+	Offline  []AgentInfo // Lost or stopped, as of now
+}
+
+// buildReport gathers a tenant's activity between from and to.
+func (s *server) buildReport(td *tenantData, name string, from, to time.Time) reportData {
+	d := reportData{Name: name, Tenant: td.id, From: from, To: to, Generated: s.now()}
+
+	hosts := make(map[string]*hostCount)
+	host := func(id string) *hostCount {
+		if hosts[id] == nil {
+			hosts[id] = &hostCount{AgentID: id}
+		}
+		return hosts[id]
+	}
+	for _, id := range td.timeline.agents() {
+		for _, e := range td.timeline.between(id, from, to) {
+			if e.Suppressed == "" {
+				host(id).Alerts++
+				d.Alerts++
+			}
+		}
+	}
+
+	severities := make(map[string]int)
+	tactics := make(map[string]int)
+	for _, inc := range td.incidents.list() {
+		counted := false
+		for _, det := range inc.Detections {
+			if det.Time.Before(from) || !det.Time.Before(to) {
+				continue
+			}
+			if !counted {
+				d.Incidents++
+				counted = true
+			}
+			d.Detections++
+			host(det.AgentID).Detections++
+			severities[det.Severity]++
+			tactics[cmp.Or(det.Tactic, "none")]++
+		}
+	}
+	for _, h := range hosts {
+		d.TopHosts = append(d.TopHosts, *h)
+	}
+	slices.SortFunc(d.TopHosts, func(a, b hostCount) int {
+		return cmp.Or(b.Alerts-a.Alerts, b.Detections-a.Detections, strings.Compare(a.AgentID, b.AgentID))
+	})
+	d.TopHosts = d.TopHosts[:min(len(d.TopHosts), reportTopHosts)]
+	for _, sev := range []string{"critical", "high", "medium", "low"} {
+		d.BySeverity = append(d.BySeverity, keyCount{sev, severities[sev]})
+	}
+	for t, n := range tactics {
+		d.ByTactic = append(d.ByTactic, keyCount{t, n})
+	}
+	slices.SortFunc(d.ByTactic, func(a, b keyCount) int { return cmp.Or(b.Count-a.Count, strings.Compare(a.Key, b.Key)) })
+
+	var closing time.Duration
+	for _, c := range s.cases.list(td.id, "", "", "") {
+		if !c.Created.Before(from) && c.Created.Before(to) {
+			d.CasesOpened++
+		}
+		if !c.Closed.IsZero() && !c.Closed.Before(from) && c.Closed.Before(to) {
+			d.CasesClosed++
+			closing += c.Closed.Sub(c.Created)
+		}
+		if c.Created.Before(to) && (c.Closed.IsZero() || !c.Closed.Before(to)) {
+			d.CasesOpen++
+		}
+	}
+	if d.CasesClosed > 0 {
+		d.MeanTimeToClose = closing / time.Duration(d.CasesClosed)
+	}
+
+	for agent, findings := range td.inventory.findingsSince(from) {
+		for _, f := range findings {
+			if f.FirstSeen.Before(to) {
+				d.NewVulns = append(d.NewVulns, reportVuln{agent, f.VulnID, f.Package.Name, f.Package.Version, strings.Join(f.FixedIn, ", "), f.FirstSeen})
+			}
+		}
+	}
+	slices.SortFunc(d.NewVulns, func(a, b reportVuln) int {
+		return cmp.Or(strings.Compare(a.AgentID, b.AgentID), strings.Compare(a.VulnID, b.VulnID), strings.Compare(a.Package, b.Package))
+	})
+
+	for _, a := range td.agents.list() {
+		if a.Status != AgentOnline {
+			d.Offline = append(d.Offline, a)
+		}
+	}
+	return d
+}
+
+// renderReport renders d as "html" or "markdown".
+func renderReport(format string, d reportData) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "html":
+		err = htmlReport.Execute(&buf, d)
+	case "markdown":
+		err = mdReport.Execute(&buf, d)
+	default:
+		return nil, fmt.Errorf("unknown format %q (want html or markdown)", format)
+	}
+	return buf.Bytes(), err
+}
+
+// --- Schedules ---
+
+// Report is a scheduled report. Each run covers the Period before it and
+// goes to the Webhook if there is one, or to a file in the server's
+// reports directory.
+type Report struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant"`
+	Name      string    `json:"name"`
+	Format    string    `json:"format"`             // "html" or "markdown"
+	Schedule  string    `json:"schedule"`           // Cron, e.g. "0 8 * * 1" for Mondays at 8:00
+	Timezone  string    `json:"timezone,omitempty"` // For the schedule; default UTC
+	Period    string    `json:"period,omitempty"`   // Covered window, default 168h
+	Webhook   string    `json:"webhook,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	Created   time.Time `json:"created"`
+	NextRun   time.Time `json:"next_run,omitzero"`
+	LastRun   time.Time `json:"last_run,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
+	LastFile  string    `json:"last_file,omitempty"`
+	Runs      int       `json:"runs"`
+
+	cron   *cronSchedule
+	loc    *time.Location
+	period time.Duration
+}
+
+func (rep *Report) compile() error {
+	if _, ok := reportFormats[rep.Format]; !ok {
+		return fmt.Errorf("unknown format %q (want html or markdown)", rep.Format)
+	}
+	var err error
+	if rep.cron, err = parseCron(rep.Schedule); err != nil {
+		return fmt.Errorf("schedule: %w", err)
+	}
+	if rep.loc, err = time.LoadLocation(rep.Timezone); err != nil {
+		return fmt.Errorf("timezone: %w", err)
+	}
+	rep.period = defaultReportPeriod
+	if rep.Period != "" {
+		if rep.period, err = time.ParseDuration(rep.Period); err != nil || rep.period <= 0 {
+			return fmt.Errorf("bad period %q", rep.Period)
+		}
+	}
+	if rep.Webhook != "" {
+		u, err := url.Parse(rep.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook must be an http(s) URL")
+		}
+	}
+	return nil
+}
+
+// redacted hides the webhook's path and query, which often hold a token,
+// from API responses and the audit log.
+func (rep Report) redacted() Report {
+	if u, err := url.Parse(rep.Webhook); err == nil && rep.Webhook != "" {
+		rep.Webhook = u.Scheme + "://" + u.Host + "/…"
+	}
+	return rep
+}
+
+// scheduleAfter sets NextRun to the first firing after t.
+func (rep *Report) scheduleAfter(t time.Time) {
+	rep.NextRun = rep.cron.next(t.In(rep.loc))
+}
+
+func (rep *Report) due(now time.Time) bool {
+	return !rep.NextRun.IsZero() && !now.Before(rep.NextRun)
+}
+
+// reportStore keeps the scheduled reports, persisted as one JSON file.
+type reportStore struct {
+	mu      sync.Mutex
+	path    string
+	seq     int
+	reports []*Report
+}
+
+// openReportStore loads path, or keeps reports in memory only when path
+// is empty.
+func openReportStore(path string) (*reportStore, error) {
+	st := &reportStore{path: path}
+	if path == "" {
+		return st, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &st.reports); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, rep := range st.reports {
+		if err := rep.compile(); err != nil {
+			return nil, fmt.Errorf("%s: %w", rep.ID, err)
+		}
+		var n int
+		fmt.Sscanf(rep.ID, "RPT-%d", &n)
+		st.seq = max(st.seq, n)
+	}
+	return st, nil
+}
+
+// saveLocked writes the reports atomically. Callers hold mu.
+func (st *reportStore) saveLocked() error {
+	if st.path == "" {
+		return nil
+	}
+	data, _ := json.MarshalIndent(st.reports, "", "  ")
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path)
+}
+
+func (st *reportStore) create(rep Report, now time.Time) (Report, error) {
+	if strings.TrimSpace(rep.Name) == "" {
+		return rep, fmt.Errorf("a name is required")
+	}
+	if err := rep.compile(); err != nil {
+		return rep, err
+	}
+	rep.Created, rep.LastRun, rep.LastError, rep.LastFile, rep.Runs = now, time.Time{}, "", "", 0
+	rep.scheduleAfter(now)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.seq++
+	rep.ID = fmt.Sprintf("RPT-%04d", st.seq)
+	st.reports = append(st.reports, &rep)
+	return rep, st.saveLocked()
+}
+
+func (st *reportStore) delete(tenant, id string) (Report, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	i := slices.IndexFunc(st.reports, func(rep *Report) bool { return rep.ID == id && rep.Tenant == tenant })
+	if i < 0 {
+		return Report{}, errReportNotFound
+	}
+	rep := *st.reports[i]
+	st.reports = slices.Delete(st.reports, i, i+1)
+	return rep, st.saveLocked()
+}
+
+func (st *reportStore) get(tenant, id string) (Report, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, rep := range st.reports {
+		if rep.ID == id && rep.Tenant == tenant {
+			return *rep, true
+		}
+	}
+	return Report{}, false
+}
+
+func (st *reportStore) list(tenant string) []Report {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := make([]Report, 0, len(st.reports))
+	for _, rep := range st.reports {
+		if rep.Tenant == tenant {
+			out = append(out, *rep)
+		}
+	}
+	return out
+}
+
+func (st *reportStore) due(now time.Time) []Report {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var out []Report
+	for _, rep := range st.reports {
+		if rep.due(now) {
+			out = append(out, *rep)
+		}
+	}
+	return out
+}
+
+// finished records a run at now and schedules the next one. A server that
+// was down over several firings runs once to catch up, not once for each.
+func (st *reportStore) finished(id string, now time.Time, file string, runErr error) (Report, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, rep := range st.reports {
+		if rep.ID == id {
+			rep.LastRun, rep.LastFile, rep.LastError = now, file, ""
+			if runErr != nil {
+				rep.LastError = runErr.Error()
+			}
+			rep.Runs++
+			rep.scheduleAfter(now)
+			return *rep, st.saveLocked()
+		}
+	}
+	return Report{}, errReportNotFound
+}
+
+// snapshot returns the ID sequence and copies of the reports.
+func (st *reportStore) snapshot() (int, []Report) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := make([]Report, len(st.reports))
+	for i, rep := range st.reports {
+		out[i] = *rep
+	}
+	return st.seq, out
+}
+
+// restore replaces the reports, from a cluster snapshot.
+func (st *reportStore) restore(seq int, reports []Report) error {
+	out := make([]*Report, len(reports))
+	for i, rep := range reports {
+		if err := rep.compile(); err != nil {
+			return fmt.Errorf("%s: %w", rep.ID, err)
+		}
+		out[i] = &rep
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.seq, st.reports = seq, out
+	return st.saveLocked()
+}
+
+// reportRun is a report.finished write's arguments
+type reportRun struct {
+	ID    string    `json:"id"`
+	Time  time.Time `json:"time"` // When the run started
+	File  string    `json:"file,omitempty"`
+	Error string    `json:"error,omitempty"`
+}
+
+func applyCreateReport(s *server, rep Report, now time.Time) (any, error) {
+	return s.reports.create(rep, now)
+}
+
+func applyDeleteReport(s *server, ref storeRef, now time.Time) (any, error) {
+	return s.reports.delete(ref.Tenant, ref.ID)
+}
+
+func applyReportFinished(s *server, run reportRun, now time.Time) (any, error) {
+	var runErr error
+	if run.Error != "" {
+		runErr = errors.New(run.Error)
+	}
+	return s.reports.finished(run.ID, run.Time, run.File, runErr)
+}
+
+// --- Delivery ---
+
+// reportClient posts reports to webhooks. A slow receiver mustn't hold
+// up the report loop for long.
+var reportClient = &http.Client{Timeout: 30 * time.Second}
+
+// runReport renders rep over the period ending now, delivers it and
+// returns rep as saved after the run.
+func (s *server) runReport(rep Report) (Report, error) {
+	now := s.now()
+	d := s.buildReport(s.tenant(rep.Tenant), rep.Name, now.Add(-rep.period), now)
+	body, err := renderReport(rep.Format, d)
+	var file string
+	if err == nil {
+		file, err = s.deliverReport(rep, now, body)
+	}
+	if err != nil {
+		s.logger.Error("Report failed", "report", rep.ID, "tenant", rep.Tenant, "error", err)
+	} else {
+		s.logger.Info("Report delivered", "report", rep.ID, "tenant", rep.Tenant, "file", file, "webhook", rep.Webhook != "", "bytes", len(body))
+	}
+	run := reportRun{ID: rep.ID, Time: now, File: file}
+	if err != nil {
+		run.Error = err.Error()
+	}
+	updated, saveErr := writeAs[Report](s, "report.finished", run)
+	if saveErr != nil && !errors.Is(saveErr, errReportNotFound) {
+		s.logger.Error("Failed to save report", "report", rep.ID, "error", saveErr)
+	}
+	return updated, err
+}
+
+// deliverReport posts body to the report's webhook, or writes it to
+// <reports dir>/<tenant>/<id>-<time>.<ext>.
+func (s *server) deliverReport(rep Report, now time.Time, body []byte) (string, error) {
+	f := reportFormats[rep.Format]
+	if rep.Webhook != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), reportClient.Timeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, rep.Webhook, bytes.NewReader(body))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", f.contentType)
+		req.Header.Set("X-XDR-Report", rep.ID)
+		resp, err := reportClient.Do(req)
+		if err != nil {
+			// Without the URL, which *url.Error would repeat
+			var uerr *url.Error
+			if errors.As(err, &uerr) {
+				err = uerr.Err
+			}
+			return "", fmt.Errorf("webhook: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return "", fmt.Errorf("webhook answered %s", resp.Status)
+		}
+		return "", nil
+	}
+
+	if s.reportsDir == "" {
+		return "", errors.New("no reports directory configured")
+	}
+	dir := filepath.Join(s.reportsDir, rep.Tenant)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, rep.ID+"-"+now.UTC().Format("20060102T150405Z")+f.ext)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, body, 0600); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
+
+// reportLoop runs scheduled reports as they come due. In a cluster only
+// the leader runs them, so each goes out once.
+func (s *server) reportLoop() {
+	for range time.Tick(30 * time.Second) {
+		if !s.leader() {
+			continue
+		}
+		for _, rep := range s.reports.due(s.now()) {
+			s.runReport(rep)
+		}
+	}
+}
+
+// --- Handlers ---
+
+// handlePreviewReport serves GET /reports/preview?format=&from=&to=, a
+// report rendered straight into the response (default: Markdown over the
+// last week).
+func (s *server) handlePreviewReport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := cmp.Or(q.Get("format"), "markdown")
+	f, ok := reportFormats[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown format %q (want html or markdown)", format), http.StatusBadRequest)
+		return
+	}
+	to := s.now()
+	from := to.Add(-defaultReportPeriod)
+	for name, p := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := q.Get(name); v != "" {
+			t, err := parseTimeParam(v)
+			if err != nil {
+				http.Error(w, name+": "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			*p = t
+		}
+	}
+	body, err := renderReport(format, s.buildReport(s.data(r), "Security report", from, to))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", f.contentType)
+	if format == "html" {
+		w.Header().Set("Content-Security-Policy", reportCSP)
+	}
+	w.Write(body)
+}
+
+type reportRequest struct {
+	Name     string `json:"name"`
+	Format   string `json:"format"`
+	Schedule string `json:"schedule"`
+	Timezone string `json:"timezone"`
+	Period   string `json:"period"`
+	Webhook  string `json:"webhook"`
+}
+
+func (s *server) handleCreateReport(w http.ResponseWriter, r *http.Request) {
+	var req reportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	who, now := analyst(r), s.now()
+	rep, err := writeAs[Report](s, "report.create", Report{
+		Tenant:    s.tenantOf(r),
+		Name:      req.Name,
+		Format:    cmp.Or(req.Format, "html"),
+		Schedule:  req.Schedule,
+		Timezone:  req.Timezone,
+		Period:    req.Period,
+		Webhook:   req.Webhook,
+		CreatedBy: who,
+	})
+	if s.writeFailed(w, err, http.StatusBadRequest) {
+		return
+	}
+
+	rep = rep.redacted()
+	changes := []FieldChange{{Field: "name", To: rep.Name}, {Field: "format", To: rep.Format}, {Field: "schedule", To: rep.Schedule}}
+	for _, c := range []FieldChange{{Field: "timezone", To: rep.Timezone}, {Field: "period", To: rep.Period}, {Field: "webhook", To: rep.Webhook}} {
+		if c.To != "" {
+			changes = append(changes, c)
+		}
+	}
+	if _, err := s.audit.append(AuditEntry{Time: now, Tenant: rep.Tenant, Actor: who, Action: "report.create", Target: rep.ID, Changes: changes}); err != nil {
+		s.logger.Error("Failed to audit report", "report", rep.ID, "error", err)
+	}
+	s.logger.Info("Report scheduled", "report", rep.ID, "schedule", rep.Schedule, "next", rep.NextRun, "by", who)
+	writeJSONStatus(w, http.StatusCreated, rep)
+}
+
+func (s *server) handleListReports(w http.ResponseWriter, r *http.Request) {
+	reports := s.reports.list(s.tenantOf(r))
+	for i := range reports {
+		reports[i] = reports[i].redacted()
+	}
+	writeJSON(w, reports)
+}
+
+// handleRunReport serves POST /reports/{id}/run: a scheduled run, now. The
+// next scheduled run is counted from this one.
+func (s *server) handleRunReport(w http.ResponseWriter, r *http.Request) {
+	rep, ok := s.reports.get(s.tenantOf(r), r.PathValue("id"))
+	if !ok {
+		http.Error(w, errReportNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	s.logger.Info("Report run on demand", "report", rep.ID, "by", analyst(r))
+	updated, err := s.runReport(rep)
+	status := http.StatusOK
+	if err != nil {
+		status = http.StatusBadGateway
+	}
+	writeJSONStatus(w, status, updated.redacted())
+}
+
+func (s *server) handleDeleteReport(w http.ResponseWriter, r *http.Request) {
+	rep, err := writeAs[Report](s, "report.delete", storeRef{Tenant: s.tenantOf(r), ID: r.PathValue("id")})
+	if errors.Is(err, errReportNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if s.writeFailed(w, err, http.StatusInternalServerError) {
+		return
+	}
+	who := analyst(r)
+	if _, err := s.audit.append(AuditEntry{Time: s.now(), Tenant: rep.Tenant, Actor: who, Action: "report.delete", Target: rep.ID}); err != nil {
+		s.logger.Error("Failed to audit report", "report", rep.ID, "error", err)
+	}
+	s.logger.Info("Report deleted", "report", rep.ID, "by", who)
+	w.WriteHeader(http.StatusNoContent)
+}
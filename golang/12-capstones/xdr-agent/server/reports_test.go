@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReportContents(t *testing.T) {
+	s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	now := time.Date(2026, 3, 2, 8, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	td := s.tenant(defaultTenant)
+	alert := func(id, agent, typ, details string, at time.Time) {
+		s.ingestAt(Alert{ID: id, AgentID: agent, EventType: typ, Details: details, Timestamp: at.Unix()}, at)
+	}
+
+	alert("a1", "web-1", "UNAUTHORIZED_ACCESS", "miner_x started", now.Add(-48*time.Hour))
+	alert("a2", "web-1", "UNAUTHORIZED_ACCESS", "miner_x started", now.Add(-47*time.Hour-45*time.Minute))
+	alert("a3", "web-1", "FILE_MODIFIED", "/etc/hosts changed", now.Add(-46*time.Hour))
+	alert("a4", "db-1", "FILE_MODIFIED", "/etc/passwd accessed", now.Add(-2*time.Hour))
+	alert("a5", "db-1", "UNAUTHORIZED_ACCESS", "miner_x started", now.Add(-8*24*time.Hour)) // Last week
+
+	// A case closed after two days, one still open, and one closed before the week
+	c1, _ := s.cases.create(Case{Tenant: defaultTenant, Title: "Miner on web-1", Severity: "high"}, "alice", now.Add(-4*24*time.Hour))
+	s.cases.create(Case{Tenant: defaultTenant, Title: "passwd on db-1", Severity: "medium"}, "alice", now.Add(-time.Hour))
+	c3, _ := s.cases.create(Case{Tenant: defaultTenant, Title: "Old", Severity: "low"}, "alice", now.Add(-20*24*time.Hour))
+	closed := "closed"
+	s.cases.update(defaultTenant, c1.ID, 0, "bob", "case.update", now.Add(-2*24*time.Hour), casePatch{Status: &closed}.apply)
+	s.cases.update(defaultTenant, c3.ID, 0, "bob", "case.update", now.Add(-10*24*time.Hour), casePatch{Status: &closed}.apply)
+	if c, _ := s.cases.get(defaultTenant, c1.ID); !c.Closed.Equal(now.Add(-2 * 24 * time.Hour)) {
+		t.Errorf("closed case = %+v; want the closing time", c)
+	}
+
+	td.inventory.setFindings("db-1", []VulnFinding{
+		{VulnID: "CVE-2026-0001", Package: Package{Name: "lib<script>", Version: "1.0|beta"}, FixedIn: []string{"1.1"}},
+	}, now.Add(-3*time.Hour))
+	td.agents.seen("old-1", now.Add(-5*time.Hour))
+	td.agents.seen("web-1", now)
+	td.agents.seen("db-1", now)
+	td.agents.sweep(now, time.Hour)
+
+	d := s.buildReport(td, "Weekly", now.Add(-defaultReportPeriod), now)
+	if d.Alerts != 4 || d.Detections != 3 || d.Incidents != 2 {
+		t.Errorf("alerts %d, detections %d, incidents %d; want 4, 3, 2", d.Alerts, d.Detections, d.Incidents)
+	}
+	if len(d.TopHosts) != 2 || d.TopHosts[0] != (hostCount{"web-1", 3, 2}) || d.TopHosts[1] != (hostCount{"db-1", 1, 1}) {
+		t.Errorf("top hosts = %+v", d.TopHosts)
+	}
+	if d.BySeverity[1] != (keyCount{"high", 2}) || d.BySeverity[2] != (keyCount{"medium", 1}) || d.BySeverity[0].Count != 0 {
+		t.Errorf("by severity = %+v", d.BySeverity)
+	}
+	if len(d.ByTactic) != 2 || d.ByTactic[0] != (keyCount{"Impact", 2}) {
+		t.Errorf("by tactic = %+v", d.ByTactic)
+	}
+	if d.CasesOpened != 2 || d.CasesClosed != 1 || d.CasesOpen != 1 || d.MeanTimeToClose != 48*time.Hour {
+		t.Errorf("cases opened %d, closed %d, open %d, MTTC %v", d.CasesOpened, d.CasesClosed, d.CasesOpen, d.MeanTimeToClose)
+	}
+	if len(d.NewVulns) != 1 || d.NewVulns[0].AgentID != "db-1" || len(d.Offline) != 1 || d.Offline[0].ID != "old-1" {
+		t.Errorf("new vulns %+v, offline %+v", d.NewVulns, d.Offline)
+	}
+
+	md, err := renderReport("markdown", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"| web-1 | 3 | 2 |", "| Mean time to close | 2d 0h |", "| Impact | 2 |", `| 1.0\|beta |`, "| old-1 | lost |"} {
+		if !strings.Contains(string(md), want) {
+			t.Errorf("Markdown report lacks %q:\n%s", want, md)
+		}
+	}
+	html, err := renderReport("html", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(html), "lib&lt;script&gt;") || strings.Contains(string(html), "lib<script>") {
+		t.Error("HTML report doesn't escape package names")
+	}
+}
+
+func TestScheduledReport(t *testing.T) {
+	s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC) // A Sunday
+	s.now = func() time.Time { return now }
+	s.reportsDir = t.TempDir()
+	storePath := filepath.Join(t.TempDir(), "reports.json")
+	var err error
+	if s.reports, err = openReportStore(storePath); err != nil {
+		t.Fatal(err)
+	}
+	handler := s.routes()
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return rr
+	}
+
+	var mu sync.Mutex
+	var posted []*http.Request
+	status := http.StatusOK
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		posted = append(posted, r)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(hook.Close)
+
+	for _, bad := range []string{
+		`{"name": "Weekly", "schedule": "0 8 * *"}`,
+		`{"name": "Weekly", "schedule": "0 8 * * 1", "format": "pdf"}`,
+		`{"name": "Weekly", "schedule": "0 8 * * 1", "timezone": "Mars/Olympus"}`,
+		`{"name": "Weekly", "schedule": "0 8 * * 1", "webhook": "file:///etc/passwd"}`,
+	} {
+		if rr := do("POST", "/reports", bad); rr.Code != http.StatusBadRequest {
+			t.Errorf("POST /reports %s = %d; want 400", bad, rr.Code)
+		}
+	}
+	if rr := do("POST", "/reports", `{"name": "Weekly", "format": "markdown", "schedule": "0 8 * * mon"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("POST /reports = %d: %s", rr.Code, rr.Body)
+	}
+	rr := do("POST", "/reports", `{"name": "For management", "schedule": "0 9 * * 1", "timezone": "America/New_York", "webhook": "`+hook.URL+`/hooks/T0KEN"}`)
+	var rep Report
+	json.NewDecoder(rr.Body).Decode(&rep)
+	if rr.Code != http.StatusCreated || !rep.NextRun.Equal(time.Date(2026, 3, 2, 14, 0, 0, 0, time.UTC)) {
+		t.Fatalf("POST /reports = %d %+v; want the next run Monday 9:00 in New York", rr.Code, rep)
+	}
+	if strings.Contains(rr.Body.String(), "T0KEN") || strings.Contains(do("GET", "/reports", "").Body.String(), "T0KEN") {
+		t.Error("webhook token shown by the API")
+	}
+
+	// Monday 8:00 UTC: only the first is due
+	now = time.Date(2026, 3, 2, 8, 0, 0, 0, time.UTC)
+	due := s.reports.due(now)
+	if len(due) != 1 || due[0].ID != "RPT-0001" {
+		t.Fatalf("due = %+v", due)
+	}
+	ran, err := s.runReport(due[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := os.ReadFile(ran.LastFile)
+	if err != nil || !strings.HasPrefix(string(body), "# Weekly") || filepath.Dir(ran.LastFile) != filepath.Join(s.reportsDir, defaultTenant) {
+		t.Errorf("report file %s: %v %.40q", ran.LastFile, err, body)
+	}
+	if !ran.NextRun.Equal(time.Date(2026, 3, 9, 8, 0, 0, 0, time.UTC)) || ran.Runs != 1 {
+		t.Errorf("after the run: %+v; want the next Monday", ran)
+	}
+
+	now = time.Date(2026, 3, 2, 14, 0, 0, 0, time.UTC)
+	for _, rep := range s.reports.due(now) {
+		s.runReport(rep)
+	}
+	mu.Lock()
+	if len(posted) != 1 || posted[0].URL.Path != "/hooks/T0KEN" || posted[0].Header.Get("Content-Type") != "text/html; charset=utf-8" || posted[0].Header.Get("X-XDR-Report") != "RPT-0002" {
+		t.Errorf("webhook got %d posts: %+v", len(posted), posted)
+	}
+	status = http.StatusServiceUnavailable
+	mu.Unlock()
+
+	// A failed delivery is reported without the token
+	rr = do("POST", "/reports/RPT-0002/run", "")
+	if rr.Code != http.StatusBadGateway || !strings.Contains(rr.Body.String(), "503") || strings.Contains(rr.Body.String(), "T0KEN") {
+		t.Errorf("run with the webhook down = %d %s", rr.Code, rr.Body)
+	}
+
+	// Schedules and their progress survive a restart
+	reopened, err := openReportStore(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := reopened.get(defaultTenant, "RPT-0001"); !got.NextRun.Equal(ran.NextRun) || got.Runs != 1 {
+		t.Errorf("reopened report = %+v", got)
+	}
+	if len(reopened.due(now)) != 0 {
+		t.Error("reports due again after a restart")
+	}
+
+	if rr := do("GET", "/reports/preview?format=html", ""); rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("preview = %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if rr := do("DELETE", "/reports/RPT-0002", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("DELETE = %d", rr.Code)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Alerts buffered per subscriber. A client that falls further behind
+// misses alerts rather than slowing ingest down.
+const streamBuffer = 256
+
+// alertHub fans ingested alerts out to live subscribers
+type alertHub struct {
+	mu      sync.Mutex
+	subs    map[chan Alert]struct{}
+	dropped atomic.Uint64 // Alerts a slow subscriber missed
+}
+
+func newAlertHub() *alertHub {
+	return &alertHub{subs: make(map[chan Alert]struct{})}
+}
+
+func (h *alertHub) subscribe() chan Alert {
+	ch := make(chan Alert, streamBuffer)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *alertHub) unsubscribe(ch chan Alert) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+func (h *alertHub) subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+func (h *alertHub) publish(a Alert) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- a:
+		default:
+			h.dropped.Add(1)
+		}
+	}
+}
+
+// handleAlertStream serves GET /alerts/stream?agent= as server-sent
+// events, one "alert" event per ingested alert of the caller's tenant.
+// Suppressed alerts are never published.
+func (s *server) handleAlertStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	agent := r.URL.Query().Get("agent")
+
+	hub := s.data(r).stream
+	ch := hub.subscribe()
+	defer hub.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Comments keep proxies from closing an idle stream
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case a := <-ch:
+			if agent != "" && a.AgentID != agent {
+				continue
+			}
+			data, _ := json.Marshal(a)
+			fmt.Fprintf(w, "event: alert\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
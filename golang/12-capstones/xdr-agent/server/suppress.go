@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A suppression that hasn't matched anything for this long is probably
+// covering tooling that no longer runs
+const defaultStaleAfter = 30 * 24 * time.Hour
+
+var errSuppressionNotFound = errors.New("suppression not found")
+
+// Suppression hides matching alerts from the alert stream, detection and
+// incidents. The alerts are still stored, tagged with the suppression ID.
+// Every matcher that is set must match.
+type Suppression struct {
+	ID          string    `json:"id"`
+	Tenant      string    `json:"tenant,omitempty"` // Empty in rules from before tenants
+	AgentID     string    `json:"agent_id,omitempty"`
+	EventType   string    `json:"event_type,omitempty"`
+	PathGlob    string    `json:"path_glob,omitempty"`    // * stays within a directory, ** crosses them
+	ProcessHash string    `json:"process_hash,omitempty"` // SHA-256 of the executable
+	Reason      string    `json:"reason"`
+	CreatedBy   string    `json:"created_by"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires,omitzero"`
+	Hits        int       `json:"hits"`
+	LastHit     time.Time `json:"last_hit,omitzero"`
+
+	glob *regexp.Regexp
+}
+
+// compileGlob turns a path glob into an anchored regexp.
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// alertPaths are the paths a glob is tried against: the path and exe
+// fields, and any absolute path in the details.
+func alertPaths(a Alert) []string {
+	var out []string
+	for _, k := range []string{"path", "exe"} {
+		if v := a.Fields[k]; v != "" {
+			out = append(out, v)
+		}
+	}
+	for _, tok := range strings.FieldsFunc(a.Details, func(r rune) bool { return strings.ContainsRune(" \t'\"(),", r) }) {
+		if strings.HasPrefix(tok, "/") {
+			out = append(out, tok)
+		}
+	}
+	return out
+}
+
+func (sp *Suppression) expired(now time.Time) bool {
+	return !sp.Expires.IsZero() && !now.Before(sp.Expires)
+}
+
+func (sp *Suppression) matches(a Alert) bool {
+	if tenantOrDefault(sp.Tenant) != tenantOrDefault(a.Tenant) {
+		return false
+	}
+	if sp.AgentID != "" && sp.AgentID != a.AgentID {
+		return false
+	}
+	if sp.EventType != "" && sp.EventType != a.EventType {
+		return false
+	}
+	if sp.ProcessHash != "" && !strings.EqualFold(sp.ProcessHash, a.Fields["sha256"]) {
+		return false
+	}
+	if sp.glob != nil && !slices.ContainsFunc(alertPaths(a), sp.glob.MatchString) {
+		return false
+	}
+	return true
+}
+
+// stale reports whether the suppression has gone unused for staleAfter.
+func (sp *Suppression) stale(now time.Time, staleAfter time.Duration) bool {
+	last := sp.LastHit
+	if last.IsZero() {
+		last = sp.Created
+	}
+	return now.Sub(last) >= staleAfter
+}
+
+// suppressionStore keeps the rules, persisted as one JSON file.
+type suppressionStore struct {
+	mu    sync.Mutex
+	path  string
+	seq   int
+	rules []*Suppression
+	dirty bool
+}
+
+// openSuppressionStore loads path, or keeps the rules in memory only when
+// path is empty.
+func openSuppressionStore(path string) (*suppressionStore, error) {
+	st := &suppressionStore{path: path}
+	if path == "" {
+		return st, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &st.rules); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, sp := range st.rules {
+		if sp.PathGlob != "" {
+			if sp.glob, err = compileGlob(sp.PathGlob); err != nil {
+				return nil, fmt.Errorf("%s: %w", sp.ID, err)
+			}
+		}
+		var n int
+		fmt.Sscanf(sp.ID, "SUP-%d", &n)
+		st.seq = max(st.seq, n)
+	}
+	return st, nil
+}
+
+// saveLocked writes the rules atomically. Callers hold mu.
+func (st *suppressionStore) saveLocked() error {
+	if st.path == "" {
+		return nil
+	}
+	data, _ := json.MarshalIndent(st.rules, "", "  ")
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, st.path); err != nil {
+		return err
+	}
+	st.dirty = false
+	return nil
+}
+
+// save persists hit counters if they changed.
+func (st *suppressionStore) save() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.dirty {
+		return nil
+	}
+	return st.saveLocked()
+}
+
+func (st *suppressionStore) create(sp Suppression, now time.Time) (Suppression, error) {
+	if strings.TrimSpace(sp.Reason) == "" {
+		return sp, fmt.Errorf("a reason is required")
+	}
+	if sp.AgentID == "" && sp.EventType == "" && sp.PathGlob == "" && sp.ProcessHash == "" {
+		return sp, fmt.Errorf("at least one of agent_id, event_type, path_glob, process_hash is required")
+	}
+	if !sp.Expires.IsZero() && !sp.Expires.After(now) {
+		return sp, fmt.Errorf("expires is in the past")
+	}
+	if sp.PathGlob != "" {
+		var err error
+		if sp.glob, err = compileGlob(sp.PathGlob); err != nil {
+			return sp, err
+		}
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.seq++
+	sp.ID = fmt.Sprintf("SUP-%04d", st.seq)
+	sp.Created, sp.Hits, sp.LastHit = now, 0, time.Time{}
+	st.rules = append(st.rules, &sp)
+	return sp, st.saveLocked()
+}
+
+func (st *suppressionStore) delete(tenant, id string) (Suppression, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	i := slices.IndexFunc(st.rules, func(sp *Suppression) bool { return sp.ID == id && tenantOrDefault(sp.Tenant) == tenant })
+	if i < 0 {
+		return Suppression{}, errSuppressionNotFound
+	}
+	sp := *st.rules[i]
+	st.rules = slices.Delete(st.rules, i, i+1)
+	return sp, st.saveLocked()
+}
+
+// snapshot returns the ID sequence and copies of the rules, hit counters
+// included.
+func (st *suppressionStore) snapshot() (int, []Suppression) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := make([]Suppression, len(st.rules))
+	for i, sp := range st.rules {
+		out[i] = *sp
+	}
+	return st.seq, out
+}
+
+// restore replaces the rules, from a cluster snapshot.
+func (st *suppressionStore) restore(seq int, rules []Suppression) error {
+	out := make([]*Suppression, len(rules))
+	for i, sp := range rules {
+		if sp.PathGlob != "" {
+			var err error
+			if sp.glob, err = compileGlob(sp.PathGlob); err != nil {
+				return fmt.Errorf("%s: %w", sp.ID, err)
+			}
+		}
+		out[i] = &sp
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.seq, st.rules = seq, out
+	return st.saveLocked()
+}
+
+// match returns the ID of the first unexpired rule matching the alert and
+// counts the hit, or "".
+func (st *suppressionStore) match(a Alert, now time.Time) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, sp := range st.rules {
+		if sp.expired(now) || !sp.matches(a) {
+			continue
+		}
+		sp.Hits++
+		sp.LastHit = now
+		st.dirty = true
+		return sp.ID
+	}
+	return ""
+}
+
+// suppressionView adds the computed state to a rule
+type suppressionView struct {
+	Suppression
+	Expired bool `json:"expired"`
+	Stale   bool `json:"stale"` // No hits for the stale window
+}
+
+// list returns the tenant's rules.
+func (st *suppressionStore) list(tenant string, now time.Time, staleAfter time.Duration) []suppressionView {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := make([]suppressionView, 0, len(st.rules))
+	for _, sp := range st.rules {
+		if tenantOrDefault(sp.Tenant) != tenant {
+			continue
+		}
+		out = append(out, suppressionView{*sp, sp.expired(now), sp.stale(now, staleAfter)})
+	}
+	return out
+}
+
+func applyCreateSuppression(s *server, sp Suppression, now time.Time) (any, error) {
+	return s.suppress.create(sp, now)
+}
+
+func applyDeleteSuppression(s *server, ref storeRef, now time.Time) (any, error) {
+	return s.suppress.delete(ref.Tenant, ref.ID)
+}
+
+// --- Handlers ---
+
+type suppressionRequest struct {
+	AgentID     string    `json:"agent_id"`
+	EventType   string    `json:"event_type"`
+	PathGlob    string    `json:"path_glob"`
+	ProcessHash string    `json:"process_hash"`
+	Reason      string    `json:"reason"`
+	Expires     time.Time `json:"expires"`
+}
+
+func (s *server) handleCreateSuppression(w http.ResponseWriter, r *http.Request) {
+	var req suppressionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	who, now := analyst(r), s.now()
+	sp, err := writeAs[Suppression](s, "suppression.create", Suppression{
+		Tenant:      s.tenantOf(r),
+		AgentID:     req.AgentID,
+		EventType:   req.EventType,
+		PathGlob:    req.PathGlob,
+		ProcessHash: strings.ToLower(req.ProcessHash),
+		Reason:      req.Reason,
+		CreatedBy:   who,
+		Expires:     req.Expires,
+	})
+	if s.writeFailed(w, err, http.StatusBadRequest) {
+		return
+	}
+
+	changes := []FieldChange{{Field: "reason", To: sp.Reason}}
+	for _, c := range []FieldChange{
+		{Field: "agent_id", To: sp.AgentID},
+		{Field: "event_type", To: sp.EventType},
+		{Field: "path_glob", To: sp.PathGlob},
+		{Field: "process_hash", To: sp.ProcessHash},
+	} {
+		if c.To != "" {
+			changes = append(changes, c)
+		}
+	}
+	if !sp.Expires.IsZero() {
+		changes = append(changes, FieldChange{Field: "expires", To: sp.Expires.UTC().Format(time.RFC3339)})
+	}
+	if _, err := s.audit.append(AuditEntry{Time: now, Tenant: sp.Tenant, Actor: who, Action: "suppression.create", Target: sp.ID, Changes: changes}); err != nil {
+		s.logger.Error("Failed to audit suppression", "suppression", sp.ID, "error", err)
+	}
+	s.logger.Info("Suppression created", "suppression", sp.ID, "reason", sp.Reason, "by", who)
+	writeJSONStatus(w, http.StatusCreated, sp)
+}
+
+// handleListSuppressions serves GET /suppressions?stale_after=720h. With
+// stale=true only rules without recent hits are listed.
+func (s *server) handleListSuppressions(w http.ResponseWriter, r *http.Request) {
+	staleAfter := defaultStaleAfter
+	if v := r.URL.Query().Get("stale_after"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "stale_after: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		staleAfter = d
+	}
+	out := s.suppress.list(s.tenantOf(r), s.now(), staleAfter)
+	if r.URL.Query().Get("stale") == "true" {
+		out = slices.DeleteFunc(out, func(v suppressionView) bool { return !v.Stale })
+	}
+	writeJSON(w, out)
+}
+
+func (s *server) handleDeleteSuppression(w http.ResponseWriter, r *http.Request) {
+	sp, err := writeAs[Suppression](s, "suppression.delete", storeRef{Tenant: s.tenantOf(r), ID: r.PathValue("id")})
+	if errors.Is(err, errSuppressionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if s.writeFailed(w, err, http.StatusInternalServerError) {
+		return
+	}
+	who := analyst(r)
+	if _, err := s.audit.append(AuditEntry{
+		Time:    s.now(),
+		Tenant:  tenantOrDefault(sp.Tenant),
+		Actor:   who,
+		Action:  "suppression.delete",
+		Target:  sp.ID,
+		Changes: []FieldChange{{Field: "hits", From: fmt.Sprint(sp.Hits)}},
+	}); err != nil {
+		s.logger.Error("Failed to audit suppression", "suppression", sp.ID, "error", err)
+	}
+	s.logger.Info("Suppression deleted", "suppression", sp.ID, "hits", sp.Hits, "by", who)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// saveStateLoop persists the learned baselines and suppression hit
+// counters every minute.
+func (s *server) saveStateLoop() {
+	for range time.Tick(time.Minute) {
+		for _, td := range s.tenants.all() {
+			if err := td.baseline.save(); err != nil {
+				s.logger.Error("Failed to save baseline", "tenant", td.id, "error", err)
+			}
+		}
+		if err := s.suppress.save(); err != nil {
+			s.logger.Error("Failed to save suppressions", "error", err)
+		}
+	}
+}
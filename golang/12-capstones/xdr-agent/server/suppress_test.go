@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSuppressionMatch(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	backup := Alert{AgentID: "db-1", EventType: "FILE_MODIFIED", Details: "/var/backups/db/2026-03-01.tar modified"}
+	scanner := Alert{AgentID: "web-1", EventType: "PROCESS_START", Fields: map[string]string{"exe": "/opt/scanner/bin/scan", "sha256": "ABCDEF0123"}}
+
+	tests := []struct {
+		name string
+		sp   Suppression
+		a    Alert
+		want bool
+	}{
+		{"glob * stays in dir", Suppression{PathGlob: "/var/backups/*"}, backup, false},
+		{"glob ** crosses dirs", Suppression{PathGlob: "/var/backups/**"}, backup, true},
+		{"glob with event type", Suppression{EventType: "FILE_MODIFIED", PathGlob: "/var/backups/**/*.tar"}, backup, true},
+		{"wrong agent", Suppression{AgentID: "db-2", PathGlob: "/var/backups/**"}, backup, false},
+		{"exe field", Suppression{PathGlob: "/opt/scanner/bin/*"}, scanner, true},
+		{"hash ignores case", Suppression{ProcessHash: "abcdef0123"}, scanner, true},
+		{"hash differs", Suppression{ProcessHash: "abcdef0124"}, scanner, false},
+		{"expired", Suppression{AgentID: "web-1", Expires: now}, scanner, false},
+	}
+	for _, tt := range tests {
+		st := &suppressionStore{}
+		tt.sp.Reason = "test"
+		// Created an hour ago, since create refuses an expiry in the past
+		if _, err := st.create(tt.sp, now.Add(-time.Hour)); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := st.match(tt.a, now) != ""; got != tt.want {
+			t.Errorf("%s: match = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSuppressedAlertsHidden(t *testing.T) {
+	s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	handler := s.routes()
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return rr
+	}
+
+	if rr := do("POST", "/suppressions", `{"agent_id":"web-1"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("suppression without reason = %d; want 400", rr.Code)
+	}
+	rr := do("POST", "/suppressions", `{"agent_id":"web-1","path_glob":"/etc/passwd","reason":"Config management rewrites it nightly"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create = %d %s", rr.Code, rr.Body)
+	}
+
+	sub := s.tenant(defaultTenant).stream.subscribe()
+	defer s.tenant(defaultTenant).stream.unsubscribe(sub)
+	s.ingest(Alert{ID: "a1", AgentID: "web-1", EventType: "FILE_MODIFIED", Details: "/etc/passwd accessed by unknown user"})
+	s.ingest(Alert{ID: "a2", AgentID: "web-2", EventType: "FILE_MODIFIED", Details: "/etc/passwd accessed by unknown user"})
+
+	// Only web-2's alert reaches the stream and an incident...
+	select {
+	case a := <-sub:
+		if a.ID != "a2" {
+			t.Errorf("streamed %s; want only a2", a.ID)
+		}
+	default:
+		t.Error("a2 not streamed")
+	}
+	if len(sub) != 0 {
+		t.Errorf("%d more alerts streamed; want none", len(sub))
+	}
+	if incs := s.tenant(defaultTenant).incidents.list(); len(incs) != 1 || incs[0].AgentID != "web-2" {
+		t.Errorf("incidents = %+v; want one on web-2", incs)
+	}
+
+	// ...but web-1's is still on its timeline, tagged
+	events := s.tenant(defaultTenant).timeline.between("web-1", time.Unix(0, 0), now.Add(time.Hour))
+	if len(events) != 1 || events[0].Alert.Suppressed != "SUP-0001" {
+		t.Errorf("web-1 timeline = %+v; want a1 suppressed by SUP-0001", events)
+	}
+
+	// A month without hits makes the rule stale
+	var list []suppressionView
+	json.NewDecoder(do("GET", "/suppressions?stale=true", "").Body).Decode(&list)
+	if len(list) != 0 {
+		t.Errorf("stale right after a hit: %+v", list)
+	}
+	now = now.Add(31 * 24 * time.Hour)
+	json.NewDecoder(do("GET", "/suppressions?stale=true", "").Body).Decode(&list)
+	if len(list) != 1 || list[0].Hits != 1 || !list[0].Stale {
+		t.Errorf("stale suppressions = %+v; want SUP-0001 with 1 hit", list)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"log/slog"
+	"maps"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every principal belongs to a tenant. The default tenant is the one a
+// single-tenant install has always had; its admins are the operators of
+// the whole server.
+const defaultTenant = "default"
+
+// Tenant IDs end up in file names, so they're kept plain
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+func validTenant(id string) bool { return tenantPattern.MatchString(id) }
+
+// tenantOrDefault maps the empty tenant of records saved before tenants
+// existed to the default one.
+func tenantOrDefault(id string) string {
+	if id == "" {
+		return defaultTenant
+	}
+	return id
+}
+
+// operator reports whether p administers the server rather than one
+// tenant: only operators see across tenants and manage global rules.
+func (p Principal) operator() bool {
+	return p.Role == RoleAdmin && tenantOrDefault(p.Tenant) == defaultTenant
+}
+
+// principal returns who made the request. With -no-auth every request is
+// an operator in the default tenant.
+func (s *server) principal(r *http.Request) Principal {
+	if p, ok := principalFrom(r.Context()); ok {
+		p.Tenant = tenantOrDefault(p.Tenant)
+		return p
+	}
+	return Principal{Name: analyst(r), Role: RoleAdmin, Tenant: defaultTenant}
+}
+
+// tenantOf is the tenant a request reads from and writes to.
+func (s *server) tenantOf(r *http.Request) string {
+	return s.principal(r).Tenant
+}
+
+// data returns the caller's tenant's state.
+func (s *server) data(r *http.Request) *tenantData {
+	return s.tenant(s.tenantOf(r))
+}
+
+func (s *server) tenant(id string) *tenantData {
+	return s.tenants.get(id)
+}
+
+// serverWide guards endpoints about the server itself rather than one
+// tenant's data, like metrics and feed reloads. They're for the default
+// tenant, whose staff run the server.
+func (s *server) serverWide(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p := s.principal(r); p.Tenant != defaultTenant {
+			s.denied(r, p, "server", "other tenant")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// tenantData is everything a tenant's agents have told the server: it is
+// never shared, so two tenants can even run agents with the same ID.
+type tenantData struct {
+	id         string
+	agents     *agentRegistry
+	seenAlerts *recentIDs
+	inventory  *inventoryStore
+	incidents  *correlator
+	commands   *commandQueue
+	procs      *processTable
+	timeline   *timelineStore
+	baseline   *baselineStore
+	stream     *alertHub
+}
+
+func newTenantData(id string, baseline *baselineStore) *tenantData {
+	return &tenantData{
+		id:         id,
+		agents:     newAgentRegistry(),
+		seenAlerts: newRecentIDs(10000),
+		inventory:  newInventoryStore(),
+		incidents:  newCorrelator(incidentWindow),
+		commands:   newCommandQueue(),
+		procs:      newProcessTable(),
+		timeline:   newTimelineStore(),
+		baseline:   baseline,
+		stream:     newAlertHub(),
+	}
+}
+
+// tenantSet creates each tenant's state the first time it's needed. The
+// default tenant keeps the baseline file as configured; others get
+// their own next to it, e.g. xdr-baseline.acme.json.
+type tenantSet struct {
+	mu           sync.Mutex
+	byID         map[string]*tenantData
+	logger       *slog.Logger
+	baselinePath string // Empty keeps baselines in memory
+	learn        time.Duration
+	threshold    int
+}
+
+func newTenantSet(logger *slog.Logger) *tenantSet {
+	return &tenantSet{
+		byID:      make(map[string]*tenantData),
+		logger:    logger,
+		learn:     defaultLearningWindow,
+		threshold: defaultAnomalyThreshold,
+	}
+}
+
+// open returns the tenant's state, loading its saved baseline if this is
+// the first use.
+func (ts *tenantSet) open(id string) (*tenantData, error) {
+	id = tenantOrDefault(id)
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if td, ok := ts.byID[id]; ok {
+		return td, nil
+	}
+	b, err := openBaselineStore(tenantFile(ts.baselinePath, id), ts.learn, ts.threshold)
+	if err != nil {
+		return nil, err
+	}
+	td := newTenantData(id, b)
+	ts.byID[id] = td
+	return td, nil
+}
+
+// get is open for callers that can't fail: a baseline file that won't
+// load is logged, and the tenant learns from scratch in memory so the
+// file isn't overwritten.
+func (ts *tenantSet) get(id string) *tenantData {
+	id = tenantOrDefault(id)
+	td, err := ts.open(id)
+	if err == nil {
+		return td
+	}
+	ts.logger.Error("Failed to load tenant baseline, learning in memory", "tenant", id, "error", err)
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if td, ok := ts.byID[id]; ok {
+		return td
+	}
+	td = newTenantData(id, newBaselineStore(ts.learn, ts.threshold))
+	ts.byID[id] = td
+	return td
+}
+
+// all returns every tenant seen so far, by ID.
+func (ts *tenantSet) all() []*tenantData {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	out := make([]*tenantData, 0, len(ts.byID))
+	for _, id := range slices.Sorted(maps.Keys(ts.byID)) {
+		out = append(out, ts.byID[id])
+	}
+	return out
+}
+
+// tenantFile is the default tenant's path with the tenant ID before the
+// extension.
+func tenantFile(path, id string) string {
+	if path == "" || id == defaultTenant {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + id + ext
+}
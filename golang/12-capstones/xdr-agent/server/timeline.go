@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Oldest events are dropped past this many per agent
+const maxTimelineEvents = 50000
+
+// TimelineEvent is one alert placed on a host's timeline
+type TimelineEvent struct {
+	Time     time.Time `json:"time"`
+	Category string    `json:"category"` // process, file, network, auth or other
+	Alert
+}
+
+// eventCategory groups event types for the timeline view.
+func eventCategory(eventType string) string {
+	switch {
+	case strings.HasPrefix(eventType, "PROCESS_"), eventType == "UNAUTHORIZED_ACCESS":
+		return "process"
+	case strings.HasPrefix(eventType, "FILE_"):
+		return "file"
+	case strings.HasPrefix(eventType, "NETWORK_"):
+		return "network"
+	case strings.HasPrefix(eventType, "AUTH_"):
+		return "auth"
+	default:
+		return "other"
+	}
+}
+
+// timelineStore keeps each agent's events sorted by time. Events arriving
+// late (e.g. from the spool) are inserted in place.
+type timelineStore struct {
+	mu    sync.Mutex
+	hosts map[string][]TimelineEvent
+}
+
+func newTimelineStore() *timelineStore {
+	return &timelineStore{hosts: make(map[string][]TimelineEvent)}
+}
+
+func (t *timelineStore) add(a Alert) {
+	ev := TimelineEvent{Time: time.Unix(a.Timestamp, 0).UTC(), Category: eventCategory(a.EventType), Alert: a}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	events := t.hosts[a.AgentID]
+	// After any events with the same time, so arrival order breaks ties
+	i := sort.Search(len(events), func(i int) bool { return events[i].Time.After(ev.Time) })
+	events = append(events, TimelineEvent{})
+	copy(events[i+1:], events[i:])
+	events[i] = ev
+	if len(events) > maxTimelineEvents {
+		events = events[len(events)-maxTimelineEvents:]
+	}
+	t.hosts[a.AgentID] = events
+}
+
+// agents lists the agents that have events.
+func (t *timelineStore) agents() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]string, 0, len(t.hosts))
+	for id := range t.hosts {
+		out = append(out, id)
+	}
+	return out
+}
+
+// between returns the agent's events with from <= time < to.
+func (t *timelineStore) between(agentID string, from, to time.Time) []TimelineEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	events := t.hosts[agentID]
+	lo := sort.Search(len(events), func(i int) bool { return !events[i].Time.Before(from) })
+	hi := sort.Search(len(events), func(i int) bool { return !events[i].Time.Before(to) })
+	if lo >= hi {
+		return []TimelineEvent{}
+	}
+	return append([]TimelineEvent(nil), events[lo:hi]...)
+}
+
+// snapshot copies every host's events, for a cluster snapshot.
+func (t *timelineStore) snapshot() map[string][]TimelineEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string][]TimelineEvent, len(t.hosts))
+	for id, events := range t.hosts {
+		out[id] = append([]TimelineEvent(nil), events...)
+	}
+	return out
+}
+
+func (t *timelineStore) restore(hosts map[string][]TimelineEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.hosts = hosts
+	if t.hosts == nil {
+		t.hosts = make(map[string][]TimelineEvent)
+	}
+}
+
+// parseTimeParam accepts RFC 3339 or unix seconds.
+func parseTimeParam(v string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time %q, want RFC 3339 or unix seconds", v)
+	}
+	return t, nil
+}
+
+// handleTimeline serves GET /agents/{id}/timeline?from=&to=
+// Both bounds are optional.
+func (s *server) handleTimeline(w http.ResponseWriter, r *http.Request) {
+	from, to := time.Unix(0, 0), time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, dst := range map[string]*time.Time{"from": &from, "to": &to} {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			continue
+		}
+		t, err := parseTimeParam(v)
+		if err != nil {
+			http.Error(w, name+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		*dst = t
+	}
+	writeJSON(w, s.data(r).timeline.between(r.PathValue("id"), from, to))
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Version comparison for the ecosystems the agent inventories. Each
+// function returns -1, 0 or +1 like strings.Compare.
+
+// compareFuncFor picks the comparator for an OSV ecosystem, or nil if we
+// can't order its versions (only exact "versions" matches work then).
+func compareFuncFor(ecosystem string) func(a, b string) int {
+	switch ecosystem {
+	case "Debian", "Ubuntu":
+		return compareDebian
+	case "Red Hat", "Rocky Linux", "AlmaLinux", "openSUSE", "SUSE":
+		return compareRPM
+	case "Go":
+		return compareSemver
+	}
+	return nil
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+func isAlpha(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+
+// splitEpoch splits "1:2.3" into 1 and "2.3". A missing epoch is 0.
+func splitEpoch(v string) (int, string) {
+	e, rest, ok := strings.Cut(v, ":")
+	if !ok {
+		return 0, v
+	}
+	n, err := strconv.Atoi(e)
+	if err != nil {
+		return 0, v
+	}
+	return n, rest
+}
+
+// --- Debian (dpkg) ---
+
+// compareDebian implements dpkg's [epoch:]upstream[-revision] ordering,
+// where '~' sorts before everything, even the end of the string.
+func compareDebian(a, b string) int {
+	ea, a := splitEpoch(a)
+	eb, b := splitEpoch(b)
+	if ea != eb {
+		return sign(ea - eb)
+	}
+
+	ua, ra := a, ""
+	if i := strings.LastIndexByte(a, '-'); i >= 0 {
+		ua, ra = a[:i], a[i+1:]
+	}
+	ub, rb := b, ""
+	if i := strings.LastIndexByte(b, '-'); i >= 0 {
+		ub, rb = b[:i], b[i+1:]
+	}
+
+	if c := debVerrevcmp(ua, ub); c != 0 {
+		return c
+	}
+	return debVerrevcmp(ra, rb)
+}
+
+func debOrder(c byte) int {
+	switch {
+	case isDigit(c):
+		return 0
+	case isAlpha(c):
+		return int(c)
+	case c == '~':
+		return -1
+	}
+	return int(c) + 256
+}
+
+// debVerrevcmp is dpkg's verrevcmp: alternate non-digit runs (compared
+// with debOrder) and digit runs (compared numerically).
+func debVerrevcmp(a, b string) int {
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for (i < len(a) && !isDigit(a[i])) || (j < len(b) && !isDigit(b[j])) {
+			ac, bc := 0, 0
+			if i < len(a) {
+				ac = debOrder(a[i])
+			}
+			if j < len(b) {
+				bc = debOrder(b[j])
+			}
+			if ac != bc {
+				return sign(ac - bc)
+			}
+			i++
+			j++
+		}
+
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+		firstDiff := 0
+		for i < len(a) && isDigit(a[i]) && j < len(b) && isDigit(b[j]) {
+			if firstDiff == 0 {
+				firstDiff = int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+		}
+		if i < len(a) && isDigit(a[i]) {
+			return 1
+		}
+		if j < len(b) && isDigit(b[j]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return sign(firstDiff)
+		}
+	}
+	return 0
+}
+
+// --- RPM ---
+
+// compareRPM orders [epoch:]version[-release] like rpm does.
+func compareRPM(a, b string) int {
+	ea, a := splitEpoch(a)
+	eb, b := splitEpoch(b)
+	if ea != eb {
+		return sign(ea - eb)
+	}
+
+	va, ra, hasRA := cutLast(a, '-')
+	vb, rb, hasRB := cutLast(b, '-')
+	if c := rpmvercmp(va, vb); c != 0 {
+		return c
+	}
+	if !hasRA || !hasRB {
+		// "1.0" matches any release of 1.0
+		return 0
+	}
+	return rpmvercmp(ra, rb)
+}
+
+func cutLast(s string, sep byte) (before, after string, found bool) {
+	if i := strings.LastIndexByte(s, sep); i >= 0 {
+		return s[:i], s[i+1:], true
+	}
+	return s, "", false
+}
+
+// rpmvercmp compares alternating numeric and alphabetic segments; '~'
+// sorts before anything and '^' after the base version but before any
+// further segment.
+func rpmvercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	isSep := func(c byte) bool { return !isDigit(c) && !isAlpha(c) && c != '~' && c != '^' }
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for i < len(a) && isSep(a[i]) {
+			i++
+		}
+		for j < len(b) && isSep(b[j]) {
+			j++
+		}
+
+		aTilde, bTilde := i < len(a) && a[i] == '~', j < len(b) && b[j] == '~'
+		if aTilde || bTilde {
+			if !aTilde {
+				return 1
+			}
+			if !bTilde {
+				return -1
+			}
+			i++
+			j++
+			continue
+		}
+
+		aCaret, bCaret := i < len(a) && a[i] == '^', j < len(b) && b[j] == '^'
+		if aCaret || bCaret {
+			switch {
+			case i >= len(a):
+				return -1
+			case j >= len(b):
+				return 1
+			case !aCaret:
+				return 1
+			case !bCaret:
+				return -1
+			}
+			i++
+			j++
+			continue
+		}
+
+		if i >= len(a) || j >= len(b) {
+			break
+		}
+
+		// Grab one segment of the same kind from each side
+		si, sj := i, j
+		numeric := isDigit(a[i])
+		same := isAlpha
+		if numeric {
+			same = isDigit
+		}
+		for i < len(a) && same(a[i]) {
+			i++
+		}
+		for j < len(b) && same(b[j]) {
+			j++
+		}
+		segA, segB := a[si:i], b[sj:j]
+
+		if segB == "" {
+			// Different segment types: numeric is newer
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+		if numeric {
+			segA = strings.TrimLeft(segA, "0")
+			segB = strings.TrimLeft(segB, "0")
+			if len(segA) != len(segB) {
+				return sign(len(segA) - len(segB))
+			}
+		}
+		if c := strings.Compare(segA, segB); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case i >= len(a) && j >= len(b):
+		return 0
+	case i >= len(a):
+		return -1
+	}
+	return 1
+}
+
+// --- Semantic versions (Go modules) ---
+
+// compareSemver orders "v1.2.3-pre+build" versions. The "v" prefix is
+// optional since OSV's Go entries leave it out.
+func compareSemver(a, b string) int {
+	a, b = strings.TrimPrefix(a, "v"), strings.TrimPrefix(b, "v")
+	a, _, _ = strings.Cut(a, "+")
+	b, _, _ = strings.Cut(b, "+")
+	coreA, preA, _ := strings.Cut(a, "-")
+	coreB, preB, _ := strings.Cut(b, "-")
+
+	pa, pb := strings.Split(coreA, "."), strings.Split(coreB, ".")
+	for k := 0; k < 3; k++ {
+		if c := compareNumeric(part(pa, k), part(pb, k)); c != 0 {
+			return c
+		}
+	}
+
+	// A pre-release sorts before the release itself
+	switch {
+	case preA == preB:
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	}
+
+	ida, idb := strings.Split(preA, "."), strings.Split(preB, ".")
+	for k := 0; k < len(ida) && k < len(idb); k++ {
+		na, errA := strconv.Atoi(ida[k])
+		nb, errB := strconv.Atoi(idb[k])
+		switch {
+		case errA == nil && errB == nil:
+			if na != nb {
+				return sign(na - nb)
+			}
+		case errA == nil:
+			return -1 // Numeric identifiers sort first
+		case errB == nil:
+			return 1
+		default:
+			if c := strings.Compare(ida[k], idb[k]); c != 0 {
+				return c
+			}
+		}
+	}
+	return sign(len(ida) - len(idb))
+}
+
+func part(parts []string, k int) string {
+	if k < len(parts) {
+		return parts[k]
+	}
+	return "0"
+}
+
+func compareNumeric(a, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return sign(len(a) - len(b))
+	}
+	return strings.Compare(a, b)
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		name string
+		cmp  func(a, b string) int
+		a, b string
+		want int
+	}{
+		{"debian equal", compareDebian, "1.2-3", "1.2-3", 0},
+		{"debian numeric", compareDebian, "1.10", "1.9", 1},
+		{"debian epoch wins", compareDebian, "1:1.0", "2.0", 1},
+		{"debian tilde sorts first", compareDebian, "1.0~rc1", "1.0", -1},
+		{"debian revision", compareDebian, "3.0.2-0ubuntu1.9", "3.0.2-0ubuntu1.10", -1},
+		{"debian letters before symbols", compareDebian, "1.0a", "1.0+", -1},
+
+		{"rpm equal", compareRPM, "3.0.7-24.el9", "3.0.7-24.el9", 0},
+		{"rpm release", compareRPM, "3.0.7-24.el9", "3.0.7-25.el9", -1},
+		{"rpm numeric segments", compareRPM, "1.10", "1.9", 1},
+		{"rpm numeric beats alpha", compareRPM, "1.0.1", "1.0.a", 1},
+		{"rpm tilde", compareRPM, "1.0~beta", "1.0", -1},
+		{"rpm caret", compareRPM, "1.0^git1", "1.0", 1},
+		{"rpm epoch", compareRPM, "1:1.0-1", "2.0-1", 1},
+		{"rpm release optional", compareRPM, "1.0", "1.0-5", 0},
+
+		{"semver patch", compareSemver, "v1.2.3", "1.2.10", -1},
+		{"semver prerelease", compareSemver, "1.0.0-rc.1", "1.0.0", -1},
+		{"semver numeric prerelease", compareSemver, "1.0.0-rc.2", "1.0.0-rc.10", -1},
+		{"semver build ignored", compareSemver, "1.0.0+abc", "1.0.0", 0},
+		{"go toolchain", compareSemver, "1.21", "1.21.0", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cmp(tt.a, tt.b); got != tt.want {
+				t.Errorf("compare(%q, %q) = %d; want %d", tt.a, tt.b, got, tt.want)
+			}
+			if got := tt.cmp(tt.b, tt.a); got != -tt.want {
+				t.Errorf("compare(%q, %q) = %d; want %d", tt.b, tt.a, got, -tt.want)
+			}
+		})
+	}
+}
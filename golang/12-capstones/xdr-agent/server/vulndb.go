@@ -0,0 +1,268 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// OSV schema, only the parts we match on.
+// See https://ossf.github.io/osv-schema/
+type osvEntry struct {
+	ID        string        `json:"id"`
+	Aliases   []string      `json:"aliases"`
+	Summary   string        `json:"summary"`
+	Withdrawn string        `json:"withdrawn"`
+	Affected  []osvAffected `json:"affected"`
+}
+
+type osvAffected struct {
+	Package struct {
+		Ecosystem string `json:"ecosystem"`
+		Name      string `json:"name"`
+	} `json:"package"`
+	Ranges   []osvRange `json:"ranges"`
+	Versions []string   `json:"versions"`
+}
+
+type osvRange struct {
+	Type   string     `json:"type"` // SEMVER, ECOSYSTEM or GIT
+	Events []osvEvent `json:"events"`
+}
+
+type osvEvent struct {
+	Introduced   string `json:"introduced,omitempty"`
+	Fixed        string `json:"fixed,omitempty"`
+	LastAffected string `json:"last_affected,omitempty"`
+}
+
+func (e osvEvent) version() string {
+	switch {
+	case e.Introduced != "":
+		return e.Introduced
+	case e.Fixed != "":
+		return e.Fixed
+	}
+	return e.LastAffected
+}
+
+// VulnFinding is one vulnerable package on one host
+type VulnFinding struct {
+	VulnID  string   `json:"vuln_id"`
+	Aliases []string `json:"aliases,omitempty"`
+	Summary string   `json:"summary,omitempty"`
+	Package Package  `json:"package"`
+	FixedIn []string `json:"fixed_in,omitempty"`
+}
+
+func (f VulnFinding) key() string { return f.VulnID + "|" + f.Package.key() }
+
+type vulnRef struct {
+	entry    *osvEntry
+	affected *osvAffected
+}
+
+// vulnDB is an in-memory index of OSV entries by ecosystem and package.
+type vulnDB struct {
+	mu    sync.RWMutex
+	index map[string][]vulnRef // "Debian|openssl" -> entries
+	count int
+}
+
+func newVulnDB() *vulnDB {
+	return &vulnDB{index: make(map[string][]vulnRef)}
+}
+
+// ecosystemBase drops the release suffix: "Debian:12" -> "Debian". We
+// match across releases since the agent doesn't report one; versions
+// differ enough between releases that this rarely misfires.
+func ecosystemBase(eco string) string {
+	base, _, _ := strings.Cut(eco, ":")
+	return base
+}
+
+// loadDir replaces the database with every OSV entry in dir. Both loose
+// *.json files and the per-ecosystem all.zip exports are read.
+func (db *vulnDB) loadDir(dir string) error {
+	index := make(map[string][]vulnRef)
+	count := 0
+	add := func(r io.Reader, name string) error {
+		var e osvEntry
+		if err := json.NewDecoder(r).Decode(&e); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if e.Withdrawn != "" {
+			return nil
+		}
+		count++
+		for i := range e.Affected {
+			a := &e.Affected[i]
+			k := ecosystemBase(a.Package.Ecosystem) + "|" + a.Package.Name
+			index[k] = append(index[k], vulnRef{entry: &e, affected: a})
+		}
+		return nil
+	}
+
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch filepath.Ext(path) {
+		case ".json":
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return add(f, path)
+		case ".zip":
+			zr, err := zip.OpenReader(path)
+			if err != nil {
+				return err
+			}
+			defer zr.Close()
+			for _, zf := range zr.File {
+				if filepath.Ext(zf.Name) != ".json" {
+					continue
+				}
+				rc, err := zf.Open()
+				if err != nil {
+					return err
+				}
+				err = add(rc, path+"/"+zf.Name)
+				rc.Close()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	db.index, db.count = index, count
+	db.mu.Unlock()
+	return nil
+}
+
+func (db *vulnDB) size() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.count
+}
+
+// match returns every known vulnerability affecting the given packages.
+func (db *vulnDB) match(pkgs []Package) []VulnFinding {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var out []VulnFinding
+	for _, p := range pkgs {
+		names := []string{p.Name}
+		if p.SrcPackage != "" && p.SrcPackage != p.Name {
+			// Debian/Ubuntu advisories are filed against source packages
+			names = append(names, p.SrcPackage)
+		}
+		seen := make(map[string]bool)
+		for _, name := range names {
+			for _, ref := range db.index[ecosystemBase(p.Ecosystem)+"|"+name] {
+				if seen[ref.entry.ID] || !affects(ref.affected, p.Ecosystem, p.Version) {
+					continue
+				}
+				seen[ref.entry.ID] = true
+				out = append(out, VulnFinding{
+					VulnID:  ref.entry.ID,
+					Aliases: ref.entry.Aliases,
+					Summary: ref.entry.Summary,
+					Package: p,
+					FixedIn: fixedVersions(ref.affected),
+				})
+			}
+		}
+	}
+	return out
+}
+
+// affects applies OSV's evaluation: walk the range events in version order
+// and let the last one at or below our version decide.
+func affects(a *osvAffected, ecosystem, version string) bool {
+	for _, v := range a.Versions {
+		if v == version {
+			return true
+		}
+	}
+
+	for _, r := range a.Ranges {
+		var cmp func(a, b string) int
+		switch r.Type {
+		case "SEMVER":
+			cmp = compareSemver
+		case "ECOSYSTEM":
+			cmp = compareFuncFor(ecosystemBase(ecosystem))
+		}
+		if cmp == nil {
+			continue // GIT ranges or an ecosystem we can't order
+		}
+
+		events := append([]osvEvent(nil), r.Events...)
+		sort.SliceStable(events, func(i, j int) bool {
+			return rangeCompare(cmp, events[i].version(), events[j].version()) < 0
+		})
+
+		affected := false
+		for _, e := range events {
+			switch {
+			case e.Introduced != "":
+				if rangeCompare(cmp, version, e.Introduced) >= 0 {
+					affected = true
+				}
+			case e.Fixed != "":
+				if cmp(version, e.Fixed) >= 0 {
+					affected = false
+				}
+			case e.LastAffected != "":
+				if cmp(version, e.LastAffected) > 0 {
+					affected = false
+				}
+			}
+		}
+		if affected {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeCompare is cmp with OSV's special "0" meaning "before everything".
+func rangeCompare(cmp func(a, b string) int, a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "0":
+		return -1
+	case b == "0":
+		return 1
+	}
+	return cmp(a, b)
+}
+
+func fixedVersions(a *osvAffected) []string {
+	var out []string
+	for _, r := range a.Ranges {
+		for _, e := range r.Events {
+			if e.Fixed != "" {
+				out = append(out, e.Fixed)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const osvOpenSSL = `{
+  "id": "DSA-0001-1",
+  "aliases": ["CVE-2099-0001"],
+  "affected": [{
+    "package": {"ecosystem": "Debian:12", "name": "openssl"},
+    "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "3.0.11-1~deb12u2"}]}]
+  }]
+}`
+
+const osvGoModule = `{
+  "id": "GO-2099-0002",
+  "affected": [{
+    "package": {"ecosystem": "Go", "name": "golang.org/x/net"},
+    "ranges": [{"type": "SEMVER", "events": [
+      {"introduced": "0"}, {"fixed": "0.17.0"},
+      {"introduced": "0.20.0"}, {"last_affected": "0.21.0"}
+    ]}]
+  }]
+}`
+
+func TestVulnDBMatch(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "DSA-0001-1.json"), []byte(osvOpenSSL), 0644)
+	os.WriteFile(filepath.Join(dir, "GO-2099-0002.json"), []byte(osvGoModule), 0644)
+
+	db := newVulnDB()
+	if err := db.loadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		pkg  Package
+		want string // Expected vuln ID, "" for none
+	}{
+		{"old libssl via source package", Package{Ecosystem: "Debian", Name: "libssl3", SrcPackage: "openssl", Version: "3.0.11-1~deb12u1"}, "DSA-0001-1"},
+		{"fixed openssl", Package{Ecosystem: "Debian", Name: "openssl", Version: "3.0.11-1~deb12u2"}, ""},
+		{"other ecosystem", Package{Ecosystem: "Red Hat", Name: "openssl", Version: "1.0"}, ""},
+		{"go module before fix", Package{Ecosystem: "Go", Name: "golang.org/x/net", Version: "v0.16.0"}, "GO-2099-0002"},
+		{"go module after fix", Package{Ecosystem: "Go", Name: "golang.org/x/net", Version: "v0.19.0"}, ""},
+		{"go module last affected", Package{Ecosystem: "Go", Name: "golang.org/x/net", Version: "v0.21.0"}, "GO-2099-0002"},
+		{"go module past last affected", Package{Ecosystem: "Go", Name: "golang.org/x/net", Version: "v0.22.0"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found := db.match([]Package{tt.pkg})
+			got := ""
+			if len(found) > 0 {
+				got = found[0].VulnID
+			}
+			if got != tt.want || len(found) > 1 {
+				t.Errorf("match(%s %s) = %+v; want %q", tt.pkg.Name, tt.pkg.Version, found, tt.want)
+			}
+		})
+	}
+}
+
+func TestInventoryFindingsRaisedOnce(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "DSA-0001-1.json"), []byte(osvOpenSSL), 0644)
+
+	s := newServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s.osvDir = dir
+	s.reloadVulnDB()
+
+	vulnerable := Package{Ecosystem: "Debian", Name: "openssl", Version: "3.0.9-1", Source: "dpkg"}
+	s.tenant(defaultTenant).inventory.apply(InventoryReport{AgentID: "web-1", Full: true, Added: []Package{vulnerable}})
+	s.scanHost(s.tenant(defaultTenant), "web-1")
+	s.scanHost(s.tenant(defaultTenant), "web-1")
+	if got := len(s.tenant(defaultTenant).inventory.openFindings("web-1")); got != 1 {
+		t.Fatalf("open findings = %d; want 1", got)
+	}
+
+	// Upgrade closes the finding
+	fixed := vulnerable
+	fixed.Version = "3.0.11-1~deb12u2"
+	s.tenant(defaultTenant).inventory.apply(InventoryReport{AgentID: "web-1", Added: []Package{fixed}, Removed: []Package{vulnerable}})
+	s.scanHost(s.tenant(defaultTenant), "web-1")
+	if got := len(s.tenant(defaultTenant).inventory.openFindings("web-1")); got != 0 {
+		t.Errorf("open findings after upgrade = %d; want 0", got)
+	}
+
+	// A diff without a baseline is refused
+	if err := s.tenant(defaultTenant).inventory.apply(InventoryReport{AgentID: "new-host"}); err != errNoBaseline {
+		t.Errorf("diff without baseline: err = %v; want errNoBaseline", err)
+	}
+}
@@ -0,0 +1,558 @@
+// XDR console. Everything here talks to the server's own API, so the
+// dashboard works on an air-gapped network: no CDN, no external fonts.
+"use strict";
+
+const maxFeed = 500; // Alerts kept in the live feed
+
+const state = {
+  token: sessionStorage.getItem("xdr.token") || "",
+  user: sessionStorage.getItem("xdr.user") || "",
+  alerts: [],
+  stream: null, // AbortController of the open /alerts/stream request
+  timer: 0, // Refresh timer of the current page
+};
+
+const view = document.getElementById("view");
+
+// --- Rendering ---
+
+// Raw marks markup that html`` must not escape again.
+class Raw {
+  constructor(s) { this.s = s; }
+}
+
+function esc(s) {
+  return String(s).replace(/[&<>"']/g, (c) => `&#${c.charCodeAt(0)};`);
+}
+
+function render(v) {
+  if (v instanceof Raw) return v.s;
+  if (Array.isArray(v)) return v.map(render).join("");
+  if (v === null || v === undefined || v === false) return "";
+  return esc(v);
+}
+
+// html escapes every interpolated value, so server data can't inject markup.
+function html(strings, ...values) {
+  let out = strings[0];
+  values.forEach((v, i) => { out += render(v) + strings[i + 1]; });
+  return new Raw(out);
+}
+
+function show(content) {
+  view.innerHTML = render(content);
+}
+
+function sev(s) {
+  return html`<span class="sev sev-${s}">${s}</span>`;
+}
+
+function when(t) {
+  if (!t) return "";
+  const d = typeof t === "number" ? new Date(t * 1000) : new Date(t);
+  return d.getTime() > 0 ? d.toLocaleString() : "";
+}
+
+function formData(form) {
+  return Object.fromEntries(new FormData(form).entries());
+}
+
+// --- API ---
+
+function authHeaders() {
+  return state.token ? { Authorization: "Bearer " + state.token } : {};
+}
+
+// request returns the raw response, for callers that need headers.
+async function request(path, opts = {}) {
+  const headers = { ...authHeaders(), ...opts.headers };
+  let body = opts.body;
+  if (body !== undefined) {
+    headers["Content-Type"] = "application/json";
+    body = JSON.stringify(body);
+  }
+  const res = await fetch(path, { ...opts, headers, body });
+  if (res.status === 401) {
+    signOut();
+    throw new Error("Sign in to continue");
+  }
+  if (!res.ok) {
+    const err = new Error((await res.text()).trim() || res.statusText);
+    err.status = res.status;
+    throw err;
+  }
+  return res;
+}
+
+async function api(path, opts) {
+  const res = await request(path, opts);
+  if (res.status === 204) return null;
+  return res.json();
+}
+
+// --- Sign in ---
+
+function signIn(token, user) {
+  state.token = token;
+  state.user = user;
+  sessionStorage.setItem("xdr.token", token);
+  sessionStorage.setItem("xdr.user", user);
+  document.getElementById("login").hidden = true;
+  start();
+}
+
+function signOut() {
+  state.token = state.user = "";
+  sessionStorage.removeItem("xdr.token");
+  sessionStorage.removeItem("xdr.user");
+  if (state.stream) state.stream.abort();
+  clearInterval(state.timer);
+  view.innerHTML = "";
+  document.getElementById("login").hidden = false;
+  document.getElementById("logout").hidden = true;
+  document.getElementById("who").textContent = "";
+}
+
+document.getElementById("login-form").addEventListener("submit", async (e) => {
+  e.preventDefault();
+  const creds = formData(e.target);
+  try {
+    const res = await fetch("/login", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(creds),
+    });
+    if (!res.ok) throw new Error((await res.text()).trim());
+    signIn((await res.json()).token, creds.username);
+  } catch (err) {
+    document.getElementById("login-error").textContent = err.message;
+  }
+});
+
+// API keys go in the same Bearer header; the server tells them apart by
+// their xdr_ prefix.
+document.getElementById("key-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  const key = formData(e.target).key.trim();
+  if (key) signIn(key, "API key");
+});
+
+document.getElementById("logout").addEventListener("click", signOut);
+
+// --- Live alert feed ---
+
+function onAlert(a) {
+  state.alerts.unshift(a);
+  state.alerts.length = Math.min(state.alerts.length, maxFeed);
+  if (currentPage() === "alerts") renderFeed(a.id);
+}
+
+// connectStream reads /alerts/stream with fetch rather than EventSource,
+// which can't send the Authorization header.
+async function connectStream() {
+  if (state.stream) return;
+  const ctrl = new AbortController();
+  state.stream = ctrl;
+  try {
+    const res = await request("/alerts/stream", { signal: ctrl.signal });
+    const reader = res.body.pipeThrough(new TextDecoderStream()).getReader();
+    let buf = "";
+    for (;;) {
+      const { value, done } = await reader.read();
+      if (done) break;
+      buf += value;
+      let end;
+      while ((end = buf.indexOf("\n\n")) >= 0) {
+        const data = buf.slice(0, end).split("\n")
+          .filter((l) => l.startsWith("data: "))
+          .map((l) => l.slice(6))
+          .join("\n");
+        buf = buf.slice(end + 2);
+        if (data) onAlert(JSON.parse(data));
+      }
+    }
+  } catch (err) {
+    if (ctrl.signal.aborted) return;
+  }
+  // Dropped by the server or the network: retry while still signed in
+  state.stream = null;
+  if (document.getElementById("login").hidden) setTimeout(connectStream, 3000);
+}
+
+function renderFeed(freshID) {
+  const filter = (document.getElementById("feed-filter")?.value || "").toLowerCase();
+  const rows = state.alerts.filter((a) =>
+    !filter || [a.agent_id, a.event_type, a.details].some((v) => (v || "").toLowerCase().includes(filter)));
+  const body = document.getElementById("feed");
+  if (!body) return;
+  body.innerHTML = render(rows.map((a) => html`
+    <tr class="${a.id && a.id === freshID ? "fresh" : ""}">
+      <td>${when(a.timestamp)}</td>
+      <td><a href="#/agents/${encodeURIComponent(a.agent_id)}">${a.agent_id}</a></td>
+      <td>${a.event_type}</td>
+      <td class="mono">${a.details}</td>
+      <td>${(a.intel || []).map((m) => html`<div class="mono">${m.observable} (${m.confidence})</div>`)}</td>
+    </tr>`));
+  document.getElementById("feed-count").textContent =
+    `${rows.length} alert${rows.length === 1 ? "" : "s"} since this page was opened`;
+}
+
+function alertsPage() {
+  show(html`
+    <h2>Live alerts</h2>
+    <form class="inline" id="feed-form">
+      <label>Filter <input id="feed-filter" placeholder="agent, event type or text"></label>
+      <span id="feed-count" class="muted"></span>
+    </form>
+    <table>
+      <thead><tr><th>Time</th><th>Agent</th><th>Event</th><th>Details</th><th>Intel</th></tr></thead>
+      <tbody id="feed"></tbody>
+    </table>`);
+  document.getElementById("feed-form").addEventListener("submit", (e) => e.preventDefault());
+  document.getElementById("feed-filter").addEventListener("input", () => renderFeed());
+  renderFeed();
+}
+
+// --- Agents ---
+
+async function agentsPage() {
+  const load = async () => {
+    const agents = await api("/agents");
+    agents.sort((a, b) => a.id.localeCompare(b.id));
+    const online = agents.filter((a) => a.status === "online").length;
+    show(html`
+      <h2>Fleet <span class="muted">${online} of ${agents.length} online</span></h2>
+      <table>
+        <thead><tr><th>Agent</th><th>Status</th><th>Last seen</th><th></th></tr></thead>
+        <tbody>${agents.map((a) => html`
+          <tr>
+            <td>${a.id}</td>
+            <td><span class="status status-${a.status}">${a.status}</span></td>
+            <td>${when(a.last_seen)}</td>
+            <td><a href="#/process-tree/${encodeURIComponent(a.id)}">Process tree</a></td>
+          </tr>`)}
+        </tbody>
+      </table>`);
+  };
+  await load();
+  state.timer = setInterval(() => load().catch(showError), 10000);
+}
+
+// --- Incidents ---
+
+async function incidentsPage() {
+  const incidents = await api("/incidents");
+  incidents.sort((a, b) => b.last_seen.localeCompare(a.last_seen));
+  show(html`
+    <h2>Incidents</h2>
+    <table>
+      <thead><tr><th>ID</th><th>Agent</th><th>Severity</th><th>Tactics</th><th>Detections</th><th>Last seen</th></tr></thead>
+      <tbody>${incidents.map((i) => html`
+        <tr class="clickable" data-href="#/incidents/${encodeURIComponent(i.id)}">
+          <td>${i.id}</td>
+          <td>${i.agent_id}</td>
+          <td>${sev(i.severity)}</td>
+          <td>${(i.tactics || []).join(", ")}</td>
+          <td>${i.detections.length}</td>
+          <td>${when(i.last_seen)}</td>
+        </tr>`)}
+      </tbody>
+    </table>`);
+}
+
+async function incidentPage(id) {
+  const inc = await api(`/incidents/${encodeURIComponent(id)}`);
+  show(html`
+    <h2>${inc.id} on ${inc.agent_id} ${sev(inc.severity)}</h2>
+    <p class="muted">${when(inc.first_seen)} – ${when(inc.last_seen)}</p>
+    <button id="open-case">Open a case</button>
+    <h3>Detections</h3>
+    <table>
+      <thead><tr><th>Time</th><th>Rule</th><th>Severity</th><th>Tactic</th><th>Alert</th></tr></thead>
+      <tbody>${inc.detections.map((d) => html`
+        <tr>
+          <td>${when(d.time)}</td>
+          <td>${d.rule_id} ${d.rule_name}</td>
+          <td>${sev(d.severity)}</td>
+          <td>${d.tactic}</td>
+          <td class="mono">${d.alert_id}</td>
+        </tr>`)}
+      </tbody>
+    </table>`);
+  document.getElementById("open-case").addEventListener("click", async () => {
+    try {
+      const c = await api("/cases", { method: "POST", body: { title: `${inc.id} on ${inc.agent_id}`, incidents: [inc.id] } });
+      location.hash = `#/cases/${encodeURIComponent(c.id)}`;
+    } catch (err) {
+      showError(err);
+    }
+  });
+}
+
+// --- Cases ---
+
+async function casesPage() {
+  const cases = await api("/cases");
+  show(html`
+    <h2>Cases</h2>
+    <form class="inline" id="new-case">
+      <label>Title <input name="title" required></label>
+      <label>Severity <select name="severity">
+        ${["low", "medium", "high", "critical"].map((s) => html`<option ${s === "medium" ? "selected" : ""}>${s}</option>`)}
+      </select></label>
+      <button>New case</button>
+    </form>
+    <table>
+      <thead><tr><th>ID</th><th>Title</th><th>Status</th><th>Severity</th><th>Assignee</th><th>Updated</th></tr></thead>
+      <tbody>${cases.map((c) => html`
+        <tr class="clickable" data-href="#/cases/${encodeURIComponent(c.id)}">
+          <td>${c.id}</td>
+          <td>${c.title}</td>
+          <td>${c.status}</td>
+          <td>${sev(c.severity)}</td>
+          <td>${c.assignee}</td>
+          <td>${when(c.updated)}</td>
+        </tr>`)}
+      </tbody>
+    </table>`);
+  document.getElementById("new-case").addEventListener("submit", async (e) => {
+    e.preventDefault();
+    try {
+      const c = await api("/cases", { method: "POST", body: formData(e.target) });
+      location.hash = `#/cases/${encodeURIComponent(c.id)}`;
+    } catch (err) {
+      showError(err);
+    }
+  });
+}
+
+async function casePage(id) {
+  const path = `/cases/${encodeURIComponent(id)}`;
+  const res = await request(path);
+  const etag = res.headers.get("ETag");
+  const c = await res.json();
+  show(html`
+    <h2>${c.id}: ${c.title} ${sev(c.severity)}</h2>
+    <p class="muted">Opened ${when(c.created)}, updated ${when(c.updated)}</p>
+    <form class="inline" id="case-edit">
+      <label>Status <select name="status">
+        ${["new", "triaging", "contained", "closed"].map((s) => html`<option ${s === c.status ? "selected" : ""}>${s}</option>`)}
+      </select></label>
+      <label>Assignee <input name="assignee" value="${c.assignee || ""}"></label>
+      <button>Save</button>
+    </form>
+    <p>Incidents: ${(c.incidents || []).map((i) => html`<a href="#/incidents/${encodeURIComponent(i)}">${i}</a> `)}</p>
+    <p>Tags: ${(c.tags || []).join(", ")}</p>
+    <h3>Notes</h3>
+    ${(c.notes || []).map((n) => html`<div class="note"><span class="muted">${n.author}, ${when(n.time)}</span><br>${n.text}</div>`)}
+    <form id="add-note">
+      <textarea name="text" required></textarea>
+      <button>Add note</button>
+    </form>`);
+
+  document.getElementById("case-edit").addEventListener("submit", async (e) => {
+    e.preventDefault();
+    try {
+      await api(path, { method: "PATCH", body: formData(e.target), headers: { "If-Match": etag } });
+      route();
+    } catch (err) {
+      if (err.status === 412) err.message = "Someone else changed this case. Reload to see their edit.";
+      showError(err);
+    }
+  });
+  document.getElementById("add-note").addEventListener("submit", async (e) => {
+    e.preventDefault();
+    try {
+      await api(`${path}/notes`, { method: "POST", body: formData(e.target) });
+      route();
+    } catch (err) {
+      showError(err);
+    }
+  });
+}
+
+// --- Process tree ---
+
+function procLabel(p) {
+  return html`<span class="proc"><b>${p.pid}</b> ${p.exe || "?"}</span>
+    <span class="mono muted">${p.cmdline}</span>
+    <span class="muted">${when(p.start)}${p.exit ? html` – exited ${when(p.exit)}` : ""}</span>`;
+}
+
+async function processTreePage(agent = "") {
+  show(html`
+    <h2>Process tree</h2>
+    <form class="inline" id="tree-form">
+      <label>Agent <input name="agent" value="${agent}" required></label>
+      <label>PID <input name="pid" type="number" min="1" required></label>
+      <label>At <input name="at" type="datetime-local"></label>
+      <button>Show</button>
+    </form>
+    <div id="tree"></div>`);
+  document.getElementById("tree-form").addEventListener("submit", async (e) => {
+    e.preventDefault();
+    const f = formData(e.target);
+    const q = new URLSearchParams({ pid: f.pid });
+    if (f.at) q.set("at", new Date(f.at).toISOString().replace(/\.\d+Z$/, "Z"));
+    try {
+      const t = await api(`/agents/${encodeURIComponent(f.agent)}/process-tree?${q}`);
+      // Ancestry lists the process first; draw from the oldest parent down
+      const chain = [...t.ancestry].reverse();
+      document.getElementById("tree").innerHTML = render(chain.reduceRight((inner, p, i) => {
+        const focus = i === chain.length - 1;
+        return html`<ul class="${i === 0 ? "tree" : ""}"><li class="${focus ? "focus" : ""}">${procLabel(p)}${inner}</li></ul>`;
+      }, html`<ul>${(t.children || []).map((c) => html`<li>${procLabel(c)}</li>`)}</ul>`));
+    } catch (err) {
+      showError(err);
+    }
+  });
+}
+
+// --- Rules ---
+
+async function rulesPage() {
+  const rules = await api("/rules");
+  show(html`
+    <h2>Detection rules</h2>
+    <table>
+      <thead><tr><th>ID</th><th>Name</th><th>Matches</th><th>Severity</th><th>Tactic</th><th></th></tr></thead>
+      <tbody>${rules.map((r) => html`
+        <tr class="${r.disabled ? "muted" : ""}">
+          <td>${r.id}</td>
+          <td>${r.name}</td>
+          <td class="mono">${r.event_type || "any"}${r.contains ? html` containing “${r.contains}”` : ""}${r.intel_confidence ? html`, intel ≥ ${r.intel_confidence}` : ""}</td>
+          <td>${sev(r.severity)}</td>
+          <td>${r.tactic}</td>
+          <td>
+            <button data-toggle="${r.id}">${r.disabled ? "Enable" : "Disable"}</button>
+            <button data-edit="${r.id}">Edit</button>
+            <button data-delete="${r.id}">Delete</button>
+          </td>
+        </tr>`)}
+      </tbody>
+    </table>
+    <h3>Add or edit a rule</h3>
+    <form class="inline" id="rule-form">
+      <label>ID <input name="id" required pattern="[^/ ]+"></label>
+      <label>Name <input name="name" required></label>
+      <label>Event type <input name="event_type"></label>
+      <label>Details contain <input name="contains"></label>
+      <label>Severity <select name="severity">
+        ${["low", "medium", "high", "critical"].map((s) => html`<option>${s}</option>`)}
+      </select></label>
+      <label>Tactic <input name="tactic"></label>
+      <label>Intel confidence <input name="intel_confidence" type="number" min="0" max="100"></label>
+      <button>Save rule</button>
+    </form>`);
+
+  const byID = Object.fromEntries(rules.map((r) => [r.id, r]));
+  const save = (r) => api(`/rules/${encodeURIComponent(r.id)}`, { method: "PUT", body: r });
+  const form = document.getElementById("rule-form");
+
+  view.querySelectorAll("[data-toggle]").forEach((b) => b.addEventListener("click", async () => {
+    const r = byID[b.dataset.toggle];
+    try {
+      await save({ ...r, disabled: !r.disabled });
+      route();
+    } catch (err) {
+      showError(err);
+    }
+  }));
+  view.querySelectorAll("[data-edit]").forEach((b) => b.addEventListener("click", () => {
+    const r = byID[b.dataset.edit];
+    for (const el of form.elements) {
+      if (el.name) el.value = r[el.name] ?? "";
+    }
+    form.scrollIntoView();
+  }));
+  view.querySelectorAll("[data-delete]").forEach((b) => b.addEventListener("click", async () => {
+    if (!confirm(`Delete rule ${b.dataset.delete}?`)) return;
+    try {
+      await api(`/rules/${encodeURIComponent(b.dataset.delete)}`, { method: "DELETE" });
+      route();
+    } catch (err) {
+      showError(err);
+    }
+  }));
+  form.addEventListener("submit", async (e) => {
+    e.preventDefault();
+    const r = formData(form);
+    r.intel_confidence = Number(r.intel_confidence) || 0;
+    r.disabled = byID[r.id]?.disabled || false;
+    try {
+      await save(r);
+      route();
+    } catch (err) {
+      showError(err);
+    }
+  });
+}
+
+// --- Routing ---
+
+const routes = [
+  [/^#\/alerts$/, alertsPage],
+  [/^#\/agents$/, agentsPage],
+  [/^#\/agents\/([^/]+)$/, processTreePage],
+  [/^#\/incidents$/, incidentsPage],
+  [/^#\/incidents\/([^/]+)$/, incidentPage],
+  [/^#\/cases$/, casesPage],
+  [/^#\/cases\/([^/]+)$/, casePage],
+  [/^#\/process-tree(?:\/([^/]+))?$/, processTreePage],
+  [/^#\/rules$/, rulesPage],
+];
+
+function currentPage() {
+  return (location.hash || "#/alerts").split("/")[1];
+}
+
+function showError(err) {
+  let box = document.getElementById("page-error");
+  if (!box) {
+    box = document.createElement("p");
+    box.id = "page-error";
+    box.className = "error";
+    view.prepend(box);
+  }
+  box.textContent = err.message;
+}
+
+async function route() {
+  if (!document.getElementById("login").hidden) return;
+  clearInterval(state.timer);
+  const hash = location.hash || "#/alerts";
+  document.querySelectorAll("nav a").forEach((a) =>
+    a.classList.toggle("active", a.getAttribute("href").split("/")[1] === currentPage()));
+  for (const [re, page] of routes) {
+    const m = hash.match(re);
+    if (!m) continue;
+    try {
+      await page(...m.slice(1).map((v) => (v === undefined ? undefined : decodeURIComponent(v))));
+    } catch (err) {
+      show(html`<p class="error">${err.message}</p>`);
+    }
+    return;
+  }
+  location.hash = "#/alerts";
+}
+
+view.addEventListener("click", (e) => {
+  const row = e.target.closest("[data-href]");
+  if (row && !e.target.closest("a, button")) location.hash = row.dataset.href;
+});
+window.addEventListener("hashchange", route);
+
+// start probes the API: a server run with -no-auth needs no sign-in.
+async function start() {
+  try {
+    await request("/agents");
+  } catch (err) {
+    return;
+  }
+  document.getElementById("who").textContent = state.user;
+  document.getElementById("logout").hidden = !state.token;
+  connectStream();
+  route();
+}
+
+start();
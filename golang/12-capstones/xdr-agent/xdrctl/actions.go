@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Command is a response action queued for an agent
+type Command struct {
+	ID      string            `json:"id"`
+	AgentID string            `json:"agent_id"`
+	Action  string            `json:"action"`
+	Args    map[string]string `json:"args,omitempty"`
+	Status  string            `json:"status"`
+	Output  string            `json:"output,omitempty"`
+	Created time.Time         `json:"created"`
+	Updated time.Time         `json:"updated"`
+}
+
+func (c Command) finished() bool { return c.Status == "done" || c.Status == "failed" }
+
+func (a *app) actionsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "actions",
+		Aliases: []string{"action"},
+		Short:   "Queue response actions on an agent",
+		Long: `Queue a response action. The agent runs it the next time it is connected;
+--wait blocks until it reports back.`,
+	}
+
+	var pid int
+	kill := a.actionCmd("kill AGENT --pid PID", "Kill a process on the agent", "kill_process", func() (map[string]string, error) {
+		if pid <= 0 {
+			return nil, fmt.Errorf("--pid is required")
+		}
+		return map[string]string{"pid": strconv.Itoa(pid)}, nil
+	})
+	kill.Flags().IntVar(&pid, "pid", 0, "Process to kill")
+
+	var path string
+	quarantine := a.actionCmd("quarantine AGENT --path FILE", "Move a file on the agent into quarantine", "quarantine_file", func() (map[string]string, error) {
+		if path == "" {
+			return nil, fmt.Errorf("--path is required")
+		}
+		return map[string]string{"path": path}, nil
+	})
+	quarantine.Flags().StringVar(&path, "path", "", "Absolute path of the file")
+
+	isolate := a.actionCmd("isolate AGENT", "Ask the agent to isolate its host from the network", "isolate_host", func() (map[string]string, error) {
+		return nil, nil
+	})
+
+	cmd.AddCommand(kill, quarantine, isolate)
+	return cmd
+}
+
+// actionCmd builds one action command. args turns its flags into the
+// command arguments.
+func (a *app) actionCmd(use, short, action string, args func() (map[string]string, error)) *cobra.Command {
+	var wait time.Duration
+	cmd := &cobra.Command{
+		Use:               use,
+		Short:             short,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: a.completeAgents,
+		RunE: func(cmd *cobra.Command, posArgs []string) error {
+			actionArgs, err := args()
+			if err != nil {
+				return err
+			}
+			c, err := a.client()
+			if err != nil {
+				return err
+			}
+			path := "/agents/" + url.PathEscape(posArgs[0]) + "/commands"
+			var queued Command
+			if _, err := c.call(cmd.Context(), "POST", path, map[string]any{"action": action, "args": actionArgs}, &queued, nil); err != nil {
+				return err
+			}
+			if wait > 0 {
+				if queued, err = a.waitCommand(cmd, c, path, queued, wait); err != nil {
+					return err
+				}
+			}
+			return a.print(queued, func(w io.Writer) {
+				fmt.Fprintln(w, "COMMAND\tAGENT\tACTION\tSTATUS\tOUTPUT")
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", queued.ID, queued.AgentID, queued.Action, queued.Status, dash(queued.Output))
+			})
+		},
+	}
+	cmd.Flags().DurationVar(&wait, "wait", 0, "Wait this long for the agent's result (0 to return once queued)")
+	return cmd
+}
+
+// waitCommand polls the agent's commands until cmd finishes or the wait is
+// over, and returns its latest state.
+func (a *app) waitCommand(cmd *cobra.Command, c *client, path string, queued Command, wait time.Duration) (Command, error) {
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-cmd.Context().Done():
+			return queued, cmd.Context().Err()
+		case <-deadline.C:
+			return queued, fmt.Errorf("%s is still %s after %s", queued.ID, queued.Status, wait)
+		case <-tick.C:
+		}
+		var cmds []Command
+		if err := c.get(cmd.Context(), path, &cmds); err != nil {
+			return queued, err
+		}
+		if i := slices.IndexFunc(cmds, func(x Command) bool { return x.ID == queued.ID }); i >= 0 {
+			queued = cmds[i]
+		}
+		if queued.finished() {
+			return queued, nil
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Agent is one entry of GET /agents
+type Agent struct {
+	ID       string    `json:"id"`
+	Status   string    `json:"status"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Vulnerability is an open finding from GET /agents/{id}/vulnerabilities
+type Vulnerability struct {
+	VulnID  string   `json:"vuln_id"`
+	Summary string   `json:"summary,omitempty"`
+	FixedIn []string `json:"fixed_in,omitempty"`
+	Package struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"package"`
+}
+
+// agentDetail is what agents get prints
+type agentDetail struct {
+	Agent
+	Vulnerabilities []Vulnerability `json:"vulnerabilities"`
+	Commands        []Command       `json:"commands"`
+}
+
+func (a *app) agentsCmd() *cobra.Command {
+	cmd := &cobra.Command{Use: "agents", Aliases: []string{"agent"}, Short: "Inspect the agent fleet"}
+
+	var status string
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List agents and whether they are online",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			agents, err := a.listAgents(cmd)
+			if err != nil {
+				return err
+			}
+			if status != "" {
+				agents = slices.DeleteFunc(agents, func(ag Agent) bool { return ag.Status != status })
+			}
+			return a.print(agents, func(w io.Writer) {
+				fmt.Fprintln(w, "ID\tSTATUS\tLAST SEEN")
+				for _, ag := range agents {
+					fmt.Fprintf(w, "%s\t%s\t%s\n", ag.ID, ag.Status, ago(ag.LastSeen))
+				}
+			})
+		},
+	}
+	list.Flags().StringVar(&status, "status", "", "Only agents in this state: online, stopped or lost")
+	list.RegisterFlagCompletionFunc("status", cobra.FixedCompletions([]string{"online", "stopped", "lost"}, cobra.ShellCompDirectiveNoFileComp))
+
+	get := &cobra.Command{
+		Use:               "get ID",
+		Short:             "Show one agent with its open vulnerabilities and recent commands",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: a.completeAgents,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			agents, err := a.listAgents(cmd)
+			if err != nil {
+				return err
+			}
+			i := slices.IndexFunc(agents, func(ag Agent) bool { return ag.ID == args[0] })
+			if i < 0 {
+				return fmt.Errorf("no agent %q", args[0])
+			}
+			c, err := a.client()
+			if err != nil {
+				return err
+			}
+			d := agentDetail{Agent: agents[i]}
+			base := "/agents/" + url.PathEscape(d.ID)
+			if err := c.get(cmd.Context(), base+"/vulnerabilities", &d.Vulnerabilities); err != nil {
+				return err
+			}
+			if err := c.get(cmd.Context(), base+"/commands", &d.Commands); err != nil {
+				return err
+			}
+			return a.print(d, func(w io.Writer) {
+				fmt.Fprintf(w, "ID:\t%s\n", d.ID)
+				fmt.Fprintf(w, "Status:\t%s\n", d.Status)
+				fmt.Fprintf(w, "Last seen:\t%s (%s)\n", d.LastSeen.Local().Format(time.RFC3339), ago(d.LastSeen))
+				fmt.Fprintf(w, "\nVULNERABILITY\tPACKAGE\tFIXED IN\tSUMMARY\n")
+				for _, v := range d.Vulnerabilities {
+					fmt.Fprintf(w, "%s\t%s %s\t%s\t%s\n", v.VulnID, v.Package.Name, v.Package.Version,
+						dash(strings.Join(v.FixedIn, ", ")), truncate(v.Summary, 60))
+				}
+				fmt.Fprintf(w, "\nCOMMAND\tACTION\tSTATUS\tUPDATED\n")
+				for _, cm := range d.Commands {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", cm.ID, cm.Action, cm.Status, ago(cm.Updated))
+				}
+			})
+		},
+	}
+
+	cmd.AddCommand(list, get)
+	return cmd
+}
+
+func (a *app) listAgents(cmd *cobra.Command) ([]Agent, error) {
+	c, err := a.client()
+	if err != nil {
+		return nil, err
+	}
+	var agents []Agent
+	if err := c.get(cmd.Context(), "/agents", &agents); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(agents, func(x, y Agent) int { return strings.Compare(x.ID, y.ID) })
+	return agents, nil
+}
+
+// completeAgents offers agent IDs for the first argument.
+func (a *app) completeAgents(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	agents, err := a.listAgents(cmd)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	ids := make([]string, len(agents))
+	for i, ag := range agents {
+		ids[i] = ag.ID
+	}
+	return ids, cobra.ShellCompDirectiveNoFileComp
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Alert is an alert as the server returns it
+type Alert struct {
+	ID         string            `json:"id,omitempty"`
+	AgentID    string            `json:"agent_id"`
+	EventType  string            `json:"event_type"`
+	Details    string            `json:"details"`
+	Timestamp  int64             `json:"timestamp"`
+	Fields     map[string]string `json:"fields,omitempty"`
+	Intel      []json.RawMessage `json:"intel,omitempty"`
+	Suppressed string            `json:"suppressed,omitempty"`
+}
+
+// TimelineEvent is an alert placed on a host timeline
+type TimelineEvent struct {
+	Time     time.Time `json:"time"`
+	Category string    `json:"category"`
+	Alert
+}
+
+// alertFilter is the client-side part of alerts search and tail
+type alertFilter struct {
+	eventType string
+	contains  string
+}
+
+func (f alertFilter) match(a Alert) bool {
+	return (f.eventType == "" || strings.EqualFold(a.EventType, f.eventType)) &&
+		strings.Contains(strings.ToLower(a.Details), strings.ToLower(f.contains))
+}
+
+func (f *alertFilter) register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.eventType, "type", "", "Only this event type, e.g. PROCESS_START")
+	cmd.Flags().StringVar(&f.contains, "contains", "", "Only alerts whose details contain this text (case-insensitive)")
+}
+
+func (a *app) alertsCmd() *cobra.Command {
+	cmd := &cobra.Command{Use: "alerts", Aliases: []string{"alert"}, Short: "Search and follow alerts"}
+	cmd.AddCommand(a.alertsSearchCmd(), a.alertsTailCmd())
+	return cmd
+}
+
+func (a *app) alertsSearchCmd() *cobra.Command {
+	var (
+		f      alertFilter
+		agents []string
+		since  time.Duration
+		limit  int
+	)
+	cmd := &cobra.Command{
+		Use:   "search",
+		Short: "Search the host timelines",
+		Long: `Search the host timelines of one or more agents, newest first.
+Without --agent every known agent is searched.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := a.client()
+			if err != nil {
+				return err
+			}
+			if len(agents) == 0 {
+				all, err := a.listAgents(cmd)
+				if err != nil {
+					return err
+				}
+				for _, ag := range all {
+					agents = append(agents, ag.ID)
+				}
+			}
+
+			q := url.Values{}
+			if since > 0 {
+				q.Set("from", time.Now().Add(-since).UTC().Format(time.RFC3339))
+			}
+			var found []TimelineEvent
+			for _, id := range agents {
+				var events []TimelineEvent
+				if err := c.get(cmd.Context(), "/agents/"+url.PathEscape(id)+"/timeline?"+q.Encode(), &events); err != nil {
+					return fmt.Errorf("agent %s: %w", id, err)
+				}
+				for _, e := range events {
+					if f.match(e.Alert) {
+						found = append(found, e)
+					}
+				}
+			}
+			slices.SortStableFunc(found, func(x, y TimelineEvent) int { return y.Time.Compare(x.Time) })
+			if limit > 0 && len(found) > limit {
+				found = found[:limit]
+			}
+
+			return a.print(found, func(w io.Writer) {
+				fmt.Fprintln(w, "TIME\tAGENT\tTYPE\tDETAILS")
+				for _, e := range found {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Time.Local().Format(time.DateTime), e.AgentID, e.EventType, truncate(e.Details, 80))
+				}
+			})
+		},
+	}
+	f.register(cmd)
+	cmd.Flags().StringSliceVar(&agents, "agent", nil, "Agents to search (repeatable, default all)")
+	cmd.Flags().DurationVar(&since, "since", 24*time.Hour, "How far back to search (0 for everything)")
+	cmd.Flags().IntVar(&limit, "limit", 100, "Most alerts to print (0 for no limit)")
+	cmd.RegisterFlagCompletionFunc("agent", a.completeAgents)
+	return cmd
+}
+
+func (a *app) alertsTailCmd() *cobra.Command {
+	var (
+		f     alertFilter
+		agent string
+	)
+	cmd := &cobra.Command{
+		Use:   "tail",
+		Short: "Follow alerts live as the server ingests them",
+		Long: `Follow the live alert stream until interrupted. JSON output is one alert
+per line; YAML output is one document per alert.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := a.client()
+			if err != nil {
+				return err
+			}
+			path := "/alerts/stream"
+			if agent != "" {
+				path += "?agent=" + url.QueryEscape(agent)
+			}
+			resp, err := c.do(cmd.Context(), "GET", path, nil, nil)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			if a.output == outputTable {
+				fmt.Fprintf(a.out, "%-19s  %-12s  %-20s  %s\n", "TIME", "AGENT", "TYPE", "DETAILS")
+			}
+			err = readEvents(resp.Body, func(event string, data []byte) error {
+				var al Alert
+				if event != "alert" || json.Unmarshal(data, &al) != nil || !f.match(al) {
+					return nil
+				}
+				switch a.output {
+				case outputJSON:
+					_, err := fmt.Fprintf(a.out, "%s\n", data)
+					return err
+				case outputYAML:
+					fmt.Fprintln(a.out, "---")
+					return writeYAML(a.out, al)
+				}
+				_, err := fmt.Fprintf(a.out, "%-19s  %-12s  %-20s  %s\n", time.Unix(al.Timestamp, 0).Format(time.DateTime),
+					al.AgentID, al.EventType, truncate(al.Details, 80))
+				return err
+			})
+			if cmd.Context().Err() != nil {
+				return nil // Interrupted
+			}
+			return err
+		},
+	}
+	f.register(cmd)
+	cmd.Flags().StringVar(&agent, "agent", "", "Only alerts from this agent")
+	cmd.RegisterFlagCompletionFunc("agent", a.completeAgents)
+	return cmd
+}
+
+// readEvents parses a server-sent event stream, calling fn per event.
+func readEvents(r io.Reader, fn func(event string, data []byte) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	var event string
+	var data []byte
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			if data != nil {
+				if err := fn(event, data); err != nil {
+					return err
+				}
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data != nil {
+				data = append(data, '\n')
+			}
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")...)
+		}
+	}
+	return sc.Err()
+}
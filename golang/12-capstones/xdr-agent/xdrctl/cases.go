@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Case is an investigation record
+type Case struct {
+	ID        string     `json:"id"`
+	Title     string     `json:"title"`
+	Status    string     `json:"status"`
+	Severity  string     `json:"severity"`
+	Assignee  string     `json:"assignee,omitempty"`
+	Incidents []string   `json:"incidents,omitempty"`
+	Alerts    []string   `json:"alerts,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+	Notes     []CaseNote `json:"notes,omitempty"`
+	Created   time.Time  `json:"created"`
+	Updated   time.Time  `json:"updated"`
+	Version   int        `json:"version"`
+}
+
+// CaseNote is one analyst note on a case
+type CaseNote struct {
+	Author string    `json:"author"`
+	Text   string    `json:"text"`
+	Time   time.Time `json:"time"`
+}
+
+// casePatch mirrors the server's PATCH body; nil fields stay unchanged.
+type casePatch struct {
+	Title         *string  `json:"title,omitempty"`
+	Status        *string  `json:"status,omitempty"`
+	Severity      *string  `json:"severity,omitempty"`
+	Assignee      *string  `json:"assignee,omitempty"`
+	AddTags       []string `json:"add_tags,omitempty"`
+	RemoveTags    []string `json:"remove_tags,omitempty"`
+	LinkAlerts    []string `json:"link_alerts,omitempty"`
+	LinkIncidents []string `json:"link_incidents,omitempty"`
+}
+
+func (a *app) casesCmd() *cobra.Command {
+	cmd := &cobra.Command{Use: "cases", Aliases: []string{"case"}, Short: "Work on cases"}
+
+	var (
+		title, status, severity, assignee, note string
+		p                                       casePatch
+	)
+	update := &cobra.Command{
+		Use:   "update ID",
+		Short: "Change a case's fields, tags and links, or add a note",
+		Example: `  xdrctl cases update CASE-0001 --status contained --assignee alice
+  xdrctl cases update CASE-0001 --add-tag ransomware --link-incident INC-0007
+  xdrctl cases update CASE-0001 --note "Host reimaged"`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags := cmd.Flags()
+			for name, dst := range map[string]**string{"title": &p.Title, "status": &p.Status, "severity": &p.Severity, "assignee": &p.Assignee} {
+				if flags.Changed(name) {
+					v, _ := flags.GetString(name)
+					*dst = &v
+				}
+			}
+			edit := p.Title != nil || p.Status != nil || p.Severity != nil || p.Assignee != nil ||
+				len(p.AddTags)+len(p.RemoveTags)+len(p.LinkAlerts)+len(p.LinkIncidents) > 0
+			if !edit && note == "" {
+				return errors.New("nothing to update: give at least one field flag or --note")
+			}
+
+			c, err := a.client()
+			if err != nil {
+				return err
+			}
+			path := "/cases/" + url.PathEscape(args[0])
+			var cs Case
+			if edit {
+				// The server only takes an edit against the version it was
+				// based on, so a concurrent change isn't silently overwritten
+				h, err := c.call(cmd.Context(), "GET", path, nil, &cs, nil)
+				if err != nil {
+					return err
+				}
+				_, err = c.call(cmd.Context(), "PATCH", path, p, &cs, http.Header{"If-Match": {h.Get("ETag")}})
+				var apiErr *apiError
+				if errors.As(err, &apiErr) && apiErr.Status == http.StatusPreconditionFailed {
+					return fmt.Errorf("%s was changed by someone else while updating; check it and try again", args[0])
+				}
+				if err != nil {
+					return err
+				}
+			}
+			if note != "" {
+				if _, err := c.call(cmd.Context(), "POST", path+"/notes", map[string]string{"text": note}, &cs, nil); err != nil {
+					return err
+				}
+			}
+			return a.print(cs, func(w io.Writer) {
+				fmt.Fprintf(w, "ID:\t%s\n", cs.ID)
+				fmt.Fprintf(w, "Title:\t%s\n", cs.Title)
+				fmt.Fprintf(w, "Status:\t%s\n", cs.Status)
+				fmt.Fprintf(w, "Severity:\t%s\n", cs.Severity)
+				fmt.Fprintf(w, "Assignee:\t%s\n", dash(cs.Assignee))
+				fmt.Fprintf(w, "Tags:\t%s\n", dash(strings.Join(cs.Tags, ", ")))
+				fmt.Fprintf(w, "Incidents:\t%s\n", dash(strings.Join(cs.Incidents, ", ")))
+				fmt.Fprintf(w, "Notes:\t%d\n", len(cs.Notes))
+				fmt.Fprintf(w, "Version:\t%d\n", cs.Version)
+			})
+		},
+	}
+	f := update.Flags()
+	f.StringVar(&title, "title", "", "New title")
+	f.StringVar(&status, "status", "", "New status: new, triaging, contained or closed")
+	f.StringVar(&severity, "severity", "", "New severity")
+	f.StringVar(&assignee, "assignee", "", "New assignee (empty to unassign)")
+	f.StringSliceVar(&p.AddTags, "add-tag", nil, "Tag to add (repeatable)")
+	f.StringSliceVar(&p.RemoveTags, "remove-tag", nil, "Tag to remove (repeatable)")
+	f.StringSliceVar(&p.LinkIncidents, "link-incident", nil, "Incident to link (repeatable)")
+	f.StringSliceVar(&p.LinkAlerts, "link-alert", nil, "Alert ID to link (repeatable)")
+	f.StringVar(&note, "note", "", "Add this note")
+	update.RegisterFlagCompletionFunc("status", cobra.FixedCompletions([]string{"new", "triaging", "contained", "closed"}, cobra.ShellCompDirectiveNoFileComp))
+	update.RegisterFlagCompletionFunc("severity", cobra.FixedCompletions(severities, cobra.ShellCompDirectiveNoFileComp))
+
+	cmd.AddCommand(update)
+	return cmd
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// requestTimeout bounds every call except streams
+const requestTimeout = 30 * time.Second
+
+// client calls the XDR server's HTTP API
+type client struct {
+	base   string
+	apiKey string
+	http   *http.Client
+}
+
+func newClient(base, apiKey string) *client {
+	return &client{base: strings.TrimRight(base, "/"), apiKey: apiKey, http: &http.Client{}}
+}
+
+// apiError is a non-2xx answer. Status lets callers react to 404 or 412.
+type apiError struct {
+	Status int
+	Msg    string
+}
+
+func (e *apiError) Error() string {
+	switch e.Status {
+	case http.StatusUnauthorized:
+		return "not authenticated: set an API key with --api-key or in the context"
+	case http.StatusForbidden:
+		return "permission denied: " + e.Msg
+	}
+	return fmt.Sprintf("server returned %d: %s", e.Status, e.Msg)
+}
+
+// do sends body as JSON and returns the response, which the caller closes.
+func (c *client) do(ctx context.Context, method, path string, body any, header http.Header) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, r)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &apiError{Status: resp.StatusCode, Msg: strings.TrimSpace(string(msg))}
+	}
+	return resp, nil
+}
+
+// call sends a request and decodes the JSON answer into out, if not nil.
+// It returns the response headers, e.g. for an ETag.
+func (c *client) call(ctx context.Context, method, path string, body, out any, header http.Header) (http.Header, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, err := c.do(ctx, method, path, body, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return nil, fmt.Errorf("decoding %s %s: %w", method, path, err)
+		}
+	}
+	return resp.Header, nil
+}
+
+func (c *client) get(ctx context.Context, path string, out any) error {
+	_, err := c.call(ctx, "GET", path, nil, out, nil)
+	return err
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultServer = "http://localhost:9090"
+
+// Config is the xdrctl config file
+type Config struct {
+	CurrentContext string    `yaml:"current-context"`
+	Contexts       []Context `yaml:"contexts"`
+}
+
+// Context is one named server
+type Context struct {
+	Name   string `yaml:"name"`
+	Server string `yaml:"server"`
+	APIKey string `yaml:"api-key,omitempty"`
+}
+
+// defaultConfigPath is $XDRCTL_CONFIG, else xdrctl/config.yaml in the
+// user's config directory.
+func defaultConfigPath() string {
+	if p := os.Getenv("XDRCTL_CONFIG"); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "xdrctl.yaml"
+	}
+	return filepath.Join(dir, "xdrctl", "config.yaml")
+}
+
+// loadConfig reads the config file. A missing file is an empty config.
+func loadConfig(path string) (*Config, error) {
+	var c Config
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// save writes the config owner-only, since it holds API keys.
+func (c *Config) save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func (c *Config) find(name string) (*Context, bool) {
+	i := slices.IndexFunc(c.Contexts, func(x Context) bool { return x.Name == name })
+	if i < 0 {
+		return nil, false
+	}
+	return &c.Contexts[i], true
+}
+
+// client resolves the server and key: flags first, then $XDR_SERVER and
+// $XDR_API_KEY, then the selected context.
+func (a *app) client() (*client, error) {
+	cfg, err := loadConfig(a.configPath)
+	if err != nil {
+		return nil, err
+	}
+	var ctx Context
+	if name := firstOf(a.context, cfg.CurrentContext); name != "" {
+		c, ok := cfg.find(name)
+		if !ok {
+			return nil, fmt.Errorf("no context %q in %s", name, a.configPath)
+		}
+		ctx = *c
+	}
+	server := firstOf(a.server, os.Getenv("XDR_SERVER"), ctx.Server, defaultServer)
+	key := firstOf(a.apiKey, os.Getenv("XDR_API_KEY"), ctx.APIKey)
+	return newClient(server, key), nil
+}
+
+// firstOf returns the first non-empty string.
+func firstOf(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (a *app) completeContexts(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	cfg, err := loadConfig(a.configPath)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	var names []string
+	for _, c := range cfg.Contexts {
+		names = append(names, c.Name)
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// --- Commands ---
+
+func (a *app) configCmd() *cobra.Command {
+	cmd := &cobra.Command{Use: "config", Short: "Manage server contexts"}
+
+	getContexts := &cobra.Command{
+		Use:   "get-contexts",
+		Short: "List the configured contexts",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig(a.configPath)
+			if err != nil {
+				return err
+			}
+			// Keys stay out of the listing
+			type row struct {
+				Name    string `json:"name"`
+				Server  string `json:"server"`
+				Current bool   `json:"current"`
+				HasKey  bool   `json:"has_api_key"`
+			}
+			rows := make([]row, 0, len(cfg.Contexts))
+			for _, c := range cfg.Contexts {
+				rows = append(rows, row{c.Name, c.Server, c.Name == cfg.CurrentContext, c.APIKey != ""})
+			}
+			return a.print(rows, func(w io.Writer) {
+				fmt.Fprintln(w, "CURRENT\tNAME\tSERVER\tAPI KEY")
+				for _, r := range rows {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", mark(r.Current), r.Name, r.Server, yesNo(r.HasKey))
+				}
+			})
+		},
+	}
+
+	useContext := &cobra.Command{
+		Use:               "use-context NAME",
+		Short:             "Make a context the current one",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: a.completeContexts,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig(a.configPath)
+			if err != nil {
+				return err
+			}
+			if _, ok := cfg.find(args[0]); !ok {
+				return fmt.Errorf("no context %q in %s", args[0], a.configPath)
+			}
+			cfg.CurrentContext = args[0]
+			if err := cfg.save(a.configPath); err != nil {
+				return err
+			}
+			fmt.Fprintf(a.out, "Switched to context %q.\n", args[0])
+			return nil
+		},
+	}
+
+	var server, key string
+	setContext := &cobra.Command{
+		Use:   "set-context NAME",
+		Short: "Add a context or change its server or API key",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig(a.configPath)
+			if err != nil {
+				return err
+			}
+			c, ok := cfg.find(args[0])
+			if !ok {
+				cfg.Contexts = append(cfg.Contexts, Context{Name: args[0], Server: defaultServer})
+				c = &cfg.Contexts[len(cfg.Contexts)-1]
+			}
+			if cmd.Flags().Changed("server") {
+				c.Server = server
+			}
+			if cmd.Flags().Changed("api-key") {
+				c.APIKey = key
+			}
+			if cfg.CurrentContext == "" {
+				cfg.CurrentContext = c.Name
+			}
+			if err := cfg.save(a.configPath); err != nil {
+				return err
+			}
+			fmt.Fprintf(a.out, "Context %q saved.\n", c.Name)
+			return nil
+		},
+	}
+	// Local flags shadow the global --server and --api-key here
+	setContext.Flags().StringVar(&server, "server", "", "Server URL")
+	setContext.Flags().StringVar(&key, "api-key", "", "API key")
+
+	cmd.AddCommand(getContexts, useContext, setContext)
+	return cmd
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Incident groups correlated detections on one agent
+type Incident struct {
+	ID         string      `json:"id"`
+	AgentID    string      `json:"agent_id"`
+	Severity   string      `json:"severity"`
+	Tactics    []string    `json:"tactics"`
+	Detections []Detection `json:"detections"`
+	FirstSeen  time.Time   `json:"first_seen"`
+	LastSeen   time.Time   `json:"last_seen"`
+}
+
+// Detection is one rule match
+type Detection struct {
+	RuleID   string    `json:"rule_id"`
+	RuleName string    `json:"rule_name"`
+	Severity string    `json:"severity"`
+	Tactic   string    `json:"tactic,omitempty"`
+	AlertID  string    `json:"alert_id,omitempty"`
+	AgentID  string    `json:"agent_id"`
+	Time     time.Time `json:"time"`
+}
+
+var severityRank = map[string]int{"low": 1, "medium": 2, "high": 3, "critical": 4}
+
+var severities = []string{"low", "medium", "high", "critical"}
+
+func (a *app) incidentsCmd() *cobra.Command {
+	cmd := &cobra.Command{Use: "incidents", Aliases: []string{"incident"}, Short: "Review incidents"}
+
+	var (
+		agent       string
+		minSeverity string
+	)
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List incidents, most recent first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if minSeverity != "" && severityRank[minSeverity] == 0 {
+				return fmt.Errorf("unknown severity %q", minSeverity)
+			}
+			c, err := a.client()
+			if err != nil {
+				return err
+			}
+			var incidents []Incident
+			if err := c.get(cmd.Context(), "/incidents", &incidents); err != nil {
+				return err
+			}
+			incidents = slices.DeleteFunc(incidents, func(i Incident) bool {
+				return (agent != "" && i.AgentID != agent) || severityRank[i.Severity] < severityRank[minSeverity]
+			})
+			slices.SortFunc(incidents, func(x, y Incident) int { return y.LastSeen.Compare(x.LastSeen) })
+
+			return a.print(incidents, func(w io.Writer) {
+				fmt.Fprintln(w, "ID\tAGENT\tSEVERITY\tDETECTIONS\tTACTICS\tLAST SEEN")
+				for _, i := range incidents {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", i.ID, i.AgentID, i.Severity, len(i.Detections),
+						dash(strings.Join(i.Tactics, ", ")), ago(i.LastSeen))
+				}
+			})
+		},
+	}
+	list.Flags().StringVar(&agent, "agent", "", "Only incidents on this agent")
+	list.Flags().StringVar(&minSeverity, "severity", "", "Minimum severity: low, medium, high or critical")
+	list.RegisterFlagCompletionFunc("agent", a.completeAgents)
+	list.RegisterFlagCompletionFunc("severity", cobra.FixedCompletions(severities, cobra.ShellCompDirectiveNoFileComp))
+
+	show := &cobra.Command{
+		Use:   "show ID",
+		Short: "Show an incident and its detections",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := a.client()
+			if err != nil {
+				return err
+			}
+			var i Incident
+			if err := c.get(cmd.Context(), "/incidents/"+url.PathEscape(args[0]), &i); err != nil {
+				return err
+			}
+			return a.print(i, func(w io.Writer) {
+				fmt.Fprintf(w, "ID:\t%s\n", i.ID)
+				fmt.Fprintf(w, "Agent:\t%s\n", i.AgentID)
+				fmt.Fprintf(w, "Severity:\t%s\n", i.Severity)
+				fmt.Fprintf(w, "Tactics:\t%s\n", dash(strings.Join(i.Tactics, ", ")))
+				fmt.Fprintf(w, "Window:\t%s – %s\n", i.FirstSeen.Local().Format(time.DateTime), i.LastSeen.Local().Format(time.DateTime))
+				fmt.Fprintln(w, "\nTIME\tRULE\tSEVERITY\tTACTIC\tALERT")
+				for _, d := range i.Detections {
+					fmt.Fprintf(w, "%s\t%s %s\t%s\t%s\t%s\n", d.Time.Local().Format(time.DateTime), d.RuleID, d.RuleName,
+						d.Severity, dash(d.Tactic), dash(d.AlertID))
+				}
+			})
+		},
+	}
+
+	cmd.AddCommand(list, show)
+	return cmd
+}
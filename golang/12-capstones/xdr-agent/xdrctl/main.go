@@ -0,0 +1,82 @@
+package main
+
+// xdrctl is a command-line client for the XDR server's HTTP API.
+//
+//	xdrctl config set-context lab --server http://localhost:9090 --api-key xdr_...
+//	xdrctl agents list
+//	xdrctl alerts tail --agent web-1
+//	xdrctl rules push rules.yaml
+//	source <(xdrctl completion bash)
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// app holds the global flags and builds the API client from them and the
+// config file once a command runs.
+type app struct {
+	out        io.Writer
+	configPath string
+	context    string
+	server     string
+	apiKey     string
+	output     string
+}
+
+func newRootCmd(out io.Writer) *cobra.Command {
+	a := &app{out: out}
+	root := &cobra.Command{
+		Use:   "xdrctl",
+		Short: "Command-line client for the XDR server",
+		Long: `xdrctl queries and manages an XDR server: agents, alerts, incidents,
+cases, detection rules and response actions.
+
+Servers are configured as named contexts in the config file, like kubectl.
+--server and --api-key (or $XDR_SERVER and $XDR_API_KEY) override the
+current context.`,
+		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if !slices.Contains(outputFormats, a.output) {
+				return fmt.Errorf("unknown output format %q (want table, json or yaml)", a.output)
+			}
+			return nil
+		},
+	}
+	root.SetOut(out)
+
+	flags := root.PersistentFlags()
+	flags.StringVar(&a.configPath, "config", defaultConfigPath(), "Config file with server contexts")
+	flags.StringVar(&a.context, "context", "", "Context to use instead of the current one")
+	flags.StringVar(&a.server, "server", "", "Server URL, overrides the context")
+	flags.StringVar(&a.apiKey, "api-key", "", "API key, overrides the context")
+	flags.StringVarP(&a.output, "output", "o", outputTable, "Output format: table, json or yaml")
+	root.RegisterFlagCompletionFunc("output", cobra.FixedCompletions(outputFormats, cobra.ShellCompDirectiveNoFileComp))
+	root.RegisterFlagCompletionFunc("context", a.completeContexts)
+
+	root.AddCommand(
+		a.configCmd(),
+		a.agentsCmd(),
+		a.alertsCmd(),
+		a.incidentsCmd(),
+		a.casesCmd(),
+		a.rulesCmd(),
+		a.actionsCmd(),
+	)
+	return root
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := newRootCmd(os.Stdout).ExecuteContext(ctx); err != nil {
+		os.Exit(1)
+	}
+}
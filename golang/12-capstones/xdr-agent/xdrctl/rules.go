@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+
+	"12-capstones/xdr-agent/recording"
+)
+
+// Rule is a detection rule as the server stores it
+type Rule struct {
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	EventType       string `json:"event_type"`
+	Contains        string `json:"contains,omitempty"`
+	Severity        string `json:"severity"`
+	Tactic          string `json:"tactic,omitempty"`
+	Disabled        bool   `json:"disabled,omitempty"`
+	IntelConfidence int    `json:"intel_confidence,omitempty"`
+	Tenant          string `json:"tenant,omitempty"` // Empty is global for operators, the key's own tenant otherwise
+}
+
+// ruleTestResult is the server's verdict on one rule from POST /rules/test
+type ruleTestResult struct {
+	RuleID  string   `json:"rule_id"`
+	Error   string   `json:"error,omitempty"`
+	Matches []string `json:"matches"`
+}
+
+// loadRules reads a YAML or JSON list of rules. YAML keys are the same as
+// the API's JSON fields.
+func loadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var generic any
+	if err := yaml.Unmarshal(data, &generic); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	js, err := json.Marshal(generic)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	var rules []Rule
+	if err := json.Unmarshal(js, &rules); err != nil {
+		return nil, fmt.Errorf("%s: want a list of rules: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for _, r := range rules {
+		if seen[r.ID] {
+			return nil, fmt.Errorf("%s: rule %q is defined twice", path, r.ID)
+		}
+		seen[r.ID] = true
+	}
+	return rules, nil
+}
+
+// loadAlerts takes the alerts out of an agent recording (agent -record).
+func loadAlerts(path string) ([]json.RawMessage, error) {
+	records, err := recording.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var alerts []json.RawMessage
+	for _, rec := range records {
+		if rec.Kind == recording.KindAlert {
+			alerts = append(alerts, rec.Alert)
+		}
+	}
+	return alerts, nil
+}
+
+// testRules has the server check the rules, and run them over the alerts
+// if there are any. The live rule set is not touched.
+func testRules(cmd *cobra.Command, c *client, rules []Rule, alerts []json.RawMessage) ([]ruleTestResult, error) {
+	body := map[string]any{"rules": rules, "alerts": alerts}
+	var results []ruleTestResult
+	_, err := c.call(cmd.Context(), "POST", "/rules/test", body, &results, nil)
+	return results, err
+}
+
+func invalid(results []ruleTestResult) int {
+	n := 0
+	for _, r := range results {
+		if r.Error != "" {
+			n++
+		}
+	}
+	return n
+}
+
+func (a *app) rulesCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "rules",
+		Aliases: []string{"rule"},
+		Short:   "Validate, test and deploy detection rules",
+		Long: `Rules files are YAML or JSON lists of rules:
+
+  - id: custom-001
+    name: Netcat listener
+    event_type: PROCESS_START
+    contains: "nc -l"
+    severity: medium
+    tactic: Command and Control`,
+	}
+	cmd.AddCommand(a.rulesValidateCmd(), a.rulesTestCmd(), a.rulesPushCmd())
+	return cmd
+}
+
+func (a *app) rulesValidateCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "validate FILE",
+		Short: "Check a rules file against the server's rule checks",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			rules, err := loadRules(args[0])
+			if err != nil {
+				return err
+			}
+			c, err := a.client()
+			if err != nil {
+				return err
+			}
+			results, err := testRules(cmd, c, rules, nil)
+			if err != nil {
+				return err
+			}
+			err = a.print(results, func(w io.Writer) {
+				fmt.Fprintln(w, "RULE\tRESULT")
+				for _, r := range results {
+					fmt.Fprintf(w, "%s\t%s\n", r.RuleID, firstOf(r.Error, "ok"))
+				}
+			})
+			if err != nil {
+				return err
+			}
+			if n := invalid(results); n > 0 {
+				return fmt.Errorf("%d of %d rules are invalid", n, len(results))
+			}
+			return nil
+		},
+	}
+}
+
+func (a *app) rulesTestCmd() *cobra.Command {
+	var alertsPath string
+	cmd := &cobra.Command{
+		Use:   "test FILE --alerts RECORDING",
+		Short: "Run rules over a recorded session and show what they would match",
+		Long: `Run the rules in FILE over the alerts of an agent recording (agent -record)
+on the server, without changing the live rules. Alerts are enriched with
+threat intel first, as on ingest.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			rules, err := loadRules(args[0])
+			if err != nil {
+				return err
+			}
+			alerts, err := loadAlerts(alertsPath)
+			if err != nil {
+				return err
+			}
+			c, err := a.client()
+			if err != nil {
+				return err
+			}
+			results, err := testRules(cmd, c, rules, alerts)
+			if err != nil {
+				return err
+			}
+			return a.print(results, func(w io.Writer) {
+				fmt.Fprintf(w, "RULE\tMATCHES\tALERTS\n")
+				for _, r := range results {
+					if r.Error != "" {
+						fmt.Fprintf(w, "%s\t-\tinvalid: %s\n", r.RuleID, r.Error)
+						continue
+					}
+					fmt.Fprintf(w, "%s\t%d/%d\t%s\n", r.RuleID, len(r.Matches), len(alerts), dash(truncate(strings.Join(r.Matches, ", "), 60)))
+				}
+			})
+		},
+	}
+	cmd.Flags().StringVar(&alertsPath, "alerts", "", "Agent recording (NDJSON) to take sample alerts from")
+	cmd.MarkFlagRequired("alerts")
+	cmd.MarkFlagFilename("alerts", "ndjson", "jsonl")
+	return cmd
+}
+
+func (a *app) rulesPushCmd() *cobra.Command {
+	var dryRun bool
+	cmd := &cobra.Command{
+		Use:   "push FILE",
+		Short: "Create or replace the rules in FILE on the server",
+		Long: `Create or replace every rule in FILE. Nothing is pushed unless all rules
+are valid. Rules on the server that aren't in FILE are left alone.
+
+Tenant admins push rules for their own tenant. Rules without a tenant
+pushed by an operator are global and run for every tenant.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			rules, err := loadRules(args[0])
+			if err != nil {
+				return err
+			}
+			c, err := a.client()
+			if err != nil {
+				return err
+			}
+			results, err := testRules(cmd, c, rules, nil)
+			if err != nil {
+				return err
+			}
+			for _, r := range results {
+				if r.Error != "" {
+					return fmt.Errorf("rule %s: %s", r.RuleID, r.Error)
+				}
+			}
+			if dryRun {
+				fmt.Fprintf(a.out, "%d rules are valid, nothing pushed (--dry-run).\n", len(rules))
+				return nil
+			}
+
+			for _, r := range rules {
+				resp, err := c.do(cmd.Context(), "PUT", "/rules/"+url.PathEscape(r.ID), r, nil)
+				var apiErr *apiError
+				if errors.As(err, &apiErr) && apiErr.Status == http.StatusForbidden {
+					return fmt.Errorf("pushing rules needs the admin role, and global rules an operator: %w", err)
+				}
+				if err != nil {
+					return fmt.Errorf("rule %s: %w", r.ID, err)
+				}
+				resp.Body.Close()
+				verb := "updated"
+				if resp.StatusCode == http.StatusCreated {
+					verb = "created"
+				}
+				fmt.Fprintf(a.out, "rule %s %s\n", r.ID, verb)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only validate")
+	return cmd
+}
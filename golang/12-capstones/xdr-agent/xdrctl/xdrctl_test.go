@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// run executes xdrctl with a throwaway config file.
+func run(t *testing.T, cfg string, args ...string) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	cmd := newRootCmd(&out)
+	cmd.SetErr(&out)
+	cmd.SetArgs(append([]string{"--config", cfg}, args...))
+	err := cmd.Execute()
+	return out.String(), err
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestOutputFormats(t *testing.T) {
+	t.Setenv("XDR_API_KEY", "")
+	seen := time.Now().Add(-90 * time.Second)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, []Agent{{ID: "web-2", Status: "lost", LastSeen: seen}, {ID: "web-1", Status: "online", LastSeen: seen}})
+	}))
+	defer srv.Close()
+	cfg := filepath.Join(t.TempDir(), "config.yaml")
+
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{"table", []string{"ID     STATUS  LAST SEEN\n", "web-1  online  1m ago\n", "web-2  lost    1m ago\n"}},
+		{"json", []string{`"id": "web-1",`, `"status": "online",`}},
+		{"yaml", []string{"- id: web-1\n  last_seen:", "  status: online\n"}},
+	}
+	for _, tt := range tests {
+		out, err := run(t, cfg, "--server", srv.URL, "-o", tt.format, "agents", "list")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.format, err)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(out, want) {
+				t.Errorf("%s output is missing %q:\n%s", tt.format, want, out)
+			}
+		}
+	}
+	if _, err := run(t, cfg, "--server", srv.URL, "-o", "xml", "agents", "list"); err == nil {
+		t.Error("-o xml was accepted")
+	}
+}
+
+func TestContexts(t *testing.T) {
+	t.Setenv("XDR_SERVER", "")
+	t.Setenv("XDR_API_KEY", "")
+	var gotKey string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotKey = r.Header.Get("X-API-Key")
+		writeJSON(w, []Agent{})
+	}))
+	defer srv.Close()
+	cfg := filepath.Join(t.TempDir(), "xdrctl", "config.yaml")
+
+	for _, args := range [][]string{
+		{"config", "set-context", "lab", "--server", srv.URL, "--api-key", "xdr_lab"},
+		{"config", "set-context", "prod", "--server", "http://prod.invalid:9090", "--api-key", "xdr_prod"},
+	} {
+		if _, err := run(t, cfg, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fi, err := os.Stat(cfg); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("config file mode = %v, %v; want 0600", fi.Mode().Perm(), err)
+	}
+
+	// The first context added becomes the current one
+	if _, err := run(t, cfg, "agents", "list"); err != nil || gotKey != "xdr_lab" {
+		t.Errorf("agents list with the lab context: key %q, %v", gotKey, err)
+	}
+	if _, err := run(t, cfg, "config", "use-context", "prod"); err != nil {
+		t.Fatal(err)
+	}
+	// Flags override the context, the environment overrides it too
+	t.Setenv("XDR_API_KEY", "xdr_env")
+	if _, err := run(t, cfg, "--server", srv.URL, "agents", "list"); err != nil || gotKey != "xdr_env" {
+		t.Errorf("--server with $XDR_API_KEY: key %q, %v", gotKey, err)
+	}
+	if _, err := run(t, cfg, "--context", "missing", "agents", "list"); err == nil {
+		t.Error("an unknown --context was accepted")
+	}
+
+	out, err := run(t, cfg, "config", "get-contexts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "*        prod") || strings.Contains(out, "xdr_prod") {
+		t.Errorf("get-contexts should mark prod current and hide keys:\n%s", out)
+	}
+}
+
+func TestCasesUpdateSendsIfMatch(t *testing.T) {
+	var patched bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /cases/CASE-0001":
+			w.Header().Set("ETag", `"3"`)
+			writeJSON(w, Case{ID: "CASE-0001", Status: "triaging", Version: 3})
+		case "PATCH /cases/CASE-0001":
+			var p casePatch
+			json.NewDecoder(r.Body).Decode(&p)
+			if r.Header.Get("If-Match") != `"3"` || p.Status == nil || *p.Status != "contained" || p.Assignee != nil {
+				http.Error(w, "unexpected patch", http.StatusBadRequest)
+				return
+			}
+			patched = true
+			writeJSON(w, Case{ID: "CASE-0001", Status: "contained", Version: 4})
+		case "POST /cases/CASE-0001/notes":
+			writeJSON(w, Case{ID: "CASE-0001", Status: "contained", Notes: []CaseNote{{Text: "reimaged"}}, Version: 5})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	cfg := filepath.Join(t.TempDir(), "config.yaml")
+
+	out, err := run(t, cfg, "--server", srv.URL, "cases", "update", "CASE-0001", "--status", "contained", "--note", "reimaged")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if !patched || !strings.Contains(out, "Version:    5") {
+		t.Errorf("patched = %v, output:\n%s", patched, out)
+	}
+	if _, err := run(t, cfg, "--server", srv.URL, "cases", "update", "CASE-0001"); err == nil {
+		t.Error("update with no changes was accepted")
+	}
+}
+
+func TestRulesPushValidatesFirst(t *testing.T) {
+	var puts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/rules/test":
+			var req struct{ Rules []Rule }
+			json.NewDecoder(r.Body).Decode(&req)
+			var out []ruleTestResult
+			for _, rule := range req.Rules {
+				res := ruleTestResult{RuleID: rule.ID}
+				if rule.Severity != "medium" {
+					res.Error = "bad severity"
+				}
+				out = append(out, res)
+			}
+			writeJSON(w, out)
+		case r.Method == "PUT":
+			puts = append(puts, r.URL.Path)
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	cfg := filepath.Join(dir, "config.yaml")
+	write := func(name, body string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	bad := write("bad.yaml", "- {id: r1, name: A, event_type: X, severity: medium}\n- {id: r2, name: B, event_type: X, severity: severe}\n")
+	if _, err := run(t, cfg, "--server", srv.URL, "rules", "push", bad); err == nil || len(puts) > 0 {
+		t.Errorf("push of an invalid file: err %v, PUTs %v", err, puts)
+	}
+	out, err := run(t, cfg, "--server", srv.URL, "rules", "validate", bad)
+	if err == nil || !strings.Contains(out, "r2    bad severity") {
+		t.Errorf("validate: err %v\n%s", err, out)
+	}
+
+	good := write("good.json", `[{"id": "r1", "name": "A", "event_type": "X", "severity": "medium"}]`)
+	if out, err := run(t, cfg, "--server", srv.URL, "rules", "push", good); err != nil || out != "rule r1 created\n" {
+		t.Errorf("push: %v\n%s", err, out)
+	}
+	if len(puts) != 1 || puts[0] != "/rules/r1" {
+		t.Errorf("PUTs = %v", puts)
+	}
+
+	if _, err := run(t, cfg, "rules", "validate", write("dup.yaml", "- {id: r1}\n- {id: r1}\n")); err == nil {
+		t.Error("a file with a duplicate rule ID was accepted")
+	}
+}
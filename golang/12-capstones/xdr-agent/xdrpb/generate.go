@@ -0,0 +1,7 @@
+// Package xdrpb holds the protobuf messages and gRPC service shared by the
+// XDR agent and server. Regenerate after editing xdr.proto:
+//
+//	go generate ./xdr-agent/xdrpb
+package xdrpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative xdr.proto
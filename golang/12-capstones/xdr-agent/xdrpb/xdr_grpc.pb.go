@@ -0,0 +1,202 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: xdr.proto
+
+package xdrpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	XDR_StreamAlerts_FullMethodName  = "/xdr.v1.XDR/StreamAlerts"
+	XDR_SendHeartbeat_FullMethodName = "/xdr.v1.XDR/SendHeartbeat"
+	XDR_Commands_FullMethodName      = "/xdr.v1.XDR/Commands"
+)
+
+// XDRClient is the client API for XDR service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// XDR is the agent <-> server protocol. Alerts, heartbeats and commands all
+// share one HTTP/2 connection.
+type XDRClient interface {
+	// StreamAlerts carries alerts from the agent. The server acknowledges each
+	// one by ID once it has been ingested; the agent caps how many alerts may
+	// be in flight without an ack.
+	StreamAlerts(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Alert, AlertAck], error)
+	SendHeartbeat(ctx context.Context, in *Heartbeat, opts ...grpc.CallOption) (*HeartbeatReply, error)
+	// Commands is opened by the agent. The server pushes queued commands down
+	// it and the agent answers each with a result.
+	Commands(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[CommandResult, Command], error)
+}
+
+type xDRClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewXDRClient(cc grpc.ClientConnInterface) XDRClient {
+	return &xDRClient{cc}
+}
+
+func (c *xDRClient) StreamAlerts(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Alert, AlertAck], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &XDR_ServiceDesc.Streams[0], XDR_StreamAlerts_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[Alert, AlertAck]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type XDR_StreamAlertsClient = grpc.BidiStreamingClient[Alert, AlertAck]
+
+func (c *xDRClient) SendHeartbeat(ctx context.Context, in *Heartbeat, opts ...grpc.CallOption) (*HeartbeatReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(HeartbeatReply)
+	err := c.cc.Invoke(ctx, XDR_SendHeartbeat_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *xDRClient) Commands(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[CommandResult, Command], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &XDR_ServiceDesc.Streams[1], XDR_Commands_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[CommandResult, Command]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type XDR_CommandsClient = grpc.BidiStreamingClient[CommandResult, Command]
+
+// XDRServer is the server API for XDR service.
+// All implementations must embed UnimplementedXDRServer
+// for forward compatibility.
+//
+// XDR is the agent <-> server protocol. Alerts, heartbeats and commands all
+// share one HTTP/2 connection.
+type XDRServer interface {
+	// StreamAlerts carries alerts from the agent. The server acknowledges each
+	// one by ID once it has been ingested; the agent caps how many alerts may
+	// be in flight without an ack.
+	StreamAlerts(grpc.BidiStreamingServer[Alert, AlertAck]) error
+	SendHeartbeat(context.Context, *Heartbeat) (*HeartbeatReply, error)
+	// Commands is opened by the agent. The server pushes queued commands down
+	// it and the agent answers each with a result.
+	Commands(grpc.BidiStreamingServer[CommandResult, Command]) error
+	mustEmbedUnimplementedXDRServer()
+}
+
+// UnimplementedXDRServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedXDRServer struct{}
+
+func (UnimplementedXDRServer) StreamAlerts(grpc.BidiStreamingServer[Alert, AlertAck]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamAlerts not implemented")
+}
+func (UnimplementedXDRServer) SendHeartbeat(context.Context, *Heartbeat) (*HeartbeatReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendHeartbeat not implemented")
+}
+func (UnimplementedXDRServer) Commands(grpc.BidiStreamingServer[CommandResult, Command]) error {
+	return status.Errorf(codes.Unimplemented, "method Commands not implemented")
+}
+func (UnimplementedXDRServer) mustEmbedUnimplementedXDRServer() {}
+func (UnimplementedXDRServer) testEmbeddedByValue()             {}
+
+// UnsafeXDRServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to XDRServer will
+// result in compilation errors.
+type UnsafeXDRServer interface {
+	mustEmbedUnimplementedXDRServer()
+}
+
+func RegisterXDRServer(s grpc.ServiceRegistrar, srv XDRServer) {
+	// If the following call pancis, it indicates UnimplementedXDRServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&XDR_ServiceDesc, srv)
+}
+
+func _XDR_StreamAlerts_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(XDRServer).StreamAlerts(&grpc.GenericServerStream[Alert, AlertAck]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type XDR_StreamAlertsServer = grpc.BidiStreamingServer[Alert, AlertAck]
+
+func _XDR_SendHeartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Heartbeat)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(XDRServer).SendHeartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: XDR_SendHeartbeat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(XDRServer).SendHeartbeat(ctx, req.(*Heartbeat))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _XDR_Commands_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(XDRServer).Commands(&grpc.GenericServerStream[CommandResult, Command]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type XDR_CommandsServer = grpc.BidiStreamingServer[CommandResult, Command]
+
+// XDR_ServiceDesc is the grpc.ServiceDesc for XDR service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var XDR_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "xdr.v1.XDR",
+	HandlerType: (*XDRServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SendHeartbeat",
+			Handler:    _XDR_SendHeartbeat_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamAlerts",
+			Handler:       _XDR_StreamAlerts_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Commands",
+			Handler:       _XDR_Commands_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "xdr.proto",
+}